@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"path"
-	"syscall"
 	"strings"
 	"time"
 	"unsafe"
@@ -18,6 +17,7 @@ import (
 	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/ioutils"
+	"golang.org/x/sys/unix"
 )
 
 // Copied from lcfs.h
@@ -60,7 +60,7 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 	driver.naiveDiff = graphdriver.NewNaiveDiffDriver(driver, uidMaps, gidMaps)
 
 	// Open layer root directory
-	fd, err = syscall.Open(home, syscall.O_DIRECTORY, 0);
+	fd, err = unix.Open(home, unix.O_DIRECTORY, 0);
 	if err != nil {
 		logrus.Errorf("err %v\n", err)
 		return nil, err
@@ -75,7 +75,7 @@ func Init(home string, options []string, uidMaps, gidMaps []idtools.IDMap) (grap
 
 	// Check if swapping of layers enabled when layers committed
 	cbuf := make([]byte, unsafe.Sizeof(uint64(0)))
-	_, err = syscall.Getxattr(home, ".", cbuf)
+	_, err = unix.Getxattr(home, ".", cbuf)
 	if err == nil {
 		enable := int64(binary.LittleEndian.Uint64(cbuf))
 		if enable != 0 {
@@ -145,10 +145,10 @@ func (d *Driver) ioctl(cmd int, parent, id string) error {
 		op = uintptr((1 << 30) | (len(name) << 16) | (plen << 8) | cmd);
 		arg = uintptr(unsafe.Pointer(&[]byte(name)[0]))
 	}
-	_, _, ep := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), op, arg);
+	_, _, ep := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), op, arg)
 	if ep != 0 {
-		logrus.Errorf("err %v\n", syscall.Errno(ep))
-		return syscall.Errno(ep)
+		logrus.Errorf("err %v\n", ep)
+		return ep
 	}
 	return nil
 }
@@ -158,7 +158,7 @@ func (d *Driver) Cleanup() error {
 	logrus.Debugf("Cleanup")
 	err := d.ioctl(UmountAll, "", "")
 	if fd != 0 {
-		syscall.Close(fd)
+		unix.Close(fd)
 		fd = 0
 	}
 	return err
@@ -167,7 +167,7 @@ func (d *Driver) Cleanup() error {
 // CreateReadWrite creates a layer that is writable for use as a container
 // file system.
 func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts) error {
-	logrus.Debugf("CreateReadWrite - parent %s id %d", parent, id)
+	logrus.Debugf("CreateReadWrite - parent %s id %s", parent, id)
 	return d.ioctl(CloneCreate, parent, id)
 }
 
@@ -220,7 +220,7 @@ func generate_diff(d *Driver, id string) []archive.Change {
 	   var dir string
 
 	   cbuf := make([]byte, 4096)
-	   size, err := syscall.Getxattr(d.home, id, cbuf)
+	   size, err := unix.Getxattr(d.home, id, cbuf)
 	   if err != nil {
 		logrus.Errorf("err %v\n", err)
 			   return nil
@@ -256,14 +256,14 @@ func generate_diff(d *Driver, id string) []archive.Change {
 							   case 2:
 									   actype = archive.ChangeDelete
 							   }
-							   changes = append(changes, archive.Change{file, actype})
+							   changes = append(changes, archive.Change{Path: file, Kind: actype})
 					   }
 					   psize += minSize + plen
 			   }
 			   if psize == 0 {
 					   break
 			   }
-			   size, err = syscall.Getxattr(d.home, id, cbuf)
+			   size, err = unix.Getxattr(d.home, id, cbuf)
 			   if err != nil {
 					   logrus.Errorf("Changes: err %v\n", err)
 					   return nil
@@ -282,7 +282,7 @@ func diff(d *Driver, id, parent string) io.ReadCloser {
 	   if swapLayers {
 			   diffPath := strings.Join([]string{"/.lcfs-diff", id}, "-")
 			   logrus.Debugf("DiffPath %s", diffPath)
-			   changes = append(changes, archive.Change{diffPath, archive.ChangeAdd})
+			   changes = append(changes, archive.Change{Path: diffPath, Kind: archive.ChangeAdd})
 			   layerFs = path.Join(d.home, parent)
 	   } else {
 			   changes = generate_diff(d, id)
@@ -347,7 +347,7 @@ func (d *Driver) ApplyDiff(id, parent string, diff io.Reader) (size int64, err e
 	size, err = d.naiveDiff.ApplyDiff(id, parent, diff)
 	if swapLayers && err == nil && parent != "" && size < 20 {
 		cbuf := make([]byte, unsafe.Sizeof(uint64(0)))
-		_, err := syscall.Getxattr(d.home, id, cbuf)
+		_, err := unix.Getxattr(d.home, id, cbuf)
 		if err == nil {
 			nsize := int64(binary.LittleEndian.Uint64(cbuf))
 			if nsize > size {
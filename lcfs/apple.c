@@ -30,3 +30,16 @@ lc_getTotalMemory() {
     return (usermemlen == sizeof(uint64_t)) ?
                 *(uint64_t *)usermembuf : *(uint32_t *)usermembuf;
 }
+
+/* Find out resident memory of the process */
+uint64_t
+lc_getResidentMemory() {
+    struct mach_task_basic_info info;
+    mach_msg_type_number_t count = MACH_TASK_BASIC_INFO_COUNT;
+
+    if (task_info(mach_task_self(), MACH_TASK_BASIC_INFO,
+                  (task_info_t)&info, &count) != KERN_SUCCESS) {
+        return 0;
+    }
+    return info.resident_size;
+}
@@ -585,6 +585,7 @@ retry:
                                           LC_MEMTYPE_DATA);
                 }
                 lc_readBlock(gfs, fs, block, page->p_data);
+                lc_decryptPage(fs, page);
                 page->p_dvalid = 1;
                 missed = true;
             }
@@ -597,8 +598,10 @@ retry:
     assert(page->p_block == block);
     if (missed) {
         __sync_add_and_fetch(&gfs->gfs_pmissed, 1);
+        __sync_add_and_fetch(&fs->fs_pmissed, 1);
     } else if (hit) {
         __sync_add_and_fetch(&gfs->gfs_phit, 1);
+        __sync_add_and_fetch(&fs->fs_phit, 1);
     }
     return page;
 }
@@ -618,6 +621,7 @@ lc_getPageNew(struct gfs *gfs, struct fs *fs, uint64_t block, char *data) {
     page->p_dvalid = 1;
     page->p_hitCount = 0;
     page->p_nocache = 0;
+    page->p_encrypt = 0;
     return page;
 }
 
@@ -672,6 +676,7 @@ lc_readPages(struct gfs *gfs, struct fs *fs, struct page **pages,
             lhash = lc_lockPageRead(fs, sblock);
             if (!page->p_dvalid) {
                 lc_readBlock(gfs, fs, sblock, page->p_data);
+                lc_decryptPage(fs, page);
                 page->p_dvalid = 1;
                 rcount = 1;
             }
@@ -701,6 +706,9 @@ lc_readPages(struct gfs *gfs, struct fs *fs, struct page **pages,
 
                 /* Mark pages having valid data */
                 for (; j < i; j++) {
+                    if (!pages[j]->p_dvalid) {
+                        lc_decryptPage(fs, pages[j]);
+                    }
                     pages[j]->p_dvalid = 1;
                 }
                 rcount += iovcnt;
@@ -734,6 +742,9 @@ lc_readPages(struct gfs *gfs, struct fs *fs, struct page **pages,
         if (iovcnt) {
             lc_readBlocks(gfs, fs, iovec, iovcnt, sblock);
             for (; j < count; j++) {
+                if (!pages[j]->p_dvalid) {
+                    lc_decryptPage(fs, pages[j]);
+                }
                 pages[j]->p_dvalid = 1;
             }
             rcount += iovcnt;
@@ -751,15 +762,22 @@ lc_flushPageCluster(struct gfs *gfs, struct fs *fs,
     uint64_t i, j, iovcount;
     struct iovec *iovec;
     uint64_t block = 0;
+    char *cbuf = NULL;
 
     /* Mark superblock dirty before modifying something */
     lc_markSuperDirty(fs);
 
+    /* Data of encrypted layers is written encrypted */
+    if (fs->fs_encrypted) {
+        cbuf = lc_encryptPages(fs, head, count);
+    }
+
     /* Use pwrite(2) interface if there is just one block */
     if (count == 1) {
         block = page->p_block;
         assert(block != 0);
-        lc_writeBlock(gfs, fs, page->p_data, block);
+        lc_writeBlock(gfs, fs, (cbuf && page->p_encrypt) ? cbuf : page->p_data,
+                      block);
     } else {
         iovcount = (count < LC_WRITE_CLUSTER_SIZE) ?
                         count : LC_WRITE_CLUSTER_SIZE;
@@ -782,7 +800,8 @@ lc_flushPageCluster(struct gfs *gfs, struct fs *fs,
                 }
                 j = 0;
             }
-            iovec[j].iov_base = page->p_data;
+            iovec[j].iov_base = (cbuf && page->p_encrypt) ?
+                                &cbuf[i * LC_BLOCK_SIZE] : page->p_data;
             iovec[j].iov_len = LC_BLOCK_SIZE;
             if (j == 0) {
                 block = page->p_block;
@@ -797,6 +816,9 @@ lc_flushPageCluster(struct gfs *gfs, struct fs *fs,
             lc_writeBlocks(gfs, fs, iovec, j, block);
         }
     }
+    if (cbuf) {
+        free(cbuf);
+    }
 
     /* Release the pages after writing */
     lc_releasePages(gfs, fs, head, fs->fs_removed && (fs->fs_pinval != -1));
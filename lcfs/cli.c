@@ -34,6 +34,12 @@ cmd_ioctl(char *pgm, int argc, char *argv[]) {
     return ioctl_main(pgm, argc, argv);
 }
 
+/* Read files of a layer into the cache */
+static int
+cmd_prefetch(char *pgm, int argc, char *argv[]) {
+    return prefetch_main(pgm, argc, argv);
+}
+
 static struct
 cmd_group lcfs_cmd_group[] = {
     {
@@ -43,7 +49,7 @@ cmd_group lcfs_cmd_group[] = {
 #ifndef __MUSL__
             "[-p] "
 #endif
-            "[-f] [-d] [-m] [-r] [-t] [-v]",
+            "[-f] [-d] [-m] [-r] [-t] [-v] [-S <stats-file>]",
         "\tdevice     - device or file - image layers will be saved here\n"
         "\thost-mount - mount point on host\n"
         "\thost-mount - mount point propogated to the plugin\n"
@@ -57,7 +63,8 @@ cmd_group lcfs_cmd_group[] = {
         "\t-p         - enable profiling (optional)\n"
 #endif
         "\t-s         - swap layers when committed\n"
-        "\t-v         - enable verbose mode (optional)\n",
+        "\t-v         - enable verbose mode (optional)\n"
+        "\t-S         - publish stats in a file mapped by readers (optional)\n",
         3,
         cmd_daemon
     },
@@ -105,6 +112,16 @@ cmd_group lcfs_cmd_group[] = {
         1,
         cmd_ioctl
     },
+    {
+        "prefetch",
+        "Read files of a layer into the cache",
+        "<mnt> <id> <list>",
+        "\tmnt     - mount point\n"
+        "\tid      - layer name\n"
+        "\tlist    - file listing paths within the layer, - for stdin\n",
+        3,
+        cmd_prefetch
+    },
     {
         "grow",
         "Grow size of the file system",
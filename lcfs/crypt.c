@@ -0,0 +1,229 @@
+#include "includes.h"
+
+#ifndef __APPLE__
+#include <sys/syscall.h>
+#include <linux/keyctl.h>
+#include <openssl/evp.h>
+
+/* Load the key of an encrypted layer from the kernel keyring.  Keys are user
+ * keys holding LC_KEY_SIZE bytes, found by the description recorded in the
+ * superblock of the layer, so keys are never stored in the file system.
+ */
+int
+lc_loadKey(struct fs *fs) {
+    unsigned char key[LC_KEY_SIZE + 1];
+    long id, len;
+
+    if (fs->fs_encrypted) {
+        return 0;
+    }
+    id = syscall(SYS_request_key, "user", fs->fs_super->sb_keyRef, NULL, 0);
+    if (id < 0) {
+        return errno;
+    }
+    len = syscall(SYS_keyctl, KEYCTL_READ, id, key, sizeof(key));
+    if (len < 0) {
+        return errno;
+    }
+    if (len != LC_KEY_SIZE) {
+        memset(key, 0, sizeof(key));
+        return EKEYREJECTED;
+    }
+    memcpy(fs->fs_key, key, LC_KEY_SIZE);
+    memset(key, 0, sizeof(key));
+    __sync_synchronize();
+    fs->fs_encrypted = true;
+    return 0;
+}
+
+/* Load keys of a layer and of any encrypted layer it shares blocks with */
+int
+lc_loadKeys(struct fs *fs) {
+    int err;
+
+    while (fs) {
+        if (fs->fs_super->sb_keyRef[0]) {
+            err = lc_loadKey(fs);
+            if (err) {
+                return err;
+            }
+        }
+        fs = fs->fs_parent;
+    }
+    return 0;
+}
+
+/* Forget the key of a layer */
+void
+lc_unloadKey(struct fs *fs) {
+    memset(fs->fs_key, 0, LC_KEY_SIZE);
+    fs->fs_encrypted = false;
+}
+
+/* Encrypt or decrypt a block with AES-256-XTS, using the block number as the
+ * tweak, so identical data in different blocks differs on disk.
+ */
+static void
+lc_cryptBlock(struct fs *fs, uint64_t block, const void *in, void *out,
+              int enc) {
+    EVP_CIPHER_CTX *ctx = EVP_CIPHER_CTX_new();
+    unsigned char tweak[16];
+    int i, len = 0;
+
+    for (i = 0; i < sizeof(tweak); i++) {
+        tweak[i] = (i < sizeof(block)) ? (block >> (i * 8)) & 0xff : 0;
+    }
+    assert(ctx);
+    i = EVP_CipherInit_ex(ctx, EVP_aes_256_xts(), NULL, fs->fs_key, tweak,
+                          enc);
+    assert(i == 1);
+    i = EVP_CipherUpdate(ctx, out, &len, in, LC_BLOCK_SIZE);
+    assert((i == 1) && (len == LC_BLOCK_SIZE));
+    EVP_CIPHER_CTX_free(ctx);
+}
+
+/* Check if a block is in a sorted list of extents */
+static bool
+lc_extentHasBlock(struct extent *extent, uint64_t block) {
+    uint64_t start;
+
+    while (extent) {
+        start = lc_getExtentStart(extent);
+        if (block < start) {
+            break;
+        }
+        if (block < (start + lc_getExtentCount(extent))) {
+            return true;
+        }
+        extent = extent->ex_next;
+    }
+    return false;
+}
+
+/* Record the oldest of the encrypted layers a layer was created from, if the
+ * layer is encrypted.  Layers created from an encrypted layer are encrypted
+ * with the same key and a key is set only on layers without children, so the
+ * layers from this one down to that layer are the only ones encrypted.  Looked
+ * up once, as the layers a layer was created from do not change.
+ */
+static struct fs *
+lc_keyLayerOf(struct fs *fs) {
+    struct fs *pfs, *kfs = NULL;
+
+    if (fs->fs_keyLooked) {
+        return fs->fs_keyLayer;
+    }
+    for (pfs = fs; pfs && pfs->fs_super->sb_keyRef[0]; pfs = pfs->fs_parent) {
+        kfs = pfs;
+    }
+    fs->fs_keyLayer = kfs;
+    __sync_synchronize();
+    fs->fs_keyLooked = true;
+    return kfs;
+}
+
+/* Remember a layer is encrypted, once a key is set for it */
+void
+lc_setKeyLayer(struct fs *fs) {
+    fs->fs_keyLayer = fs;
+    __sync_synchronize();
+    fs->fs_keyLooked = true;
+}
+
+/* Find the encrypted layer which allocated a block read through a layer, if
+ * any.  Blocks are shared with layers created from the layer allocating
+ * those, so the block is decrypted with the key of that layer.  Only extents
+ * of the encrypted layers are searched, layers the block is not allocated by
+ * being those the layer was created from, which do not encrypt data.
+ */
+static struct fs *
+lc_keyLayer(struct fs *fs, uint64_t block) {
+    struct fs *pfs, *kfs = lc_keyLayerOf(fs);
+    bool found;
+
+    if (kfs == NULL) {
+        return NULL;
+    }
+    for (pfs = fs; pfs != kfs->fs_parent; pfs = pfs->fs_parent) {
+        pthread_mutex_lock(&pfs->fs_alock);
+        found = lc_extentHasBlock(pfs->fs_aextents, block);
+        pthread_mutex_unlock(&pfs->fs_alock);
+        if (found) {
+            return pfs;
+        }
+    }
+    return NULL;
+}
+
+/* Decrypt data of a page read from disk, if written by an encrypted layer.
+ * Data of layers with keys not loaded is never presented.
+ */
+void
+lc_decryptPage(struct fs *fs, struct page *page) {
+    struct fs *kfs = lc_keyLayer(fs, page->p_block);
+
+    if (kfs == NULL) {
+        return;
+    }
+    if (!kfs->fs_encrypted) {
+        lc_reportError(__func__, __LINE__, page->p_block, ENOKEY);
+        memset(page->p_data, 0, LC_BLOCK_SIZE);
+        return;
+    }
+    lc_cryptBlock(kfs, page->p_block, page->p_data, page->p_data, 0);
+}
+
+/* Encrypt data of pages of a cluster marked for encryption into a buffer
+ * aligned for direct I/O, leaving data in the cache as is.  Returns NULL if no
+ * page needs to be encrypted.
+ */
+char *
+lc_encryptPages(struct fs *fs, struct page *page, uint64_t count) {
+    char *buf = NULL;
+    uint64_t i;
+    int err;
+
+    for (i = 0; i < count; i++, page = page->p_dnext) {
+        if (!page->p_encrypt) {
+            continue;
+        }
+        if (buf == NULL) {
+            err = posix_memalign((void **)&buf, LC_BLOCK_SIZE,
+                                 count * LC_BLOCK_SIZE);
+            assert(err == 0);
+        }
+        lc_cryptBlock(fs, page->p_block, page->p_data,
+                      &buf[i * LC_BLOCK_SIZE], 1);
+    }
+    return buf;
+}
+#else
+
+/* Encryption is not supported on macOS */
+int
+lc_loadKey(struct fs *fs) {
+    return ENOTSUP;
+}
+
+int
+lc_loadKeys(struct fs *fs) {
+    return fs->fs_super->sb_keyRef[0] ? ENOTSUP : 0;
+}
+
+void
+lc_unloadKey(struct fs *fs) {
+}
+
+void
+lc_setKeyLayer(struct fs *fs) {
+}
+
+void
+lc_decryptPage(struct fs *fs, struct page *page) {
+}
+
+char *
+lc_encryptPages(struct fs *fs, struct page *page, uint64_t count) {
+    return NULL;
+}
+#endif
@@ -20,7 +20,8 @@ usage(char *prog) {
 #ifndef __MUSL__
                        " [-p]"
 #endif
-                       " [-f] [-c] [-d] [-m] [-r] [-t] [-s] [-v]\n",
+                       " [-f] [-c] [-d] [-m] [-r] [-t] [-s] [-v]"
+                       " [-S <stats-file>]\n",
                        prog);
     lc_syslog(LOG_ERR, "\tdevice        - device or file - image layers"
                        " will be saved here\n"
@@ -37,7 +38,9 @@ usage(char *prog) {
                     "\t-p            - enable profiling (optional)\n"
 #endif
                     "\t-s            - swap layers when committed\n"
-                    "\t-v            - enable verbose mode (optional)\n");
+                    "\t-v            - enable verbose mode (optional)\n"
+                    "\t-S            - publish daemon stats in a file mapped"
+                                       " by readers (optional)\n");
 }
 
 /* Notify parent process completion */
@@ -104,7 +107,7 @@ lc_stopSession(struct gfs *gfs, struct fuse_session *se, enum lc_mountId id) {
 static void *
 lc_startThreads(void *data) {
     struct gfs *gfs = (struct gfs *)data;
-    pthread_t flusher, syncer;
+    pthread_t flusher, syncer, publisher;
     int err;
 
     /* Start a thread to flush dirty pages */
@@ -115,6 +118,12 @@ lc_startThreads(void *data) {
     err = pthread_create(&syncer, NULL, lc_syncer, gfs);
     assert(err == 0);
 
+    /* Start a thread to publish stats if requested */
+    if (gfs->gfs_statsPage) {
+        err = pthread_create(&publisher, NULL, lc_statsPublisher, gfs);
+        assert(err == 0);
+    }
+
     /* Flush and purge pages in the background */
     lc_cleaner();
 
@@ -123,6 +132,9 @@ lc_startThreads(void *data) {
     pthread_cond_signal(&gfs->gfs_syncerCond);
     pthread_join(syncer, NULL);
     pthread_join(flusher, NULL);
+    if (gfs->gfs_statsPage) {
+        pthread_join(publisher, NULL);
+    }
     return NULL;
 }
 
@@ -314,6 +326,7 @@ lc_start(struct gfs *gfs, char *device, enum lc_mountId id) {
 int
 lcfs_main(char *pgm, int argc, char *argv[]) {
     bool daemon = true, format = false, ftypes = false, swap = false;
+    char *statsPage = NULL;
     int i, err = -1, waiter[2], fd, count;
     char *arg[argc + 1], completed;
     struct fuse_session *se;
@@ -407,6 +420,8 @@ lcfs_main(char *pgm, int argc, char *argv[]) {
             swap = true;
         } else if (!strcmp(argv[i], "-v")) {
             lc_verbose = true;
+        } else if (!strcmp(argv[i], "-S") && ((i + 1) < argc)) {
+            statsPage = argv[++i];
         } else {
             if (!strcmp(argv[i], "-f") ||
                 !strcmp(argv[i], "-d")) {
@@ -462,6 +477,7 @@ lcfs_main(char *pgm, int argc, char *argv[]) {
     gfs->gfs_profiling = profiling;
 #endif
     gfs->gfs_swapLayersForCommit = swap;
+    gfs->gfs_statsPage = statsPage;
 
     /* Setup arguments for fuse mount */
     arg[0] = pgm;
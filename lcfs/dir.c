@@ -716,7 +716,7 @@ lc_dirReaddir(fuse_req_t req, struct fs *fs, struct inode *dir,
                     }
                     return ENOENT;
                 }
-                lc_copyStat(&ep.attr, inode);
+                lc_copyStat(nfs ? nfs : fs, &ep.attr, inode);
                 lc_inodeUnlock(inode);
                 if (nfs) {
                     lc_unlock(nfs);
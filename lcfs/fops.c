@@ -22,7 +22,7 @@ lc_createInode(struct fs *fs, ino_t parent, const char *name, mode_t mode,
     struct inode *dir, *inode;
     ino_t ino;
 
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, parent, EROFS);
         return EROFS;
     }
@@ -50,7 +50,9 @@ lc_createInode(struct fs *fs, ino_t parent, const char *name, mode_t mode,
         lc_dirCopy(dir);
     }
 
-    /* Get a new inode */
+    /* Get a new inode, owned by the ids stored for the caller */
+    uid = lc_unshiftId(uid, fs->fs_super->sb_uidShift);
+    gid = lc_unshiftId(gid, fs->fs_super->sb_gidShift);
     inode = lc_inodeInit(fs, mode, uid, gid, rdev, parent, target);
     ino = inode->i_ino;
 
@@ -71,7 +73,7 @@ lc_createInode(struct fs *fs, ino_t parent, const char *name, mode_t mode,
     lc_markInodeDirty(dir, LC_INODE_DIRDIRTY);
     lc_inodeUnlock(dir);
     lc_markInodeDirty(inode, 0);
-    lc_copyStat(&ep->attr, inode);
+    lc_copyStat(fs, &ep->attr, inode);
     if (fi) {
         inode->i_ocount++;
         fi->fh = (uint64_t)inode;
@@ -232,7 +234,7 @@ lc_remove(struct fs *fs, ino_t parent, const char *name, void **inodep,
     struct inode *dir;
     int err;
 
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, parent, EROFS);
         return EROFS;
     }
@@ -318,7 +320,7 @@ lc_lookup(fuse_req_t req, fuse_ino_t parent, const char *name) {
         fuse_reply_err(req, ENOENT);
         err = ENOENT;
     } else {
-        lc_copyStat(&ep.attr, inode);
+        lc_copyStat(nfs ? nfs : fs, &ep.attr, inode);
         lc_inodeUnlock(inode);
         ep.ino = lc_setHandle(gindex, ino);
         lc_epInit(&ep);
@@ -362,7 +364,7 @@ lc_getattr(fuse_req_t req, fuse_ino_t ino, struct fuse_file_info *fi) {
         err = ENOENT;
         goto out;
     }
-    lc_copyStat(&stbuf, inode);
+    lc_copyStat(fs, &stbuf, inode);
     parent = inode->i_parent;
     lc_inodeUnlock(inode);
     stbuf.st_ino = lc_setHandle(lc_getIndex(fs, parent, stbuf.st_ino),
@@ -384,6 +386,8 @@ lc_setattr(fuse_req_t req, fuse_ino_t ino, struct stat *attr,
     struct timeval start;
     struct stat stbuf;
     struct fs *fs;
+    uid_t uid;
+    gid_t gid;
 
     lc_displayEntry(__func__, ino, 0, NULL);
 
@@ -405,13 +409,15 @@ lc_setattr(fuse_req_t req, fuse_ino_t ino, struct stat *attr,
 #endif
                ));
     fs = lc_getLayerLocked(ino, false);
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, ino, EROFS);
         fuse_reply_err(req, EROFS);
         err = EROFS;
         goto out;
     }
     handle = fi ? (struct inode *)fi->fh : NULL;
+    uid = lc_unshiftId(attr->st_uid, fs->fs_super->sb_uidShift);
+    gid = lc_unshiftId(attr->st_gid, fs->fs_super->sb_gidShift);
 
     /* Check if uid/gid is really being changed */
     if (change && !(to_set & ~(FUSE_SET_ATTR_UID | FUSE_SET_ATTR_GID))) {
@@ -424,11 +430,11 @@ lc_setattr(fuse_req_t req, fuse_ino_t ino, struct stat *attr,
             goto out;
         }
         if ((to_set & FUSE_SET_ATTR_UID) &&
-            (inode->i_dinode.di_uid == attr->st_uid)) {
+            (inode->i_dinode.di_uid == uid)) {
             new_set &= ~FUSE_SET_ATTR_UID;
         }
         if ((to_set & FUSE_SET_ATTR_GID) &&
-            (inode->i_dinode.di_gid == attr->st_gid)) {
+            (inode->i_dinode.di_gid == gid)) {
             new_set &= ~FUSE_SET_ATTR_GID;
         }
         if (new_set == 0) {
@@ -453,13 +459,13 @@ lc_setattr(fuse_req_t req, fuse_ino_t ino, struct stat *attr,
 
     /* Change user id */
     if (to_set & FUSE_SET_ATTR_UID) {
-        inode->i_dinode.di_uid = attr->st_uid;
+        inode->i_dinode.di_uid = uid;
         ctime = true;
     }
 
     /* Change group id */
     if (to_set & FUSE_SET_ATTR_GID) {
-        inode->i_dinode.di_gid = attr->st_gid;
+        inode->i_dinode.di_gid = gid;
         ctime = true;
     }
 
@@ -494,7 +500,7 @@ lc_setattr(fuse_req_t req, fuse_ino_t ino, struct stat *attr,
     lc_markInodeDirty(inode, flags);
 
 reply:
-    lc_copyStat(&stbuf, inode);
+    lc_copyStat(fs, &stbuf, inode);
     lc_inodeUnlock(inode);
     stbuf.st_ino = lc_setHandle(fs->fs_gindex, stbuf.st_ino);
     fuse_reply_attr(req, &stbuf, LC_TIMEOUT_SEC);
@@ -707,7 +713,7 @@ lc_rename(fuse_req_t req, fuse_ino_t parent, const char *name,
     lc_statsBegin(&start);
     lc_displayEntry(__func__, parent, newparent, name);
     fs = lc_getLayerLocked(parent, false);
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, parent, EROFS);
         fuse_reply_err(req, EROFS);
         err = EROFS;
@@ -863,7 +869,7 @@ lc_link(fuse_req_t req, fuse_ino_t ino, fuse_ino_t newparent,
     lc_statsBegin(&start);
     lc_displayEntry(__func__, newparent, ino, newname);
     fs = lc_getLayerLocked(ino, false);
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, ino, EROFS);
         fuse_reply_err(req, EROFS);
         err = EROFS;
@@ -905,7 +911,7 @@ lc_link(fuse_req_t req, fuse_ino_t ino, fuse_ino_t newparent,
     inode->i_nlink++;
     lc_updateInodeTimes(inode, false, true);
     lc_markInodeDirty(inode, 0);
-    lc_copyStat(&ep.attr, inode);
+    lc_copyStat(fs, &ep.attr, inode);
     lc_inodeUnlock(inode);
     ep.ino = lc_setHandle(fs->fs_gindex, ino);
     lc_epInit(&ep);
@@ -926,7 +932,7 @@ lc_openInode(struct fs *fs, fuse_ino_t ino, struct fuse_file_info *fi) {
     modify = (fi->flags & (O_WRONLY | O_RDWR));
 
     /* Do not allow modify operations in immutable layers */
-    if (unlikely(modify && fs->fs_frozen)) {
+    if (unlikely(modify && lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, ino, EROFS);
         return EROFS;
     }
@@ -1156,6 +1162,8 @@ retry:
         lc_inodeLock(inode, false);
         goto retry;
     }
+    __sync_add_and_fetch(&fs->fs_readBytes, endoffset - off);
+    __sync_add_and_fetch(&fs->fs_readOps, 1);
 
 out:
     lc_waitMemory(fs->fs_gfs, false);
@@ -1478,6 +1486,34 @@ lc_create(fuse_req_t req, fuse_ino_t parent, const char *name,
 }
 
 
+/* Reply to a handshake with the magic number inverted and what was decoded
+ * from the command, refusing requests encoded differently.
+ */
+static void
+lc_handshake(fuse_req_t req, int cmd, const void *in_buf, size_t in_bufsz,
+             size_t out_bufsz) {
+    struct lc_handshake hs;
+
+    if ((in_bufsz != sizeof(hs)) || (out_bufsz < sizeof(hs))) {
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    memcpy(&hs, in_buf, sizeof(hs));
+    if ((hs.hs_magic != LC_HANDSHAKE_MAGIC) ||
+        (hs.hs_revision != LC_IOCTL_REVISION)) {
+        lc_syslog(LOG_ERR, "Handshake with magic %lx revision %u refused\n",
+                  hs.hs_magic, hs.hs_revision);
+        fuse_reply_err(req, EPROTO);
+        return;
+    }
+    hs.hs_magic = ~LC_HANDSHAKE_MAGIC;
+    hs.hs_revision = LC_IOCTL_REVISION;
+    hs.hs_size = in_bufsz;
+    hs.hs_type = _IOC_TYPE(cmd);
+    hs.hs_wordSize = sizeof(long);
+    fuse_reply_ioctl(req, 0, &hs, sizeof(hs));
+}
+
 /* IOCTLs for certain operations.  Supported only on layer root directory */
 static void
 lc_ioctl(fuse_req_t req, fuse_ino_t ino, int cmd, void *arg,
@@ -1486,7 +1522,7 @@ lc_ioctl(fuse_req_t req, fuse_ino_t ino, int cmd, void *arg,
     char name[in_bufsz + 1], *layer, *parent;
     struct gfs *gfs = getfs();
     uint64_t value;
-    int len, op;
+    int len, op, err;
 
     lc_displayEntry(__func__, ino, cmd, NULL);
     op = _IOC_NR(cmd);
@@ -1502,7 +1538,8 @@ lc_ioctl(fuse_req_t req, fuse_ino_t ino, int cmd, void *arg,
         return;
     }
     if ((op != SYNCER_TIME) && (op != DCACHE_MEMORY) && (op != DCACHE_FLUSH) &&
-        (op != LCFS_COMMIT) && (op != LCFS_GROW)) {
+        (op != LCFS_COMMIT) && (op != LCFS_SYNC) && (op != LCFS_GROW) &&
+        (op != LCFS_HANDSHAKE)) {
         if (in_bufsz) {
             memcpy(name, in_buf, in_bufsz);
         }
@@ -1512,8 +1549,12 @@ lc_ioctl(fuse_req_t req, fuse_ino_t ino, int cmd, void *arg,
     case LAYER_CREATE:
     case LAYER_CREATE_RW:
 
-        /* Check if parent is specified */
+        /* Check if parent is specified, followed by a name */
         len = _IOC_TYPE(cmd);
+        if (unlikely(len && (len >= in_bufsz))) {
+            fuse_reply_err(req, EINVAL);
+            break;
+        }
         if (len) {
             parent = name;
             name[len] = 0;
@@ -1531,11 +1572,66 @@ lc_ioctl(fuse_req_t req, fuse_ino_t ino, int cmd, void *arg,
         break;
 
     case LAYER_MOUNT:
+
+        /* Check if mount options are specified, followed by a name */
+        len = _IOC_TYPE(cmd);
+        if (unlikely(len && (len >= in_bufsz))) {
+            fuse_reply_err(req, EINVAL);
+            break;
+        }
+        if (len) {
+            name[len] = 0;
+            lc_layerIoctl(req, gfs, &name[len + 1], name, op);
+        } else {
+            lc_layerIoctl(req, gfs, name, NULL, op);
+        }
+        break;
+
     case LAYER_STAT:
     case LAYER_UMOUNT:
     case UMOUNT_ALL:
     case CLEAR_STAT:
-        lc_layerIoctl(req, gfs, name, op);
+        lc_layerIoctl(req, gfs, name, NULL, op);
+        break;
+
+    case LAYER_STATS:
+        lc_layerStats(req, gfs, name, out_bufsz);
+        break;
+
+    case LCFS_STATS:
+        lc_daemonStats(req, gfs, out_bufsz);
+        break;
+
+    case LAYERS_EXIST:
+        lc_layersExist(req, gfs, name, in_bufsz, out_bufsz);
+        break;
+
+    case LAYER_EXTENTS:
+        lc_layerExtents(req, gfs, name, in_bufsz, out_bufsz);
+        break;
+
+    case LAYERS_UMOUNT:
+        lc_layersUmount(req, gfs, name, in_bufsz, out_bufsz);
+        break;
+
+    case LAYER_ENCRYPT:
+        lc_layerEncrypt(req, gfs, name, in_bufsz);
+        break;
+
+    case LAYER_SEAL:
+        lc_layerSeal(req, gfs, name);
+        break;
+
+    case LAYERS_MOUNTED:
+        lc_layersMounted(req, gfs, name, in_bufsz, out_bufsz);
+        break;
+
+    case LAYERS_LIST:
+        lc_layersList(req, gfs, name, out_bufsz);
+        break;
+
+    case LAYER_SHIFT:
+        lc_layerShift(req, gfs, name, in_bufsz);
         break;
 
     case SYNCER_TIME:
@@ -1581,6 +1677,24 @@ lc_ioctl(fuse_req_t req, fuse_ino_t ino, int cmd, void *arg,
         fuse_reply_ioctl(req, 0, NULL, 0);
         break;
 
+    case LCFS_HANDSHAKE:
+        lc_handshake(req, cmd, in_buf, in_bufsz, out_bufsz);
+        break;
+
+    case LCFS_SYNC:
+
+        /* Reply once a commit started after this request is on disk, with
+         * everything changed before.  Let the caller retry if commits kept
+         * being skipped while layers are being created or removed.
+         */
+        err = lc_syncWait(gfs);
+        if (err) {
+            fuse_reply_err(req, err);
+        } else {
+            fuse_reply_ioctl(req, 0, NULL, 0);
+        }
+        break;
+
 #ifndef __MUSL__
     case LCFS_PROFILE:
         if (name[0]) {
@@ -1647,7 +1761,7 @@ lc_write_buf(fuse_req_t req, fuse_ino_t ino,
     dpages = alloca(pcount * sizeof(struct dpage));
     fs = lc_getLayerLocked(ino, false);
     gfs = fs->fs_gfs;
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, ino, EROFS);
         fuse_reply_err(req, EROFS);
         err = EROFS;
@@ -1681,6 +1795,8 @@ lc_write_buf(fuse_req_t req, fuse_ino_t ino,
     /* Now the write cannot fail, so respond success */
     fuse_reply_write(req, size);
     assert(S_ISREG(inode->i_mode));
+    __sync_add_and_fetch(&fs->fs_writeBytes, size);
+    __sync_add_and_fetch(&fs->fs_writeOps, 1);
 
     /* Link the dirty pages to the inode and update times */
     count = lc_addPages(inode, off, size, dpages, pcount);
@@ -1729,7 +1845,7 @@ lc_fallocate(fuse_req_t req, fuse_ino_t ino, int mode,
     lc_statsBegin(&start);
     lc_displayEntry(__func__, ino, 0, NULL);
     fs = lc_getLayerLocked(ino, false);
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, ino, EROFS);
         err = EROFS;
         goto out;
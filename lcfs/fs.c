@@ -132,6 +132,12 @@ lc_freeLayer(struct fs *fs, bool remove) {
 
     lc_destroyPages(gfs, fs, remove);
     assert(fs->fs_bcache == NULL);
+    if (fs->fs_context) {
+        lc_free(fs, fs->fs_context, strlen(fs->fs_context) + 1,
+                LC_MEMTYPE_XATTRVALUE);
+        fs->fs_context = NULL;
+    }
+    lc_unloadKey(fs);
     lc_statsDeinit(fs);
 #ifdef LC_MUTEX_DESTROY
 #ifndef LC_IC_LOCK
@@ -471,6 +477,7 @@ lc_gfsInit(struct gfs *gfs) {
     pthread_cond_init(&gfs->gfs_mcond, NULL);
     pthread_cond_init(&gfs->gfs_flusherCond, NULL);
     pthread_cond_init(&gfs->gfs_cleanerCond, NULL);
+    pthread_cond_init(&gfs->gfs_commitCond, NULL);
     pthread_mutex_init(&gfs->gfs_lock, NULL);
     pthread_mutex_init(&gfs->gfs_alock, NULL);
     pthread_mutex_init(&gfs->gfs_clock, NULL);
@@ -501,6 +508,7 @@ lc_gfsDeinit(struct gfs *gfs) {
     pthread_cond_destroy(&gfs->gfs_mcond);
     pthread_cond_destroy(&gfs->gfs_flusherCond);
     pthread_cond_destroy(&gfs->gfs_cleanerCond);
+    pthread_cond_destroy(&gfs->gfs_commitCond);
 #endif
 #ifdef LC_MUTEX_DESTROY
     pthread_mutex_destroy(&gfs->gfs_lock);
@@ -811,9 +819,10 @@ lc_cleanupAfterRestart(struct gfs *gfs, struct fs *fs) {
 }
 
 /* Commit changes in root layer and write out superblock */
-void
+bool
 lc_commitRoot(struct gfs *gfs, int count) {
     struct fs *fs = lc_getGlobalFs(gfs);
+    bool committed = false;
     int err;
 
     /* Flush dirty pages with shared lock */
@@ -829,7 +838,7 @@ lc_commitRoot(struct gfs *gfs, int count) {
     /* Lock the layer exclusive and flush everything and write out superblock
      */
     if (lc_tryLock(fs, true)) {
-        return;
+        return false;
     }
     if ((gfs->gfs_layerInProgress == 0) && (count == gfs->gfs_syncRequired)) {
         lc_allocateSuperBlocks(gfs, fs);
@@ -847,20 +856,37 @@ lc_commitRoot(struct gfs *gfs, int count) {
             assert(err == 0);
         }
         gfs->gfs_syncRequired -= count;
+        committed = true;
         lc_printf("file system committed to disk\n");
     }
     lc_unlock(fs);
+    return committed;
+}
+
+/* Record a commit completed, waking up requests waiting for it */
+static void
+lc_commitDone(struct gfs *gfs, uint64_t commit) {
+    pthread_mutex_lock(&gfs->gfs_slock);
+    if (commit > gfs->gfs_commitDone) {
+        gfs->gfs_commitDone = commit;
+    }
+    pthread_cond_broadcast(&gfs->gfs_commitCond);
+    pthread_mutex_unlock(&gfs->gfs_slock);
 }
 
 /* Commit the file system to a consistent state */
 void
 lc_commit(struct gfs *gfs) {
     int i, count, gindex;
+    uint64_t commit;
     struct fs *fs;
 
     if (gfs->gfs_layerInProgress || (gfs->gfs_syncRequired == 0)) {
         return;
     }
+    pthread_mutex_lock(&gfs->gfs_slock);
+    commit = ++gfs->gfs_commitStarted;
+    pthread_mutex_unlock(&gfs->gfs_slock);
 
     /* Sync all layers */
     rcu_register_thread();
@@ -943,7 +969,64 @@ lc_commit(struct gfs *gfs) {
     if ((gfs->gfs_layerInProgress == 0) && (count == gfs->gfs_syncRequired)) {
 
         /* Sync everything from the root layer */
-        lc_commitRoot(gfs, count);
+        if (lc_commitRoot(gfs, count)) {
+            lc_commitDone(gfs, commit);
+        }
+    }
+}
+
+/* Commit the file system and wait for a commit started after the request to
+ * complete, which includes everything changed before the request, however
+ * many layers changed meanwhile, unless nothing is left to commit.  Commits
+ * are skipped while layers are being created or removed, so commits are
+ * retried until one completes.  Returns EAGAIN if none completed in
+ * LC_SYNC_WAIT seconds.
+ */
+int
+lc_syncWait(struct gfs *gfs) {
+    struct timespec deadline, retry;
+    uint64_t start, done;
+    long delay = 1000000;
+    struct timeval now;
+
+    pthread_mutex_lock(&gfs->gfs_slock);
+    start = gfs->gfs_commitStarted;
+    pthread_mutex_unlock(&gfs->gfs_slock);
+    gettimeofday(&now, NULL);
+    deadline.tv_sec = now.tv_sec + LC_SYNC_WAIT;
+    deadline.tv_nsec = now.tv_usec * 1000;
+    for (;;) {
+        lc_layerChanged(gfs, false, false);
+        lc_commit(gfs);
+        if (gfs->gfs_syncRequired == 0) {
+            return 0;
+        }
+        pthread_mutex_lock(&gfs->gfs_slock);
+        if (gfs->gfs_commitDone <= start) {
+            gettimeofday(&now, NULL);
+            retry.tv_sec = now.tv_sec;
+            retry.tv_nsec = now.tv_usec * 1000 + delay;
+            if (retry.tv_nsec >= 1000000000) {
+                retry.tv_sec++;
+                retry.tv_nsec -= 1000000000;
+            }
+            pthread_cond_timedwait(&gfs->gfs_commitCond, &gfs->gfs_slock,
+                                   &retry);
+        }
+        done = gfs->gfs_commitDone;
+        pthread_mutex_unlock(&gfs->gfs_slock);
+        if (done > start) {
+            return 0;
+        }
+        gettimeofday(&now, NULL);
+        if (gfs->gfs_unmounting || (now.tv_sec > deadline.tv_sec) ||
+            ((now.tv_sec == deadline.tv_sec) &&
+             (now.tv_usec * 1000 >= deadline.tv_nsec))) {
+            return EAGAIN;
+        }
+        if (delay < 100000000) {
+            delay *= 2;
+        }
     }
 }
 
@@ -16,6 +16,12 @@ enum lc_mountId {
 /* Time in seconds syncer is woken to checkpoint file system */
 #define LC_SYNC_INTERVAL       60
 
+/* Longest time in seconds a sync request waits for a commit */
+#define LC_SYNC_WAIT           10
+
+/* Time in seconds between updates of the stats page */
+#define LC_STATS_PAGE_INTERVAL 1
+
 /* Global file system */
 struct gfs {
 
@@ -83,6 +89,9 @@ struct gfs {
     /* pipe to communicate with parent */
     int *gfs_waiter;
 
+    /* File resource usage is published in, if any */
+    char *gfs_statsPage;
+
     /* Number of blocks reserved */
     uint64_t gfs_blocksReserved;
 
@@ -110,6 +119,9 @@ struct gfs {
     /* Condition variable syncer thread is waiting on */
     pthread_cond_t gfs_syncerCond;
 
+    /* Condition variable sync requests wait on for a commit */
+    pthread_cond_t gfs_commitCond;
+
     /* Count of pages in use */
     uint64_t gfs_pcount;
 
@@ -152,6 +164,12 @@ struct gfs {
     /* Set if layers are pending flush */
     int gfs_syncRequired;
 
+    /* Commits started, and the last one of those completed, protected by
+     * gfs_slock
+     */
+    uint64_t gfs_commitStarted;
+    uint64_t gfs_commitDone;
+
     /* Layer from pages being purged */
     int gfs_cleanerIndex;
 
@@ -182,6 +200,9 @@ struct gfs {
     bool gfs_swapLayersForCommit;
 } __attribute__((packed));
 
+/* Size of the key of an encrypted layer, two AES-256 keys used with XTS */
+#define LC_KEY_SIZE 64
+
 /* A file system structure created for each layer */
 struct fs {
 
@@ -324,6 +345,17 @@ struct fs {
     /* Stats for this file system */
     struct stats *fs_stats;
 
+    /* SELinux context of files of the layer given when mounted */
+    char *fs_context;
+
+    /* Key encrypting data of the layer, loaded from the kernel keyring */
+    unsigned char fs_key[LC_KEY_SIZE];
+
+    /* Oldest of the encrypted layers this layer was created from, if the
+     * layer is encrypted, valid once fs_keyLooked is set
+     */
+    struct fs *fs_keyLayer;
+
     /* Count of inodes */
     uint64_t fs_icount;
 
@@ -345,6 +377,24 @@ struct fs {
     /* Number of writes */
     uint64_t fs_writes;
 
+    /* Bytes read by read requests */
+    uint64_t fs_readBytes;
+
+    /* Bytes written by write requests */
+    uint64_t fs_writeBytes;
+
+    /* Number of read requests */
+    uint64_t fs_readOps;
+
+    /* Number of write requests */
+    uint64_t fs_writeOps;
+
+    /* Pages found in cache */
+    uint64_t fs_phit;
+
+    /* Pages read from disk */
+    uint64_t fs_pmissed;
+
     /* Inodes written */
     uint64_t fs_iwrite;
 
@@ -384,12 +434,21 @@ struct fs {
     /* No more changes in the file system */
     bool fs_frozen;
 
+    /* Set if changes are refused before the layer is frozen */
+    bool fs_sealed;
+
     /* Set if extended attributes are enabled */
     bool fs_xattrEnabled;
 
     /* Set if layer is being removed */
     bool fs_removed;
 
+    /* Set once the key of an encrypted layer is loaded */
+    bool fs_encrypted;
+
+    /* Set once fs_keyLayer is looked up */
+    bool fs_keyLooked;
+
     /* Set if layer is remounted */
     bool fs_restarted;
 
@@ -403,6 +462,27 @@ struct fs {
     bool fs_locked;
 } __attribute__((packed));
 
+/* Extended attribute holding the SELinux context of a file */
+#define LC_SELINUX_XATTR "security.selinux"
+
+/* Id stored for ids outside of the range of a shifted layer */
+#define LC_OVERFLOW_ID 65534
+
+/* Return the id stored in a layer shifted by shift for an id presented */
+static inline uint32_t
+lc_unshiftId(uint32_t id, uint32_t shift) {
+    if (shift == 0) {
+        return id;
+    }
+    return (id >= shift) ? (id - shift) : LC_OVERFLOW_ID;
+}
+
+/* Check if changes to a layer are refused */
+static inline bool
+lc_layerImmutable(struct fs *fs) {
+    return fs->fs_frozen || fs->fs_sealed;
+}
+
 /* Let the syncer know something changed and a checkpoint could be triggered */
 static inline void
 lc_layerChanged(struct gfs *gfs, bool new, bool wakeup) {
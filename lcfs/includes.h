@@ -30,6 +30,7 @@
 #include <zlib.h>
 #include <assert.h>
 #include <sys/ioctl.h>
+#include <sys/mman.h>
 #include <syslog.h>
 #include <urcu.h>
 #include <nmmintrin.h>
@@ -68,6 +69,14 @@ int lcfs_main(char *pgm, int argc, char *argv[]);
 
 int ioctl_main(char *pgm, int argc, char *argv[]);
 
+int lc_loadKey(struct fs *fs);
+int lc_loadKeys(struct fs *fs);
+void lc_unloadKey(struct fs *fs);
+void lc_setKeyLayer(struct fs *fs);
+void lc_decryptPage(struct fs *fs, struct page *page);
+char *lc_encryptPages(struct fs *fs, struct page *page, uint64_t count);
+int prefetch_main(char *pgm, int argc, char *argv[]);
+
 void lc_memStatsEnable();
 uint64_t lc_memoryInit(uint64_t limit);
 void *lc_malloc(struct fs *fs, size_t size, enum lc_memTypes type);
@@ -85,6 +94,7 @@ void lc_memTransferExtents(struct gfs *gfs, struct fs *fs, struct fs *cfs,
                            struct extent *extent);
 void lc_checkMemStats(struct fs *fs, bool unmount);
 void lc_displayGlobalMemStats();
+void lc_memoryStats(struct lc_daemonStats *stats);
 void lc_displayMemStats(struct fs *fs);
 
 void lc_readBlock(struct gfs *gfs, struct fs *fs, off_t block, void *dbuf);
@@ -98,6 +108,7 @@ void lc_verifyBlock(void *buf, uint32_t *crc);
 
 int lc_deviceOpen(char *device);
 uint64_t lc_getTotalMemory();
+uint64_t lc_getResidentMemory();
 
 void lc_addExtent(struct gfs *gfs, struct fs *fs, struct extent **extents,
                   uint64_t start, uint64_t block, uint64_t count, bool sort);
@@ -161,14 +172,16 @@ void lc_releaseInodeBlock(struct gfs *gfs, struct fs *fs);
 void lc_flushInodeBlocks(struct gfs *gfs, struct fs *fs);
 void lc_invalidateInodeBlocks(struct gfs *gfs, struct fs *fs);
 void *lc_syncer(void *data);
-void lc_commitRoot(struct gfs *gfs, int count);
+bool lc_commitRoot(struct gfs *gfs, int count);
+void lc_commit(struct gfs *gfs);
+int lc_syncWait(struct gfs *gfs);
 void lc_unmount(struct gfs *gfs);
 struct fs *lc_newLayer(struct gfs *gfs, bool rw);
 void lc_destroyLayer(struct fs *fs, bool remove);
 
 void lc_icache_init(struct fs *fs, size_t size);
 void lc_icache_deinit(struct icache *icache);
-void lc_copyStat(struct stat *st, struct inode *inode);
+void lc_copyStat(struct fs *fs, struct stat *st, struct inode *inode);
 void lc_copyFakeStat(struct stat *st);
 ino_t lc_inodeAlloc(struct fs *fs);
 void lc_updateFtypeStats(struct fs *fs, mode_t mode, bool incr);
@@ -305,13 +318,28 @@ void lc_xattrFree(struct inode *inode);
 ino_t lc_getRootIno(struct fs *fs, const char *name, struct inode *pdir,
                     bool err);
 void lc_linkParent(struct fs *fs, struct fs *pfs);
+void lc_layersExist(fuse_req_t req, struct gfs *gfs, const char *names,
+                    size_t len, size_t size);
+void lc_layerExtents(fuse_req_t req, struct gfs *gfs, const char *name,
+                     size_t len, size_t size);
+void lc_layersUmount(fuse_req_t req, struct gfs *gfs, const char *names,
+                     size_t len, size_t size);
+void lc_layersMounted(fuse_req_t req, struct gfs *gfs, const char *names,
+                      size_t len, size_t size);
+void lc_layersList(fuse_req_t req, struct gfs *gfs, const char *start,
+                   size_t size);
+void lc_layerShift(fuse_req_t req, struct gfs *gfs, const char *name,
+                   size_t len);
+void lc_layerEncrypt(fuse_req_t req, struct gfs *gfs, const char *name,
+                     size_t len);
+void lc_layerSeal(fuse_req_t req, struct gfs *gfs, const char *name);
 void lc_createLayer(fuse_req_t req, struct gfs *gfs, const char *name,
                     const char *parent, size_t size, bool rw);
 void lc_deleteLayer(fuse_req_t req, struct gfs *gfs, const char *name);
 int lc_removeRoot(struct fs *rfs, struct inode *dir, ino_t ino, bool rmdir,
                   void **fsp);
 void lc_layerIoctl(fuse_req_t req, struct gfs *gfs, const char *name,
-                   enum ioctl_cmd cmd);
+                   const char *options, enum ioctl_cmd cmd);
 void lc_commitLayer(fuse_req_t req, struct fs *fs, ino_t ino, const char *name,
                     struct fuse_file_info *fi);
 
@@ -333,6 +361,10 @@ void lc_displayStats(struct fs *fs);
 void lc_displayStatsAll(struct gfs *gfs);
 void lc_displayGlobalStats(struct gfs *gfs);
 void lc_statsDeinit(struct fs *fs);
+void lc_layerStats(fuse_req_t req, struct gfs *gfs, const char *name,
+                   size_t size);
+void lc_daemonStats(fuse_req_t req, struct gfs *gfs, size_t size);
+void *lc_statsPublisher(void *data);
 
 #ifdef DEBUG
 void lc_validate(struct gfs *gfs);
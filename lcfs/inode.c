@@ -28,17 +28,17 @@ lc_icache_init(struct fs *fs, size_t size) {
     fs->fs_icacheSize = size;
 }
 
-/* Copy disk inode to stat structure */
+/* Copy disk inode to stat structure, with ids shifted as in the layer */
 void
-lc_copyStat(struct stat *st, struct inode *inode) {
+lc_copyStat(struct fs *fs, struct stat *st, struct inode *inode) {
     struct dinode *dinode = &inode->i_dinode;
 
     st->st_dev = 0;
     st->st_ino = dinode->di_ino;
     st->st_mode = dinode->di_mode;
     st->st_nlink = dinode->di_nlink;
-    st->st_uid = dinode->di_uid;
-    st->st_gid = dinode->di_gid;
+    st->st_uid = dinode->di_uid + fs->fs_super->sb_uidShift;
+    st->st_gid = dinode->di_gid + fs->fs_super->sb_gidShift;
     st->st_rdev = dinode->di_rdev;
     st->st_size = dinode->di_size;
     st->st_blksize = LC_BLOCK_SIZE;
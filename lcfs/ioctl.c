@@ -153,3 +153,109 @@ ioctl_main(char *pgm, int argc, char *argv[]) {
     close(fd);
     return 0;
 }
+
+/* Read a file under a directory into the cache, returning the number of
+ * bytes read.  Every component of the path is opened without following
+ * symbolic links, so none leads out of the layer.
+ */
+static ssize_t
+prefetchFile(int dfd, char *path) {
+    char buf[64 * 1024], *name, *next;
+    ssize_t count, total = 0;
+    struct stat st;
+    int fd;
+
+    while (*path == '/') {
+        path++;
+    }
+    fd = dup(dfd);
+    for (name = path; (fd >= 0) && name; name = next) {
+        next = strchr(name, '/');
+        if (next) {
+            *next++ = 0;
+            while (*next == '/') {
+                next++;
+            }
+            if (*next == 0) {
+                next = NULL;
+            }
+        }
+        dfd = fd;
+        fd = openat(dfd, *name ? name : ".", O_RDONLY | O_NOFOLLOW |
+                    (next ? O_DIRECTORY : O_NONBLOCK));
+        close(dfd);
+    }
+    if (fd < 0) {
+        return -1;
+    }
+    if (fstat(fd, &st) || !S_ISREG(st.st_mode)) {
+        close(fd);
+        return 0;
+    }
+    while ((count = read(fd, buf, sizeof(buf))) > 0) {
+        total += count;
+    }
+    close(fd);
+    return (count < 0) ? -1 : total;
+}
+
+/* Read files listed, one path within the layer per line, into the cache.
+ * The list may be recorded while a container is starting.
+ */
+int
+prefetch_main(char *pgm, int argc, char *argv[]) {
+    size_t dlen, size = 0, files = 0, bytes = 0;
+    char *line = NULL, *dir;
+    ssize_t len, count;
+    FILE *list;
+    int dfd;
+
+    if (argc != 4) {
+        fprintf(stderr, "usage: %s %s <mnt> <id> <list>\n", pgm, argv[0]);
+        fprintf(stderr, "\t mnt    - mount point\n");
+        fprintf(stderr, "\t id     - layer name\n");
+        fprintf(stderr, "\t list   - file listing paths, - for stdin\n");
+        exit(EINVAL);
+    }
+    if (strchr(argv[2], '/') || (strlen(argv[2]) > LAYER_NAME_MAX)) {
+        fprintf(stderr, "Invalid layer name %s\n", argv[2]);
+        exit(EINVAL);
+    }
+    list = strcmp(argv[3], "-") ? fopen(argv[3], "r") : stdin;
+    if (list == NULL) {
+        perror("fopen");
+        exit(errno);
+    }
+    dlen = strlen(argv[1]) + strlen(LC_LAYER_ROOT_DIR) + strlen(argv[2]) + 3;
+    dir = alloca(dlen);
+    sprintf(dir, "%s/%s/%s", argv[1], LC_LAYER_ROOT_DIR, argv[2]);
+    dfd = open(dir, O_RDONLY | O_DIRECTORY);
+    if (dfd < 0) {
+        perror("open");
+        exit(errno);
+    }
+    while ((len = getline(&line, &size, list)) > 0) {
+        if (line[len - 1] == '\n') {
+            line[--len] = 0;
+        }
+
+        /* Skip empty lines and paths leading out of the layer */
+        if ((len == 0) || !strcmp(line, "..") || !strncmp(line, "../", 3) ||
+            strstr(line, "/../") ||
+            ((len >= 3) && !strcmp(&line[len - 3], "/.."))) {
+            continue;
+        }
+        count = prefetchFile(dfd, line);
+        if (count >= 0) {
+            files++;
+            bytes += count;
+        }
+    }
+    free(line);
+    close(dfd);
+    if (list != stdin) {
+        fclose(list);
+    }
+    printf("Prefetched %zu files, %zu bytes\n", files, bytes);
+    return 0;
+}
@@ -140,6 +140,20 @@ lc_createLayer(fuse_req_t req, struct gfs *gfs, const char *name,
         assert(!(fs->fs_super->sb_flags & LC_SUPER_ZOMBIE));
         assert(pfs->fs_root == lc_getInodeHandle(pinum));
         lc_linkParent(fs, pfs);
+
+        /* Present files shared with the parent with the same ids */
+        super->sb_uidShift = pfs->fs_super->sb_uidShift;
+        super->sb_gidShift = pfs->fs_super->sb_gidShift;
+
+        /* Encrypt data with the key of the parent */
+        if (pfs->fs_super->sb_keyRef[0]) {
+            memcpy(super->sb_keyRef, pfs->fs_super->sb_keyRef,
+                   LC_KEY_REF_MAX);
+            if (pfs->fs_encrypted) {
+                memcpy(fs->fs_key, pfs->fs_key, LC_KEY_SIZE);
+                fs->fs_encrypted = true;
+            }
+        }
     }
 
     /* Add this file system to global list of file systems */
@@ -335,7 +349,7 @@ out:
     lc_unlock(rfs);
 }
 
-/* Unmount a layer */
+/* Unmount a layer, replying to the request if one is specified */
 static void
 lc_umountLayer(fuse_req_t req, struct gfs *gfs, ino_t root) {
     struct fs *fs = lc_getLayerLocked(root, false);
@@ -344,7 +358,9 @@ lc_umountLayer(fuse_req_t req, struct gfs *gfs, ino_t root) {
     mcount = __sync_sub_and_fetch(&fs->fs_mcount, 1);
     if (mcount || fs->fs_removed) {
         lc_unlock(fs);
-        fuse_reply_ioctl(req, 0, NULL, 0);
+        if (req) {
+            fuse_reply_ioctl(req, 0, NULL, 0);
+        }
         return;
     }
     if (!fs->fs_frozen && (fs->fs_readOnly ||
@@ -360,7 +376,9 @@ lc_umountLayer(fuse_req_t req, struct gfs *gfs, ino_t root) {
         assert(!fs->fs_removed);
         assert((fs->fs_child == NULL) || fs->fs_commitInProgress);
         assert(!fs->fs_frozen);
-        fuse_reply_ioctl(req, 0, NULL, 0);
+        if (req) {
+            fuse_reply_ioctl(req, 0, NULL, 0);
+        }
         fs->fs_dirtyInodes = NULL;
         lc_freezeLayer(gfs, fs);
 
@@ -390,7 +408,9 @@ lc_umountLayer(fuse_req_t req, struct gfs *gfs, ino_t root) {
         }
         rcu_unregister_thread();
     } else {
-        fuse_reply_ioctl(req, 0, NULL, 0);
+        if (req) {
+            fuse_reply_ioctl(req, 0, NULL, 0);
+        }
         if (fs->fs_super->sb_icount != fs->fs_icount) {
             fs->fs_super->sb_icount = fs->fs_icount;
             lc_markSuperDirty(fs);
@@ -400,10 +420,380 @@ lc_umountLayer(fuse_req_t req, struct gfs *gfs, ino_t root) {
     }
 }
 
+/* Check which of the layers named exist.  Names are NUL separated, a byte is
+ * returned for each name, set if the layer exists.
+ */
+void
+lc_layersExist(fuse_req_t req, struct gfs *gfs, const char *names,
+               size_t len, size_t size) {
+    const char *name = names, *end = &names[len];
+    char exists[len + 1];
+    struct fs *rfs;
+    size_t count = 0;
+
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    while ((name < end) && *name) {
+        if (count >= size) {
+            lc_unlock(rfs);
+            fuse_reply_err(req, EINVAL);
+            return;
+        }
+        exists[count++] = lc_getRootIno(rfs, name, NULL, false) !=
+                          LC_INVALID_INODE;
+        name += strlen(name) + 1;
+    }
+    lc_unlock(rfs);
+    fuse_reply_ioctl(req, 0, exists, count);
+}
+
+/* Return extents of blocks allocated in a layer, starting with the extent at
+ * the index specified after the name of the layer.  Blocks shared with parent
+ * layers are not allocated in the layer, so these are the blocks changed by
+ * the layer, including its metadata.
+ */
+void
+lc_layerExtents(fuse_req_t req, struct gfs *gfs, const char *name,
+                size_t len, size_t size) {
+    size_t nlen = strlen(name), max;
+    uint64_t start = 0, index = 0;
+    struct lc_layerExtents *reply;
+    struct extent *extent;
+    struct fs *fs, *rfs;
+    char buf[size];
+    ino_t root;
+
+    if (size < sizeof(struct lc_layerExtents)) {
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    if ((nlen + 1) < len) {
+        start = strtoull(&name[nlen + 1], NULL, 10);
+    }
+    max = (size - sizeof(struct lc_layerExtents)) /
+          sizeof(struct lc_blockExtent);
+    reply = (struct lc_layerExtents *)buf;
+    reply->le_count = 0;
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    root = lc_getRootIno(rfs, name, NULL, true);
+    if (unlikely(root == LC_INVALID_INODE)) {
+        lc_unlock(rfs);
+        fuse_reply_err(req, ENOENT);
+        return;
+    }
+    fs = lc_getLayerLocked(root, false);
+    pthread_mutex_lock(&fs->fs_alock);
+    extent = fs->fs_aextents;
+    while (extent) {
+        if ((index >= start) && (reply->le_count < max)) {
+            reply->le_extents[reply->le_count].be_start =
+                                                lc_getExtentStart(extent);
+            reply->le_extents[reply->le_count].be_count =
+                                                lc_getExtentCount(extent);
+            reply->le_count++;
+        }
+        index++;
+        extent = extent->ex_next;
+    }
+    pthread_mutex_unlock(&fs->fs_alock);
+    reply->le_total = index;
+    lc_unlock(fs);
+    lc_unlock(rfs);
+    fuse_reply_ioctl(req, 0, reply, sizeof(struct lc_layerExtents) +
+                     (reply->le_count * sizeof(struct lc_blockExtent)));
+}
+
+/* Unmount the layers named.  Names are NUL separated, a byte is returned for
+ * each name, set to the error unmounting the layer failed with.  The reply is
+ * sent once all layers are looked up, as unmounting those cannot fail.
+ */
+void
+lc_layersUmount(fuse_req_t req, struct gfs *gfs, const char *names,
+                size_t len, size_t size) {
+    const char *name = names, *end = &names[len];
+    char status[len + 1];
+    ino_t roots[(len / 2) + 1];
+    struct timeval start;
+    size_t count = 0, i;
+    struct fs *rfs;
+
+    lc_statsBegin(&start);
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    while ((name < end) && *name) {
+        if (count >= size) {
+            lc_unlock(rfs);
+            fuse_reply_err(req, EINVAL);
+            return;
+        }
+        roots[count] = lc_getRootIno(rfs, name, NULL, true);
+        status[count] = (roots[count] == LC_INVALID_INODE) ? ENOENT : 0;
+        count++;
+        name += strlen(name) + 1;
+    }
+    fuse_reply_ioctl(req, 0, status, count);
+    for (i = 0; i < count; i++) {
+        if (status[i] == 0) {
+            lc_umountLayer(NULL, gfs, roots[i]);
+        }
+        lc_statsAdd(rfs, LC_UMOUNT, status[i], &start);
+    }
+    lc_unlock(rfs);
+}
+
+/* Return how many times each of the layers named is mounted.  Names are NUL
+ * separated, a byte is returned for each name, zero if the layer does not
+ * exist and capped at 255.
+ */
+void
+lc_layersMounted(fuse_req_t req, struct gfs *gfs, const char *names,
+                 size_t len, size_t size) {
+    const char *name = names, *end = &names[len];
+    char mounted[len + 1];
+    struct fs *fs, *rfs;
+    size_t count = 0;
+    ino_t root;
+    int mcount;
+
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    while ((name < end) && *name) {
+        if (count >= size) {
+            lc_unlock(rfs);
+            fuse_reply_err(req, EINVAL);
+            return;
+        }
+        root = lc_getRootIno(rfs, name, NULL, false);
+        mcount = 0;
+        if (root != LC_INVALID_INODE) {
+            fs = lc_getLayerLocked(root, false);
+            mcount = fs->fs_mcount;
+            lc_unlock(fs);
+        }
+        mounted[count++] = (mcount > 255) ? 255 : mcount;
+        name += strlen(name) + 1;
+    }
+    lc_unlock(rfs);
+    fuse_reply_ioctl(req, 0, mounted, count);
+}
+
+/* Return names of layers, starting with the layer at the index specified.
+ * Names follow the header, NUL terminated, as many as fit.  Layers removed are
+ * unlinked from the layer root directory, including those kept as zombie
+ * layers until their children are removed, so those are not returned.
+ */
+void
+lc_layersList(fuse_req_t req, struct gfs *gfs, const char *start,
+              size_t size) {
+    struct inode *dir = gfs->gfs_layerRootInode;
+    uint64_t first = strtoull(start, NULL, 10), index = 0;
+    struct lc_layerList *reply;
+    struct dirent *dirent;
+    size_t remain;
+    char buf[size];
+    struct fs *rfs;
+    char *names;
+    bool hashed;
+    int i, max;
+
+    if (size < sizeof(struct lc_layerList)) {
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    reply = (struct lc_layerList *)buf;
+    reply->ll_count = 0;
+    names = reply->ll_names;
+    remain = size - sizeof(struct lc_layerList);
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    lc_inodeLock(dir, false);
+    hashed = (dir->i_flags & LC_INODE_DHASHED);
+    max = hashed ? LC_DIRCACHE_SIZE : 1;
+    for (i = 0; i < max; i++) {
+        dirent = hashed ? dir->i_hdirent[i] : dir->i_dirent;
+        while (dirent) {
+            if (S_ISDIR(dirent->di_mode)) {
+
+                /* Stop returning names once one does not fit */
+                if ((index == (first + reply->ll_count)) &&
+                    ((dirent->di_size + 1) <= remain)) {
+                    memcpy(names, dirent->di_name, dirent->di_size);
+                    names[dirent->di_size] = 0;
+                    names += dirent->di_size + 1;
+                    remain -= dirent->di_size + 1;
+                    reply->ll_count++;
+                }
+                index++;
+            }
+            dirent = dirent->di_next;
+        }
+    }
+    lc_inodeUnlock(dir);
+    lc_unlock(rfs);
+    reply->ll_total = index;
+    fuse_reply_ioctl(req, 0, reply, size - remain);
+}
+
+/* Shift user and group ids presented by a layer.  Name of the layer is
+ * followed by the shifts as "uid:gid".  Shifts are set on layers just created,
+ * neither mounted nor having children, as those would see ids changing.
+ */
+void
+lc_layerShift(fuse_req_t req, struct gfs *gfs, const char *name, size_t len) {
+    size_t nlen = strlen(name);
+    unsigned int uid, gid;
+    struct fs *fs, *rfs;
+    ino_t root;
+
+    if (((nlen + 1) >= len) ||
+        (sscanf(&name[nlen + 1], "%u:%u", &uid, &gid) != 2)) {
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    root = lc_getRootIno(rfs, name, NULL, true);
+    if (unlikely(root == LC_INVALID_INODE)) {
+        lc_unlock(rfs);
+        fuse_reply_err(req, ENOENT);
+        return;
+    }
+    fs = lc_getLayerLocked(root, true);
+    lc_unlock(rfs);
+    if (fs->fs_mcount || fs->fs_frozen) {
+        lc_unlock(fs);
+        fuse_reply_err(req, EBUSY);
+        return;
+    }
+    fs->fs_super->sb_uidShift = uid;
+    fs->fs_super->sb_gidShift = gid;
+    lc_markSuperDirty(fs);
+    lc_markInodesDirty(fs);
+    lc_unlock(fs);
+    lc_layerChanged(gfs, false, false);
+    lc_printf("Layer %s shifted by uid %u gid %u\n", name, uid, gid);
+    fuse_reply_ioctl(req, 0, NULL, 0);
+}
+
+/* Refuse changes to a read-only layer from now on, even while it is still
+ * mounted, instead of once it is unmounted for the last time.  The layer is
+ * frozen as before when unmounted, and read-only layers are frozen when loaded
+ * again, so nothing is stored.
+ */
+void
+lc_layerSeal(fuse_req_t req, struct gfs *gfs, const char *name) {
+    struct fs *fs, *rfs;
+    ino_t root;
+
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    root = lc_getRootIno(rfs, name, NULL, true);
+    if (unlikely(root == LC_INVALID_INODE)) {
+        lc_unlock(rfs);
+        fuse_reply_err(req, ENOENT);
+        return;
+    }
+
+    /* Taking the exclusive lock makes sure changes in progress are done */
+    fs = lc_getLayerLocked(root, true);
+    lc_unlock(rfs);
+    if (!fs->fs_readOnly) {
+        lc_unlock(fs);
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    fs->fs_sealed = true;
+    lc_unlock(fs);
+    lc_printf("Layer %s sealed\n", name);
+    fuse_reply_ioctl(req, 0, NULL, 0);
+}
+
+/* Set the SELinux context of files of a layer from the options of a mount,
+ * given as context="<label>" like the mount option.  The context is presented
+ * as the label of every file of the layer, instead of relabeling files.
+ */
+static int
+lc_setContext(struct fs *fs, const char *options) {
+    const char *label;
+    size_t len;
+
+    if (strncmp(options, "context=", 8)) {
+        return EINVAL;
+    }
+    label = options + 8;
+    len = strlen(label);
+    if ((len >= 2) && (label[0] == '"') && (label[len - 1] == '"')) {
+        label++;
+        len -= 2;
+    }
+    if (fs->fs_context) {
+        if ((strlen(fs->fs_context) == len) &&
+            !strncmp(fs->fs_context, label, len)) {
+            return 0;
+        }
+        lc_free(fs, fs->fs_context, strlen(fs->fs_context) + 1,
+                LC_MEMTYPE_XATTRVALUE);
+        fs->fs_context = NULL;
+    }
+    if (len) {
+        fs->fs_context = lc_malloc(fs, len + 1, LC_MEMTYPE_XATTRVALUE);
+        memcpy(fs->fs_context, label, len);
+        fs->fs_context[len] = 0;
+    }
+    return 0;
+}
+
+/* Encrypt data of a layer with a key from the kernel keyring.  Name of the
+ * layer is followed by the description of the key.  Keys are set on layers
+ * just created, neither mounted nor having data, and are inherited by layers
+ * created from the layer.
+ */
+void
+lc_layerEncrypt(fuse_req_t req, struct gfs *gfs, const char *name,
+                size_t len) {
+    size_t nlen = strlen(name), rlen;
+    struct fs *fs, *rfs;
+    const char *ref;
+    ino_t root;
+    int err;
+
+    ref = &name[nlen + 1];
+    rlen = ((nlen + 1) < len) ? strnlen(ref, len - nlen - 1) : 0;
+    if ((rlen == 0) || (rlen >= LC_KEY_REF_MAX)) {
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    root = lc_getRootIno(rfs, name, NULL, true);
+    if (unlikely(root == LC_INVALID_INODE)) {
+        lc_unlock(rfs);
+        fuse_reply_err(req, ENOENT);
+        return;
+    }
+    fs = lc_getLayerLocked(root, true);
+    lc_unlock(rfs);
+    if (fs->fs_mcount || fs->fs_frozen || fs->fs_blocks ||
+        fs->fs_super->sb_keyRef[0]) {
+        lc_unlock(fs);
+        fuse_reply_err(req, EBUSY);
+        return;
+    }
+    memset(fs->fs_super->sb_keyRef, 0, LC_KEY_REF_MAX);
+    memcpy(fs->fs_super->sb_keyRef, ref, rlen);
+    err = lc_loadKey(fs);
+    if (err) {
+        memset(fs->fs_super->sb_keyRef, 0, LC_KEY_REF_MAX);
+        lc_unlock(fs);
+        lc_reportError(__func__, __LINE__, root, err);
+        fuse_reply_err(req, err);
+        return;
+    }
+    lc_setKeyLayer(fs);
+    lc_markSuperDirty(fs);
+    lc_unlock(fs);
+    lc_layerChanged(gfs, false, false);
+    lc_printf("Layer %s encrypted with key %s\n", name, ref);
+    fuse_reply_ioctl(req, 0, NULL, 0);
+}
+
 /* Mount, unmount, stat a layer */
 void
 lc_layerIoctl(fuse_req_t req, struct gfs *gfs, const char *name,
-              enum ioctl_cmd cmd) {
+              const char *options, enum ioctl_cmd cmd) {
     struct timeval start;
     struct fs *fs, *rfs;
     ino_t root;
@@ -434,7 +824,20 @@ lc_layerIoctl(fuse_req_t req, struct gfs *gfs, const char *name,
 
         /* Mark a layer as mounted */
         if (likely(err == 0)) {
-            fs = lc_getLayerLocked(root, false);
+            fs = lc_getLayerLocked(root, options != NULL);
+            if (options) {
+                err = lc_setContext(fs, options);
+            }
+
+            /* Data of encrypted layers cannot be read without the keys */
+            if (likely(err == 0)) {
+                err = lc_loadKeys(fs);
+            }
+            if (unlikely(err)) {
+                lc_unlock(fs);
+                lc_statsAdd(rfs, LC_MOUNT, err, &start);
+                break;
+            }
             __sync_add_and_fetch(&fs->fs_mcount, 1);
             if (!fs->fs_frozen) {
                 fs->fs_super->sb_flags |= LC_SUPER_DIRTY;
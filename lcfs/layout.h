@@ -19,6 +19,9 @@
 /* Invalid block */
 #define LC_INVALID_BLOCK    0x0000FFFFFFFFFFFFul
 
+/* Longest description of the key of an encrypted layer, including the NUL */
+#define LC_KEY_REF_MAX      64
+
 /* Invalid inode */
 #define LC_INVALID_INODE   -1
 
@@ -179,8 +182,17 @@ struct super {
     /* pcache limit */
     uint32_t sb_pcache;
 
+    /* Added to user ids stored in the layer when presented */
+    uint32_t sb_uidShift;
+
+    /* Added to group ids stored in the layer when presented */
+    uint32_t sb_gidShift;
+
+    /* Description of the key in the kernel keyring encrypting data */
+    char     sb_keyRef[LC_KEY_REF_MAX];
+
     /* Padding for filling up a block */
-    uint8_t  sb_pad[LC_BLOCK_SIZE - 216];
+    uint8_t  sb_pad[LC_BLOCK_SIZE - 288];
 } __attribute__((packed));
 static_assert(sizeof(struct super) == LC_BLOCK_SIZE, "superblock size != LC_BLOCK_SIZE");
 
@@ -18,8 +18,53 @@ enum ioctl_cmd {
     LCFS_GROW = 113,                /* Grow file system */
     LCFS_PROFILE = 114,             /* Enable/disable profiling */
     LCFS_VERBOSE = 115,             /* Enable/disable verbose mode */
+    LAYER_STATS = 116,              /* Return I/O counters of a layer */
+    LCFS_STATS = 117,               /* Return resource usage of daemon */
+    LAYERS_EXIST = 118,             /* Check which of the layers exist */
+    LAYER_EXTENTS = 119,            /* Return blocks allocated in a layer */
+    LAYERS_UMOUNT = 120,            /* Unmount a batch of layers */
+    LAYERS_MOUNTED = 121,           /* Return mount counts of layers */
+    LCFS_SYNC = 122,                /* Commit to disk and wait for it */
+    LCFS_HANDSHAKE = 123,           /* Verify ioctls are encoded alike */
+    LAYER_SHIFT = 124,              /* Shift user and group ids of a layer */
+    LAYER_ENCRYPT = 125,            /* Encrypt data of a layer with a key */
+    LAYER_SEAL = 126,               /* Refuse changes to a read-only layer */
+    LAYERS_LIST = 127,              /* Return names of all layers */
 };
 
+/* Magic number exchanged with LCFS_HANDSHAKE, returned inverted */
+#define LC_HANDSHAKE_MAGIC          0x6c6366732d696f63ull
+
+/* Revision of the ioctl interface, bumped on incompatible changes */
+#define LC_IOCTL_REVISION           2
+
+/* Type field of the command of LCFS_HANDSHAKE */
+#define LC_HANDSHAKE_TYPE           0x5a
+
+/* Data structure exchanged with LCFS_HANDSHAKE.  The caller fills in the
+ * magic number and its revision, the daemon returns the magic number
+ * inverted and what it decoded from the command, so the caller can verify
+ * both sides agree on the byte order, the encoding of commands and the layout
+ * of the data structures.
+ */
+struct lc_handshake {
+
+    /* LC_HANDSHAKE_MAGIC, inverted in the response */
+    uint64_t hs_magic;
+
+    /* Revision of the ioctl interface */
+    uint32_t hs_revision;
+
+    /* Size of the request decoded from the command */
+    uint32_t hs_size;
+
+    /* Type field decoded from the command */
+    uint32_t hs_type;
+
+    /* Size of a long in the daemon */
+    uint32_t hs_wordSize;
+} __attribute__((packed));
+
 /* Prefix of fake file name used to trigger layer commit */
 #define LC_COMMIT_TRIGGER_PREFIX    ".lcfs-diff-"
 
@@ -36,4 +81,130 @@ struct pchange {
     char ch_path[0];
 } __attribute__((packed));
 
+/* Data structure used to respond to LAYER_STATS */
+struct lc_layerStats {
+
+    /* Bytes read from files in the layer */
+    uint64_t ls_readBytes;
+
+    /* Bytes written to files in the layer */
+    uint64_t ls_writeBytes;
+
+    /* Number of read requests */
+    uint64_t ls_readOps;
+
+    /* Number of write requests */
+    uint64_t ls_writeOps;
+
+    /* Number of blocks read from disk */
+    uint64_t ls_blockReads;
+
+    /* Number of blocks written to disk */
+    uint64_t ls_blockWrites;
+
+    /* Count of inodes */
+    uint64_t ls_inodes;
+
+    /* Count of dirty pages */
+    uint64_t ls_dirtyPages;
+
+    /* Pages found in cache, possibly shared with other layers */
+    uint64_t ls_cacheHits;
+
+    /* Pages read from disk */
+    uint64_t ls_cacheMisses;
+
+    /* Number of ancestors of the layer */
+    uint64_t ls_depth;
+} __attribute__((packed));
+
+/* Data structure used to respond to LCFS_STATS */
+struct lc_daemonStats {
+
+    /* Resident memory of the daemon in bytes */
+    uint64_t ds_residentMemory;
+
+    /* Memory used for data pages */
+    uint64_t ds_pageMemory;
+
+    /* Memory targetted for data pages by cleaner */
+    uint64_t ds_pageMemoryLimit;
+
+    /* Memory allocated globally */
+    uint64_t ds_globalMemory;
+
+    /* Count of pages in use */
+    uint64_t ds_pages;
+
+    /* Count of total dirty pages */
+    uint64_t ds_dirtyPages;
+
+    /* Count of file systems in use */
+    uint64_t ds_layers;
+} __attribute__((packed));
+
+/* Magic number of the stats page published by the daemon */
+#define LC_STATS_PAGE_MAGIC         0x4c435350
+
+/* Current version of the stats page */
+#define LC_STATS_PAGE_VERSION       1
+
+/* Resource usage of the daemon published in a file mapped by readers, instead
+ * of issuing LCFS_STATS.  The sequence number is odd while the page is being
+ * updated, readers retry if it changed while reading.
+ */
+struct lc_statsPage {
+
+    /* Set to LC_STATS_PAGE_MAGIC once the page is initialized */
+    uint32_t sp_magic;
+
+    /* Version of the layout of the page */
+    uint32_t sp_version;
+
+    /* Incremented before and after each update */
+    uint64_t sp_seq;
+
+    /* Time of the last update in seconds since the epoch */
+    uint64_t sp_time;
+
+    /* Resource usage of the daemon */
+    struct lc_daemonStats sp_stats;
+} __attribute__((packed));
+
+/* Extent of blocks allocated in a layer */
+struct lc_blockExtent {
+
+    /* First block of the extent */
+    uint64_t be_start;
+
+    /* Number of blocks in the extent */
+    uint64_t be_count;
+} __attribute__((packed));
+
+/* Data structure used to respond to LAYER_EXTENTS */
+struct lc_layerExtents {
+
+    /* Number of extents allocated in the layer */
+    uint64_t le_total;
+
+    /* Number of extents returned */
+    uint64_t le_count;
+
+    /* Extents returned - Variable length */
+    struct lc_blockExtent le_extents[0];
+} __attribute__((packed));
+
+/* Data structure used to respond to LAYERS_LIST */
+struct lc_layerList {
+
+    /* Number of layers */
+    uint64_t ll_total;
+
+    /* Number of layers returned */
+    uint64_t ll_count;
+
+    /* Names of the layers returned, NUL terminated - Variable length */
+    char ll_names[0];
+} __attribute__((packed));
+
 #endif
@@ -14,3 +14,19 @@ lc_getTotalMemory() {
     sysinfo(&info);
     return info.totalram;
 }
+
+/* Find out resident memory of the process */
+uint64_t
+lc_getResidentMemory() {
+    uint64_t size, resident = 0;
+    FILE *file;
+
+    file = fopen("/proc/self/statm", "r");
+    if (file) {
+        if (fscanf(file, "%lu %lu", &size, &resident) != 2) {
+            resident = 0;
+        }
+        fclose(file);
+    }
+    return resident * sysconf(_SC_PAGESIZE);
+}
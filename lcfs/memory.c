@@ -245,6 +245,14 @@ lc_displayGlobalMemStats() {
               lc_mem.m_totalMemory, lc_mem.m_purgeMemory / (1024 * 1024));
 }
 
+/* Report memory usage in daemon stats */
+void
+lc_memoryStats(struct lc_daemonStats *stats) {
+    stats->ds_pageMemory = lc_mem.m_totalMemory;
+    stats->ds_pageMemoryLimit = lc_mem.m_purgeMemory;
+    stats->ds_globalMemory = lc_mem.m_globalMemory;
+}
+
 /* Display memory stats */
 void
 lc_displayMemStats(struct fs *fs) {
@@ -927,6 +927,7 @@ lc_readFile(fuse_req_t req, struct fs *fs, struct inode *inode, off_t soffset,
 
         /* Consider all the pages read as missed in the cache */
         __sync_add_and_fetch(&gfs->gfs_pmissed, rcount);
+        __sync_add_and_fetch(&fs->fs_pmissed, rcount);
     }
     return 0;
 }
@@ -1095,6 +1096,7 @@ lc_flushPages(struct gfs *gfs, struct fs *fs, struct inode *inode,
                 zcount++;
             }
             page = lc_getPageNew(gfs, fs, block + count, pdata);
+            page->p_encrypt = fs->fs_encrypted;
 
             if (read) {
                 page->p_hitCount++;
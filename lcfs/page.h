@@ -127,7 +127,10 @@ struct page {
     uint32_t p_refCount;
 
     /* Page cache hitcount */
-    uint32_t p_hitCount:27;
+    uint32_t p_hitCount:26;
+
+    /* Set if data is encrypted when written */
+    uint32_t p_encrypt:1;
 
     /* page is not in hash lists */
     uint32_t p_nohash:1;
@@ -242,3 +242,123 @@ lc_statsDeinit(struct fs *fs) {
         assert(fs->fs_stats == NULL);
     }
 }
+
+/* Return I/O counters of a layer */
+void
+lc_layerStats(fuse_req_t req, struct gfs *gfs, const char *name,
+              size_t size) {
+    struct lc_layerStats stats;
+    struct fs *fs, *rfs, *pfs;
+    size_t len;
+    ino_t root;
+
+    /* Callers predating the depth of a layer pass a shorter buffer */
+    len = sizeof(struct lc_layerStats);
+    if (size < len) {
+        len -= sizeof(stats.ls_depth);
+    }
+    if (size < len) {
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    rfs = lc_getLayerLocked(LC_ROOT_INODE, false);
+    root = lc_getRootIno(rfs, name, NULL, true);
+    if (unlikely(root == LC_INVALID_INODE)) {
+        lc_unlock(rfs);
+        fuse_reply_err(req, ENOENT);
+        return;
+    }
+    fs = lc_getLayerLocked(root, false);
+    stats.ls_readBytes = fs->fs_readBytes;
+    stats.ls_writeBytes = fs->fs_writeBytes;
+    stats.ls_readOps = fs->fs_readOps;
+    stats.ls_writeOps = fs->fs_writeOps;
+    stats.ls_blockReads = fs->fs_reads;
+    stats.ls_blockWrites = fs->fs_writes;
+    stats.ls_inodes = fs->fs_icount;
+    stats.ls_dirtyPages = fs->fs_pcount;
+    stats.ls_cacheHits = fs->fs_phit;
+    stats.ls_cacheMisses = fs->fs_pmissed;
+    stats.ls_depth = 0;
+    for (pfs = fs->fs_parent; pfs; pfs = pfs->fs_parent) {
+        stats.ls_depth++;
+    }
+    lc_unlock(fs);
+    lc_unlock(rfs);
+    fuse_reply_ioctl(req, 0, &stats, len);
+}
+
+/* Gather resource usage of the daemon */
+static void
+lc_getDaemonStats(struct gfs *gfs, struct lc_daemonStats *stats) {
+    memset(stats, 0, sizeof(struct lc_daemonStats));
+    stats->ds_residentMemory = lc_getResidentMemory();
+    lc_memoryStats(stats);
+    stats->ds_pages = gfs->gfs_pcount;
+    stats->ds_dirtyPages = gfs->gfs_dcount;
+    stats->ds_layers = gfs->gfs_count;
+}
+
+/* Return resource usage of the daemon */
+void
+lc_daemonStats(fuse_req_t req, struct gfs *gfs, size_t size) {
+    struct lc_daemonStats stats;
+
+    if (size < sizeof(struct lc_daemonStats)) {
+        fuse_reply_err(req, EINVAL);
+        return;
+    }
+    lc_getDaemonStats(gfs, &stats);
+    fuse_reply_ioctl(req, 0, &stats, sizeof(struct lc_daemonStats));
+}
+
+/* Publish resource usage of the daemon in the stats page file every
+ * LC_STATS_PAGE_INTERVAL seconds until the file system is unmounted.
+ */
+void *
+lc_statsPublisher(void *data) {
+    struct gfs *gfs = (struct gfs *)data;
+    struct lc_daemonStats stats;
+    struct lc_statsPage *page;
+    struct timeval now;
+    int fd;
+
+    fd = open(gfs->gfs_statsPage, O_RDWR | O_CREAT | O_TRUNC, 0644);
+    if (fd == -1) {
+        lc_syslog(LOG_ERR, "Failed to create stats page %s, err %d\n",
+                  gfs->gfs_statsPage, errno);
+        return NULL;
+    }
+    if (ftruncate(fd, sizeof(struct lc_statsPage))) {
+        lc_syslog(LOG_ERR, "Failed to size stats page %s, err %d\n",
+                  gfs->gfs_statsPage, errno);
+        close(fd);
+        return NULL;
+    }
+    page = mmap(NULL, sizeof(struct lc_statsPage), PROT_READ | PROT_WRITE,
+                MAP_SHARED, fd, 0);
+    close(fd);
+    if (page == MAP_FAILED) {
+        lc_syslog(LOG_ERR, "Failed to map stats page %s, err %d\n",
+                  gfs->gfs_statsPage, errno);
+        return NULL;
+    }
+    page->sp_version = LC_STATS_PAGE_VERSION;
+    __sync_synchronize();
+    page->sp_magic = LC_STATS_PAGE_MAGIC;
+    lc_syslog(LOG_INFO, "Publishing stats in %s\n", gfs->gfs_statsPage);
+    while (!gfs->gfs_unmounting) {
+        lc_getDaemonStats(gfs, &stats);
+        __sync_add_and_fetch(&page->sp_seq, 1);
+        memcpy(&page->sp_stats, &stats, sizeof(struct lc_daemonStats));
+        gettimeofday(&now, NULL);
+        page->sp_time = now.tv_sec;
+        __sync_add_and_fetch(&page->sp_seq, 1);
+        sleep(LC_STATS_PAGE_INTERVAL);
+    }
+
+    /* Readers fall back to LCFS_STATS once the page is no longer updated */
+    page->sp_magic = 0;
+    munmap(page, sizeof(struct lc_statsPage));
+    return NULL;
+}
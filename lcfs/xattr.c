@@ -57,7 +57,14 @@ lc_xattrAdd(fuse_req_t req, ino_t ino, const char *name,
     }
     lc_statsBegin(&start);
     fs = lc_getLayerLocked(ino, false);
-    if (unlikely(fs->fs_frozen)) {
+
+    /* Files of a layer mounted with a context cannot be relabeled */
+    if (fs->fs_context && (strcmp(name, LC_SELINUX_XATTR) == 0)) {
+        fuse_reply_err(req, EOPNOTSUPP);
+        err = EOPNOTSUPP;
+        goto out;
+    }
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, ino, EROFS);
         fuse_reply_err(req, EROFS);
         err = EROFS;
@@ -160,6 +167,22 @@ lc_xattrGet(fuse_req_t req, ino_t ino, const char *name,
     lc_statsBegin(&start);
     fs = lc_getLayerLocked(ino, false);
 
+    /* Files of a layer mounted with a context are labeled with that, like
+     * files of a file system mounted with the context mount option.
+     */
+    if (fs->fs_context && (strcmp(name, LC_SELINUX_XATTR) == 0)) {
+        xsize = strlen(fs->fs_context) + 1;
+        if (size == 0) {
+            fuse_reply_xattr(req, xsize);
+        } else if (size >= xsize) {
+            fuse_reply_buf(req, fs->fs_context, xsize);
+        } else {
+            fuse_reply_err(req, ERANGE);
+            err = ERANGE;
+        }
+        goto out;
+    }
+
     /* If the file system does not have any extended attributes, return without
      * looking up the inode.
      */
@@ -320,6 +343,13 @@ lc_xattrRemove(fuse_req_t req, ino_t ino, const char *name) {
     lc_statsBegin(&start);
     fs = lc_getLayerLocked(ino, false);
 
+    /* Files of a layer mounted with a context cannot be relabeled */
+    if (fs->fs_context && (strcmp(name, LC_SELINUX_XATTR) == 0)) {
+        fuse_reply_err(req, EOPNOTSUPP);
+        err = EOPNOTSUPP;
+        goto out;
+    }
+
     /* If the file system does not have any extended attributes, return without
      * looking up the inode.
      */
@@ -328,7 +358,7 @@ lc_xattrRemove(fuse_req_t req, ino_t ino, const char *name) {
         err = ENODATA;
         goto out;
     }
-    if (unlikely(fs->fs_frozen)) {
+    if (unlikely(lc_layerImmutable(fs))) {
         lc_reportError(__func__, __LINE__, ino, EROFS);
         fuse_reply_err(req, EROFS);
         err = EROFS;
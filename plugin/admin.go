@@ -0,0 +1,1132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// adminServer serves the REST admin API of the plugin on a local socket, and
+// over TLS if configured.  All requests need to present the configured token
+// as "Authorization: Bearer <token>", or the read token for requests not
+// changing anything.
+type adminServer struct {
+	d         *Driver
+	token     []byte
+	readToken []byte
+	listeners []net.Listener
+	mux       *http.ServeMux
+}
+
+// adminConfig is the body accepted for updating tunables of the file system.
+type adminConfig struct {
+	PcacheMB       *int64  `json:"pcache_mb,omitempty"`
+	Verbose        *bool   `json:"verbose,omitempty"`
+	CommitInterval *string `json:"commit_interval,omitempty"`
+}
+
+// validate checks the values of tunables to be updated.
+func (c *adminConfig) validate() error {
+	if c.PcacheMB != nil && *c.PcacheMB <= 0 {
+		return fmt.Errorf("invalid pcache_mb %d", *c.PcacheMB)
+	}
+	if c.CommitInterval != nil {
+		interval, err := time.ParseDuration(*c.CommitInterval)
+		if err != nil || (interval != 0 && interval < time.Second) {
+			return fmt.Errorf("invalid commit_interval %q", *c.CommitInterval)
+		}
+	}
+	return nil
+}
+
+// setCommitInterval sets the interval between commits of the file system to
+// disk, periodic commits are disabled if zero.
+func (d *Driver) setCommitInterval(interval time.Duration) error {
+	return d.setTunable(SyncerTime, strconv.FormatInt(int64(interval/time.Second), 10))
+}
+
+// updateConfig applies new values of tunables to the file system.
+func (d *Driver) updateConfig(c *adminConfig) error {
+	if c.PcacheMB != nil {
+		err := d.setTunable(DcacheMemory, strconv.FormatInt(*c.PcacheMB, 10))
+		if err != nil {
+			return err
+		}
+	}
+	if c.Verbose != nil {
+		value := ""
+		if *c.Verbose {
+			value = "1"
+		}
+		if err := d.setTunable(LcfsVerbose, value); err != nil {
+			return err
+		}
+	}
+	if c.CommitInterval != nil {
+		interval, _ := time.ParseDuration(*c.CommitInterval)
+		if err := d.setCommitInterval(interval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushCache releases memory used for caching pages not in use.  Memory
+// reclaimed is checked when alerts are enabled, querying the daemon as the
+// stats page may not be updated yet.
+func (d *Driver) flushCache() error {
+	if d.alerts == nil {
+		return d.ioctl(DcacheFlush, "", "")
+	}
+	before, serr := d.queryDaemonStats()
+	if err := d.ioctl(DcacheFlush, "", ""); err != nil {
+		return err
+	}
+	if serr != nil {
+		return nil
+	}
+	after, serr := d.queryDaemonStats()
+	if serr != nil {
+		return nil
+	}
+	var reclaimed uint64
+	if before.PageMemory > after.PageMemory {
+		reclaimed = before.PageMemory - after.PageMemory
+	}
+	d.alerts.gcResult(reclaimed)
+	return nil
+}
+
+// adminLayer describes a layer in admin API responses.
+type adminLayer struct {
+	ID       string            `json:"id"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// listenUnix creates a unix socket accessible only by the owner.
+func listenUnix(socket string) (net.Listener, error) {
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// newAdminServer starts serving the admin API on the configured unix socket
+// for the admin and read users, and on the TLS address if any.
+func newAdminServer(d *Driver, opts *driverOptions) (*adminServer, error) {
+	var err error
+
+	a := &adminServer{d: d, mux: http.NewServeMux()}
+	a.token, err = readToken(opts.AdminTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	if opts.AdminReadTokenFile != "" {
+		a.readToken, err = readToken(opts.AdminReadTokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.AdminSocket != "" {
+		l, err := listenUnixRoles(opts.AdminSocket, opts.AdminUIDs,
+			opts.AdminReadUIDs)
+		if err != nil {
+			return nil, err
+		}
+		a.listeners = append(a.listeners, l)
+	}
+	if opts.AdminTLSAddress != "" {
+		l, err := listenTLS(opts.AdminTLSAddress, opts.AdminTLSCert,
+			opts.AdminTLSKey, opts.AdminTLSClientCA)
+		if err != nil {
+			a.close()
+			return nil, err
+		}
+		a.listeners = append(a.listeners, l)
+	}
+	a.mux.HandleFunc("/v1/layers", a.layers)
+	a.mux.HandleFunc("/v1/layers/", a.layer)
+	a.mux.HandleFunc("/v1/exists", a.exists)
+	a.mux.HandleFunc("/v1/stats", a.stats)
+	a.mux.HandleFunc("/v1/gc", a.gc)
+	a.mux.HandleFunc("/v1/config", a.config)
+	a.mux.HandleFunc("/v1/audit", a.auditChain)
+	a.mux.HandleFunc("/v1/squash", a.squash)
+	a.mux.HandleFunc("/v1/clone", a.clone)
+	a.mux.HandleFunc("/v1/frozen", a.frozen)
+	a.mux.HandleFunc("/v1/pinned", a.pinned)
+	a.mux.HandleFunc("/v1/receive", a.receive)
+	a.mux.HandleFunc("/v1/snapshots", a.snapshots)
+	a.mux.HandleFunc("/v1/snapshots/", a.snapshot)
+	a.mux.HandleFunc("/v1/snapshot-groups", a.snapshotGroups)
+	a.mux.HandleFunc("/v1/snapshot-groups/", a.snapshotGroup)
+	a.mux.HandleFunc("/v1/snapshot-mounts", a.snapshotMounts)
+	a.mux.HandleFunc("/v1/backups", a.backupList)
+	a.mux.HandleFunc("/v1/backups/", a.backup)
+	a.mux.HandleFunc("/v1/rebuild", a.rebuild)
+	a.mux.HandleFunc("/v1/oci-export", a.ociExport)
+	for _, l := range a.listeners {
+		go func(l net.Listener) {
+			server := &http.Server{Handler: a, ConnContext: withConnRole}
+			err := server.Serve(l)
+			logrus.Infof("Admin API on %s stopped: %v", l.Addr(), err)
+		}(l)
+		logrus.Infof("Serving admin API on %s", l.Addr())
+	}
+	return a, nil
+}
+
+// close stops serving the admin API.
+func (a *adminServer) close() error {
+	var err error
+
+	for _, l := range a.listeners {
+		if cerr := l.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ServeHTTP authenticates a request before dispatching it.  Requests of
+// readers, by token or by the user connecting, are limited to those not
+// changing anything.
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	role := tokenRole(r.Header.Get("Authorization"), a.token, a.readToken)
+	if role == roleNone {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	if c := requestConnRole(r); c < role {
+		role = c
+	}
+
+	// Requests of a layer are authorized by the route of the layer
+	if role < roleAdmin && !readOnlyRequest(r) &&
+		!strings.HasPrefix(r.URL.Path, "/v1/layers/") {
+		writeError(w, http.StatusForbidden, fmt.Errorf("forbidden"))
+		return
+	}
+	logrus.Debugf("Admin %s %s", r.Method, r.URL.Path)
+	a.mux.ServeHTTP(w, r.WithContext(withRequestRole(r.Context(), role)))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"Err": err.Error()})
+}
+
+// errorStatus returns the status of a response failing with an error of a
+// layer or snapshot.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, os.ErrExist), errors.Is(err, errLayerBusy),
+		errors.Is(err, errLayerPinned):
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// GET /v1/layers lists all layers.
+func (a *adminServer) layers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	ids, err := a.d.listLayers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	layers := make([]adminLayer, 0, len(ids))
+	for _, id := range ids {
+		layers = append(layers, adminLayer{ID: id})
+	}
+	writeJSON(w, http.StatusOK, layers)
+}
+
+// GET /v1/layers/<id> returns metadata of a layer, actions on a layer are
+// routed by the last element of the path.  Each route states the role
+// required, readers are allowed only routes not changing anything or
+// exporting contents of the layer.
+func (a *adminServer) layer(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/layers/")
+	action := ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, action = id[:i], id[i+1:]
+	}
+	required := roleAdmin
+	var serve func(http.ResponseWriter, *http.Request, string)
+	switch action {
+	case "":
+		required, serve = roleRead, a.layerMetadata
+	case "extents":
+		required, serve = roleRead, a.extents
+	case "diffstat":
+		required, serve = roleRead, a.diffStat
+	case "signature":
+		required, serve = methodRole(r, http.MethodGet), a.signature
+	case "labels":
+		required, serve = methodRole(r, http.MethodGet), a.labels
+	case "diff":
+		required, serve = roleAdmin, a.diff
+	case "prefetch":
+		required, serve = roleAdmin, a.prefetch
+	case "rollback":
+		required, serve = roleAdmin, a.rollback
+	case "clones":
+		required, serve = roleAdmin, a.fanOut
+	case "freeze", "thaw":
+		required, serve = roleAdmin, func(w http.ResponseWriter,
+			r *http.Request, id string) {
+			a.freeze(w, r, id, action == "freeze")
+		}
+	case "pin":
+		required, serve = roleAdmin, a.pin
+	case "snapshot-mount":
+		required, serve = roleAdmin, a.mountSnapshot
+	case "restore":
+		required, serve = roleAdmin, a.restore
+	case "export":
+		required, serve = roleAdmin, a.exportDiskImage
+	}
+	if id == "" || serve == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("layer %q not found", id))
+		return
+	}
+	if requestRole(r) < required {
+		writeError(w, http.StatusForbidden, fmt.Errorf("forbidden"))
+		return
+	}
+	if !a.d.Exists(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("layer %q not found", id))
+		return
+	}
+	serve(w, r, id)
+}
+
+// GET /v1/layers/<id> returns metadata of a layer.
+func (a *adminServer) layerMetadata(w http.ResponseWriter, r *http.Request,
+	id string) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	metadata, err := a.d.GetMetadata(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, adminLayer{ID: id, Metadata: metadata})
+}
+
+// GET /v1/layers/<id>/extents returns the ranges of the device changed by a
+// layer.
+func (a *adminServer) extents(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	extents, err := a.d.ChangedExtents(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, extents)
+}
+
+// GET /v1/layers/<id>/diffstat?parent=<parent> returns the files changed by a
+// layer.
+func (a *adminServer) diffStat(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	stat, err := a.d.DiffStat(id, r.URL.Query().Get("parent"))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stat)
+}
+
+// GET /v1/layers/<id>/diff?parent=<parent> returns the changes of a layer as
+// a gzip compressed tar archive.
+func (a *adminServer) diff(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	parent := r.URL.Query().Get("parent")
+	if err := validateLayer(id, parent); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	err := a.d.writeCompressedDiff(w, id, parent)
+	if err != nil {
+		logrus.Errorf("Export of layer %s failed: %v", id, err)
+	}
+}
+
+// adminPrefetch is the optional body of a prefetch request, listing files to
+// be read.
+type adminPrefetch struct {
+	Paths []string `json:"paths"`
+}
+
+// POST /v1/layers/<id>/prefetch reads files listed in the body, or metadata
+// and executables of a layer, into the cache in the background.
+func (a *adminServer) prefetch(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var p adminPrefetch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.d.Prefetch(id, p.Paths); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminSignatures describes the diff applied to a layer and its signatures.
+type adminSignatures struct {
+	Root       string           `json:"root"`
+	Signatures []layerSignature `json:"signatures"`
+}
+
+// GET /v1/layers/<id>/signature returns the Merkle root of the diff applied
+// to a layer, which is signed, and the signatures recorded, POST records the
+// signature in the body by a trusted key.
+func (a *adminServer) signature(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		rec, err := a.d.layerRecord(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		sigs := rec.Signatures
+		if sigs == nil {
+			sigs = []layerSignature{}
+		}
+		writeJSON(w, http.StatusOK, adminSignatures{rec.Root, sigs})
+
+	case http.MethodPost:
+		var sig layerSignature
+		if err := json.NewDecoder(r.Body).Decode(&sig); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := a.d.signLayer(id, sig); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// adminExists is the body of a request checking layers exist.
+type adminExists struct {
+	IDs []string `json:"ids"`
+}
+
+// POST /v1/exists checks which of the layers listed in the body exist,
+// returning a map from layer to existence.
+func (a *adminServer) exists(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var e adminExists
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	exists, err := a.d.ExistsAll(e.IDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	reply := make(map[string]bool, len(e.IDs))
+	for i, id := range e.IDs {
+		reply[id] = exists[i]
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// GET /v1/stats returns capacity of the file system and operation metrics.
+func (a *adminServer) stats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	c, err := a.d.stats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// POST /v1/gc releases memory used for caching pages not in use.
+func (a *adminServer) gc(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := a.d.flushCache(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /v1/audit verifies the hash chain of the audit log.
+func (a *adminServer) auditChain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if a.d.audit == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("audit log not enabled"))
+		return
+	}
+	c, err := a.d.audit.verify()
+	if err != nil {
+		c.Error = err.Error()
+		writeJSON(w, http.StatusConflict, c)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// GET /v1/config returns the driver options, PUT /v1/config updates tunables
+// of the file system.
+func (a *adminServer) config(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.d.opts)
+
+	case http.MethodPut:
+		var c adminConfig
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := c.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := a.d.updateConfig(&c); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// GET /v1/snapshots lists snapshots, of the layer or with the tag given as
+// query parameters if any, POST /v1/snapshots takes a snapshot as described
+// in the body.
+func (a *adminServer) snapshots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		recs, err := a.d.Snapshots(q.Get("layer"), q.Get("tag"))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, recs)
+
+	case http.MethodPost:
+		var req snapshotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		rec, err := a.d.Snapshot(&req)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, rec)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// GET /v1/snapshots/<ref> returns the snapshot with the id, name or tag,
+// DELETE removes it, POST /v1/snapshots/<ref>/promote detaches it from the
+// parent of its layer.
+func (a *adminServer) snapshot(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/v1/snapshots/")
+	if strings.HasSuffix(ref, "/send") {
+		a.send(w, r, strings.TrimSuffix(ref, "/send"))
+		return
+	}
+	if strings.HasSuffix(ref, "/promote") {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		rec, err := a.d.PromoteSnapshot(strings.TrimSuffix(ref, "/promote"))
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rec, err := a.d.LookupSnapshot(ref)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, rec)
+
+	case http.MethodDelete:
+		if err := a.d.RemoveSnapshot(ref); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// POST /v1/snapshot-groups takes snapshots of the layers of a group as
+// described in the body.
+func (a *adminServer) snapshotGroups(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req snapshotGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	recs, err := a.d.SnapshotGroup(&req)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, recs)
+}
+
+// GET /v1/snapshot-groups/<name> returns the snapshots of a group, DELETE
+// removes those, POST /v1/snapshot-groups/<name>/rollback reverts the layers
+// of the group to those.
+func (a *adminServer) snapshotGroup(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/snapshot-groups/")
+	if strings.HasSuffix(name, "/rollback") {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err := a.d.RollbackGroup(strings.TrimSuffix(name, "/rollback"))
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		recs, err := a.d.SnapshotGroupMembers(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, recs)
+
+	case http.MethodDelete:
+		if err := a.d.RemoveSnapshotGroup(name); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// GET /v1/backups lists backups, of the layer given as query parameter if any,
+// POST /v1/backups stores a backup of a snapshot or of a layer as described in
+// the body.
+func (a *adminServer) backupList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		manifests, err := a.d.Backups(r.URL.Query().Get("layer"))
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, manifests)
+
+	case http.MethodPost:
+		var req backupRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		m, err := a.d.Backup(&req)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, m)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// adminRestoreBackup is the body of a request restoring a backup, with the
+// layer replacing the parent of the layer of the snapshot of the full backup.
+type adminRestoreBackup struct {
+	Base string `json:"base,omitempty"`
+}
+
+// GET /v1/backups/<id> returns the manifest of a backup, DELETE removes it,
+// POST /v1/backups/<id>/verify checks its streams, POST
+// /v1/backups/<id>/restore receives its snapshot.
+func (a *adminServer) backup(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/backups/")
+	if strings.HasSuffix(id, "/verify") {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		chain, err := a.d.VerifyBackup(strings.TrimSuffix(id, "/verify"))
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, chain)
+		return
+	}
+	if strings.HasSuffix(id, "/restore") {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		var req adminRestoreBackup
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		rec, err := a.d.RestoreBackup(strings.TrimSuffix(id, "/restore"),
+			req.Base)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, rec)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		m, err := a.d.LookupBackup(id)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+
+	case http.MethodDelete:
+		if err := a.d.RemoveBackup(id); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// POST /v1/rebuild creates the layers backed up not present from backups.
+func (a *adminServer) rebuild(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	rebuilt, err := a.d.Rebuild()
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rebuilt)
+}
+
+// POST /v1/oci-export writes the image described in the body to an OCI image
+// layout.
+func (a *adminServer) ociExport(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req ociExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	img, err := a.d.ExportOCI(&req)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, img)
+}
+
+// GET /v1/snapshots/<ref>/send streams the snapshot, relative to the older
+// snapshot named by the since parameter if given.
+func (a *adminServer) send(w http.ResponseWriter, r *http.Request, ref string) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	since := r.URL.Query().Get("since")
+	for _, s := range []string{ref, since} {
+		if s == "" {
+			continue
+		}
+		if _, err := a.d.LookupSnapshot(s); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := a.d.Send(w, ref, since); err != nil {
+		logrus.Errorf("Sending snapshot %s failed: %v", ref, err)
+	}
+}
+
+// POST /v1/receive applies the send stream in the body, returning the
+// snapshot received.  The base parameter replaces the parent the snapshot was
+// sent relative to.
+func (a *adminServer) receive(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	rec, err := a.d.Receive(r.Body, r.URL.Query().Get("base"))
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, rec)
+}
+
+// adminRollback is the body of a rollback request, naming the snapshot by id,
+// name or tag.
+type adminRollback struct {
+	Snapshot string `json:"snapshot"`
+}
+
+// POST /v1/layers/<id>/rollback reverts a layer not mounted to the snapshot
+// named in the body.
+func (a *adminServer) rollback(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req adminRollback
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.d.Rollback(id, req.Snapshot); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminRestore is the body of a request restoring files, naming the snapshot
+// by id, name or tag, and the paths of the files in the layer.
+type adminRestore struct {
+	Snapshot string   `json:"snapshot"`
+	Paths    []string `json:"paths"`
+}
+
+// POST /v1/layers/<id>/restore copies files named in the body from a
+// snapshot back to a layer.
+func (a *adminServer) restore(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req adminRestore
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	res, err := a.d.RestoreFiles(id, req.Snapshot, req.Paths)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// POST /v1/layers/<id>/export writes a layer to a disk image described in
+// the body.
+func (a *adminServer) exportDiskImage(w http.ResponseWriter, r *http.Request,
+	id string) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req diskImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	img, err := a.d.ExportDiskImage(id, &req)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, img)
+}
+
+// POST /v1/layers/<id>/freeze stops all writes to a layer until POST
+// /v1/layers/<id>/thaw.
+func (a *adminServer) freeze(w http.ResponseWriter, r *http.Request, id string,
+	freeze bool) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	op := a.d.Thaw
+	if freeze {
+		op = a.d.Freeze
+	}
+	if err := op(id); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /v1/layers/<id>/pin pins a layer, DELETE unpins it.
+func (a *adminServer) pin(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if err := a.d.Pin(id, r.Method == http.MethodPost); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /v1/pinned lists the layers pinned.
+func (a *adminServer) pinned(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	pinned := []string{}
+	if a.d.pins != nil {
+		pinned = a.d.pins.list()
+	}
+	writeJSON(w, http.StatusOK, pinned)
+}
+
+// adminFrozen is a layer frozen, and the time it was frozen at.
+type adminFrozen struct {
+	ID    string    `json:"id"`
+	Since time.Time `json:"since"`
+}
+
+// adminSnapshotMount is the body of a request mounting a snapshot, naming the
+// snapshot by id, name or tag, and the directory to mount it at.
+type adminSnapshotMount struct {
+	Snapshot string `json:"snapshot"`
+	Target   string `json:"target"`
+}
+
+// POST /v1/layers/<id>/snapshot-mount mounts a snapshot of a layer read-only
+// at the directory named in the body.
+func (a *adminServer) mountSnapshot(w http.ResponseWriter, r *http.Request,
+	id string) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req adminSnapshotMount
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	m, err := a.d.MountSnapshot(id, req.Snapshot, req.Target)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// GET /v1/snapshot-mounts lists the snapshots mounted, DELETE
+// /v1/snapshot-mounts?target=<path> unmounts the snapshot mounted at a path.
+func (a *adminServer) snapshotMounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.d.SnapshotMounts())
+
+	case http.MethodDelete:
+		if err := a.d.UnmountSnapshot(r.URL.Query().Get("target")); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// GET /v1/frozen lists the layers frozen.
+func (a *adminServer) frozen(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.d.frozen.list())
+}
+
+// GET /v1/layers/<id>/labels returns the labels of a layer matched by
+// snapshot policies, PUT replaces those with the labels in the body.
+func (a *adminServer) labels(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		labels, err := a.d.Labels(id)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, labels)
+
+	case http.MethodPut:
+		var labels map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := a.d.SetLabels(id, labels); err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// adminFanOut lists the ids of layers created by a fan out.
+type adminFanOut struct {
+	IDs []string `json:"ids"`
+}
+
+// POST /v1/layers/<id>/clones creates writable layers from a layer, as many
+// as the count in the body, returning their ids.
+func (a *adminServer) fanOut(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req fanOutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ids, err := a.d.FanOut(id, &req)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, adminFanOut{IDs: ids})
+}
+
+// adminSquash is the body of a squash request, listing a chain of layers from
+// the first to the last, and the parent of the first if not known.
+type adminSquash struct {
+	Layers []string `json:"layers"`
+	Parent string   `json:"parent,omitempty"`
+}
+
+// POST /v1/squash merges the chain of layers in the body into a new layer,
+// returning its id.
+func (a *adminServer) squash(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req adminSquash
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := a.d.Squash(req.Parent, req.Layers...)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, adminLayer{ID: id})
+}
+
+// POST /v1/clone copies the chain of layers in the body to another lcfs file
+// system mounted on the host.
+func (a *adminServer) clone(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req cloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := a.d.Clone(&req); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
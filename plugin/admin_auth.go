@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminRole is what a client of the admin API or RPC service is allowed to
+// do.  Readers can query layers and stats but not change anything, so
+// credentials given to monitoring cannot prefetch, export or sign layers, or
+// change tunables.
+type adminRole int
+
+const (
+	roleNone adminRole = iota
+	roleRead
+	roleAdmin
+)
+
+// roleConn is a connection from a client with the role of its credentials.
+type roleConn struct {
+	net.Conn
+	role adminRole
+}
+
+// connRole returns the role of the client of a connection.  Clients
+// connecting over TLS present a certificate signed by the configured CA and
+// are limited by their token only.
+func connRole(conn net.Conn) adminRole {
+	if c, ok := conn.(*roleConn); ok {
+		return c.role
+	}
+	return roleAdmin
+}
+
+// Key of the role of a connection in the context of requests
+type connRoleKey struct{}
+
+// withConnRole adds the role of a connection to the context of its requests.
+func withConnRole(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connRoleKey{}, connRole(conn))
+}
+
+// requestConnRole returns the role of the connection of a request.
+func requestConnRole(r *http.Request) adminRole {
+	if role, ok := r.Context().Value(connRoleKey{}).(adminRole); ok {
+		return role
+	}
+	return roleAdmin
+}
+
+// Key of the role of the client of a request in its context
+type requestRoleKey struct{}
+
+// withRequestRole adds the role of the client of a request to its context.
+func withRequestRole(ctx context.Context, role adminRole) context.Context {
+	return context.WithValue(ctx, requestRoleKey{}, role)
+}
+
+// requestRole returns the role of the client of a request, by its
+// credentials and connection.
+func requestRole(r *http.Request) adminRole {
+	if role, ok := r.Context().Value(requestRoleKey{}).(adminRole); ok {
+		return role
+	}
+	return roleAdmin
+}
+
+// methodRole returns the role required for a request of a route readers are
+// allowed to use with method only.
+func methodRole(r *http.Request, method string) adminRole {
+	if r.Method == method {
+		return roleRead
+	}
+	return roleAdmin
+}
+
+// readToken reads a bearer token from a file.
+func readToken(file string) ([]byte, error) {
+	token, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	token = []byte(strings.TrimSpace(string(token)))
+	if len(token) == 0 {
+		return nil, fmt.Errorf("lcfs: admin token file %s is empty", file)
+	}
+	return token, nil
+}
+
+// tokenRole returns the role of the bearer token in an Authorization header.
+func tokenRole(auth string, token, readToken []byte) adminRole {
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return roleNone
+	}
+	presented := []byte(strings.TrimPrefix(auth, "Bearer "))
+	if subtle.ConstantTimeCompare(presented, token) == 1 {
+		return roleAdmin
+	}
+	if len(readToken) > 0 && subtle.ConstantTimeCompare(presented, readToken) == 1 {
+		return roleRead
+	}
+	return roleNone
+}
+
+// Requests of the admin API allowed to readers, by method and path, with *
+// matching a single element of the path.  Requests exporting contents of
+// layers or snapshots, like /diff and /send, are left out, as are routes not
+// listed here.  Routes of a layer state the role required in layer.
+var readerRoutes = []struct {
+	method, path string
+}{
+	{http.MethodGet, "/v1/layers"},
+	{http.MethodPost, "/v1/exists"},
+	{http.MethodGet, "/v1/stats"},
+	{http.MethodGet, "/v1/config"},
+	{http.MethodGet, "/v1/audit"},
+	{http.MethodGet, "/v1/frozen"},
+	{http.MethodGet, "/v1/pinned"},
+	{http.MethodGet, "/v1/snapshots"},
+	{http.MethodGet, "/v1/snapshots/*"},
+	{http.MethodGet, "/v1/snapshot-groups/*"},
+	{http.MethodGet, "/v1/snapshot-mounts"},
+	{http.MethodGet, "/v1/backups"},
+	{http.MethodGet, "/v1/backups/*"},
+}
+
+// readOnlyRequest checks if a request of the admin API is allowed to readers,
+// as it does not change anything or export contents of layers.
+func readOnlyRequest(r *http.Request) bool {
+	for _, route := range readerRoutes {
+		if r.Method == route.method && matchRoute(route.path, r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoute checks if a path matches a route, with * matching any single
+// non-empty element.
+func matchRoute(route, p string) bool {
+	routeParts := strings.Split(route, "/")
+	parts := strings.Split(p, "/")
+	if len(parts) != len(routeParts) {
+		return false
+	}
+	for i, part := range routeParts {
+		if part == "*" && parts[i] != "" {
+			continue
+		}
+		if part != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// listenTLS listens on a TCP address for TLS connections from clients
+// presenting a certificate signed by a CA in caFile.
+func listenTLS(address, certFile, keyFile, caFile string) (net.Listener, error) {
+	config, err := tlsConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", address, config)
+}
+
+// tlsConfig returns the configuration of servers presenting the certificate
+// in certFile, requiring clients to present a certificate signed by a CA in
+// caFile.
+func tlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("lcfs: no certificates in %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/portworx/lcfs/plugin/adminpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestAdminRoles(t *testing.T) {
+	home, err := ioutil.TempDir("", "lcfs-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d := &Driver{home: home, opts: &driverOptions{}}
+	a := &adminServer{d: d, token: []byte("admin"), readToken: []byte("reader"),
+		mux: http.NewServeMux()}
+	a.mux.HandleFunc("/v1/layers", a.layers)
+	a.mux.HandleFunc("/v1/layers/", a.layer)
+	a.mux.HandleFunc("/v1/gc", a.gc)
+
+	for _, c := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", "/v1/layers", "admin", http.StatusOK},
+		{"GET", "/v1/layers", "reader", http.StatusOK},
+		{"GET", "/v1/layers", "other", http.StatusUnauthorized},
+		{"POST", "/v1/gc", "reader", http.StatusForbidden},
+		{"GET", "/v1/layers/a/diff", "reader", http.StatusForbidden},
+		{"GET", "/v1/layers/a/diff", "admin", http.StatusNotFound},
+		{"GET", "/v1/layers/a", "reader", http.StatusNotFound},
+		{"GET", "/v1/layers/a/signature", "reader", http.StatusNotFound},
+		{"POST", "/v1/layers/a/signature", "reader", http.StatusForbidden},
+		{"POST", "/v1/layers/a/pin", "reader", http.StatusForbidden},
+		{"GET", "/v1/layers/a/unknown", "reader", http.StatusNotFound},
+		{"GET", "/v1/snapshots/s/send", "reader", http.StatusForbidden},
+		{"GET", "/v1/snapshots/s/send?since=r", "reader", http.StatusForbidden},
+		{"GET", "/v1/snapshots/s/send", "admin", http.StatusNotFound},
+		{"GET", "/v1/unknown", "reader", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s %s with token %s returned %d, expected %d", c.method,
+				c.path, c.token, w.Code, c.status)
+		}
+	}
+
+	// Readers connecting to the socket are limited by their credentials
+	r := httptest.NewRequest("POST", "/v1/gc", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	r = r.WithContext(withConnRole(r.Context(), &roleConn{nil, roleRead}))
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("reader allowed to release memory, status %d", w.Code)
+	}
+}
+
+func TestAdminRPCReadOnly(t *testing.T) {
+	home, err := ioutil.TempDir("", "lcfs-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d := &Driver{home: home, opts: &driverOptions{}}
+
+	socket := path.Join(home, "admin.sock")
+	s, err := newAdminRPCServer(d, &driverOptions{AdminRPCSocket: socket,
+		AdminReadUIDs: []uint32{uint32(os.Getuid())}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	client, disconnect := dialAdminRPC(t, "unix:"+socket, nil)
+	defer disconnect()
+	ctx := context.Background()
+	if _, err := client.Layers(ctx, &emptypb.Empty{}); err != nil {
+		t.Fatalf("Layers failed: %v", err)
+	}
+	watch, err := client.WatchStats(ctx, &adminpb.WatchStatsRequest{
+		Interval: durationpb.New(time.Millisecond)})
+	if err == nil {
+		_, err = watch.Recv()
+	}
+	if err != nil {
+		t.Errorf("reader not allowed to watch stats, err %v", err)
+	}
+	_, err = client.GC(ctx, &emptypb.Empty{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("reader allowed to release memory, err %v", err)
+	}
+	_, err = client.SetConfig(ctx, &adminpb.SetConfigRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("reader allowed to update config, err %v", err)
+	}
+}
+
+// writeCert writes a certificate signed by parent, or self-signed, and its
+// key in PEM to dir.
+func writeCert(t *testing.T, dir, name string, tmpl, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	// Not derived with SHA-1, not allowed in FIPS 140-only mode
+	tmpl.SubjectKeyId = []byte(name)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey,
+		parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(path.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+		0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestAdminTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "ca"},
+		NotBefore: now, NotAfter: now.Add(time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "lcfs"},
+		NotBefore: now, NotAfter: now.Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "scraper"},
+		NotBefore: now, NotAfter: now.Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	tokens := path.Join(dir, "token")
+	ioutil.WriteFile(tokens, []byte("admin\n"), 0600)
+	d := &Driver{home: dir, opts: &driverOptions{}}
+	a, err := newAdminServer(d, &driverOptions{
+		AdminTokenFile:   tokens,
+		AdminTLSAddress:  "127.0.0.1:0",
+		AdminTLSCert:     path.Join(dir, "server.pem"),
+		AdminTLSKey:      path.Join(dir, "server.key"),
+		AdminTLSClientCA: path.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	url := "https://" + a.listeners[0].Addr().String() + "/v1/layers"
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := client.Get(url); err == nil {
+		resp.Body.Close()
+		t.Errorf("client without a certificate served, status %d", resp.StatusCode)
+	}
+	cert, err := tls.LoadX509KeyPair(path.Join(dir, "client.pem"),
+		path.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: pool, Certificates: []tls.Certificate{cert}}}
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminRPCTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "ca"},
+		NotBefore: now, NotAfter: now.Add(time.Hour), IsCA: true,
+		BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "lcfs"},
+		NotBefore: now, NotAfter: now.Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	for i, name := range []string{"scraper", "fleet"} {
+		writeCert(t, dir, name, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(3 + i)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    now, NotAfter: now.Add(time.Hour),
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, caKey)
+	}
+	d := &Driver{home: dir, opts: &driverOptions{}}
+	s, err := newAdminRPCServer(d, &driverOptions{
+		AdminRPCTLSAddress: "127.0.0.1:0",
+		AdminRPCTLSAdmins:  []string{"fleet"},
+		AdminTLSCert:       path.Join(dir, "server.pem"),
+		AdminTLSKey:        path.Join(dir, "server.key"),
+		AdminTLSClientCA:   path.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	// Clients are readers unless their certificate names an admin
+	for _, name := range []string{"scraper", "fleet"} {
+		cert, err := tls.LoadX509KeyPair(path.Join(dir, name+".pem"),
+			path.Join(dir, name+".key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, disconnect := dialAdminRPC(t, s.listeners[0].Addr().String(),
+			credentials.NewTLS(&tls.Config{RootCAs: pool,
+				Certificates: []tls.Certificate{cert}}))
+		ctx := context.Background()
+		if _, err := client.Layers(ctx, &emptypb.Empty{}); err != nil {
+			t.Errorf("Layers of %s failed: %v", name, err)
+		}
+		_, err = client.GC(ctx, &emptypb.Empty{})
+		if readOnly := status.Code(err) == codes.PermissionDenied; readOnly !=
+			(name == "scraper") {
+			t.Errorf("GC of %s returned %v", name, err)
+		}
+		disconnect()
+	}
+}
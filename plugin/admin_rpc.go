@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/portworx/lcfs/plugin/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// adminService implements the Admin gRPC service of adminpb/admin.proto,
+// served on the admin RPC socket and over mutual TLS.  Clients are
+// authorized by the credentials of the connecting process or by their
+// certificate, readers are denied calls changing anything.
+type adminService struct {
+	adminpb.UnimplementedAdminServer
+	d      *Driver
+	admins map[string]bool
+}
+
+// errReadOnly is returned for calls of readers changing anything.
+var errReadOnly = status.Error(codes.PermissionDenied, "lcfs: not allowed for readers")
+
+// Methods of the admin service allowed to readers, others are for admins
+var readerMethods = map[string]bool{
+	adminpb.Admin_Layers_FullMethodName:     true,
+	adminpb.Admin_Layer_FullMethodName:      true,
+	adminpb.Admin_Extents_FullMethodName:    true,
+	adminpb.Admin_Exists_FullMethodName:     true,
+	adminpb.Admin_Stats_FullMethodName:      true,
+	adminpb.Admin_WatchStats_FullMethodName: true,
+	adminpb.Admin_Config_FullMethodName:     true,
+}
+
+// peerCredInfo is the auth info of clients of the admin RPC socket, with
+// the role of the user running the connecting process.
+type peerCredInfo struct {
+	credentials.CommonAuthInfo
+	role adminRole
+}
+
+// AuthType returns the type of authorization of clients of the socket.
+func (peerCredInfo) AuthType() string {
+	return "peercred"
+}
+
+// peerCredentials hands connections accepted on the admin RPC socket to
+// gRPC with the role the listener authorized them for.
+type peerCredentials struct{}
+
+// ClientHandshake fails, the credentials are used by the service only.
+func (peerCredentials) ClientHandshake(ctx context.Context, authority string,
+	conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("lcfs: peer credentials not usable by clients")
+}
+
+// ServerHandshake returns the role of the client of a connection.
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	info := peerCredInfo{role: connRole(conn)}
+	info.SecurityLevel = credentials.PrivacyAndIntegrity
+	return conn, info, nil
+}
+
+// Info describes the protocol of the credentials.
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+// Clone returns a copy of the credentials.
+func (c peerCredentials) Clone() credentials.TransportCredentials {
+	return c
+}
+
+// OverrideServerName is not used by the service.
+func (peerCredentials) OverrideServerName(string) error {
+	return nil
+}
+
+// role returns the role of the client of a call.  Clients over TLS with a
+// certificate of a name in admin_rpc_tls_admins are admins, others readers.
+func (s *adminService) role(ctx context.Context) adminRole {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return roleNone
+	}
+	switch info := p.AuthInfo.(type) {
+	case peerCredInfo:
+		return info.role
+	case credentials.TLSInfo:
+		certs := info.State.PeerCertificates
+		if len(certs) > 0 && s.admins[certs[0].Subject.CommonName] {
+			return roleAdmin
+		}
+		return roleRead
+	}
+	return roleNone
+}
+
+// authorize checks the client of a call is allowed the method.
+func (s *adminService) authorize(ctx context.Context, method string) error {
+	switch s.role(ctx) {
+	case roleAdmin:
+		return nil
+	case roleRead:
+		if readerMethods[method] {
+			return nil
+		}
+		return errReadOnly
+	}
+	return status.Error(codes.Unauthenticated, "lcfs: client not authorized")
+}
+
+// unary authorizes calls and returns errors of the driver with the status
+// code of the condition.
+func (s *adminService) unary(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	return resp, rpcError(err)
+}
+
+// stream authorizes streaming calls as unary ones.
+func (s *adminService) stream(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return rpcError(handler(srv, ss))
+}
+
+// rpcError converts an error of the driver to a status error with the code
+// matching the condition, for clients to check the code instead of the
+// message.
+func rpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Unknown
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		code = codes.NotFound
+	case errors.Is(err, os.ErrExist):
+		code = codes.AlreadyExists
+	case errors.Is(err, errLayerBusy):
+		code = codes.FailedPrecondition
+	case errors.Is(err, errNoSpace):
+		code = codes.ResourceExhausted
+	}
+	return status.Error(code, err.Error())
+}
+
+// layerNotFound returns the error of calls for a layer not existing.
+func layerNotFound(id string) error {
+	return status.Errorf(codes.NotFound, "layer %q not found", id)
+}
+
+// Layers lists all layers.
+func (s *adminService) Layers(ctx context.Context,
+	req *emptypb.Empty) (*adminpb.LayersResponse, error) {
+	ids, err := s.d.listLayers()
+	if err != nil {
+		return nil, err
+	}
+	resp := &adminpb.LayersResponse{Layers: make([]*adminpb.LayerInfo, 0, len(ids))}
+	for _, id := range ids {
+		resp.Layers = append(resp.Layers, &adminpb.LayerInfo{Id: id})
+	}
+	return resp, nil
+}
+
+// Layer returns metadata of a layer.
+func (s *adminService) Layer(ctx context.Context,
+	req *adminpb.LayerRequest) (*adminpb.LayerInfo, error) {
+	if req.Id == "" || !s.d.Exists(req.Id) {
+		return nil, layerNotFound(req.Id)
+	}
+	metadata, err := s.d.GetMetadata(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.LayerInfo{Id: req.Id, Metadata: metadata}, nil
+}
+
+// Extents returns the ranges of the device changed by a layer.
+func (s *adminService) Extents(ctx context.Context,
+	req *adminpb.LayerRequest) (*adminpb.ExtentsResponse, error) {
+	if req.Id == "" || !s.d.Exists(req.Id) {
+		return nil, layerNotFound(req.Id)
+	}
+	extents, err := s.d.ChangedExtents(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	resp := &adminpb.ExtentsResponse{Extents: make([]*adminpb.Extent, 0, len(extents))}
+	for _, e := range extents {
+		resp.Extents = append(resp.Extents,
+			&adminpb.Extent{Offset: e.Offset, Length: e.Length})
+	}
+	return resp, nil
+}
+
+// Exists checks which of the layers exist.
+func (s *adminService) Exists(ctx context.Context,
+	req *adminpb.ExistsRequest) (*adminpb.ExistsResponse, error) {
+	exists, err := s.d.ExistsAll(req.Ids)
+	if err != nil {
+		return nil, err
+	}
+	return &adminpb.ExistsResponse{Exists: exists}, nil
+}
+
+// Prefetch starts prefetching the listed files of a layer, or its metadata
+// and executables without paths.
+func (s *adminService) Prefetch(ctx context.Context,
+	req *adminpb.PrefetchRequest) (*emptypb.Empty, error) {
+	if req.Id == "" || !s.d.Exists(req.Id) {
+		return nil, layerNotFound(req.Id)
+	}
+	return &emptypb.Empty{}, s.d.Prefetch(req.Id, req.Paths)
+}
+
+// Freeze stops all writes to a layer until thawed.
+func (s *adminService) Freeze(ctx context.Context,
+	req *adminpb.LayerRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, s.d.Freeze(req.Id)
+}
+
+// Thaw resumes a layer frozen.
+func (s *adminService) Thaw(ctx context.Context,
+	req *adminpb.LayerRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, s.d.Thaw(req.Id)
+}
+
+// Stats reports capacity of the file system and operation metrics.
+func (s *adminService) Stats(ctx context.Context,
+	req *emptypb.Empty) (*adminpb.StatsResponse, error) {
+	stats, err := s.d.stats()
+	if err != nil {
+		return nil, err
+	}
+	return statsResponse(stats), nil
+}
+
+// WatchStats sends stats right away and then every interval, until the
+// client cancels the call or the service stops.
+func (s *adminService) WatchStats(req *adminpb.WatchStatsRequest,
+	stream adminpb.Admin_WatchStatsServer) error {
+	interval := req.Interval.AsDuration()
+	if req.Interval == nil || interval <= 0 {
+		return status.Errorf(codes.InvalidArgument, "lcfs: invalid interval %v",
+			interval)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stats, err := s.d.stats()
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(statsResponse(stats)); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// GC releases memory used for caching pages not in use.
+func (s *adminService) GC(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, s.d.flushCache()
+}
+
+// Config returns the driver options in effect, as named in the JSON of
+// GET /v1/config.
+func (s *adminService) Config(ctx context.Context,
+	req *emptypb.Empty) (*adminpb.ConfigResponse, error) {
+	var options map[string]interface{}
+
+	data, err := json.Marshal(s.d.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, err
+	}
+	resp := &adminpb.ConfigResponse{}
+	resp.Options, err = structpb.NewStruct(options)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SetConfig updates tunables of the file system.
+func (s *adminService) SetConfig(ctx context.Context,
+	req *adminpb.SetConfigRequest) (*emptypb.Empty, error) {
+	c := adminConfig{PcacheMB: req.PcacheMb, Verbose: req.Verbose}
+	if req.CommitInterval != nil {
+		interval := req.CommitInterval.AsDuration().String()
+		c.CommitInterval = &interval
+	}
+	if err := c.validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &emptypb.Empty{}, s.d.updateConfig(&c)
+}
+
+// statsResponse converts stats of the driver to the message of the service.
+func statsResponse(stats *driverStats) *adminpb.StatsResponse {
+	c := stats.Capacity
+	resp := &adminpb.StatsResponse{
+		Capacity: &adminpb.CapacityStats{
+			TotalBytes:  c.TotalBytes,
+			FreeBytes:   c.FreeBytes,
+			UsedBytes:   c.UsedBytes,
+			TotalInodes: c.TotalInodes,
+			FreeInodes:  c.FreeInodes,
+			Layers:      int64(c.Layers),
+		},
+		Operations:      make(map[string]*adminpb.OpMetric, len(stats.Operations)),
+		PendingRemovals: int64(stats.Removals),
+	}
+	for op, m := range stats.Operations {
+		resp.Operations[op] = &adminpb.OpMetric{
+			Count:  m.Count,
+			Errors: m.Errors,
+			Total:  durationpb.New(m.Total),
+			Max:    durationpb.New(m.Max),
+			Slow:   m.Slow,
+		}
+	}
+	if len(stats.Layers) > 0 {
+		resp.Layers = make(map[string]*adminpb.LayerIOStats, len(stats.Layers))
+	}
+	for id, l := range stats.Layers {
+		resp.Layers[id] = &adminpb.LayerIOStats{
+			ReadBytes:   l.ReadBytes,
+			WriteBytes:  l.WriteBytes,
+			ReadOps:     l.ReadOps,
+			WriteOps:    l.WriteOps,
+			BlockReads:  l.BlockReads,
+			BlockWrites: l.BlockWrites,
+			Inodes:      l.Inodes,
+			DirtyPages:  l.DirtyPages,
+			CacheHits:   l.CacheHits,
+			CacheMisses: l.CacheMisses,
+		}
+	}
+	if d := stats.Daemon; d != nil {
+		resp.Daemon = &adminpb.DaemonStats{
+			ResidentMemory:  d.ResidentMemory,
+			PageMemory:      d.PageMemory,
+			PageMemoryLimit: d.PageMemoryLimit,
+			GlobalMemory:    d.GlobalMemory,
+			Pages:           d.Pages,
+			DirtyPages:      d.DirtyPages,
+			Layers:          d.Layers,
+		}
+	}
+	if f := stats.Fuse; f != nil {
+		resp.Fuse = &adminpb.FuseStats{
+			Waiting:             f.Waiting,
+			MaxWaiting:          f.MaxWaiting,
+			MaxBackground:       f.MaxBackground,
+			CongestionThreshold: f.CongestionThreshold,
+			Congested:           f.Congested,
+			CongestionEvents:    f.CongestionEvents,
+		}
+	}
+	if i := stats.Ioctls; i != nil {
+		resp.Ioctls = &adminpb.IoctlStats{
+			Limit:      int64(i.Limit),
+			Active:     int64(i.Active),
+			Waiting:    int64(i.Waiting),
+			MaxWaiting: int64(i.MaxWaiting),
+			Queued:     i.Queued,
+			WaitTime:   durationpb.New(i.WaitTime),
+		}
+	}
+	if d := stats.Dedup; d != nil {
+		resp.ApplyDiffDedup = &adminpb.DedupStats{Files: d.Files, Bytes: d.Bytes}
+	}
+	if p := stats.Pruned; p != nil {
+		resp.SnapshotsPruned = &adminpb.PruneStats{Snapshots: p.Snapshots,
+			Bytes: p.Bytes}
+	}
+	return resp
+}
+
+// adminRPCServer serves the admin service on a unix socket and a TLS
+// address, with a gRPC server for each as their credentials differ.
+type adminRPCServer struct {
+	listeners []net.Listener
+	servers   []*grpc.Server
+}
+
+// newAdminRPCServer starts serving the admin RPC service on the configured
+// unix socket for the admin and read users, and on the TLS address if any.
+func newAdminRPCServer(d *Driver, opts *driverOptions) (*adminRPCServer, error) {
+	svc := &adminService{d: d, admins: make(map[string]bool)}
+	for _, name := range opts.AdminRPCTLSAdmins {
+		svc.admins[name] = true
+	}
+	s := &adminRPCServer{}
+	if opts.AdminRPCSocket != "" {
+		l, err := listenUnixRoles(opts.AdminRPCSocket, opts.AdminUIDs,
+			opts.AdminReadUIDs)
+		if err != nil {
+			return nil, err
+		}
+		s.add(svc, l, peerCredentials{})
+	}
+	if opts.AdminRPCTLSAddress != "" {
+		config, err := tlsConfig(opts.AdminTLSCert, opts.AdminTLSKey,
+			opts.AdminTLSClientCA)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		l, err := net.Listen("tcp", opts.AdminRPCTLSAddress)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.add(svc, l, credentials.NewTLS(config))
+	}
+	for i, l := range s.listeners {
+		go func(server *grpc.Server, l net.Listener) {
+			err := server.Serve(l)
+			logrus.Infof("Admin RPC service on %s stopped: %v", l.Addr(), err)
+		}(s.servers[i], l)
+		logrus.Infof("Serving admin RPC service on %s", l.Addr())
+	}
+	return s, nil
+}
+
+// add creates a gRPC server of the service for connections accepted on a
+// listener.
+func (s *adminRPCServer) add(svc *adminService, l net.Listener,
+	creds credentials.TransportCredentials) {
+	server := grpc.NewServer(grpc.Creds(creds),
+		grpc.UnaryInterceptor(svc.unary), grpc.StreamInterceptor(svc.stream))
+	adminpb.RegisterAdminServer(server, svc)
+	s.listeners = append(s.listeners, l)
+	s.servers = append(s.servers, server)
+}
+
+// close stops serving the admin RPC service, closing connections and ending
+// calls in progress.
+func (s *adminRPCServer) close() {
+	for i, server := range s.servers {
+		server.Stop()
+		s.listeners[i].Close()
+	}
+}
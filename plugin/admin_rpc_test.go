@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/portworx/lcfs/plugin/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// dialAdminRPC connects to the admin RPC service at target, with the
+// credentials of a TLS client or without if creds is nil.
+func dialAdminRPC(t *testing.T, target string,
+	creds credentials.TransportCredentials) (adminpb.AdminClient, func()) {
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adminpb.NewAdminClient(conn), func() { conn.Close() }
+}
+
+func TestAdminRPC(t *testing.T) {
+	home, err := ioutil.TempDir("", "lcfs-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	for _, id := range []string{"a", "b"} {
+		if err := os.Mkdir(path.Join(home, id), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &Driver{home: home, opts: &driverOptions{AdminUIDs: []uint32{uint32(os.Getuid())}}}
+
+	socket := path.Join(home, "admin.sock")
+	s, err := newAdminRPCServer(d, &driverOptions{AdminRPCSocket: socket,
+		AdminUIDs: d.opts.AdminUIDs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			s.close()
+		}
+	}()
+	client, disconnect := dialAdminRPC(t, "unix:"+socket, nil)
+	defer disconnect()
+	ctx := context.Background()
+
+	layers, err := client.Layers(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Layers failed: %v", err)
+	}
+	if len(layers.Layers) != 2 {
+		t.Errorf("expected 2 layers, got %v", layers.Layers)
+	}
+	_, err = client.Layer(ctx, &adminpb.LayerRequest{Id: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Layer of missing layer returned %v", err)
+	}
+	stats, err := client.Stats(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Capacity.TotalBytes == 0 || stats.Capacity.Layers != 2 {
+		t.Errorf("unexpected capacity %v", stats.Capacity)
+	}
+	config, err := client.Config(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatalf("Config failed: %v", err)
+	}
+	if _, ok := config.Options.Fields["admin_uids"]; !ok {
+		t.Errorf("admin_uids missing in config %v", config.Options)
+	}
+	_, err = client.SetConfig(ctx, &adminpb.SetConfigRequest{
+		CommitInterval: durationpb.New(time.Millisecond)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SetConfig with invalid commit interval returned %v", err)
+	}
+
+	// Stats are sent every interval on one call
+	wctx, cancel := context.WithCancel(ctx)
+	watch, err := client.WatchStats(wctx, &adminpb.WatchStatsRequest{
+		Interval: durationpb.New(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		stats, err := watch.Recv()
+		if err != nil || stats.Capacity.Layers != 2 {
+			t.Fatalf("WatchStats sent %v, err %v", stats, err)
+		}
+	}
+	cancel()
+	watch, err = client.WatchStats(ctx, &adminpb.WatchStatsRequest{})
+	if err == nil {
+		_, err = watch.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("WatchStats without interval returned %v", err)
+	}
+
+	// Calls in progress end once the service stops
+	watch, err = client.WatchStats(ctx, &adminpb.WatchStatsRequest{
+		Interval: durationpb.New(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watch.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := watch.Recv()
+		done <- err
+	}()
+	s.close()
+	stopped = true
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("WatchStats sent stats after stopping")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("WatchStats still waiting after stopping")
+	}
+}
+
+func TestAdminRPCRejectsUser(t *testing.T) {
+	home, err := ioutil.TempDir("", "lcfs-rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	d := &Driver{home: home, opts: &driverOptions{}}
+
+	socket := path.Join(home, "admin.sock")
+	s, err := newAdminRPCServer(d, &driverOptions{AdminRPCSocket: socket,
+		AdminUIDs: []uint32{uint32(os.Getuid()) + 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	client, disconnect := dialAdminRPC(t, "unix:"+socket, nil)
+	defer disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Layers(ctx, &emptypb.Empty{}); err == nil {
+		t.Errorf("expected connection from uid %d to be rejected", os.Getuid())
+	}
+}
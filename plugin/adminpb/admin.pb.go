@@ -0,0 +1,1565 @@
+// Admin service of the lcfs graph driver plugin, served over gRPC on the
+// unix socket admin_rpc_socket and over mutual TLS on admin_rpc_tls_address.
+// Go code is generated with "make proto" in the plugin directory.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: adminpb/admin.proto
+
+package adminpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type LayerInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Metadata      map[string]string      `protobuf:"bytes,2,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LayerInfo) Reset() {
+	*x = LayerInfo{}
+	mi := &file_adminpb_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LayerInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LayerInfo) ProtoMessage() {}
+
+func (x *LayerInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LayerInfo.ProtoReflect.Descriptor instead.
+func (*LayerInfo) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LayerInfo) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *LayerInfo) GetMetadata() map[string]string {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+type LayersResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Layers        []*LayerInfo           `protobuf:"bytes,1,rep,name=layers,proto3" json:"layers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LayersResponse) Reset() {
+	*x = LayersResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LayersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LayersResponse) ProtoMessage() {}
+
+func (x *LayersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LayersResponse.ProtoReflect.Descriptor instead.
+func (*LayersResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LayersResponse) GetLayers() []*LayerInfo {
+	if x != nil {
+		return x.Layers
+	}
+	return nil
+}
+
+type LayerRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LayerRequest) Reset() {
+	*x = LayerRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LayerRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LayerRequest) ProtoMessage() {}
+
+func (x *LayerRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LayerRequest.ProtoReflect.Descriptor instead.
+func (*LayerRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *LayerRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type Extent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Offset        int64                  `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	Length        int64                  `protobuf:"varint,2,opt,name=length,proto3" json:"length,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Extent) Reset() {
+	*x = Extent{}
+	mi := &file_adminpb_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Extent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Extent) ProtoMessage() {}
+
+func (x *Extent) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Extent.ProtoReflect.Descriptor instead.
+func (*Extent) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Extent) GetOffset() int64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *Extent) GetLength() int64 {
+	if x != nil {
+		return x.Length
+	}
+	return 0
+}
+
+type ExtentsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Extents       []*Extent              `protobuf:"bytes,1,rep,name=extents,proto3" json:"extents,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExtentsResponse) Reset() {
+	*x = ExtentsResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExtentsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtentsResponse) ProtoMessage() {}
+
+func (x *ExtentsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtentsResponse.ProtoReflect.Descriptor instead.
+func (*ExtentsResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ExtentsResponse) GetExtents() []*Extent {
+	if x != nil {
+		return x.Extents
+	}
+	return nil
+}
+
+type ExistsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ids           []string               `protobuf:"bytes,1,rep,name=ids,proto3" json:"ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExistsRequest) Reset() {
+	*x = ExistsRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExistsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExistsRequest) ProtoMessage() {}
+
+func (x *ExistsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExistsRequest.ProtoReflect.Descriptor instead.
+func (*ExistsRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ExistsRequest) GetIds() []string {
+	if x != nil {
+		return x.Ids
+	}
+	return nil
+}
+
+// Tells whether each of the layers requested exists, in the same order.
+type ExistsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Exists        []bool                 `protobuf:"varint,1,rep,packed,name=exists,proto3" json:"exists,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExistsResponse) Reset() {
+	*x = ExistsResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExistsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExistsResponse) ProtoMessage() {}
+
+func (x *ExistsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExistsResponse.ProtoReflect.Descriptor instead.
+func (*ExistsResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ExistsResponse) GetExists() []bool {
+	if x != nil {
+		return x.Exists
+	}
+	return nil
+}
+
+type PrefetchRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Paths         []string               `protobuf:"bytes,2,rep,name=paths,proto3" json:"paths,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PrefetchRequest) Reset() {
+	*x = PrefetchRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PrefetchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PrefetchRequest) ProtoMessage() {}
+
+func (x *PrefetchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PrefetchRequest.ProtoReflect.Descriptor instead.
+func (*PrefetchRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *PrefetchRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *PrefetchRequest) GetPaths() []string {
+	if x != nil {
+		return x.Paths
+	}
+	return nil
+}
+
+type CapacityStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TotalBytes    uint64                 `protobuf:"varint,1,opt,name=total_bytes,json=totalBytes,proto3" json:"total_bytes,omitempty"`
+	FreeBytes     uint64                 `protobuf:"varint,2,opt,name=free_bytes,json=freeBytes,proto3" json:"free_bytes,omitempty"`
+	UsedBytes     uint64                 `protobuf:"varint,3,opt,name=used_bytes,json=usedBytes,proto3" json:"used_bytes,omitempty"`
+	TotalInodes   uint64                 `protobuf:"varint,4,opt,name=total_inodes,json=totalInodes,proto3" json:"total_inodes,omitempty"`
+	FreeInodes    uint64                 `protobuf:"varint,5,opt,name=free_inodes,json=freeInodes,proto3" json:"free_inodes,omitempty"`
+	Layers        int64                  `protobuf:"varint,6,opt,name=layers,proto3" json:"layers,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CapacityStats) Reset() {
+	*x = CapacityStats{}
+	mi := &file_adminpb_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CapacityStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CapacityStats) ProtoMessage() {}
+
+func (x *CapacityStats) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CapacityStats.ProtoReflect.Descriptor instead.
+func (*CapacityStats) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *CapacityStats) GetTotalBytes() uint64 {
+	if x != nil {
+		return x.TotalBytes
+	}
+	return 0
+}
+
+func (x *CapacityStats) GetFreeBytes() uint64 {
+	if x != nil {
+		return x.FreeBytes
+	}
+	return 0
+}
+
+func (x *CapacityStats) GetUsedBytes() uint64 {
+	if x != nil {
+		return x.UsedBytes
+	}
+	return 0
+}
+
+func (x *CapacityStats) GetTotalInodes() uint64 {
+	if x != nil {
+		return x.TotalInodes
+	}
+	return 0
+}
+
+func (x *CapacityStats) GetFreeInodes() uint64 {
+	if x != nil {
+		return x.FreeInodes
+	}
+	return 0
+}
+
+func (x *CapacityStats) GetLayers() int64 {
+	if x != nil {
+		return x.Layers
+	}
+	return 0
+}
+
+type OpMetric struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Count         uint64                 `protobuf:"varint,1,opt,name=count,proto3" json:"count,omitempty"`
+	Errors        uint64                 `protobuf:"varint,2,opt,name=errors,proto3" json:"errors,omitempty"`
+	Total         *durationpb.Duration   `protobuf:"bytes,3,opt,name=total,proto3" json:"total,omitempty"`
+	Max           *durationpb.Duration   `protobuf:"bytes,4,opt,name=max,proto3" json:"max,omitempty"`
+	Slow          uint64                 `protobuf:"varint,5,opt,name=slow,proto3" json:"slow,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OpMetric) Reset() {
+	*x = OpMetric{}
+	mi := &file_adminpb_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OpMetric) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OpMetric) ProtoMessage() {}
+
+func (x *OpMetric) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OpMetric.ProtoReflect.Descriptor instead.
+func (*OpMetric) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *OpMetric) GetCount() uint64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *OpMetric) GetErrors() uint64 {
+	if x != nil {
+		return x.Errors
+	}
+	return 0
+}
+
+func (x *OpMetric) GetTotal() *durationpb.Duration {
+	if x != nil {
+		return x.Total
+	}
+	return nil
+}
+
+func (x *OpMetric) GetMax() *durationpb.Duration {
+	if x != nil {
+		return x.Max
+	}
+	return nil
+}
+
+func (x *OpMetric) GetSlow() uint64 {
+	if x != nil {
+		return x.Slow
+	}
+	return 0
+}
+
+type LayerIOStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ReadBytes     uint64                 `protobuf:"varint,1,opt,name=read_bytes,json=readBytes,proto3" json:"read_bytes,omitempty"`
+	WriteBytes    uint64                 `protobuf:"varint,2,opt,name=write_bytes,json=writeBytes,proto3" json:"write_bytes,omitempty"`
+	ReadOps       uint64                 `protobuf:"varint,3,opt,name=read_ops,json=readOps,proto3" json:"read_ops,omitempty"`
+	WriteOps      uint64                 `protobuf:"varint,4,opt,name=write_ops,json=writeOps,proto3" json:"write_ops,omitempty"`
+	BlockReads    uint64                 `protobuf:"varint,5,opt,name=block_reads,json=blockReads,proto3" json:"block_reads,omitempty"`
+	BlockWrites   uint64                 `protobuf:"varint,6,opt,name=block_writes,json=blockWrites,proto3" json:"block_writes,omitempty"`
+	Inodes        uint64                 `protobuf:"varint,7,opt,name=inodes,proto3" json:"inodes,omitempty"`
+	DirtyPages    uint64                 `protobuf:"varint,8,opt,name=dirty_pages,json=dirtyPages,proto3" json:"dirty_pages,omitempty"`
+	CacheHits     uint64                 `protobuf:"varint,9,opt,name=cache_hits,json=cacheHits,proto3" json:"cache_hits,omitempty"`
+	CacheMisses   uint64                 `protobuf:"varint,10,opt,name=cache_misses,json=cacheMisses,proto3" json:"cache_misses,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LayerIOStats) Reset() {
+	*x = LayerIOStats{}
+	mi := &file_adminpb_admin_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LayerIOStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LayerIOStats) ProtoMessage() {}
+
+func (x *LayerIOStats) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LayerIOStats.ProtoReflect.Descriptor instead.
+func (*LayerIOStats) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *LayerIOStats) GetReadBytes() uint64 {
+	if x != nil {
+		return x.ReadBytes
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetWriteBytes() uint64 {
+	if x != nil {
+		return x.WriteBytes
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetReadOps() uint64 {
+	if x != nil {
+		return x.ReadOps
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetWriteOps() uint64 {
+	if x != nil {
+		return x.WriteOps
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetBlockReads() uint64 {
+	if x != nil {
+		return x.BlockReads
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetBlockWrites() uint64 {
+	if x != nil {
+		return x.BlockWrites
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetInodes() uint64 {
+	if x != nil {
+		return x.Inodes
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetDirtyPages() uint64 {
+	if x != nil {
+		return x.DirtyPages
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetCacheHits() uint64 {
+	if x != nil {
+		return x.CacheHits
+	}
+	return 0
+}
+
+func (x *LayerIOStats) GetCacheMisses() uint64 {
+	if x != nil {
+		return x.CacheMisses
+	}
+	return 0
+}
+
+type DaemonStats struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	ResidentMemory  uint64                 `protobuf:"varint,1,opt,name=resident_memory,json=residentMemory,proto3" json:"resident_memory,omitempty"`
+	PageMemory      uint64                 `protobuf:"varint,2,opt,name=page_memory,json=pageMemory,proto3" json:"page_memory,omitempty"`
+	PageMemoryLimit uint64                 `protobuf:"varint,3,opt,name=page_memory_limit,json=pageMemoryLimit,proto3" json:"page_memory_limit,omitempty"`
+	GlobalMemory    uint64                 `protobuf:"varint,4,opt,name=global_memory,json=globalMemory,proto3" json:"global_memory,omitempty"`
+	Pages           uint64                 `protobuf:"varint,5,opt,name=pages,proto3" json:"pages,omitempty"`
+	DirtyPages      uint64                 `protobuf:"varint,6,opt,name=dirty_pages,json=dirtyPages,proto3" json:"dirty_pages,omitempty"`
+	Layers          uint64                 `protobuf:"varint,7,opt,name=layers,proto3" json:"layers,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *DaemonStats) Reset() {
+	*x = DaemonStats{}
+	mi := &file_adminpb_admin_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DaemonStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DaemonStats) ProtoMessage() {}
+
+func (x *DaemonStats) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DaemonStats.ProtoReflect.Descriptor instead.
+func (*DaemonStats) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *DaemonStats) GetResidentMemory() uint64 {
+	if x != nil {
+		return x.ResidentMemory
+	}
+	return 0
+}
+
+func (x *DaemonStats) GetPageMemory() uint64 {
+	if x != nil {
+		return x.PageMemory
+	}
+	return 0
+}
+
+func (x *DaemonStats) GetPageMemoryLimit() uint64 {
+	if x != nil {
+		return x.PageMemoryLimit
+	}
+	return 0
+}
+
+func (x *DaemonStats) GetGlobalMemory() uint64 {
+	if x != nil {
+		return x.GlobalMemory
+	}
+	return 0
+}
+
+func (x *DaemonStats) GetPages() uint64 {
+	if x != nil {
+		return x.Pages
+	}
+	return 0
+}
+
+func (x *DaemonStats) GetDirtyPages() uint64 {
+	if x != nil {
+		return x.DirtyPages
+	}
+	return 0
+}
+
+func (x *DaemonStats) GetLayers() uint64 {
+	if x != nil {
+		return x.Layers
+	}
+	return 0
+}
+
+type FuseStats struct {
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	Waiting             uint64                 `protobuf:"varint,1,opt,name=waiting,proto3" json:"waiting,omitempty"`
+	MaxWaiting          uint64                 `protobuf:"varint,2,opt,name=max_waiting,json=maxWaiting,proto3" json:"max_waiting,omitempty"`
+	MaxBackground       uint64                 `protobuf:"varint,3,opt,name=max_background,json=maxBackground,proto3" json:"max_background,omitempty"`
+	CongestionThreshold uint64                 `protobuf:"varint,4,opt,name=congestion_threshold,json=congestionThreshold,proto3" json:"congestion_threshold,omitempty"`
+	Congested           bool                   `protobuf:"varint,5,opt,name=congested,proto3" json:"congested,omitempty"`
+	CongestionEvents    uint64                 `protobuf:"varint,6,opt,name=congestion_events,json=congestionEvents,proto3" json:"congestion_events,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *FuseStats) Reset() {
+	*x = FuseStats{}
+	mi := &file_adminpb_admin_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FuseStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FuseStats) ProtoMessage() {}
+
+func (x *FuseStats) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FuseStats.ProtoReflect.Descriptor instead.
+func (*FuseStats) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *FuseStats) GetWaiting() uint64 {
+	if x != nil {
+		return x.Waiting
+	}
+	return 0
+}
+
+func (x *FuseStats) GetMaxWaiting() uint64 {
+	if x != nil {
+		return x.MaxWaiting
+	}
+	return 0
+}
+
+func (x *FuseStats) GetMaxBackground() uint64 {
+	if x != nil {
+		return x.MaxBackground
+	}
+	return 0
+}
+
+func (x *FuseStats) GetCongestionThreshold() uint64 {
+	if x != nil {
+		return x.CongestionThreshold
+	}
+	return 0
+}
+
+func (x *FuseStats) GetCongested() bool {
+	if x != nil {
+		return x.Congested
+	}
+	return false
+}
+
+func (x *FuseStats) GetCongestionEvents() uint64 {
+	if x != nil {
+		return x.CongestionEvents
+	}
+	return 0
+}
+
+type IoctlStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Limit         int64                  `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	Active        int64                  `protobuf:"varint,2,opt,name=active,proto3" json:"active,omitempty"`
+	Waiting       int64                  `protobuf:"varint,3,opt,name=waiting,proto3" json:"waiting,omitempty"`
+	MaxWaiting    int64                  `protobuf:"varint,4,opt,name=max_waiting,json=maxWaiting,proto3" json:"max_waiting,omitempty"`
+	Queued        uint64                 `protobuf:"varint,5,opt,name=queued,proto3" json:"queued,omitempty"`
+	WaitTime      *durationpb.Duration   `protobuf:"bytes,6,opt,name=wait_time,json=waitTime,proto3" json:"wait_time,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IoctlStats) Reset() {
+	*x = IoctlStats{}
+	mi := &file_adminpb_admin_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IoctlStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IoctlStats) ProtoMessage() {}
+
+func (x *IoctlStats) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IoctlStats.ProtoReflect.Descriptor instead.
+func (*IoctlStats) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *IoctlStats) GetLimit() int64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *IoctlStats) GetActive() int64 {
+	if x != nil {
+		return x.Active
+	}
+	return 0
+}
+
+func (x *IoctlStats) GetWaiting() int64 {
+	if x != nil {
+		return x.Waiting
+	}
+	return 0
+}
+
+func (x *IoctlStats) GetMaxWaiting() int64 {
+	if x != nil {
+		return x.MaxWaiting
+	}
+	return 0
+}
+
+func (x *IoctlStats) GetQueued() uint64 {
+	if x != nil {
+		return x.Queued
+	}
+	return 0
+}
+
+func (x *IoctlStats) GetWaitTime() *durationpb.Duration {
+	if x != nil {
+		return x.WaitTime
+	}
+	return nil
+}
+
+type DedupStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         uint64                 `protobuf:"varint,1,opt,name=files,proto3" json:"files,omitempty"`
+	Bytes         uint64                 `protobuf:"varint,2,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DedupStats) Reset() {
+	*x = DedupStats{}
+	mi := &file_adminpb_admin_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DedupStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DedupStats) ProtoMessage() {}
+
+func (x *DedupStats) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DedupStats.ProtoReflect.Descriptor instead.
+func (*DedupStats) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *DedupStats) GetFiles() uint64 {
+	if x != nil {
+		return x.Files
+	}
+	return 0
+}
+
+func (x *DedupStats) GetBytes() uint64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+type PruneStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Snapshots     uint64                 `protobuf:"varint,1,opt,name=snapshots,proto3" json:"snapshots,omitempty"`
+	Bytes         uint64                 `protobuf:"varint,2,opt,name=bytes,proto3" json:"bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PruneStats) Reset() {
+	*x = PruneStats{}
+	mi := &file_adminpb_admin_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PruneStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PruneStats) ProtoMessage() {}
+
+func (x *PruneStats) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PruneStats.ProtoReflect.Descriptor instead.
+func (*PruneStats) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *PruneStats) GetSnapshots() uint64 {
+	if x != nil {
+		return x.Snapshots
+	}
+	return 0
+}
+
+func (x *PruneStats) GetBytes() uint64 {
+	if x != nil {
+		return x.Bytes
+	}
+	return 0
+}
+
+// Stats of the file system and the plugin, optional ones missing when not
+// available or not enabled.
+type StatsResponse struct {
+	state           protoimpl.MessageState   `protogen:"open.v1"`
+	Capacity        *CapacityStats           `protobuf:"bytes,1,opt,name=capacity,proto3" json:"capacity,omitempty"`
+	Operations      map[string]*OpMetric     `protobuf:"bytes,2,rep,name=operations,proto3" json:"operations,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Layers          map[string]*LayerIOStats `protobuf:"bytes,3,rep,name=layers,proto3" json:"layers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Daemon          *DaemonStats             `protobuf:"bytes,4,opt,name=daemon,proto3" json:"daemon,omitempty"`
+	Fuse            *FuseStats               `protobuf:"bytes,5,opt,name=fuse,proto3" json:"fuse,omitempty"`
+	Ioctls          *IoctlStats              `protobuf:"bytes,6,opt,name=ioctls,proto3" json:"ioctls,omitempty"`
+	PendingRemovals int64                    `protobuf:"varint,7,opt,name=pending_removals,json=pendingRemovals,proto3" json:"pending_removals,omitempty"`
+	ApplyDiffDedup  *DedupStats              `protobuf:"bytes,8,opt,name=apply_diff_dedup,json=applyDiffDedup,proto3" json:"apply_diff_dedup,omitempty"`
+	SnapshotsPruned *PruneStats              `protobuf:"bytes,9,opt,name=snapshots_pruned,json=snapshotsPruned,proto3" json:"snapshots_pruned,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *StatsResponse) Reset() {
+	*x = StatsResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsResponse) ProtoMessage() {}
+
+func (x *StatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsResponse.ProtoReflect.Descriptor instead.
+func (*StatsResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *StatsResponse) GetCapacity() *CapacityStats {
+	if x != nil {
+		return x.Capacity
+	}
+	return nil
+}
+
+func (x *StatsResponse) GetOperations() map[string]*OpMetric {
+	if x != nil {
+		return x.Operations
+	}
+	return nil
+}
+
+func (x *StatsResponse) GetLayers() map[string]*LayerIOStats {
+	if x != nil {
+		return x.Layers
+	}
+	return nil
+}
+
+func (x *StatsResponse) GetDaemon() *DaemonStats {
+	if x != nil {
+		return x.Daemon
+	}
+	return nil
+}
+
+func (x *StatsResponse) GetFuse() *FuseStats {
+	if x != nil {
+		return x.Fuse
+	}
+	return nil
+}
+
+func (x *StatsResponse) GetIoctls() *IoctlStats {
+	if x != nil {
+		return x.Ioctls
+	}
+	return nil
+}
+
+func (x *StatsResponse) GetPendingRemovals() int64 {
+	if x != nil {
+		return x.PendingRemovals
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetApplyDiffDedup() *DedupStats {
+	if x != nil {
+		return x.ApplyDiffDedup
+	}
+	return nil
+}
+
+func (x *StatsResponse) GetSnapshotsPruned() *PruneStats {
+	if x != nil {
+		return x.SnapshotsPruned
+	}
+	return nil
+}
+
+type WatchStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Interval      *durationpb.Duration   `protobuf:"bytes,1,opt,name=interval,proto3" json:"interval,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchStatsRequest) Reset() {
+	*x = WatchStatsRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchStatsRequest) ProtoMessage() {}
+
+func (x *WatchStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchStatsRequest.ProtoReflect.Descriptor instead.
+func (*WatchStatsRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *WatchStatsRequest) GetInterval() *durationpb.Duration {
+	if x != nil {
+		return x.Interval
+	}
+	return nil
+}
+
+// Driver options in effect, named as the storage options and as returned by
+// GET /v1/config of the admin API.
+type ConfigResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Options       *structpb.Struct       `protobuf:"bytes,1,opt,name=options,proto3" json:"options,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConfigResponse) Reset() {
+	*x = ConfigResponse{}
+	mi := &file_adminpb_admin_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConfigResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigResponse) ProtoMessage() {}
+
+func (x *ConfigResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigResponse.ProtoReflect.Descriptor instead.
+func (*ConfigResponse) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *ConfigResponse) GetOptions() *structpb.Struct {
+	if x != nil {
+		return x.Options
+	}
+	return nil
+}
+
+// Tunables updated, those not set are left unchanged.
+type SetConfigRequest struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	PcacheMb       *int64                 `protobuf:"varint,1,opt,name=pcache_mb,json=pcacheMb,proto3,oneof" json:"pcache_mb,omitempty"`
+	Verbose        *bool                  `protobuf:"varint,2,opt,name=verbose,proto3,oneof" json:"verbose,omitempty"`
+	CommitInterval *durationpb.Duration   `protobuf:"bytes,3,opt,name=commit_interval,json=commitInterval,proto3" json:"commit_interval,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *SetConfigRequest) Reset() {
+	*x = SetConfigRequest{}
+	mi := &file_adminpb_admin_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetConfigRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetConfigRequest) ProtoMessage() {}
+
+func (x *SetConfigRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_adminpb_admin_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetConfigRequest.ProtoReflect.Descriptor instead.
+func (*SetConfigRequest) Descriptor() ([]byte, []int) {
+	return file_adminpb_admin_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *SetConfigRequest) GetPcacheMb() int64 {
+	if x != nil && x.PcacheMb != nil {
+		return *x.PcacheMb
+	}
+	return 0
+}
+
+func (x *SetConfigRequest) GetVerbose() bool {
+	if x != nil && x.Verbose != nil {
+		return *x.Verbose
+	}
+	return false
+}
+
+func (x *SetConfigRequest) GetCommitInterval() *durationpb.Duration {
+	if x != nil {
+		return x.CommitInterval
+	}
+	return nil
+}
+
+var File_adminpb_admin_proto protoreflect.FileDescriptor
+
+const file_adminpb_admin_proto_rawDesc = "" +
+	"\n" +
+	"\x13adminpb/admin.proto\x12\rlcfs.admin.v1\x1a\x1egoogle/protobuf/duration.proto\x1a\x1bgoogle/protobuf/empty.proto\x1a\x1cgoogle/protobuf/struct.proto\"\x9c\x01\n" +
+	"\tLayerInfo\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12B\n" +
+	"\bmetadata\x18\x02 \x03(\v2&.lcfs.admin.v1.LayerInfo.MetadataEntryR\bmetadata\x1a;\n" +
+	"\rMetadataEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"B\n" +
+	"\x0eLayersResponse\x120\n" +
+	"\x06layers\x18\x01 \x03(\v2\x18.lcfs.admin.v1.LayerInfoR\x06layers\"\x1e\n" +
+	"\fLayerRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"8\n" +
+	"\x06Extent\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x03R\x06offset\x12\x16\n" +
+	"\x06length\x18\x02 \x01(\x03R\x06length\"B\n" +
+	"\x0fExtentsResponse\x12/\n" +
+	"\aextents\x18\x01 \x03(\v2\x15.lcfs.admin.v1.ExtentR\aextents\"!\n" +
+	"\rExistsRequest\x12\x10\n" +
+	"\x03ids\x18\x01 \x03(\tR\x03ids\"(\n" +
+	"\x0eExistsResponse\x12\x16\n" +
+	"\x06exists\x18\x01 \x03(\bR\x06exists\"7\n" +
+	"\x0fPrefetchRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05paths\x18\x02 \x03(\tR\x05paths\"\xca\x01\n" +
+	"\rCapacityStats\x12\x1f\n" +
+	"\vtotal_bytes\x18\x01 \x01(\x04R\n" +
+	"totalBytes\x12\x1d\n" +
+	"\n" +
+	"free_bytes\x18\x02 \x01(\x04R\tfreeBytes\x12\x1d\n" +
+	"\n" +
+	"used_bytes\x18\x03 \x01(\x04R\tusedBytes\x12!\n" +
+	"\ftotal_inodes\x18\x04 \x01(\x04R\vtotalInodes\x12\x1f\n" +
+	"\vfree_inodes\x18\x05 \x01(\x04R\n" +
+	"freeInodes\x12\x16\n" +
+	"\x06layers\x18\x06 \x01(\x03R\x06layers\"\xaa\x01\n" +
+	"\bOpMetric\x12\x14\n" +
+	"\x05count\x18\x01 \x01(\x04R\x05count\x12\x16\n" +
+	"\x06errors\x18\x02 \x01(\x04R\x06errors\x12/\n" +
+	"\x05total\x18\x03 \x01(\v2\x19.google.protobuf.DurationR\x05total\x12+\n" +
+	"\x03max\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\x03max\x12\x12\n" +
+	"\x04slow\x18\x05 \x01(\x04R\x04slow\"\xc5\x02\n" +
+	"\fLayerIOStats\x12\x1d\n" +
+	"\n" +
+	"read_bytes\x18\x01 \x01(\x04R\treadBytes\x12\x1f\n" +
+	"\vwrite_bytes\x18\x02 \x01(\x04R\n" +
+	"writeBytes\x12\x19\n" +
+	"\bread_ops\x18\x03 \x01(\x04R\areadOps\x12\x1b\n" +
+	"\twrite_ops\x18\x04 \x01(\x04R\bwriteOps\x12\x1f\n" +
+	"\vblock_reads\x18\x05 \x01(\x04R\n" +
+	"blockReads\x12!\n" +
+	"\fblock_writes\x18\x06 \x01(\x04R\vblockWrites\x12\x16\n" +
+	"\x06inodes\x18\a \x01(\x04R\x06inodes\x12\x1f\n" +
+	"\vdirty_pages\x18\b \x01(\x04R\n" +
+	"dirtyPages\x12\x1d\n" +
+	"\n" +
+	"cache_hits\x18\t \x01(\x04R\tcacheHits\x12!\n" +
+	"\fcache_misses\x18\n" +
+	" \x01(\x04R\vcacheMisses\"\xf7\x01\n" +
+	"\vDaemonStats\x12'\n" +
+	"\x0fresident_memory\x18\x01 \x01(\x04R\x0eresidentMemory\x12\x1f\n" +
+	"\vpage_memory\x18\x02 \x01(\x04R\n" +
+	"pageMemory\x12*\n" +
+	"\x11page_memory_limit\x18\x03 \x01(\x04R\x0fpageMemoryLimit\x12#\n" +
+	"\rglobal_memory\x18\x04 \x01(\x04R\fglobalMemory\x12\x14\n" +
+	"\x05pages\x18\x05 \x01(\x04R\x05pages\x12\x1f\n" +
+	"\vdirty_pages\x18\x06 \x01(\x04R\n" +
+	"dirtyPages\x12\x16\n" +
+	"\x06layers\x18\a \x01(\x04R\x06layers\"\xeb\x01\n" +
+	"\tFuseStats\x12\x18\n" +
+	"\awaiting\x18\x01 \x01(\x04R\awaiting\x12\x1f\n" +
+	"\vmax_waiting\x18\x02 \x01(\x04R\n" +
+	"maxWaiting\x12%\n" +
+	"\x0emax_background\x18\x03 \x01(\x04R\rmaxBackground\x121\n" +
+	"\x14congestion_threshold\x18\x04 \x01(\x04R\x13congestionThreshold\x12\x1c\n" +
+	"\tcongested\x18\x05 \x01(\bR\tcongested\x12+\n" +
+	"\x11congestion_events\x18\x06 \x01(\x04R\x10congestionEvents\"\xc5\x01\n" +
+	"\n" +
+	"IoctlStats\x12\x14\n" +
+	"\x05limit\x18\x01 \x01(\x03R\x05limit\x12\x16\n" +
+	"\x06active\x18\x02 \x01(\x03R\x06active\x12\x18\n" +
+	"\awaiting\x18\x03 \x01(\x03R\awaiting\x12\x1f\n" +
+	"\vmax_waiting\x18\x04 \x01(\x03R\n" +
+	"maxWaiting\x12\x16\n" +
+	"\x06queued\x18\x05 \x01(\x04R\x06queued\x126\n" +
+	"\twait_time\x18\x06 \x01(\v2\x19.google.protobuf.DurationR\bwaitTime\"8\n" +
+	"\n" +
+	"DedupStats\x12\x14\n" +
+	"\x05files\x18\x01 \x01(\x04R\x05files\x12\x14\n" +
+	"\x05bytes\x18\x02 \x01(\x04R\x05bytes\"@\n" +
+	"\n" +
+	"PruneStats\x12\x1c\n" +
+	"\tsnapshots\x18\x01 \x01(\x04R\tsnapshots\x12\x14\n" +
+	"\x05bytes\x18\x02 \x01(\x04R\x05bytes\"\xd4\x05\n" +
+	"\rStatsResponse\x128\n" +
+	"\bcapacity\x18\x01 \x01(\v2\x1c.lcfs.admin.v1.CapacityStatsR\bcapacity\x12L\n" +
+	"\n" +
+	"operations\x18\x02 \x03(\v2,.lcfs.admin.v1.StatsResponse.OperationsEntryR\n" +
+	"operations\x12@\n" +
+	"\x06layers\x18\x03 \x03(\v2(.lcfs.admin.v1.StatsResponse.LayersEntryR\x06layers\x122\n" +
+	"\x06daemon\x18\x04 \x01(\v2\x1a.lcfs.admin.v1.DaemonStatsR\x06daemon\x12,\n" +
+	"\x04fuse\x18\x05 \x01(\v2\x18.lcfs.admin.v1.FuseStatsR\x04fuse\x121\n" +
+	"\x06ioctls\x18\x06 \x01(\v2\x19.lcfs.admin.v1.IoctlStatsR\x06ioctls\x12)\n" +
+	"\x10pending_removals\x18\a \x01(\x03R\x0fpendingRemovals\x12C\n" +
+	"\x10apply_diff_dedup\x18\b \x01(\v2\x19.lcfs.admin.v1.DedupStatsR\x0eapplyDiffDedup\x12D\n" +
+	"\x10snapshots_pruned\x18\t \x01(\v2\x19.lcfs.admin.v1.PruneStatsR\x0fsnapshotsPruned\x1aV\n" +
+	"\x0fOperationsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12-\n" +
+	"\x05value\x18\x02 \x01(\v2\x17.lcfs.admin.v1.OpMetricR\x05value:\x028\x01\x1aV\n" +
+	"\vLayersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x121\n" +
+	"\x05value\x18\x02 \x01(\v2\x1b.lcfs.admin.v1.LayerIOStatsR\x05value:\x028\x01\"J\n" +
+	"\x11WatchStatsRequest\x125\n" +
+	"\binterval\x18\x01 \x01(\v2\x19.google.protobuf.DurationR\binterval\"C\n" +
+	"\x0eConfigResponse\x121\n" +
+	"\aoptions\x18\x01 \x01(\v2\x17.google.protobuf.StructR\aoptions\"\xb1\x01\n" +
+	"\x10SetConfigRequest\x12 \n" +
+	"\tpcache_mb\x18\x01 \x01(\x03H\x00R\bpcacheMb\x88\x01\x01\x12\x1d\n" +
+	"\averbose\x18\x02 \x01(\bH\x01R\averbose\x88\x01\x01\x12B\n" +
+	"\x0fcommit_interval\x18\x03 \x01(\v2\x19.google.protobuf.DurationR\x0ecommitIntervalB\f\n" +
+	"\n" +
+	"_pcache_mbB\n" +
+	"\n" +
+	"\b_verbose2\xa3\x06\n" +
+	"\x05Admin\x12?\n" +
+	"\x06Layers\x12\x16.google.protobuf.Empty\x1a\x1d.lcfs.admin.v1.LayersResponse\x12>\n" +
+	"\x05Layer\x12\x1b.lcfs.admin.v1.LayerRequest\x1a\x18.lcfs.admin.v1.LayerInfo\x12F\n" +
+	"\aExtents\x12\x1b.lcfs.admin.v1.LayerRequest\x1a\x1e.lcfs.admin.v1.ExtentsResponse\x12E\n" +
+	"\x06Exists\x12\x1c.lcfs.admin.v1.ExistsRequest\x1a\x1d.lcfs.admin.v1.ExistsResponse\x12B\n" +
+	"\bPrefetch\x12\x1e.lcfs.admin.v1.PrefetchRequest\x1a\x16.google.protobuf.Empty\x12=\n" +
+	"\x06Freeze\x12\x1b.lcfs.admin.v1.LayerRequest\x1a\x16.google.protobuf.Empty\x12;\n" +
+	"\x04Thaw\x12\x1b.lcfs.admin.v1.LayerRequest\x1a\x16.google.protobuf.Empty\x12=\n" +
+	"\x05Stats\x12\x16.google.protobuf.Empty\x1a\x1c.lcfs.admin.v1.StatsResponse\x12N\n" +
+	"\n" +
+	"WatchStats\x12 .lcfs.admin.v1.WatchStatsRequest\x1a\x1c.lcfs.admin.v1.StatsResponse0\x01\x124\n" +
+	"\x02GC\x12\x16.google.protobuf.Empty\x1a\x16.google.protobuf.Empty\x12?\n" +
+	"\x06Config\x12\x16.google.protobuf.Empty\x1a\x1d.lcfs.admin.v1.ConfigResponse\x12D\n" +
+	"\tSetConfig\x12\x1f.lcfs.admin.v1.SetConfigRequest\x1a\x16.google.protobuf.EmptyB)Z'github.com/portworx/lcfs/plugin/adminpbb\x06proto3"
+
+var (
+	file_adminpb_admin_proto_rawDescOnce sync.Once
+	file_adminpb_admin_proto_rawDescData []byte
+)
+
+func file_adminpb_admin_proto_rawDescGZIP() []byte {
+	file_adminpb_admin_proto_rawDescOnce.Do(func() {
+		file_adminpb_admin_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_adminpb_admin_proto_rawDesc), len(file_adminpb_admin_proto_rawDesc)))
+	})
+	return file_adminpb_admin_proto_rawDescData
+}
+
+var file_adminpb_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 23)
+var file_adminpb_admin_proto_goTypes = []any{
+	(*LayerInfo)(nil),           // 0: lcfs.admin.v1.LayerInfo
+	(*LayersResponse)(nil),      // 1: lcfs.admin.v1.LayersResponse
+	(*LayerRequest)(nil),        // 2: lcfs.admin.v1.LayerRequest
+	(*Extent)(nil),              // 3: lcfs.admin.v1.Extent
+	(*ExtentsResponse)(nil),     // 4: lcfs.admin.v1.ExtentsResponse
+	(*ExistsRequest)(nil),       // 5: lcfs.admin.v1.ExistsRequest
+	(*ExistsResponse)(nil),      // 6: lcfs.admin.v1.ExistsResponse
+	(*PrefetchRequest)(nil),     // 7: lcfs.admin.v1.PrefetchRequest
+	(*CapacityStats)(nil),       // 8: lcfs.admin.v1.CapacityStats
+	(*OpMetric)(nil),            // 9: lcfs.admin.v1.OpMetric
+	(*LayerIOStats)(nil),        // 10: lcfs.admin.v1.LayerIOStats
+	(*DaemonStats)(nil),         // 11: lcfs.admin.v1.DaemonStats
+	(*FuseStats)(nil),           // 12: lcfs.admin.v1.FuseStats
+	(*IoctlStats)(nil),          // 13: lcfs.admin.v1.IoctlStats
+	(*DedupStats)(nil),          // 14: lcfs.admin.v1.DedupStats
+	(*PruneStats)(nil),          // 15: lcfs.admin.v1.PruneStats
+	(*StatsResponse)(nil),       // 16: lcfs.admin.v1.StatsResponse
+	(*WatchStatsRequest)(nil),   // 17: lcfs.admin.v1.WatchStatsRequest
+	(*ConfigResponse)(nil),      // 18: lcfs.admin.v1.ConfigResponse
+	(*SetConfigRequest)(nil),    // 19: lcfs.admin.v1.SetConfigRequest
+	nil,                         // 20: lcfs.admin.v1.LayerInfo.MetadataEntry
+	nil,                         // 21: lcfs.admin.v1.StatsResponse.OperationsEntry
+	nil,                         // 22: lcfs.admin.v1.StatsResponse.LayersEntry
+	(*durationpb.Duration)(nil), // 23: google.protobuf.Duration
+	(*structpb.Struct)(nil),     // 24: google.protobuf.Struct
+	(*emptypb.Empty)(nil),       // 25: google.protobuf.Empty
+}
+var file_adminpb_admin_proto_depIdxs = []int32{
+	20, // 0: lcfs.admin.v1.LayerInfo.metadata:type_name -> lcfs.admin.v1.LayerInfo.MetadataEntry
+	0,  // 1: lcfs.admin.v1.LayersResponse.layers:type_name -> lcfs.admin.v1.LayerInfo
+	3,  // 2: lcfs.admin.v1.ExtentsResponse.extents:type_name -> lcfs.admin.v1.Extent
+	23, // 3: lcfs.admin.v1.OpMetric.total:type_name -> google.protobuf.Duration
+	23, // 4: lcfs.admin.v1.OpMetric.max:type_name -> google.protobuf.Duration
+	23, // 5: lcfs.admin.v1.IoctlStats.wait_time:type_name -> google.protobuf.Duration
+	8,  // 6: lcfs.admin.v1.StatsResponse.capacity:type_name -> lcfs.admin.v1.CapacityStats
+	21, // 7: lcfs.admin.v1.StatsResponse.operations:type_name -> lcfs.admin.v1.StatsResponse.OperationsEntry
+	22, // 8: lcfs.admin.v1.StatsResponse.layers:type_name -> lcfs.admin.v1.StatsResponse.LayersEntry
+	11, // 9: lcfs.admin.v1.StatsResponse.daemon:type_name -> lcfs.admin.v1.DaemonStats
+	12, // 10: lcfs.admin.v1.StatsResponse.fuse:type_name -> lcfs.admin.v1.FuseStats
+	13, // 11: lcfs.admin.v1.StatsResponse.ioctls:type_name -> lcfs.admin.v1.IoctlStats
+	14, // 12: lcfs.admin.v1.StatsResponse.apply_diff_dedup:type_name -> lcfs.admin.v1.DedupStats
+	15, // 13: lcfs.admin.v1.StatsResponse.snapshots_pruned:type_name -> lcfs.admin.v1.PruneStats
+	23, // 14: lcfs.admin.v1.WatchStatsRequest.interval:type_name -> google.protobuf.Duration
+	24, // 15: lcfs.admin.v1.ConfigResponse.options:type_name -> google.protobuf.Struct
+	23, // 16: lcfs.admin.v1.SetConfigRequest.commit_interval:type_name -> google.protobuf.Duration
+	9,  // 17: lcfs.admin.v1.StatsResponse.OperationsEntry.value:type_name -> lcfs.admin.v1.OpMetric
+	10, // 18: lcfs.admin.v1.StatsResponse.LayersEntry.value:type_name -> lcfs.admin.v1.LayerIOStats
+	25, // 19: lcfs.admin.v1.Admin.Layers:input_type -> google.protobuf.Empty
+	2,  // 20: lcfs.admin.v1.Admin.Layer:input_type -> lcfs.admin.v1.LayerRequest
+	2,  // 21: lcfs.admin.v1.Admin.Extents:input_type -> lcfs.admin.v1.LayerRequest
+	5,  // 22: lcfs.admin.v1.Admin.Exists:input_type -> lcfs.admin.v1.ExistsRequest
+	7,  // 23: lcfs.admin.v1.Admin.Prefetch:input_type -> lcfs.admin.v1.PrefetchRequest
+	2,  // 24: lcfs.admin.v1.Admin.Freeze:input_type -> lcfs.admin.v1.LayerRequest
+	2,  // 25: lcfs.admin.v1.Admin.Thaw:input_type -> lcfs.admin.v1.LayerRequest
+	25, // 26: lcfs.admin.v1.Admin.Stats:input_type -> google.protobuf.Empty
+	17, // 27: lcfs.admin.v1.Admin.WatchStats:input_type -> lcfs.admin.v1.WatchStatsRequest
+	25, // 28: lcfs.admin.v1.Admin.GC:input_type -> google.protobuf.Empty
+	25, // 29: lcfs.admin.v1.Admin.Config:input_type -> google.protobuf.Empty
+	19, // 30: lcfs.admin.v1.Admin.SetConfig:input_type -> lcfs.admin.v1.SetConfigRequest
+	1,  // 31: lcfs.admin.v1.Admin.Layers:output_type -> lcfs.admin.v1.LayersResponse
+	0,  // 32: lcfs.admin.v1.Admin.Layer:output_type -> lcfs.admin.v1.LayerInfo
+	4,  // 33: lcfs.admin.v1.Admin.Extents:output_type -> lcfs.admin.v1.ExtentsResponse
+	6,  // 34: lcfs.admin.v1.Admin.Exists:output_type -> lcfs.admin.v1.ExistsResponse
+	25, // 35: lcfs.admin.v1.Admin.Prefetch:output_type -> google.protobuf.Empty
+	25, // 36: lcfs.admin.v1.Admin.Freeze:output_type -> google.protobuf.Empty
+	25, // 37: lcfs.admin.v1.Admin.Thaw:output_type -> google.protobuf.Empty
+	16, // 38: lcfs.admin.v1.Admin.Stats:output_type -> lcfs.admin.v1.StatsResponse
+	16, // 39: lcfs.admin.v1.Admin.WatchStats:output_type -> lcfs.admin.v1.StatsResponse
+	25, // 40: lcfs.admin.v1.Admin.GC:output_type -> google.protobuf.Empty
+	18, // 41: lcfs.admin.v1.Admin.Config:output_type -> lcfs.admin.v1.ConfigResponse
+	25, // 42: lcfs.admin.v1.Admin.SetConfig:output_type -> google.protobuf.Empty
+	31, // [31:43] is the sub-list for method output_type
+	19, // [19:31] is the sub-list for method input_type
+	19, // [19:19] is the sub-list for extension type_name
+	19, // [19:19] is the sub-list for extension extendee
+	0,  // [0:19] is the sub-list for field type_name
+}
+
+func init() { file_adminpb_admin_proto_init() }
+func file_adminpb_admin_proto_init() {
+	if File_adminpb_admin_proto != nil {
+		return
+	}
+	file_adminpb_admin_proto_msgTypes[19].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_adminpb_admin_proto_rawDesc), len(file_adminpb_admin_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   23,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_adminpb_admin_proto_goTypes,
+		DependencyIndexes: file_adminpb_admin_proto_depIdxs,
+		MessageInfos:      file_adminpb_admin_proto_msgTypes,
+	}.Build()
+	File_adminpb_admin_proto = out.File
+	file_adminpb_admin_proto_goTypes = nil
+	file_adminpb_admin_proto_depIdxs = nil
+}
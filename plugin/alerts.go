@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Time allowed for delivering an alert
+const alertTimeout = 30 * time.Second
+
+// alert describes a condition reported to the configured hooks.
+type alert struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+	Layer     string    `json:"layer,omitempty"`
+	Value     uint64    `json:"value"`
+	Threshold uint64    `json:"threshold"`
+}
+
+// alerter fires hooks when space or inode usage crosses a threshold, when a
+// layer fails to unmount repeatedly or when flushing the cache reclaims less
+// memory than expected.  Hooks are a script run with the alert as JSON on its
+// standard input and/or a webhook the alert is posted to.
+type alerter struct {
+	d              *Driver
+	exec           string
+	webhook        string
+	spaceUsed      uint64
+	inodesUsed     uint64
+	umountFailures int
+	gcMinReclaim   uint64
+	client         *http.Client
+
+	lock      sync.Mutex
+	active    map[string]bool
+	failures  map[string]int
+	delivered sync.WaitGroup
+	stop      chan struct{}
+}
+
+// newAlerter starts checking capacity of the file system every interval.
+func newAlerter(d *Driver, opts *driverOptions) *alerter {
+	a := &alerter{
+		d:              d,
+		exec:           opts.AlertExec,
+		webhook:        opts.AlertWebhook,
+		spaceUsed:      opts.AlertSpaceUsed,
+		inodesUsed:     opts.AlertInodesUsed,
+		umountFailures: opts.AlertUmountFailures,
+		gcMinReclaim:   uint64(opts.AlertGCMinReclaim),
+		client:         &http.Client{Timeout: alertTimeout},
+		active:         make(map[string]bool),
+		failures:       make(map[string]int),
+		stop:           make(chan struct{}),
+	}
+	if a.spaceUsed > 0 || a.inodesUsed > 0 {
+		go a.run(opts.AlertInterval)
+	}
+	logrus.Infof("Alerts enabled, checking capacity every %v", opts.AlertInterval)
+	return a
+}
+
+func (a *alerter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if c, err := a.d.capacity(); err == nil {
+				a.checkCapacity(c)
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// close stops checking capacity and waits for alerts being delivered.
+func (a *alerter) close() {
+	close(a.stop)
+	a.delivered.Wait()
+}
+
+// checkCapacity fires an alert when usage of space or inodes crosses the
+// threshold.  An alert fires again only after usage dropped below threshold.
+func (a *alerter) checkCapacity(c *capacityStats) {
+	if a.spaceUsed > 0 && c.TotalBytes > 0 {
+		used := (c.UsedBytes * 100) / c.TotalBytes
+		a.checkThreshold("space", used, a.spaceUsed,
+			fmt.Sprintf("%d%% of space used", used))
+	}
+	if a.inodesUsed > 0 && c.TotalInodes > 0 {
+		used := ((c.TotalInodes - c.FreeInodes) * 100) / c.TotalInodes
+		a.checkThreshold("inodes", used, a.inodesUsed,
+			fmt.Sprintf("%d%% of inodes used", used))
+	}
+}
+
+func (a *alerter) checkThreshold(kind string, value, threshold uint64, msg string) {
+	a.lock.Lock()
+	crossed := value >= threshold && !a.active[kind]
+	a.active[kind] = value >= threshold
+	a.lock.Unlock()
+	if crossed {
+		a.fire(&alert{Type: kind, Message: msg, Value: value, Threshold: threshold})
+	}
+}
+
+// opResult tracks failures of unmounting layers, firing an alert when a layer
+// failed to unmount the configured number of times in a row.  Failures of
+// layers removed are forgotten.
+func (a *alerter) opResult(op, id string, err error) {
+	removed := op == "Remove" && (err == nil || errors.Is(err, os.ErrNotExist))
+	if (op != "Put" && !removed) || a.umountFailures <= 0 {
+		return
+	}
+	a.lock.Lock()
+	if err == nil || removed {
+		delete(a.failures, id)
+		a.lock.Unlock()
+		return
+	}
+	a.failures[id]++
+	count := a.failures[id]
+	a.lock.Unlock()
+	if count == a.umountFailures {
+		a.fire(&alert{
+			Type:      "umount",
+			Message:   fmt.Sprintf("layer failed to unmount %d times: %v", count, err),
+			Layer:     id,
+			Value:     uint64(count),
+			Threshold: uint64(a.umountFailures),
+		})
+	}
+}
+
+// gcResult fires an alert if flushing the cache reclaimed less memory than
+// expected.
+func (a *alerter) gcResult(reclaimed uint64) {
+	if a.gcMinReclaim == 0 || reclaimed >= a.gcMinReclaim {
+		return
+	}
+	a.fire(&alert{
+		Type:      "gc",
+		Message:   fmt.Sprintf("cache flush reclaimed only %d bytes", reclaimed),
+		Value:     reclaimed,
+		Threshold: a.gcMinReclaim,
+	})
+}
+
+// fire delivers an alert to the hooks in the background.
+func (a *alerter) fire(al *alert) {
+	al.Time = time.Now().UTC()
+	logrus.Warnf("Alert %s: %s", al.Type, al.Message)
+	data, err := json.Marshal(al)
+	if err != nil {
+		logrus.Errorf("alert: err %v\n", err)
+		return
+	}
+	a.delivered.Add(1)
+	go func() {
+		defer a.delivered.Done()
+		if a.exec != "" {
+			if err := a.runExec(al, data); err != nil {
+				logrus.Errorf("alert: %s err %v\n", a.exec, err)
+			}
+		}
+		if a.webhook != "" {
+			if err := a.post(data); err != nil {
+				logrus.Errorf("alert: %s err %v\n", a.webhook, err)
+			}
+		}
+	}()
+}
+
+// runExec runs the alert script with the alert on standard input and its
+// type and message in the environment.
+func (a *alerter) runExec(al *alert, data []byte) error {
+	cmd := exec.Command(a.exec)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"LCFS_ALERT_TYPE="+al.Type,
+		"LCFS_ALERT_MESSAGE="+al.Message,
+		"LCFS_ALERT_LAYER="+al.Layer)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(alertTimeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("timed out after %v", alertTimeout)
+	}
+}
+
+// post sends the alert to the webhook.
+func (a *alerter) post(data []byte) error {
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
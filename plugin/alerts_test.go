@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// alertReceiver collects alerts posted to a test webhook.
+type alertReceiver struct {
+	lock   sync.Mutex
+	alerts []alert
+}
+
+func (r *alertReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var al alert
+
+	if err := json.NewDecoder(req.Body).Decode(&al); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.lock.Lock()
+	r.alerts = append(r.alerts, al)
+	r.lock.Unlock()
+}
+
+func TestAlertWebhook(t *testing.T) {
+	r := &alertReceiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	a := newAlerter(&Driver{}, &driverOptions{
+		AlertWebhook:        server.URL,
+		AlertUmountFailures: 2,
+		AlertGCMinReclaim:   1024,
+		AlertInterval:       time.Minute,
+	})
+	a.spaceUsed = 90
+	a.checkCapacity(&capacityStats{TotalBytes: 100, UsedBytes: 95})
+	a.checkCapacity(&capacityStats{TotalBytes: 100, UsedBytes: 96})
+	a.checkCapacity(&capacityStats{TotalBytes: 100, UsedBytes: 50})
+	a.checkCapacity(&capacityStats{TotalBytes: 100, UsedBytes: 91})
+	a.opResult("Put", "layer", os.ErrInvalid)
+	a.opResult("Put", "layer", os.ErrInvalid)
+	a.opResult("Put", "layer", os.ErrInvalid)
+	a.opResult("Put", "other", nil)
+	a.opResult("Put", "removed", os.ErrInvalid)
+	a.opResult("Remove", "removed", nil)
+	if len(a.failures) != 1 {
+		t.Errorf("failures of layers removed remembered %v", a.failures)
+	}
+	a.gcResult(4096)
+	a.gcResult(10)
+	a.close()
+
+	types := make(map[string]int)
+	for _, al := range r.alerts {
+		types[al.Type]++
+	}
+	if types["space"] != 2 || types["umount"] != 1 || types["gc"] != 1 {
+		t.Errorf("unexpected alerts %+v", r.alerts)
+	}
+}
+
+func TestAlertExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := path.Join(dir, "alert.sh")
+	out := path.Join(dir, "alert.out")
+	err = ioutil.WriteFile(script,
+		[]byte("#!/bin/sh\necho $LCFS_ALERT_TYPE > "+out+"\ncat >> "+out+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := newAlerter(&Driver{}, &driverOptions{
+		AlertExec:     script,
+		AlertInterval: time.Minute,
+	})
+	a.inodesUsed = 80
+	a.checkCapacity(&capacityStats{TotalInodes: 10, FreeInodes: 1})
+	a.close()
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "inodes\n{") ||
+		!strings.Contains(string(data), `"value":90`) {
+		t.Errorf("unexpected script output %q", data)
+	}
+}
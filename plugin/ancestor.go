@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Storage option creating a writable layer from an ancestor of its parent,
+// skipping the layers in between
+const ancestorStorageOpt = "from"
+
+// isAncestor checks if a layer is the parent of another, or an ancestor of
+// that.  Chains of layers are walked as far as parents are known, and layers
+// with parents not known are assumed to be descendants of the ancestor,
+// unless the file system reports those without any ancestors.
+func (d *Driver) isAncestor(id, ancestor string) bool {
+	l := id
+	seen := make(map[string]bool)
+	for !seen[l] {
+		if l == ancestor {
+			return true
+		}
+		seen[l] = true
+		p := d.known.parentOf(l)
+		if p == "" {
+			break
+		}
+		l = p
+	}
+	depth, err := d.layerDepth(l)
+	return err != nil || depth != 0
+}
+
+// ancestorParent returns the ancestor of parent a layer is created from, for
+// tooling replaying the layers in between differently, like squashing those.
+// The file system tracks changes of the layer relative to the ancestor, which
+// is recorded as its parent, so diffs relative to parent compare files.  The
+// ancestor is recorded like a rollback in the snapshot directory, so this is
+// known also once the plugin starts again.
+func (d *Driver) ancestorParent(cmd int, parent, ancestor string) (string,
+	error) {
+	if cmd != LayerCreateRw {
+		return "", fmt.Errorf("lcfs: storage option %s is for writable "+
+			"layers only", ancestorStorageOpt)
+	}
+	if d.snapshots == nil {
+		return "", fmt.Errorf("lcfs: storage option %s requires snapshot_dir",
+			ancestorStorageOpt)
+	}
+	if err := validateID(ancestor); err != nil {
+		return "", err
+	}
+	if parent == "" || !d.isAncestor(parent, ancestor) {
+		return "", fmt.Errorf("lcfs: layer %s is not an ancestor of %q",
+			ancestor, parent)
+	}
+	return ancestor, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path"
+	"testing"
+)
+
+func TestCreateFromAncestor(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"l0", "", false},
+		fakeLayer{"l1", "l0", false}, fakeLayer{"l2", "l1", false})
+	from := func(ancestor string) map[string]string {
+		return map[string]string{"from": ancestor}
+	}
+
+	// The ancestor is recorded in the snapshot directory only
+	if err := d.CreateReadWrite("rw", "l2", "", from("l0")); err == nil {
+		t.Error("layer created from an ancestor without snapshot_dir")
+	}
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	if err := d.CreateReadWrite("rw", "l2", "", from("l0")); err != nil {
+		t.Fatal(err)
+	}
+	if f.parents["rw"] != "l0" || d.known.parentOf("rw") != "l0" {
+		t.Errorf("layer created from %q", f.parents["rw"])
+	}
+
+	// Diffs relative to the parent compare files, also after a restart
+	if d.isParent("rw", "l2") || !d.rolledBack("rw") {
+		t.Error("diffs relative to the parent not compared")
+	}
+	if err := d.CreateReadWrite("rw2", "l2", "", from("l2")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		id, parent, ancestor string
+	}{
+		{"ro", "l2", "l0"},
+		{"rw3", "l0", "l1"},
+		{"rw3", "", "l0"},
+		{"rw3", "l2", "rw"},
+	} {
+		create := d.CreateReadWrite
+		if c.id == "ro" {
+			create = d.Create
+		}
+		if err := create(c.id, c.parent, "", from(c.ancestor)); err == nil {
+			t.Errorf("layer %s created from %s with parent %q", c.id,
+				c.ancestor, c.parent)
+		}
+	}
+
+	// Parents of layers not created since the plugin started are not known
+	d.known.seed([]string{"l0", "l1", "l2"})
+	if !d.isAncestor("l2", "l0") || d.isAncestor("l0", "l1") {
+		t.Error("ancestors of layers not known misjudged")
+	}
+	if err := d.Remove("rw"); err != nil {
+		t.Fatal(err)
+	}
+	if d.rolledBack("rw") {
+		t.Error("ancestor of layer removed not forgotten")
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Operations recorded in the audit log
+var auditedOps = map[string]bool{
+	"Create":          true,
+	"CreateReadWrite": true,
+	"Remove":          true,
+	"Get":             true,
+	"Put":             true,
+}
+
+// Operation of records anchoring the hash chain of the audit log
+const auditAnchorOp = "Anchor"
+
+// auditRecord is a single entry of the audit log.  Records are numbered and
+// carry the hash of the line of the previous record, so records modified,
+// removed or inserted afterwards break the chain.
+type auditRecord struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	ID      string    `json:"id,omitempty"`
+	Parent  string    `json:"parent,omitempty"`
+	Result  string    `json:"result,omitempty"`
+	Elapsed int64     `json:"elapsed_us"`
+	Prev    string    `json:"prev"`
+}
+
+// auditLog appends records of layer operations to a file as JSON lines.  The
+// file is rotated when it grows beyond maxSize, keeping maxFiles old files.
+// The hash chain continues across rotated files and restarts of the plugin.
+type auditLog struct {
+	lock     sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+
+	seq      uint64
+	prev     string
+	anchored uint64
+	stop     chan struct{}
+}
+
+// openAuditLog opens the audit log for appending new records.
+func openAuditLog(path string, maxSize int64, maxFiles int) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := a.restore(); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Recording layer operations in %s", path)
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = st.Size()
+	return nil
+}
+
+// restore continues the hash chain from the last record of the log, or of
+// the last file rotated if the log is empty.  A last record written partially
+// when the plugin or the host crashed is dropped, as records are written with
+// a newline at once, while other records not valid are corruption.
+func (a *auditLog) restore() error {
+	for _, file := range []string{a.path, a.path + ".1"} {
+		line, err := lastLine(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		var r auditRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("lcfs: invalid last record of audit log %s: %v",
+				file, err)
+		}
+		a.seq = r.Seq
+		a.anchored = r.Seq
+		a.prev = auditHash(line)
+		return nil
+	}
+	return nil
+}
+
+// lastLine returns the last line of a file, without the newline.  Data
+// following the last newline, a line written partially, is truncated.
+func lastLine(file string) ([]byte, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := st.Size()
+	var data []byte
+	for size := int64(4096); ; size *= 2 {
+		if size > end {
+			size = end
+		}
+		data = make([]byte, size)
+		if _, err := f.ReadAt(data, end-size); err != nil {
+			return nil, err
+		}
+		if end == st.Size() {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 && size < end {
+				continue
+			}
+			if i != len(data)-1 {
+				logrus.Warnf("Dropping partial last line of %s", file)
+				end -= size - int64(i) - 1
+				if err := f.Truncate(end); err != nil {
+					return nil, err
+				}
+				data = data[:i+1]
+			}
+		}
+		data = bytes.TrimRight(data, "\n")
+		if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+			return data[i+1:], nil
+		}
+		if size == end {
+			return data, nil
+		}
+	}
+}
+
+// auditHash returns the hash of the line of a record.
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// rotate renames current and old log files, dropping the oldest one, and
+// starts a new log file.  The new file is created before renaming any, so
+// the current file is kept open, and records are appended to it, if it
+// cannot be created.
+func (a *auditLog) rotate() error {
+	next := a.path + ".new"
+	file, err := os.OpenFile(next, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for i := a.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.maxFiles > 0 {
+		err = os.Rename(a.path, a.path+".1")
+	}
+	if err == nil {
+		if err = os.Rename(next, a.path); err != nil && a.maxFiles > 0 {
+			os.Rename(a.path+".1", a.path)
+		}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(next)
+		return err
+	}
+	a.file.Close()
+	a.file = file
+	a.size = 0
+	return nil
+}
+
+// record appends a record to the log, chained to the previous one.
+func (a *auditLog) record(r *auditRecord) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.write(r)
+}
+
+// write appends a record to the log.  The log needs to be locked.
+func (a *auditLog) write(r *auditRecord) bool {
+	if a.file == nil {
+		return false
+	}
+	r.Seq = a.seq + 1
+	r.Prev = a.prev
+	data, err := json.Marshal(r)
+	if err != nil {
+		logrus.Errorf("audit: err %v\n", err)
+		return false
+	}
+	data = append(data, '\n')
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			logrus.Errorf("audit: rotating %s failed, err %v\n", a.path, err)
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		logrus.Errorf("audit: err %v\n", err)
+		return false
+	}
+	a.seq = r.Seq
+	a.prev = auditHash(data[:len(data)-1])
+	return true
+}
+
+// anchor appends a record anchoring the records written since the last
+// anchor, and logs its hash.  Anchors kept elsewhere, as by a log sink
+// forwarding logs off the host, make truncating the log or rewriting it
+// entirely detectable too.
+func (a *auditLog) anchor() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.seq == a.anchored {
+		return
+	}
+	if a.write(&auditRecord{Time: time.Now().UTC(), Op: auditAnchorOp}) {
+		a.anchored = a.seq
+		logrus.Infof("Audit log anchor seq %d hash %s", a.seq, a.prev)
+	}
+}
+
+// startAnchors anchors the log every interval.
+func (a *auditLog) startAnchors(interval time.Duration) {
+	a.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.anchor()
+			case <-stop:
+				return
+			}
+		}
+	}(a.stop)
+}
+
+// close stops recording operations, anchoring the records written last.
+func (a *auditLog) close() error {
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+		a.anchor()
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// auditOp records the result of an operation on a layer if audit log enabled.
+func (d *Driver) auditOp(op, id, parent string, start time.Time, err error) {
+	if d.audit == nil || !auditedOps[op] {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	d.audit.record(&auditRecord{
+		Time:    start.UTC(),
+		Op:      op,
+		ID:      id,
+		Parent:  parent,
+		Result:  result,
+		Elapsed: int64(time.Since(start) / time.Microsecond),
+	})
+}
+
+// auditChain reports the records of the audit log verified, and the last of
+// those.
+type auditChain struct {
+	Records int    `json:"records"`
+	Seq     uint64 `json:"seq"`
+	Head    string `json:"head"`
+	Error   string `json:"error,omitempty"`
+}
+
+// verify checks the hash chain of the log and the files rotated, from the
+// oldest.  The first record of the oldest file is trusted, as the files
+// before were dropped.
+func (a *auditLog) verify() (*auditChain, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c := &auditChain{}
+	for i := a.maxFiles; i >= 0; i-- {
+		file := a.path
+		if i > 0 {
+			file = fmt.Sprintf("%s.%d", a.path, i)
+		}
+		err := c.verifyFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// verifyFile checks the records of a file continue the chain.
+func (c *auditChain) verifyFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("lcfs: audit log %s:%d: invalid record: %v",
+				file, n, err)
+		}
+		if c.Records > 0 && (r.Seq != c.Seq+1 || r.Prev != c.Head) {
+			return fmt.Errorf("lcfs: audit log %s:%d: record %d does not "+
+				"follow record %d", file, n, r.Seq, c.Seq)
+		}
+		c.Records++
+		c.Seq = r.Seq
+		c.Head = auditHash(scanner.Bytes())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func readAuditLog(t *testing.T, file string) []auditRecord {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "audit.log")
+	a, err := openAuditLog(file, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Driver{audit: a}
+	d.auditOp("Create", "layer", "parent", time.Now(), nil)
+	d.auditOp("Exists", "layer", "", time.Now(), nil)
+	d.auditOp("Remove", "layer", "", time.Now(), errors.New("device or resource busy"))
+	a.close()
+
+	records := readAuditLog(t, file)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %+v", records)
+	}
+	if records[0].Op != "Create" || records[0].Parent != "parent" || records[0].Result != "ok" {
+		t.Errorf("unexpected record %+v", records[0])
+	}
+	if records[1].Op != "Remove" || records[1].Result != "device or resource busy" {
+		t.Errorf("unexpected record %+v", records[1])
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "audit.log")
+	a, err := openAuditLog(file, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Driver{audit: a}
+	for i := 0; i < 10; i++ {
+		d.auditOp("Get", "layer", "", time.Now(), nil)
+	}
+	a.close()
+
+	for _, f := range []string{file, file + ".1", file + ".2"} {
+		if st, err := os.Stat(f); err != nil || st.Size() > 200 {
+			t.Errorf("unexpected log file %s: %v", f, err)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files to be kept")
+	}
+
+	// Records are kept in the current file if a new one cannot be created
+	if a, err = openAuditLog(file, 200, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(file+".new", 0700); err != nil {
+		t.Fatal(err)
+	}
+	d.audit = a
+	before := len(readAuditLog(t, file))
+	for i := 0; i < 3; i++ {
+		d.auditOp("Get", "layer", "", time.Now(), nil)
+	}
+	a.close()
+	if n := len(readAuditLog(t, file)); n != before+3 {
+		t.Errorf("%d records of 3 written while rotating failed", n-before)
+	}
+}
+
+func TestAuditLogChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "audit.log")
+	a, err := openAuditLog(file, 1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.startAnchors(time.Hour)
+	d := &Driver{audit: a}
+	for i := 0; i < 10; i++ {
+		d.auditOp("Get", "layer", "", time.Now(), nil)
+	}
+	a.close()
+
+	// The chain continues after a restart
+	a, err = openAuditLog(file, 1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.audit = a
+	d.auditOp("Put", "layer", "", time.Now(), nil)
+	c, err := a.verify()
+	if err != nil || c.Records != 12 || c.Seq != 12 || c.Head != a.prev {
+		t.Fatalf("unexpected chain %+v, err %v", c, err)
+	}
+	records := append(readAuditLog(t, file+".1"), readAuditLog(t, file)...)
+	if r := records[len(records)-2]; r.Op != auditAnchorOp || r.Seq != 11 {
+		t.Errorf("log not anchored when closed %+v", r)
+	}
+	a.close()
+
+	// A last record written partially is dropped, not others not valid
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":13,"op":"G`)
+	f.Close()
+	a, err = openAuditLog(file, 1000, 3)
+	if err != nil {
+		t.Fatalf("log with a partial last record not opened: %v", err)
+	}
+	d.audit = a
+	d.auditOp("Put", "layer", "", time.Now(), nil)
+	c, err = a.verify()
+	if err != nil || c.Records != 13 || c.Seq != 13 {
+		t.Fatalf("unexpected chain %+v, err %v", c, err)
+	}
+	a.close()
+	f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("garbage\n")
+	f.Close()
+	if _, err := openAuditLog(file, 1000, 3); err == nil {
+		t.Errorf("log with a record not valid opened")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.TrimSuffix(data, []byte("garbage\n"))
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records modified are detected
+	data, err = ioutil.ReadFile(file + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte(`"op":"Get"`), []byte(`"op":"Put"`), 1)
+	if err := ioutil.WriteFile(file+".1", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.verify(); err == nil {
+		t.Errorf("record modified not detected")
+	}
+}
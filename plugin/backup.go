@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Version of manifests of backups written
+const backupManifestVersion = 1
+
+// Suffixes of files of backups, the manifest and the send stream
+const (
+	backupManifestSuffix = ".json"
+	backupStreamSuffix   = ".stream"
+)
+
+// backupManifest describes a backup of a snapshot, a send stream of the
+// snapshot stored with the manifest, holding the changes of the snapshot
+// relative to the snapshot of the backup it is incremental to, or relative to
+// the parent of the layer of the snapshot for a full backup.  A backup of a
+// layer has no snapshot, its stream holds the changes of the layer relative to
+// its parent, like a diff pushed.
+type backupManifest struct {
+	Version  int             `json:"version"`
+	ID       string          `json:"id"`
+	Layer    string          `json:"layer"`
+	Snapshot *snapshotRecord `json:"snapshot,omitempty"`
+
+	// Parent of the layer of a backup of a layer, and if it was writable
+	Parent    string `json:"parent,omitempty"`
+	ReadWrite bool   `json:"read_write,omitempty"`
+
+	// Backup this backup is incremental to, empty for a full backup
+	Since string `json:"since,omitempty"`
+
+	Created time.Time `json:"created"`
+
+	// Size and SHA-256 digest of the stream
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupRequest describes a backup to be taken of a snapshot, incremental to
+// the latest backup of an older snapshot of the same layer still present,
+// unless full is set, or of a layer not written to, like a layer of an image,
+// relative to its parent, looked up if not given and known.
+type backupRequest struct {
+	Snapshot string `json:"snapshot,omitempty"`
+	Full     bool   `json:"full,omitempty"`
+
+	Layer     string `json:"layer,omitempty"`
+	Parent    string `json:"parent,omitempty"`
+	ReadWrite bool   `json:"read_write,omitempty"`
+}
+
+// validate checks a request names either a snapshot or a layer.
+func (r *backupRequest) validate() error {
+	if (r.Snapshot == "") == (r.Layer == "") {
+		return fmt.Errorf("lcfs: backup of a snapshot or of a layer expected")
+	}
+	if r.Layer == "" {
+		if r.Parent != "" || r.ReadWrite {
+			return fmt.Errorf("lcfs: parent and read_write only apply to " +
+				"backups of layers")
+		}
+		return nil
+	}
+	if r.Full {
+		return fmt.Errorf("lcfs: backups of layers are always full")
+	}
+	return validateLayer(r.Layer, r.Parent)
+}
+
+// backupTarget stores files of backups by name.
+type backupTarget interface {
+	// put stores a file, replacing it once all of r is read
+	put(name string, r io.Reader) error
+
+	open(name string) (io.ReadCloser, error)
+	list() ([]string, error)
+	remove(name string) error
+}
+
+// dirTarget stores files of backups in a local directory.
+type dirTarget struct {
+	dir string
+}
+
+// newDirTarget returns a target storing backups in dir, created if missing.
+func newDirTarget(dir string) (*dirTarget, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &dirTarget{dir}, nil
+}
+
+func (t *dirTarget) put(name string, r io.Reader) error {
+	tmp := path.Join(t.dir, "."+name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path.Join(t.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (t *dirTarget) open(name string) (io.ReadCloser, error) {
+	return os.Open(path.Join(t.dir, name))
+}
+
+func (t *dirTarget) list() ([]string, error) {
+	files, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), ".") {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (t *dirTarget) remove(name string) error {
+	err := os.Remove(path.Join(t.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// backupNotFoundError returns the error of a backup not found.
+func backupNotFoundError(id string) error {
+	return &layerError{syscall.ENOENT, os.ErrNotExist,
+		fmt.Sprintf("lcfs: backup %s not found", id)}
+}
+
+// backupStore keeps backups of snapshots in a target, a manifest and a stream
+// per backup.
+type backupStore struct {
+	target backupTarget
+
+	// Serializes taking and removing backups, so backups are not removed
+	// while others are taken incremental to those
+	lock sync.Mutex
+}
+
+// manifest reads the manifest of a backup.
+func (b *backupStore) manifest(id string) (*backupManifest, error) {
+	if validateID(id) != nil {
+		return nil, backupNotFoundError(id)
+	}
+	r, err := b.target.open(id + backupManifestSuffix)
+	if os.IsNotExist(err) {
+		return nil, backupNotFoundError(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var m backupManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("lcfs: invalid manifest of backup %s: %v", id,
+			err)
+	}
+	if m.Version != backupManifestVersion || m.ID != id || (m.Snapshot == nil &&
+		(m.Since != "" || validateLayer(m.Layer, m.Parent) != nil)) {
+		return nil, fmt.Errorf("lcfs: unsupported manifest of backup %s", id)
+	}
+	return &m, nil
+}
+
+// list returns the backups of a layer, or all backups if layer is empty,
+// oldest first.  Manifests not read are skipped.
+func (b *backupStore) list(layer string) ([]*backupManifest, error) {
+	names, err := b.target.list()
+	if err != nil {
+		return nil, err
+	}
+	var manifests []*backupManifest
+	for _, name := range names {
+		if !strings.HasSuffix(name, backupManifestSuffix) {
+			continue
+		}
+		m, err := b.manifest(strings.TrimSuffix(name, backupManifestSuffix))
+		if err != nil {
+			logrus.Warnf("Ignoring backup %s, err %v", name, err)
+			continue
+		}
+		if layer == "" || m.Layer == layer {
+			manifests = append(manifests, m)
+		}
+	}
+	sort.Slice(manifests, func(i, j int) bool {
+		if manifests[i].Created.Equal(manifests[j].Created) {
+			return manifests[i].ID < manifests[j].ID
+		}
+		return manifests[i].Created.Before(manifests[j].Created)
+	})
+	return manifests, nil
+}
+
+// chain returns the backups needed to restore a backup, the full backup first.
+func (b *backupStore) chain(id string) ([]*backupManifest, error) {
+	var chain []*backupManifest
+	seen := make(map[string]bool)
+	for id != "" {
+		if seen[id] {
+			return nil, fmt.Errorf("lcfs: backup %s is incremental to itself", id)
+		}
+		seen[id] = true
+		m, err := b.manifest(id)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]*backupManifest{m}, chain...)
+		id = m.Since
+	}
+	return chain, nil
+}
+
+// digestReader hashes and counts data read.
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	h := sha256.New()
+	return &digestReader{r: io.TeeReader(r, h), hash: h}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// check checks data read matches the size and digest of a backup.
+func (r *digestReader) check(m *backupManifest) error {
+	if r.size != m.Size || hex.EncodeToString(r.hash.Sum(nil)) != m.SHA256 {
+		return fmt.Errorf("lcfs: stream of backup %s is corrupted", m.ID)
+	}
+	return nil
+}
+
+// backupsEnabled returns the store of backups, failing if not configured.
+func (d *Driver) backupsEnabled() (*backupStore, error) {
+	if d.backups == nil {
+		return nil, fmt.Errorf("lcfs: backups not enabled, set backup_dir or " +
+			"backup_s3_url")
+	}
+	return d.backups, nil
+}
+
+// Backup stores a backup of a snapshot, a send stream of the snapshot and a
+// manifest describing it.  Backups are incremental to the latest backup of an
+// older snapshot of the same layer, holding only files changed since, as long
+// as that snapshot is still present to find the changes, and full otherwise
+// or if requested.
+func (d *Driver) Backup(req *backupRequest) (_ *backupManifest, err error) {
+	logrus.Debugf("Backup - snapshot %s layer %s full %v", req.Snapshot,
+		req.Layer, req.Full)
+	defer d.trackOp("Backup", req.Snapshot+req.Layer, req.Parent)(&err)
+	b, err := d.backupsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if req.Layer != "" {
+		return d.backupLayer(b, req)
+	}
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	rec, err := s.resolve(req.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id, err := newLayerID()
+	if err != nil {
+		return nil, err
+	}
+	m := &backupManifest{Version: backupManifestVersion, ID: id,
+		Layer: rec.Layer, Snapshot: rec, Created: time.Now().UTC()}
+	since := ""
+	if !req.Full {
+		prev, err := b.list(rec.Layer)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(prev) - 1; i >= 0; i-- {
+			p := prev[i].Snapshot
+			if p == nil || !p.Created.Before(rec.Created) {
+				continue
+			}
+			if r, err := s.resolve(p.ID); err == nil && r.ID == p.ID {
+				m.Since, since = prev[i].ID, p.ID
+				break
+			}
+		}
+	}
+	err = b.store(m, func(w io.Writer) error {
+		return d.Send(w, rec.ID, since)
+	})
+	if err != nil {
+		return nil, err
+	}
+	kind := "full"
+	if m.Since != "" {
+		kind = "incremental"
+	}
+	logrus.Infof("Backup %s of snapshot %s of layer %s stored, %s, %d bytes",
+		id, rec.Name, rec.Layer, kind, m.Size)
+	return m, nil
+}
+
+// backupLayer stores a backup of a layer, the changes of the layer relative to
+// its parent.  Layers mounted writable are refused, as files may change while
+// read, those are backed up as snapshots instead.
+func (d *Driver) backupLayer(b *backupStore, req *backupRequest) (*backupManifest, error) {
+	parent := req.Parent
+	if parent == "" {
+		parent = d.known.parentOf(req.Layer)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	defer d.layers.lock(req.Layer)()
+	for _, l := range []string{req.Layer, parent} {
+		if l != "" && !d.Exists(l) {
+			return nil, notFoundError(l)
+		}
+	}
+	if d.mounts.active(req.Layer) && !d.mounts.isReadOnly(req.Layer) {
+		return nil, mountedError(req.Layer)
+	}
+	id, err := newLayerID()
+	if err != nil {
+		return nil, err
+	}
+	m := &backupManifest{Version: backupManifestVersion, ID: id,
+		Layer: req.Layer, Parent: parent, ReadWrite: req.ReadWrite,
+		Created: time.Now().UTC()}
+	err = b.store(m, func(w io.Writer) error {
+		return sendChanges(d, w, req.Layer, parent)
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Backup %s of layer %s relative to %q stored, %d bytes", id,
+		req.Layer, parent, m.Size)
+	return m, nil
+}
+
+// store stores the stream written by send as the stream of a backup, then the
+// manifest of the backup with the size and digest of the stream.
+func (b *backupStore) store(m *backupManifest, send func(w io.Writer) error) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(send(pw))
+	}()
+	r := newDigestReader(pr)
+	err := b.target.put(m.ID+backupStreamSuffix, r)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+	m.Size, m.SHA256 = r.size, hex.EncodeToString(r.hash.Sum(nil))
+	data, err := json.Marshal(m)
+	if err == nil {
+		err = b.target.put(m.ID+backupManifestSuffix, bytes.NewReader(data))
+	}
+	if err != nil {
+		b.target.remove(m.ID + backupStreamSuffix)
+	}
+	return err
+}
+
+// Backups lists backups of a layer, or all backups, oldest first.
+func (d *Driver) Backups(layer string) ([]*backupManifest, error) {
+	b, err := d.backupsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	return b.list(layer)
+}
+
+// LookupBackup returns the manifest of a backup.
+func (d *Driver) LookupBackup(id string) (*backupManifest, error) {
+	b, err := d.backupsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	return b.manifest(id)
+}
+
+// verifyStream checks the stream of a backup matches its manifest, and that
+// it is a send stream of the snapshot of the backup relative to the snapshot
+// of the backup it is incremental to.
+func (b *backupStore) verifyStream(m *backupManifest, base string) error {
+	f, err := b.target.open(m.ID + backupStreamSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := newDigestReader(f)
+	if m.Snapshot == nil {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+		return r.check(m)
+	}
+	hdr, err := readSendHeader(bufio.NewReader(r))
+	if err != nil {
+		return fmt.Errorf("lcfs: backup %s: %v", m.ID, err)
+	}
+	if hdr.Snapshot.ID != m.Snapshot.ID || (m.Since != "" && hdr.Base != base) {
+		return fmt.Errorf("lcfs: stream of backup %s does not match its "+
+			"manifest", m.ID)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	return r.check(m)
+}
+
+// verifyChain checks the streams of the backups restoring a backup.
+func (b *backupStore) verifyChain(chain []*backupManifest) error {
+	base := ""
+	for _, m := range chain {
+		if err := b.verifyStream(m, base); err != nil {
+			return err
+		}
+		if m.Snapshot != nil {
+			base = m.Snapshot.ID
+		}
+	}
+	return nil
+}
+
+// VerifyBackup checks the streams of a backup and of the backups it is
+// incremental to are complete and match their manifests, returning those,
+// the full backup first.
+func (d *Driver) VerifyBackup(id string) (_ []*backupManifest, err error) {
+	logrus.Debugf("VerifyBackup - %s", id)
+	defer d.trackOp("VerifyBackup", id, "")(&err)
+	b, err := d.backupsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := b.chain(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.verifyChain(chain); err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
+
+// RestoreBackup receives the snapshot of a backup, with the snapshots of the
+// backups it is incremental to not present, after verifying the streams of
+// all those.  Base replaces the parent of the layer of the snapshot of the
+// full backup, like for receiving a snapshot.  The snapshot restored is
+// returned, for rolling back a layer to it or creating layers from it.
+func (d *Driver) RestoreBackup(id, base string) (_ *snapshotRecord, err error) {
+	logrus.Debugf("RestoreBackup - %s base %s", id, base)
+	defer d.trackOp("RestoreBackup", id, base)(&err)
+	b, err := d.backupsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	chain, err := b.chain(id)
+	if err != nil {
+		return nil, err
+	}
+	if chain[0].Snapshot == nil {
+		return nil, fmt.Errorf("lcfs: backup %s is of layer %s, not of a "+
+			"snapshot, restore it with rebuild", id, chain[0].Layer)
+	}
+	if err := b.verifyChain(chain); err != nil {
+		return nil, err
+	}
+	rec, err := d.receiveChain(b, s, chain, base)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Restored backup %s as snapshot %s", id, rec.Name)
+	return rec, nil
+}
+
+// receiveChain receives the snapshots of backups verified not present, the
+// full backup first, returning the snapshot of the last.
+func (d *Driver) receiveChain(b *backupStore, s *snapshotStore,
+	chain []*backupManifest, base string) (*snapshotRecord, error) {
+	var rec *snapshotRecord
+	for i, m := range chain {
+		if r, err := s.resolve(m.Snapshot.ID); err == nil && r.ID == m.Snapshot.ID {
+			rec = r
+			continue
+		}
+		if i > 0 {
+			base = ""
+		}
+		var err error
+		if rec, err = d.restoreStream(b, m, base); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// restoreStream receives the stream of a backup.
+func (d *Driver) restoreStream(b *backupStore, m *backupManifest,
+	base string) (*snapshotRecord, error) {
+	f, err := b.target.open(m.ID + backupStreamSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return d.Receive(f, base)
+}
+
+// RemoveBackup removes a backup no other backup is incremental to.
+func (d *Driver) RemoveBackup(id string) (err error) {
+	logrus.Debugf("RemoveBackup - %s", id)
+	defer d.trackOp("RemoveBackup", id, "")(&err)
+	b, err := d.backupsEnabled()
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, err := b.manifest(id); err != nil {
+		return err
+	}
+	all, err := b.list("")
+	if err != nil {
+		return err
+	}
+	for _, m := range all {
+		if m.Since == id {
+			return &layerError{syscall.EBUSY, errLayerBusy,
+				fmt.Sprintf("lcfs: backup %s is needed by backup %s", id, m.ID)}
+		}
+	}
+	if err := b.target.remove(id + backupManifestSuffix); err != nil {
+		return err
+	}
+	return b.target.remove(id + backupStreamSuffix)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	target, err := newDirTarget(path.Join(f.home, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backups = &backupStore{target: target}
+	received := make(map[string]string)
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	sendChanges = func(d *Driver, w io.Writer, id, base string) error {
+		_, err := fmt.Fprintf(w, "changes of %s relative to %s", id, base)
+		return err
+	}
+	receiveChanges = func(d *Driver, id, base string, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		received[id] = string(data)
+		return err
+	}
+	defer func() {
+		copyChanges = (*Driver).copyChanges
+		sendChanges = (*Driver).writeCompressedDiff
+		receiveChanges = (*Driver).receiveChanges
+	}()
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	var recs []*snapshotRecord
+	for _, name := range []string{"monday", "tuesday"} {
+		rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+
+	full, err := d.Backup(&backupRequest{Snapshot: "monday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	incremental, err := d.Backup(&backupRequest{Snapshot: "tuesday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.Since != "" || incremental.Since != full.ID || full.Layer != "rw" {
+		t.Errorf("unexpected backups %+v %+v", full, incremental)
+	}
+	other, err := d.Backup(&backupRequest{Snapshot: "tuesday", Full: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Since != "" {
+		t.Errorf("full backup incremental to %s", other.Since)
+	}
+	if manifests, _ := d.Backups("rw"); len(manifests) != 3 {
+		t.Errorf("unexpected backups of layer %v", manifests)
+	}
+	chain, err := d.VerifyBackup(incremental.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].ID != full.ID {
+		t.Errorf("unexpected backups verified %v", chain)
+	}
+	if err := d.RemoveBackup(full.ID); !errors.Is(err, errLayerBusy) {
+		t.Errorf("backup needed by another removed, err %v", err)
+	}
+
+	// Snapshots removed are restored with the snapshots those need
+	for _, rec := range recs {
+		if err := d.RemoveSnapshot(rec.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, err := d.RestoreBackup(incremental.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != recs[1].ID || f.parents[rec.ID] != recs[0].ID ||
+		f.parents[recs[0].ID] != "base" {
+		t.Errorf("unexpected snapshot restored %+v", rec)
+	}
+	expected := fmt.Sprintf("changes of %s relative to %s", recs[1].ID, recs[0].ID)
+	if received[rec.ID] != expected {
+		t.Errorf("received %q, expected %q", received[rec.ID], expected)
+	}
+	if rec, err := d.RestoreBackup(incremental.ID, ""); err != nil ||
+		rec.ID != recs[1].ID {
+		t.Errorf("snapshot present not found restoring again, err %v", err)
+	}
+
+	// Streams not matching manifests are refused
+	err = ioutil.WriteFile(path.Join(f.home, "backups",
+		other.ID+backupStreamSuffix), []byte(sendStreamMagic+"{}\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.VerifyBackup(other.ID); err == nil {
+		t.Error("backup corrupted verified")
+	}
+	for _, id := range []string{incremental.ID, full.ID} {
+		if err := d.RemoveBackup(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.LookupBackup(full.ID); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("backup removed found, err %v", err)
+	}
+}
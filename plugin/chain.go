@@ -0,0 +1,92 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// Suffix of the id of a layer with all files of a layer, created to flatten
+// chains of layers too deep
+const flattenSuffix = "-flat"
+
+// layerDepth returns the number of ancestors of a layer, or -1 if the file
+// system does not report it.
+func (d *Driver) layerDepth(id string) (int, error) {
+	_, depth, err := d.layerStats(id)
+	if err != nil {
+		return -1, err
+	}
+	return depth, nil
+}
+
+// chainParent returns the layer a layer is created from on the file system
+// instead of parent.  Lookups of files of a layer walk all its ancestors, so
+// chains deeper than configured are warned about, and writable layers are
+// created from a layer with all files of parent, created once for each
+// parent, if flattening is enabled.  Diffs of the layer stay relative to
+// parent, as the files of both are the same.
+func (d *Driver) chainParent(cmd int, parent string) (string, error) {
+	if d.opts == nil || parent == "" ||
+		(d.opts.ChainDepthWarning == 0 && d.opts.ChainFlattenDepth == 0) {
+		return parent, nil
+	}
+	depth, err := d.layerDepth(parent)
+	if err != nil || depth < 0 {
+		logrus.Debugf("Depth of layer %s not known, err %v", parent, err)
+		return parent, nil
+	}
+	depth++
+	if d.opts.ChainDepthWarning > 0 && depth > d.opts.ChainDepthWarning {
+		logrus.Warnf("Layer created from %s with %d ancestors, deeper than %d",
+			parent, depth, d.opts.ChainDepthWarning)
+	}
+	if cmd != LayerCreateRw || d.opts.ChainFlattenDepth == 0 ||
+		depth <= d.opts.ChainFlattenDepth {
+		return parent, nil
+	}
+	flat, err := d.flatten(parent)
+	if err != nil {
+		return "", err
+	}
+	return flat, nil
+}
+
+// flatten creates a layer from no parent with all files of a layer, or
+// returns the one created before.  The layer is removed with the layer
+// flattened.
+func (d *Driver) flatten(id string) (string, error) {
+	flat := id + flattenSuffix
+	if err := validateID(flat); err != nil {
+		return "", err
+	}
+	unlock := d.layers.lock(flat)
+	if d.Exists(flat) {
+		unlock()
+		return flat, nil
+	}
+	err := d.create(LayerCreate, flat, "", nil)
+	if err != nil {
+		unlock()
+		return "", err
+	}
+	err = squashChanges(d, flat, id, "")
+	unlock()
+	if err != nil {
+		if rerr := d.Remove(flat); rerr != nil {
+			logrus.Errorf("Removing layer %s, err %v\n", flat, rerr)
+		}
+		return "", err
+	}
+	logrus.Infof("Flattened layer %s as %s", id, flat)
+	return flat, nil
+}
+
+// removeFlattened removes the layer created to flatten a layer removed.
+func (d *Driver) removeFlattened(id string) {
+	flat := id + flattenSuffix
+	if validateID(flat) != nil || !d.Exists(flat) {
+		return
+	}
+	if err := d.Remove(flat); err != nil {
+		logrus.Errorf("Removing layer %s, err %v\n", flat, err)
+	}
+}
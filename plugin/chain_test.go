@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChainDepth(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	var squashed []string
+	squashChanges = func(d *Driver, id, layer, parent string) error {
+		squashed = append(squashed, layer)
+		return nil
+	}
+	defer func() { squashChanges = (*Driver).squashChanges }()
+	createLayers(t, d, fakeLayer{"l0", "", false},
+		fakeLayer{"l1", "l0", false}, fakeLayer{"l2", "l1", false},
+		fakeLayer{"l3", "l2", false})
+	if m, _ := d.GetMetadata("l3"); m["ChainDepth"] != "3" {
+		t.Errorf("unexpected metadata %v", m)
+	}
+
+	// Depth not known with names covering it
+	long := strings.Repeat("x", layerIOStatsSize)
+	if err := d.Create(long, "l3", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if depth, err := d.layerDepth(long); err != nil || depth != -1 {
+		t.Errorf("depth %d of layer with a long name, err %v", depth, err)
+	}
+
+	// Writable layers are flattened past the depth configured only
+	d.opts = &driverOptions{ChainFlattenDepth: 3}
+	createLayers(t, d, fakeLayer{"rw1", "l2", true},
+		fakeLayer{"ro", "l3", false})
+	if f.parents["rw1"] != "l2" || f.parents["ro"] != "l3" || squashed != nil {
+		t.Errorf("layers flattened, %v", squashed)
+	}
+	for _, id := range []string{"rw2", "rw3"} {
+		if err := d.CreateReadWrite(id, "l3", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		if f.parents[id] != "l3"+flattenSuffix {
+			t.Errorf("layer %s created from %q", id, f.parents[id])
+		}
+	}
+	if !reflect.DeepEqual(squashed, []string{"l3"}) {
+		t.Errorf("unexpected layers flattened %v", squashed)
+	}
+	if p := d.known.parentOf("rw2"); p != "l3" {
+		t.Errorf("parent %q of layer flattened known", p)
+	}
+
+	// Layers flattened are removed with the layer
+	for _, id := range []string{"rw2", "rw3", "ro", long, "l3"} {
+		if err := d.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := f.parents["l3"+flattenSuffix]; ok {
+		t.Error("layer flattened not removed")
+	}
+}
@@ -0,0 +1,1052 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// Layer root of the file system on the host, where the CLI creates layers
+// running the driver itself
+const cliLayerRoot = "/lcfs/lcfs"
+
+// Commands the CLI runs with a driver of its own instead of through the admin
+// API, as those run while Docker and the plugin are stopped
+var cliLocalCommands = map[string]bool{"migrate": true}
+
+// Environment variables setting the socket and token file of the admin API
+// the CLI connects to, unless given as flags
+const (
+	cliSocketEnv    = "LCFS_ADMIN_SOCKET"
+	cliTokenFileEnv = "LCFS_ADMIN_TOKEN_FILE"
+)
+
+// Time a request of the CLI is given to complete
+const cliTimeout = 10 * time.Minute
+
+// adminClient issues requests to the admin API on a unix socket.
+type adminClient struct {
+	client *http.Client
+	token  []byte
+}
+
+// newAdminClient returns a client of the admin API served on socket,
+// presenting the token in tokenFile.
+func newAdminClient(socket, tokenFile string) (*adminClient, error) {
+	if socket == "" || tokenFile == "" {
+		return nil, fmt.Errorf("lcfs: admin socket and token file required, "+
+			"set -socket and -token-file or %s and %s", cliSocketEnv,
+			cliTokenFileEnv)
+	}
+	token, err := readToken(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	return &adminClient{
+		client: &http.Client{
+			Transport: &http.Transport{DialContext: dial},
+			Timeout:   cliTimeout,
+		},
+		token: token,
+	}, nil
+}
+
+// do issues a request with in encoded as the body if not nil, and decodes
+// the response into out if not nil.  Errors returned by the API are returned
+// as those.
+func (c *adminClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+	resp, err := c.send(method, path, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream issues a request with body streamed, if not nil, copying the
+// response to w.  Streams are not limited in time.
+func (c *adminClient) stream(method, path string, body io.Reader,
+	w io.Writer) error {
+	resp, err := c.send(method, path, body, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// send issues a request, returning the response if successful.
+func (c *adminClient) send(method, path string, body io.Reader,
+	contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://lcfs"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(c.token))
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	client := c.client
+	if contentType == "application/octet-stream" {
+		client = &http.Client{Transport: c.client.Transport}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		var e struct{ Err string }
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Err == "" {
+			return nil, fmt.Errorf("lcfs: %s %s: %s", method, path, resp.Status)
+		}
+		return nil, fmt.Errorf("%s", e.Err)
+	}
+	return resp, nil
+}
+
+// cliCommand is a command of the CLI, run with the arguments following it.
+type cliCommand struct {
+	name  string
+	usage string
+	desc  string
+	run   func(c *cli, args []string) error
+}
+
+// cli runs a command with a client of the admin API, reading stdin and
+// printing to stdout and stderr.
+type cli struct {
+	client *adminClient
+	cmd    *cliCommand
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// Commands of the CLI, by name of one or two words
+var cliCommands = []cliCommand{
+	{"snapshot create", "-name <name> [-tag <tag>]... [-description <text>] " +
+		"[-parent <id>] [-online] <layer>", "Take a snapshot of a layer",
+		(*cli).snapshotCreate},
+	{"snapshot list", "[-layer <id>] [-tag <tag>] [-json]",
+		"List snapshots, of a layer or with a tag", (*cli).snapshotList},
+	{"snapshot show", "<id|name|tag>", "Show a snapshot", (*cli).snapshotShow},
+	{"snapshot remove", "<id|name|tag>", "Remove a snapshot and its layer",
+		(*cli).snapshotRemove},
+	{"snapshot promote", "<id|name|tag>",
+		"Detach a snapshot from the parent of its layer",
+		(*cli).snapshotPromote},
+	{"group create", "-name <group> [-description <text>] [-online] " +
+		"<layer>...", "Take snapshots of layers at the same point in time",
+		(*cli).groupCreate},
+	{"group show", "[-json] <group>",
+		"Show the snapshots of a group", (*cli).groupShow},
+	{"group remove", "<group>",
+		"Remove the snapshots of a group and their layers",
+		(*cli).groupRemove},
+	{"group rollback", "<group>",
+		"Revert the layers of a group not mounted to its snapshots",
+		(*cli).groupRollback},
+	{"snapshot mount", "<layer> <id|name|tag> <dir>",
+		"Mount a snapshot of a layer read-only at a directory",
+		(*cli).snapshotMount},
+	{"snapshot unmount", "<dir>", "Unmount the snapshot mounted at a directory",
+		(*cli).snapshotUnmount},
+	{"snapshot mounts", "", "List the snapshots mounted",
+		(*cli).snapshotMounts},
+	{"backup create", "[-full] <id|name|tag>",
+		"Store a backup of a snapshot", (*cli).backupCreate},
+	{"backup list", "[-layer <id>] [-json]",
+		"List backups, of a layer if given", (*cli).backupList},
+	{"backup layer", "[-parent <id>] [-rw] <layer>",
+		"Store a backup of a layer not written to", (*cli).backupLayer},
+	{"backup verify", "<backup>",
+		"Check the streams of a backup and those it needs",
+		(*cli).backupVerify},
+	{"backup restore", "[-base <id>] <backup>",
+		"Receive the snapshot of a backup", (*cli).backupRestore},
+	{"backup remove", "<backup>", "Remove a backup no other backup needs",
+		(*cli).backupRemove},
+	{"backup rebuild", "[-json]",
+		"Create the layers backed up not present from backups",
+		(*cli).backupRebuild},
+	{"label", "[-clear] <layer> [<key>=<value>]...",
+		"Show or replace labels of a layer matched by snapshot policies",
+		(*cli).label},
+	{"send", "[-since <id|name|tag>] <id|name|tag>",
+		"Write a stream of a snapshot to stdout", (*cli).send},
+	{"receive", "[-base <id>]",
+		"Receive a stream of a snapshot from stdin", (*cli).receive},
+	{"rollback", "<layer> <id|name|tag>",
+		"Revert a layer not mounted to a snapshot", (*cli).rollback},
+	{"restore", "<layer> <id|name|tag> <path>...",
+		"Copy files of a snapshot back to its layer", (*cli).restore},
+	{"export", "[-format raw|qcow2] [-size <size>] [-label <label>] <layer> " +
+		"<file>", "Write a layer to a disk image for a VM", (*cli).exportImage},
+	{"export-oci", "[-config <file>] [-ref <name>] <dir> <layer>...",
+		"Write an image to an OCI image layout, base layer first",
+		(*cli).exportOCI},
+	{"diffstat", "[-parent <id>] <layer>",
+		"Count files changed by a layer relative to its parent",
+		(*cli).diffStat},
+	{"pin", "<layer>", "Refuse removing a layer until unpinned", (*cli).pin},
+	{"unpin", "<layer>", "Allow removing a layer pinned again", (*cli).unpin},
+	{"freeze", "<layer>", "Stop all writes to a layer until thawed",
+		(*cli).freeze},
+	{"thaw", "<layer>", "Resume writes to a layer frozen", (*cli).thaw},
+	{"squash", "[-parent <id>] <layer>...",
+		"Merge a chain of layers, first to last, into a new layer",
+		(*cli).squash},
+	{"fanout", "[-opt <key>=<value>]... <layer> <count>",
+		"Create writable layers from a layer in one call", (*cli).fanOut},
+	{"clone", "-to <home> [-parent <id>] [-writable] <layer>...",
+		"Copy a chain of layers to another lcfs file system", (*cli).clone},
+	{"migrate", "[-from overlay2|devicemapper] [-root <dir>] [-layerdb <dir>] " +
+		"[-pool <name>] [-home <dir>] [-opt <key>=<value>]...",
+		"Create the layers of a graph with the same ids",
+		(*cli).migrate},
+}
+
+// cliUsage prints usage of the CLI.
+func cliUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: lcfs_plugin [-socket <path>] [-token-file <file>] "+
+		"<command> [<args>]\n\nCommands:\n")
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(w, "  %-20s%s\n", cmd.name, cmd.desc)
+	}
+}
+
+// findCommand returns the command named by the first words of args, and the
+// arguments following it.
+func findCommand(args []string) (*cliCommand, []string) {
+	for i := range cliCommands {
+		words := strings.Fields(cliCommands[i].name)
+		if len(args) < len(words) {
+			continue
+		}
+		if strings.Join(args[:len(words)], " ") == cliCommands[i].name {
+			return &cliCommands[i], args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+// runCLI runs a command of the CLI managing the driver through the admin API,
+// returning the exit status.
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lcfs_plugin", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { cliUsage(stderr) }
+	socket := flags.String("socket", os.Getenv(cliSocketEnv),
+		"unix socket of the admin API")
+	tokenFile := flags.String("token-file", os.Getenv(cliTokenFileEnv),
+		"file containing the admin API token")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	cmd, cmdArgs := findCommand(flags.Args())
+	if cmd == nil {
+		if flags.NArg() > 0 {
+			fmt.Fprintf(stderr, "unknown command: %s\n",
+				strings.Join(flags.Args(), " "))
+		}
+		cliUsage(stderr)
+		return 2
+	}
+	var client *adminClient
+	var err error
+	if !cliLocalCommands[cmd.name] {
+		client, err = newAdminClient(*socket, *tokenFile)
+	}
+	if err == nil {
+		err = cmd.run(&cli{client, cmd, stdin, stdout, stderr}, cmdArgs)
+	}
+	if err == flag.ErrHelp {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// flags returns the flags of the command, printing usage to stderr.
+func (c *cli) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet(c.cmd.name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: lcfs_plugin %s %s\n", c.cmd.name,
+			c.cmd.usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseCommand parses the flags of a command, expecting n arguments.  Usage
+// errors are returned as flag.ErrHelp, once usage is printed.
+func parseCommand(flags *flag.FlagSet, args []string, n int) error {
+	if err := flags.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	if flags.NArg() != n {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	return nil
+}
+
+// stringList is a flag given any number of times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(val string) error {
+	*l = append(*l, val)
+	return nil
+}
+
+// printJSON prints a value as indented JSON.
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printSnapshots prints snapshots as a table, or as JSON.
+func printSnapshots(w io.Writer, recs []*snapshotRecord, asJSON bool) error {
+	if asJSON {
+		return printJSON(w, recs)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tTAGS\tLAYER\tCREATED\tDESCRIPTION\n")
+	for _, rec := range recs {
+		fmt.Fprintf(tw, "%s\t%s\t%.12s\t%s\t%s\n", rec.Name,
+			strings.Join(rec.Tags, ","), rec.Layer,
+			rec.Created.Local().Format(time.RFC3339), rec.Description)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) snapshotCreate(args []string) error {
+	var req snapshotRequest
+	var tags stringList
+
+	flags := c.flags()
+	flags.StringVar(&req.Name, "name", "", "name of the snapshot")
+	flags.Var(&tags, "tag", "tag of the snapshot, may be repeated")
+	flags.StringVar(&req.Description, "description", "", "description")
+	flags.StringVar(&req.Parent, "parent", "", "parent of the layer")
+	flags.BoolVar(&req.Online, "online", false,
+		"snapshot the layer even if mounted, freezing processes using it")
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	req.Layer = flags.Arg(0)
+	req.Tags = tags
+	var rec snapshotRecord
+	err := c.client.do(http.MethodPost, "/v1/snapshots", &req, &rec)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, rec.ID)
+	return nil
+}
+
+func (c *cli) snapshotList(args []string) error {
+	flags := c.flags()
+	layer := flags.String("layer", "", "list snapshots of the layer")
+	tag := flags.String("tag", "", "list snapshots with the tag")
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := parseCommand(flags, args, 0); err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *layer != "" {
+		q.Set("layer", *layer)
+	}
+	if *tag != "" {
+		q.Set("tag", *tag)
+	}
+	var recs []*snapshotRecord
+	if err := c.client.do(http.MethodGet, "/v1/snapshots?"+q.Encode(), nil,
+		&recs); err != nil {
+		return err
+	}
+	return printSnapshots(c.stdout, recs, *asJSON)
+}
+
+func (c *cli) snapshotShow(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	var rec snapshotRecord
+	err := c.client.do(http.MethodGet,
+		"/v1/snapshots/"+url.PathEscape(flags.Arg(0)), nil, &rec)
+	if err != nil {
+		return err
+	}
+	return printJSON(c.stdout, &rec)
+}
+
+func (c *cli) snapshotRemove(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	return c.client.do(http.MethodDelete,
+		"/v1/snapshots/"+url.PathEscape(flags.Arg(0)), nil, nil)
+}
+
+func (c *cli) snapshotPromote(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	var rec snapshotRecord
+	err := c.client.do(http.MethodPost,
+		"/v1/snapshots/"+url.PathEscape(flags.Arg(0))+"/promote", nil, &rec)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, rec.ID)
+	return nil
+}
+
+func (c *cli) snapshotMount(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 3); err != nil {
+		return err
+	}
+	target, err := filepath.Abs(flags.Arg(2))
+	if err != nil {
+		return err
+	}
+	return c.client.do(http.MethodPost,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/snapshot-mount",
+		&adminSnapshotMount{Snapshot: flags.Arg(1), Target: target}, nil)
+}
+
+func (c *cli) snapshotUnmount(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	target, err := filepath.Abs(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	q := url.Values{}
+	q.Set("target", target)
+	return c.client.do(http.MethodDelete, "/v1/snapshot-mounts?"+q.Encode(),
+		nil, nil)
+}
+
+func (c *cli) snapshotMounts(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 0); err != nil {
+		return err
+	}
+	var mounts []*snapshotMount
+	if err := c.client.do(http.MethodGet, "/v1/snapshot-mounts", nil,
+		&mounts); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "TARGET\tSNAPSHOT\tLAYER\tSINCE\n")
+	for _, m := range mounts {
+		fmt.Fprintf(tw, "%s\t%s\t%.12s\t%s\n", m.Target, m.Snapshot, m.Layer,
+			m.Since.Local().Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) backupCreate(args []string) error {
+	var req backupRequest
+
+	flags := c.flags()
+	flags.BoolVar(&req.Full, "full", false,
+		"store all changes of the snapshot, not only those since the last backup")
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	req.Snapshot = flags.Arg(0)
+	var m backupManifest
+	if err := c.client.do(http.MethodPost, "/v1/backups", &req, &m); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, m.ID)
+	return nil
+}
+
+func (c *cli) backupLayer(args []string) error {
+	var req backupRequest
+
+	flags := c.flags()
+	flags.StringVar(&req.Parent, "parent", "",
+		"parent of the layer, if not known to the plugin")
+	flags.BoolVar(&req.ReadWrite, "rw", false,
+		"the layer is writable, created writable when rebuilt")
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	req.Layer = flags.Arg(0)
+	var m backupManifest
+	if err := c.client.do(http.MethodPost, "/v1/backups", &req, &m); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, m.ID)
+	return nil
+}
+
+// printBackups prints backups as a table, or as JSON.
+func printBackups(w io.Writer, manifests []*backupManifest, asJSON bool) error {
+	if asJSON {
+		return printJSON(w, manifests)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tSNAPSHOT\tLAYER\tSINCE\tCREATED\tSIZE\n")
+	for _, m := range manifests {
+		snapshot := "-"
+		if m.Snapshot != nil {
+			snapshot = m.Snapshot.Name
+		}
+		fmt.Fprintf(tw, "%.12s\t%s\t%.12s\t%.12s\t%s\t%s\n", m.ID,
+			snapshot, m.Layer, m.Since,
+			m.Created.Local().Format(time.RFC3339),
+			units.BytesSize(float64(m.Size)))
+	}
+	return tw.Flush()
+}
+
+func (c *cli) backupList(args []string) error {
+	flags := c.flags()
+	layer := flags.String("layer", "", "list backups of the layer")
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := parseCommand(flags, args, 0); err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *layer != "" {
+		q.Set("layer", *layer)
+	}
+	var manifests []*backupManifest
+	if err := c.client.do(http.MethodGet, "/v1/backups?"+q.Encode(), nil,
+		&manifests); err != nil {
+		return err
+	}
+	return printBackups(c.stdout, manifests, *asJSON)
+}
+
+func (c *cli) backupVerify(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	var chain []*backupManifest
+	err := c.client.do(http.MethodPost,
+		"/v1/backups/"+url.PathEscape(flags.Arg(0))+"/verify", nil, &chain)
+	if err != nil {
+		return err
+	}
+	return printBackups(c.stdout, chain, false)
+}
+
+func (c *cli) backupRestore(args []string) error {
+	var req adminRestoreBackup
+
+	flags := c.flags()
+	flags.StringVar(&req.Base, "base", "",
+		"layer replacing the parent of the layer of the full backup")
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	var rec snapshotRecord
+	err := c.client.do(http.MethodPost,
+		"/v1/backups/"+url.PathEscape(flags.Arg(0))+"/restore", &req, &rec)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, rec.Name)
+	return nil
+}
+
+func (c *cli) backupRemove(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	return c.client.do(http.MethodDelete,
+		"/v1/backups/"+url.PathEscape(flags.Arg(0)), nil, nil)
+}
+
+func (c *cli) backupRebuild(args []string) error {
+	flags := c.flags()
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := parseCommand(flags, args, 0); err != nil {
+		return err
+	}
+	var rebuilt []*rebuiltLayer
+	err := c.client.do(http.MethodPost, "/v1/rebuild", nil, &rebuilt)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(c.stdout, rebuilt)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "LAYER\tPARENT\tBACKUP\tSNAPSHOT\n")
+	for _, l := range rebuilt {
+		fmt.Fprintf(tw, "%s\t%s\t%.12s\t%s\n", l.Layer, l.Parent, l.Backup,
+			l.Snapshot)
+	}
+	return tw.Flush()
+}
+
+func (c *cli) groupCreate(args []string) error {
+	var req snapshotGroupRequest
+
+	flags := c.flags()
+	flags.StringVar(&req.Name, "name", "", "name of the group")
+	flags.StringVar(&req.Description, "description", "", "description")
+	flags.BoolVar(&req.Online, "online", false,
+		"snapshot layers even if mounted, freezing processes using those")
+	if err := flags.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	for _, l := range flags.Args() {
+		req.Layers = append(req.Layers, snapshotGroupLayer{Layer: l})
+	}
+	var recs []*snapshotRecord
+	err := c.client.do(http.MethodPost, "/v1/snapshot-groups", &req, &recs)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		fmt.Fprintln(c.stdout, rec.ID)
+	}
+	return nil
+}
+
+func (c *cli) groupShow(args []string) error {
+	flags := c.flags()
+	asJSON := flags.Bool("json", false, "print JSON")
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	var recs []*snapshotRecord
+	err := c.client.do(http.MethodGet,
+		"/v1/snapshot-groups/"+url.PathEscape(flags.Arg(0)), nil, &recs)
+	if err != nil {
+		return err
+	}
+	return printSnapshots(c.stdout, recs, *asJSON)
+}
+
+func (c *cli) groupRemove(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	return c.client.do(http.MethodDelete,
+		"/v1/snapshot-groups/"+url.PathEscape(flags.Arg(0)), nil, nil)
+}
+
+func (c *cli) groupRollback(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	return c.client.do(http.MethodPost,
+		"/v1/snapshot-groups/"+url.PathEscape(flags.Arg(0))+"/rollback", nil,
+		nil)
+}
+
+func (c *cli) label(args []string) error {
+	flags := c.flags()
+	clear := flags.Bool("clear", false, "remove all labels")
+	if err := flags.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	if flags.NArg() == 0 || (*clear && flags.NArg() > 1) {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	p := "/v1/layers/" + url.PathEscape(flags.Arg(0)) + "/labels"
+	if flags.NArg() == 1 && !*clear {
+		var labels map[string]string
+		if err := c.client.do(http.MethodGet, p, nil, &labels); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(c.stdout, "%s=%s\n", k, labels[k])
+		}
+		return nil
+	}
+	labels := make(map[string]string)
+	for _, l := range flags.Args()[1:] {
+		kv, err := parseLabels(l)
+		if err != nil {
+			return err
+		}
+		for k, v := range kv {
+			labels[k] = v
+		}
+	}
+	return c.client.do(http.MethodPut, p, labels, nil)
+}
+
+func (c *cli) rollback(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 2); err != nil {
+		return err
+	}
+	return c.client.do(http.MethodPost,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/rollback",
+		&adminRollback{Snapshot: flags.Arg(1)}, nil)
+}
+
+func (c *cli) restore(args []string) error {
+	flags := c.flags()
+	if err := flags.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	if flags.NArg() < 3 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	var res restoreResult
+	err := c.client.do(http.MethodPost,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/restore",
+		&adminRestore{Snapshot: flags.Arg(1), Paths: flags.Args()[2:]}, &res)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%d restored, %d removed\n", res.Restored,
+		res.Removed)
+	return nil
+}
+
+func (c *cli) exportImage(args []string) error {
+	var req diskImageRequest
+
+	flags := c.flags()
+	flags.StringVar(&req.Format, "format", diskImageRaw,
+		"format of the image, raw or qcow2")
+	size := flags.String("size", "", "size of the image, like 10G")
+	flags.StringVar(&req.Label, "label", "", "label of the file system")
+	if err := parseCommand(flags, args, 2); err != nil {
+		return err
+	}
+	if *size != "" {
+		var err error
+		if req.Size, err = units.RAMInBytes(*size); err != nil {
+			return err
+		}
+	}
+	var err error
+	if req.Path, err = filepath.Abs(flags.Arg(1)); err != nil {
+		return err
+	}
+	var img diskImage
+	err = c.client.do(http.MethodPost,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/export", &req, &img)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%s %s %s\n", img.Path, img.Format,
+		units.BytesSize(float64(img.Size)))
+	return nil
+}
+
+func (c *cli) migrate(args []string) error {
+	var req migrateRequest
+	var opts stringList
+
+	flags := c.flags()
+	home := flags.String("home", cliLayerRoot,
+		"layer root of the file system layers are created in")
+	flags.Var(&opts, "opt", "storage option of the driver, may be repeated")
+	flags.StringVar(&req.From, "from", migrateOverlay2,
+		"graph driver to migrate from, overlay2 or devicemapper")
+	flags.StringVar(&req.Root, "root", "",
+		"root of the graph, /var/lib/docker/<driver> by default")
+	flags.StringVar(&req.LayerDB, "layerdb", "", "layer store of Docker for "+
+		"the graph, /var/lib/docker/image/<driver>/layerdb by default")
+	flags.StringVar(&req.Pool, "pool", "",
+		"thin pool of devicemapper, the pool it created by default")
+	if err := parseCommand(flags, args, 0); err != nil {
+		return err
+	}
+	if req.Root == "" {
+		req.Root = filepath.Join("/var/lib/docker", req.From)
+	}
+	if req.LayerDB == "" {
+		req.LayerDB = filepath.Join("/var/lib/docker/image", req.From, "layerdb")
+	}
+	d := &Driver{init: Init}
+	if err := d.initLayerRoot(*home, opts, nil, nil); err != nil {
+		return err
+	}
+	defer d.Cleanup()
+	res, err := d.Migrate(&req)
+	if res != nil {
+		fmt.Fprintf(c.stdout, "%d layers migrated, %s, %d present\n",
+			len(res.Migrated), units.BytesSize(float64(res.Bytes)),
+			len(res.Skipped))
+	}
+	return err
+}
+
+func (c *cli) exportOCI(args []string) error {
+	var req ociExportRequest
+
+	flags := c.flags()
+	flags.StringVar(&req.Config, "config", "",
+		"config of the image in the image store of Docker")
+	flags.StringVar(&req.Ref, "ref", "", "name of the image in the layout")
+	if err := flags.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	var err error
+	if req.Path, err = filepath.Abs(flags.Arg(0)); err != nil {
+		return err
+	}
+	if req.Config != "" {
+		if req.Config, err = filepath.Abs(req.Config); err != nil {
+			return err
+		}
+	}
+	req.Layers = flags.Args()[1:]
+	var img ociImage
+	err = c.client.do(http.MethodPost, "/v1/oci-export", &req, &img)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, img.Manifest.Digest)
+	return nil
+}
+
+func (c *cli) diffStat(args []string) error {
+	flags := c.flags()
+	parent := flags.String("parent", "", "parent the changes are relative to")
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *parent != "" {
+		q.Set("parent", *parent)
+	}
+	var s diffStat
+	err := c.client.do(http.MethodGet,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/diffstat?"+q.Encode(),
+		nil, &s)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "\tFILES\tBYTES\n")
+	fmt.Fprintf(tw, "added\t%d\t%d\n", s.Added, s.AddedBytes)
+	fmt.Fprintf(tw, "modified\t%d\t%d\n", s.Modified, s.ModifiedBytes)
+	fmt.Fprintf(tw, "deleted\t%d\t%d\n", s.Deleted, s.DeletedBytes)
+	return tw.Flush()
+}
+
+func (c *cli) pin(args []string) error {
+	return c.layerAction(args, "pin")
+}
+
+func (c *cli) unpin(args []string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	return c.client.do(http.MethodDelete,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/pin", nil, nil)
+}
+
+func (c *cli) freeze(args []string) error {
+	return c.layerAction(args, "freeze")
+}
+
+func (c *cli) thaw(args []string) error {
+	return c.layerAction(args, "thaw")
+}
+
+// layerAction posts an action without a body for the layer in args.
+func (c *cli) layerAction(args []string, action string) error {
+	flags := c.flags()
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	return c.client.do(http.MethodPost,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/"+action, nil, nil)
+}
+
+func (c *cli) squash(args []string) error {
+	var req adminSquash
+
+	flags := c.flags()
+	flags.StringVar(&req.Parent, "parent", "", "parent of the first layer")
+	if err := flags.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	req.Layers = flags.Args()
+	var layer adminLayer
+	err := c.client.do(http.MethodPost, "/v1/squash", &req, &layer)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, layer.ID)
+	return nil
+}
+
+func (c *cli) clone(args []string) error {
+	var req cloneRequest
+
+	flags := c.flags()
+	flags.StringVar(&req.Home, "to", "",
+		"directory layers of the other file system are found in")
+	flags.StringVar(&req.Parent, "parent", "", "parent of the first layer")
+	flags.BoolVar(&req.Writable, "writable", false,
+		"create the last layer writable")
+	if err := flags.Parse(args); err != nil {
+		return flag.ErrHelp
+	}
+	if flags.NArg() == 0 || req.Home == "" {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	req.Layers = flags.Args()
+	return c.client.do(http.MethodPost, "/v1/clone", &req, nil)
+}
+
+func (c *cli) fanOut(args []string) error {
+	var req fanOutRequest
+	var opts stringList
+
+	flags := c.flags()
+	flags.Var(&opts, "opt", "storage option of the layers, may be repeated")
+	if err := parseCommand(flags, args, 2); err != nil {
+		return err
+	}
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("lcfs: invalid storage option %q", opt)
+		}
+		if req.StorageOpt == nil {
+			req.StorageOpt = make(map[string]string)
+		}
+		req.StorageOpt[kv[0]] = kv[1]
+	}
+	n, err := strconv.Atoi(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("lcfs: invalid count %q", flags.Arg(1))
+	}
+	req.Count = n
+	var out adminFanOut
+	err = c.client.do(http.MethodPost,
+		"/v1/layers/"+url.PathEscape(flags.Arg(0))+"/clones", &req, &out)
+	if err != nil {
+		return err
+	}
+	for _, id := range out.IDs {
+		fmt.Fprintln(c.stdout, id)
+	}
+	return nil
+}
+
+func (c *cli) send(args []string) error {
+	flags := c.flags()
+	since := flags.String("since", "",
+		"older snapshot of the layer received before")
+	if err := parseCommand(flags, args, 1); err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *since != "" {
+		q.Set("since", *since)
+	}
+	return c.client.stream(http.MethodGet,
+		"/v1/snapshots/"+url.PathEscape(flags.Arg(0))+"/send?"+q.Encode(),
+		nil, c.stdout)
+}
+
+func (c *cli) receive(args []string) error {
+	flags := c.flags()
+	base := flags.String("base", "",
+		"layer replacing the parent the snapshot was sent relative to")
+	if err := parseCommand(flags, args, 0); err != nil {
+		return err
+	}
+	q := url.Values{}
+	if *base != "" {
+		q.Set("base", *base)
+	}
+	var out bytes.Buffer
+	err := c.client.stream(http.MethodPost, "/v1/receive?"+q.Encode(),
+		c.stdin, &out)
+	if err != nil {
+		return err
+	}
+	var rec snapshotRecord
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, rec.ID)
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCLISnapshots(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.opts = &driverOptions{}
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	defer func() { copyChanges = (*Driver).copyChanges }()
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	socket := path.Join(f.home, "admin.sock")
+	token := path.Join(f.home, "token")
+	ioutil.WriteFile(token, []byte("admin\n"), 0600)
+	a, err := newAdminServer(d, &driverOptions{
+		AdminSocket:    socket,
+		AdminTokenFile: token,
+		AdminUIDs:      []uint32{uint32(os.Getuid())},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	run := func(args ...string) (string, int) {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-socket", socket, "-token-file", token}, args...)
+		status := runCLI(args, nil, &stdout, &stderr)
+		return stdout.String() + stderr.String(), status
+	}
+	out, status := run("snapshot", "create", "-name", "before", "-tag",
+		"pre-upgrade", "-description", "before upgrading", "rw")
+	if status != 0 {
+		t.Fatalf("snapshot create failed: %s", out)
+	}
+	id := strings.TrimSpace(out)
+	if !d.Exists(id) {
+		t.Errorf("layer %s of snapshot not created", id)
+	}
+	out, status = run("snapshot", "create", "-name", "before", "rw")
+	if status != 1 || !strings.Contains(out, "already exists") {
+		t.Errorf("snapshot taken twice, status %d: %s", status, out)
+	}
+	out, status = run("snapshot", "list", "-tag", "pre-upgrade")
+	if status != 0 || !strings.Contains(out, "before upgrading") {
+		t.Errorf("snapshot not listed, status %d: %s", status, out)
+	}
+	out, status = run("snapshot", "show", "pre-upgrade")
+	if status != 0 || !strings.Contains(out, id) {
+		t.Errorf("snapshot not shown, status %d: %s", status, out)
+	}
+	if out, status := run("rollback", "rw", "before"); status != 0 ||
+		f.parents["rw"] != id {
+		t.Errorf("layer not rolled back, status %d: %s", status, out)
+	}
+	if out, status := run("snapshot", "remove", "before"); status != 0 {
+		t.Errorf("snapshot not removed, status %d: %s", status, out)
+	}
+	if out, status := run("snapshot", "show", "before"); status != 1 ||
+		!strings.Contains(out, "not found") {
+		t.Errorf("snapshot removed shown, status %d: %s", status, out)
+	}
+
+	// Usage errors
+	for _, args := range [][]string{{"snapshot"}, {"snapshot", "show"},
+		{"snapshot", "list", "-bad"}} {
+		if _, status := run(args...); status != 2 {
+			t.Errorf("%v returned %d", args, status)
+		}
+	}
+}
+
+func TestCLIMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Migrating runs the driver in the CLI, without the admin API
+	var stdout, stderr bytes.Buffer
+	status := runCLI([]string{"migrate", "-home", path.Join(dir, "lcfs"),
+		"-root", dir, "-layerdb", dir}, nil, &stdout, &stderr)
+	if status != 1 || strings.Contains(stderr.String(), "admin socket") {
+		t.Errorf("migrate status %d: %s", status, stderr.String())
+	}
+}
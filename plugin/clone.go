@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Issues an ioctl on the layer root directory of another file system open as
+// fd, replaced by tests
+var instanceIoctl = fdIoctl
+
+// lcfsInstance is another lcfs file system mounted on the host, by the
+// directory layers are found in, like the home of the driver.
+type lcfsInstance struct {
+	home string
+	fd   int
+}
+
+// openInstance opens the layer root directory of another file system.
+func openInstance(home string) (*lcfsInstance, error) {
+	fd, err := unix.Open(home, unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("lcfs: opening %s: %v", home, err)
+	}
+	return &lcfsInstance{home: home, fd: fd}, nil
+}
+
+func (i *lcfsInstance) close() {
+	unix.Close(i.fd)
+}
+
+// ioctl issues an ioctl naming a layer to the file system.
+func (i *lcfsInstance) ioctl(cmd int, parent, id string) error {
+	if err := ioctlPolicy.check(cmd); err != nil {
+		return err
+	}
+	buf, op, err := marshalName(nil, cmd, parent, id)
+	if err != nil {
+		return err
+	}
+	err = instanceIoctl(i.fd, op, buf)
+	if err == unix.ENOTTY {
+		return fmt.Errorf("lcfs: %s is not the layer root of an lcfs file "+
+			"system", i.home)
+	}
+	return err
+}
+
+// cloneRequest describes layers to be cloned to another file system, each
+// the parent of the next, and the parent of the first if not known.  The last
+// layer is created writable on the other file system if writable is set.
+type cloneRequest struct {
+	Home     string   `json:"home"`
+	Parent   string   `json:"parent,omitempty"`
+	Layers   []string `json:"layers"`
+	Writable bool     `json:"writable,omitempty"`
+}
+
+// Copies the changes of a layer to the layer cloned on another file system,
+// replaced by tests
+var cloneChanges = (*Driver).cloneChanges
+
+// cloneChanges copies the files changed by a layer relative to parent to the
+// layer cloned, straight from one file system to the other without any
+// archive, copying only the data of files.  Files of the parent are shared
+// by the layer cloned on the other file system.
+func (d *Driver) cloneChanges(dst *lcfsInstance, id, parent string) error {
+	changes, err := d.changedFiles(id, parent)
+	if err != nil {
+		return fmt.Errorf("lcfs: finding changes of layer %s: %v", id, err)
+	}
+	if err := dst.ioctl(LayerMount, "", id); err != nil {
+		return err
+	}
+	defer func() {
+		if err := dst.ioctl(LayerUmount, "", id); err != nil {
+			logrus.Errorf("Unmounting layer %s cloned, err %v\n", id, err)
+		}
+	}()
+	return copyLayerFiles(path.Join(d.home, id), path.Join(dst.home, id),
+		changes)
+}
+
+// Clone copies layers to another lcfs file system mounted on the same host,
+// keeping the ids and parents of the layers, so layers are moved between
+// devices without exporting and importing images.  Layers are cloned from the
+// first, each once its parent is, and layers present on the other file system
+// already are skipped, so a chain is cloned again after a failure.  The
+// parent of the first layer has to be present on the other file system.
+func (d *Driver) Clone(req *cloneRequest) (err error) {
+	logrus.Debugf("Clone - %d layers to %s", len(req.Layers), req.Home)
+	if len(req.Layers) == 0 {
+		return fmt.Errorf("lcfs: no layers to clone")
+	}
+	defer d.trackOp("Clone", req.Layers[len(req.Layers)-1], req.Parent)(&err)
+	if path.Clean(req.Home) == path.Clean(d.home) {
+		return fmt.Errorf("lcfs: cannot clone layers to the same file system")
+	}
+	parent, err := d.checkChain(req.Parent, req.Layers)
+	if err != nil {
+		return err
+	}
+	dst, err := openInstance(req.Home)
+	if err != nil {
+		return err
+	}
+	defer dst.close()
+	for i, id := range req.Layers {
+		writable := req.Writable && i == len(req.Layers)-1
+		if err := d.cloneLayer(dst, id, parent, writable); err != nil {
+			return err
+		}
+		parent = id
+	}
+	logrus.Infof("Cloned %d layers to %s", len(req.Layers), req.Home)
+	return nil
+}
+
+// cloneLayer creates a layer on another file system from parent and copies
+// the changes of the layer to it, unless present already.
+func (d *Driver) cloneLayer(dst *lcfsInstance, id, parent string,
+	writable bool) error {
+	defer d.layers.lock(id)()
+	if !d.Exists(id) {
+		return notFoundError(id)
+	}
+	if d.mounts.active(id) && !d.mounts.isReadOnly(id) {
+		return mountedError(id)
+	}
+	err := dst.ioctl(LayerStat, "", id)
+	if err == nil {
+		logrus.Infof("Clone - layer %s present on %s", id, dst.home)
+		return nil
+	}
+	if err != unix.ENOENT {
+		return err
+	}
+	cmd := LayerCreate
+	if writable {
+		cmd = LayerCreateRw
+	}
+	if err := dst.ioctl(cmd, parent, id); err != nil {
+		if err == unix.ENOENT {
+			return fmt.Errorf("lcfs: parent %s of layer %s not found on %s",
+				parent, id, dst.home)
+		}
+		return err
+	}
+	if err := cloneChanges(d, dst, id, parent); err != nil {
+		if rerr := dst.ioctl(LayerRemove, "", id); rerr != nil {
+			logrus.Errorf("Removing layer %s cloned partially, err %v\n", id,
+				rerr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	other, _, cleanupOther := newFakeFS(t)
+	defer cleanupOther()
+	ioctlSyscall = f.ioctl
+	defer func() {
+		instanceIoctl = fdIoctl
+		cloneChanges = (*Driver).cloneChanges
+	}()
+	instanceIoctl = func(fd int, op uintptr, buf []byte) error {
+		return other.ioctl(op, buf)
+	}
+	var cloned []string
+	fail := ""
+	cloneChanges = func(d *Driver, dst *lcfsInstance, id, parent string) error {
+		if id == fail {
+			return errLayerBusy
+		}
+		cloned = append(cloned, id)
+		return nil
+	}
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"l1", "base", false}, fakeLayer{"l2", "l1", false})
+
+	// Layers partially cloned are removed again
+	req := &cloneRequest{Home: other.home, Layers: []string{"base", "l1", "l2"},
+		Writable: true}
+	fail = "l2"
+	if err := d.Clone(req); err == nil {
+		t.Fatal("clone succeeded with copying changes failing")
+	}
+	if _, ok := other.parents["l2"]; ok {
+		t.Error("layer partially cloned not removed")
+	}
+
+	// Layers cloned already are skipped
+	fail = ""
+	cloned = nil
+	if err := d.Clone(req); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cloned, []string{"l2"}) {
+		t.Errorf("unexpected layers cloned %v", cloned)
+	}
+	expected := map[string]string{"base": "", "l1": "base", "l2": "l1"}
+	if !reflect.DeepEqual(other.parents, expected) {
+		t.Errorf("unexpected layers on other file system %v", other.parents)
+	}
+	if other.count(LayerCreateRw) != 2 {
+		t.Error("last layer not created writable")
+	}
+
+	for _, req := range []*cloneRequest{
+		{Home: f.home, Layers: []string{"l1"}},
+		{Home: other.home, Layers: []string{"l2", "l1"}},
+		{Home: other.home},
+	} {
+		if err := d.Clone(req); err == nil {
+			t.Errorf("cloned %v to %s", req.Layers, req.Home)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// Size of the pieces compared when checking content of a file
+const dedupCompareSize = 64 * 1024
+
+// dedupStats counts regular files of diffs not written to layers, as the
+// parent already has those.
+type dedupStats struct {
+	Files uint64 `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// add accounts files of a diff not written.
+func (s *dedupStats) add(files int, size int64) {
+	atomic.AddUint64(&s.Files, uint64(files))
+	atomic.AddUint64(&s.Bytes, uint64(size))
+}
+
+// snapshot returns a copy of the counters.
+func (s *dedupStats) snapshot() *dedupStats {
+	return &dedupStats{
+		Files: atomic.LoadUint64(&s.Files),
+		Bytes: atomic.LoadUint64(&s.Bytes),
+	}
+}
+
+// diffDedup filters a diff applied to a layer created from a parent, dropping
+// regular files with the same content and metadata as the file in the parent.
+// The new layer then keeps sharing the blocks of the parent, instead of a copy
+// of the same data being written, as when pulling a rebuilt image sharing
+// most of its content with the previous one.  Files are compared byte by
+// byte, which reads files of the parent instead of writing those.
+type diffDedup struct {
+	parentDir string
+	tr        *tar.Reader
+	tw        *tar.Writer
+
+	// Paths replaced or deleted by the diff, files below those differ from
+	// the parent.  Directories in the diff only set metadata of directories
+	// the parent may have already, so those are not included.
+	touched map[string]bool
+
+	// Files dropped and their size
+	files int
+	size  int64
+}
+
+// dedupDiff returns a reader of diff without the files present in parentDir
+// unchanged.  The returned function waits for filtering to complete, closing
+// the reader, and returns the number and size of files dropped.
+func dedupDiff(parentDir string, diff io.Reader) (io.Reader, func() (int, int64, error)) {
+	reader, writer := io.Pipe()
+	f := &diffDedup{
+		parentDir: parentDir,
+		tr:        tar.NewReader(diff),
+		tw:        tar.NewWriter(writer),
+		touched:   make(map[string]bool),
+	}
+	done := make(chan error, 1)
+	go func() {
+		err := f.filter()
+		writer.CloseWithError(err)
+		done <- err
+	}()
+	return reader, func() (int, int64, error) {
+		reader.Close()
+		err := <-done
+		if err == io.ErrClosedPipe {
+			err = nil
+		}
+		return f.files, f.size, err
+	}
+}
+
+// dedupApply returns a reader of a diff applied to a layer created from
+// parent without the files of the parent unchanged, with the parent mounted
+// while the diff is read.  The returned function waits for filtering to
+// complete, releases the parent and accounts the files dropped, returning
+// their size.
+func (d *Driver) dedupApply(parent string, diff io.Reader) (io.Reader, func() (int64, error), error) {
+	unlock := d.layers.lock(parent)
+	dir, err := d.get(parent, "")
+	unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, done := dedupDiff(dir, diff)
+	return reader, func() (int64, error) {
+		files, size, err := done()
+		if err == nil {
+			d.dedup.add(files, size)
+		}
+		defer d.layers.lock(parent)()
+		if perr := d.put(parent); err == nil {
+			err = perr
+		}
+		return size, err
+	}, nil
+}
+
+// filter copies entries of the diff, dropping files found unchanged.
+func (f *diffDedup) filter() error {
+	for {
+		hdr, err := f.tr.Next()
+		if err == io.EOF {
+			return f.tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		base := path.Base(name)
+		if strings.HasPrefix(base, archive.WhiteoutPrefix) {
+			if base == archive.WhiteoutOpaqueDir {
+				f.touched[path.Dir(name)] = true
+			} else {
+				f.touched[path.Join(path.Dir(name),
+					strings.TrimPrefix(base, archive.WhiteoutPrefix))] = true
+			}
+		} else if f.candidate(name, hdr) {
+			same, err := f.compare(name, hdr)
+			if err != nil {
+				return err
+			}
+			if same {
+				f.files++
+				f.size += hdr.Size
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			f.touched[name] = true
+		}
+		if err := f.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f.tw, f.tr); err != nil {
+			return err
+		}
+	}
+}
+
+// candidate checks if an entry could be the same as the file in the parent.
+// Only regular files with data not replacing a path changed by the diff
+// before are considered.
+func (f *diffDedup) candidate(name string, hdr *tar.Header) bool {
+	if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 || len(hdr.Xattrs) > 0 {
+		return false
+	}
+	for p := name; p != "/"; p = path.Dir(p) {
+		if f.touched[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// lstat returns the file of the parent the entry replaces, if any, without
+// following symbolic links, so only files of the parent are compared.
+func (f *diffDedup) lstat(name string) (os.FileInfo, error) {
+	dir := path.Dir(name)
+	for p := dir; p != "/"; p = path.Dir(p) {
+		fi, err := os.Lstat(path.Join(f.parentDir, p))
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return nil, os.ErrNotExist
+		}
+	}
+	return os.Lstat(path.Join(f.parentDir, name))
+}
+
+// sameMetadata checks if a file of the parent has the metadata of an entry.
+func sameMetadata(fi os.FileInfo, hdr *tar.Header) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || !fi.Mode().IsRegular() || fi.Size() != hdr.Size {
+		return false
+	}
+	return int64(st.Mode&07777) == hdr.Mode&07777 &&
+		int(st.Uid) == hdr.Uid && int(st.Gid) == hdr.Gid &&
+		fi.ModTime().Equal(hdr.ModTime)
+}
+
+// compare reads the data of a candidate entry, comparing it with the file in
+// the parent.  Returns true if the data matched, otherwise the entry is
+// written with its data.  Data matched before a difference is found is
+// written again from the file of the parent, so entries are never buffered
+// as a whole.
+func (f *diffDedup) compare(name string, hdr *tar.Header) (bool, error) {
+	var file *os.File
+
+	fi, err := f.lstat(name)
+	if err == nil && sameMetadata(fi, hdr) {
+		file, err = os.Open(path.Join(f.parentDir, name))
+	}
+	if file == nil || err != nil {
+		f.touched[name] = true
+		if err := f.tw.WriteHeader(hdr); err != nil {
+			return false, err
+		}
+		_, err := io.Copy(f.tw, f.tr)
+		return false, err
+	}
+	defer file.Close()
+
+	var matched int64
+	data := make([]byte, dedupCompareSize)
+	parent := make([]byte, dedupCompareSize)
+	for matched < hdr.Size {
+		n, err := io.ReadFull(f.tr, data)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			return false, io.ErrUnexpectedEOF
+		}
+		m, err := io.ReadFull(file, parent[:n])
+		if err != nil || m != n || !bytes.Equal(data[:n], parent[:n]) {
+			f.touched[name] = true
+			if err := f.tw.WriteHeader(hdr); err != nil {
+				return false, err
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return false, err
+			}
+			if _, err := io.CopyN(f.tw, file, matched); err != nil {
+				return false, err
+			}
+			if _, err := f.tw.Write(data[:n]); err != nil {
+				return false, err
+			}
+			_, err = io.Copy(f.tw, f.tr)
+			return false, err
+		}
+		matched += int64(n)
+	}
+	return true, nil
+}
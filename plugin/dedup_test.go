@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/graphdriver"
+)
+
+func TestDedupDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Unix(1500000000, 0)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 2*dedupCompareSize/16+7)
+	changed := append([]byte(nil), large...)
+	changed[len(changed)-1] = 'x'
+	parent := map[string][]byte{
+		"same":           []byte("same content"),
+		"large":          large,
+		"changed":        large,
+		"removed":        []byte("removed and added"),
+		"opaque/file":    []byte("below opaque directory"),
+		"chmod":          []byte("mode changed"),
+		"dir/same":       []byte("nested"),
+		"link/same":      []byte("behind symbolic link"),
+		"duplicate/file": []byte("twice"),
+	}
+	for _, d := range []string{"opaque", "dir", "duplicate", "real"} {
+		if err := os.Mkdir(path.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("real", path.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	parent["real/same"] = parent["link/same"]
+	delete(parent, "link/same")
+	for name, data := range parent {
+		file := path.Join(dir, name)
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var diff bytes.Buffer
+	tw := tar.NewWriter(&diff)
+	entry := func(name string, mode int64, data []byte) {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     mode,
+			Size:     int64(len(data)),
+			Uid:      os.Getuid(),
+			Gid:      os.Getgid(),
+			ModTime:  mtime,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(data)
+	}
+	entry("same", 0644, parent["same"])
+	entry("large", 0644, large)
+	entry("changed", 0644, changed)
+	entry(".wh.removed", 0644, nil)
+	entry("removed", 0644, parent["removed"])
+	entry("opaque/.wh..wh..opq", 0644, nil)
+	entry("opaque/file", 0644, parent["opaque/file"])
+	entry("chmod", 0600, parent["chmod"])
+	entry("dir/same", 0644, parent["dir/same"])
+	entry("link/same", 0644, parent["real/same"])
+	entry("new", 0644, []byte("not in parent"))
+	entry("duplicate/file", 0644, []byte("first"))
+	entry("duplicate/file", 0644, parent["duplicate/file"])
+	tw.Close()
+
+	reader, done := dedupDiff(dir, &diff)
+	expected := []struct {
+		name string
+		data []byte
+	}{
+		{"changed", changed},
+		{".wh.removed", nil},
+		{"removed", parent["removed"]},
+		{"opaque/.wh..wh..opq", nil},
+		{"opaque/file", parent["opaque/file"]},
+		{"chmod", parent["chmod"]},
+		{"link/same", parent["real/same"]},
+		{"new", []byte("not in parent")},
+		{"duplicate/file", []byte("first")},
+		{"duplicate/file", parent["duplicate/file"]},
+	}
+	tr := tar.NewReader(reader)
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			if i != len(expected) {
+				t.Errorf("expected %d entries, got %d", len(expected), i)
+			}
+			break
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(expected) || hdr.Name != expected[i].name ||
+			!bytes.Equal(data, expected[i].data) {
+			t.Errorf("unexpected entry %d %s", i, hdr.Name)
+		}
+	}
+	files, size, err := done()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 3 || size != int64(len(parent["same"])+len(large)+len(parent["dir/same"])) {
+		t.Errorf("unexpected files %d size %d dropped", files, size)
+	}
+}
+
+// applyRecorder is a graph driver recording entries of diffs applied.
+type applyRecorder struct {
+	graphdriver.Driver
+	names []string
+}
+
+func (a *applyRecorder) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	tr := tar.NewReader(diff)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		a.names = append(a.names, hdr.Name)
+	}
+}
+
+func TestApplyDiffDedup(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	a := &applyRecorder{}
+	d.driver = a
+	d.opts = &driverOptions{ApplyDiffDedup: true}
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"top", "base", false})
+	mtime := time.Unix(1500000000, 0)
+	file := path.Join(f.home, "base", "dir", "same")
+	if err := os.Mkdir(path.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("same"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files below directories of the diff are dropped as well
+	var diff bytes.Buffer
+	tw := tar.NewWriter(&diff)
+	for _, e := range []struct {
+		name string
+		flag byte
+		data string
+	}{{"dir/", tar.TypeDir, ""}, {"dir/same", tar.TypeReg, "same"},
+		{"new", tar.TypeReg, "new"}} {
+		tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: e.flag, Mode: 0644,
+			Size: int64(len(e.data)), Uid: os.Getuid(), Gid: os.Getgid(),
+			ModTime: mtime})
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+	data := diff.Bytes()
+	size, err := d.ApplyDiff("top", "base", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(a.names, ","); names != "dir/,new" || size != 4 {
+		t.Errorf("unexpected entries applied %s, size %d", names, size)
+	}
+	if s := d.dedup.snapshot(); s.Files != 1 || s.Bytes != 4 {
+		t.Errorf("unexpected files dropped %+v", s)
+	}
+	if f.mounts["base"] != 0 {
+		t.Error("parent left mounted")
+	}
+
+	// Diffs are applied unchanged unless enabled
+	d.opts.ApplyDiffDedup = false
+	a.names = nil
+	if _, err := d.ApplyDiff("top", "base", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(a.names, ","); names != "dir/,dir/same,new" {
+		t.Errorf("unexpected entries applied %s", names)
+	}
+}
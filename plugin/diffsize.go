@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+)
+
+// diffSizeCache remembers sizes of changes in layers computed by DiffSize, so
+// repeated docker system df do not walk the same layers again.  Sizes of a
+// layer are forgotten whenever it is mounted, a diff is applied to it or it
+// is removed.  Each of those bumps the generation of the layer, so sizes
+// computed while the layer changed are not remembered.
+type diffSizeCache struct {
+	lock  sync.Mutex
+	gen   uint64
+	gens  map[string]uint64
+	sizes map[string]map[string]int64
+}
+
+// lookup returns the size remembered for a layer relative to parent, along
+// with the generation of the layer for storing a size computed.
+func (c *diffSizeCache) lookup(id, parent string) (size int64, gen uint64, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.gens == nil {
+		c.gens = make(map[string]uint64)
+		c.sizes = make(map[string]map[string]int64)
+	}
+	if c.gens[id] == 0 {
+		c.gen++
+		c.gens[id] = c.gen
+	}
+	size, ok = c.sizes[id][parent]
+	return size, c.gens[id], ok
+}
+
+// store remembers the size of a layer unless it changed since lookup.
+func (c *diffSizeCache) store(id, parent string, gen uint64, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.gens[id] != gen {
+		return
+	}
+	if c.sizes[id] == nil {
+		c.sizes[id] = make(map[string]int64)
+	}
+	c.sizes[id][parent] = size
+}
+
+// invalidate forgets sizes of a layer being modified.
+func (c *diffSizeCache) invalidate(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.gens[id] != 0 {
+		c.gen++
+		c.gens[id] = c.gen
+		delete(c.sizes, id)
+	}
+}
+
+// forget stops tracking a layer removed.
+func (c *diffSizeCache) forget(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.gens, id)
+	delete(c.sizes, id)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffSizeCache(t *testing.T) {
+	var c diffSizeCache
+
+	if _, _, ok := c.lookup("a", "p"); ok {
+		t.Fatalf("size found in empty cache")
+	}
+	_, gen, _ := c.lookup("a", "p")
+	c.store("a", "p", gen, 10)
+	if size, _, ok := c.lookup("a", "p"); !ok || size != 10 {
+		t.Errorf("size not remembered, got %d %v", size, ok)
+	}
+	if _, _, ok := c.lookup("a", ""); ok {
+		t.Errorf("size found for another parent")
+	}
+
+	// Sizes computed while the layer changed are not remembered
+	_, gen, _ = c.lookup("b", "")
+	c.invalidate("b")
+	c.store("b", "", gen, 20)
+	if _, _, ok := c.lookup("b", ""); ok {
+		t.Errorf("stale size remembered")
+	}
+
+	c.invalidate("a")
+	if _, _, ok := c.lookup("a", "p"); ok {
+		t.Errorf("size not forgotten when layer changed")
+	}
+	_, gen, _ = c.lookup("a", "p")
+	c.forget("a")
+	c.store("a", "p", gen, 10)
+	if _, _, ok := c.lookup("a", "p"); ok {
+		t.Errorf("size of removed layer remembered")
+	}
+}
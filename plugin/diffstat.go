@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// diffStat counts files added, modified and deleted by a layer relative to
+// its parent, and the bytes of those regular files, the size of files
+// deleted as found in the parent.
+type diffStat struct {
+	Added         uint64 `json:"added"`
+	Modified      uint64 `json:"modified"`
+	Deleted       uint64 `json:"deleted"`
+	AddedBytes    uint64 `json:"added_bytes"`
+	ModifiedBytes uint64 `json:"modified_bytes"`
+	DeletedBytes  uint64 `json:"deleted_bytes"`
+}
+
+// add accounts a change of a file, of the size of the file in dir.
+func (s *diffStat) add(c archive.Change, dir string) {
+	var size uint64
+	if fi, err := os.Lstat(path.Join(dir, c.Path)); err == nil &&
+		fi.Mode().IsRegular() {
+		size = uint64(fi.Size())
+	}
+	switch c.Kind {
+	case archive.ChangeAdd:
+		s.Added++
+		s.AddedBytes += size
+	case archive.ChangeModify:
+		s.Modified++
+		s.ModifiedBytes += size
+	case archive.ChangeDelete:
+		s.Deleted++
+		s.DeletedBytes += size
+	}
+}
+
+// changedFiles returns the files changed by a layer relative to parent, as
+// tracked by the file system if relative to the layer it was created from, or
+// found comparing the files of both.
+func (d *Driver) changedFiles(id, parent string) ([]archive.Change, error) {
+	if parent != "" && !swapLayers && !d.rolledBack(id) && d.isParent(id, parent) {
+		return layerChanges(d, id)
+	}
+	return d.driver.Changes(id, parent)
+}
+
+// DiffStat counts the changes of a layer relative to parent without
+// archiving those, from the changes the file system tracked for the layer,
+// so how much a container changed is reported right away however large its
+// files are.  Files of the layer are compared with parent like Diff does if
+// the file system does not track changes relative to parent.
+func (d *Driver) DiffStat(id, parent string) (_ *diffStat, err error) {
+	logrus.Debugf("DiffStat - id %s parent %s", id, parent)
+	defer d.trackOp("DiffStat", id, parent)(&err)
+	if err := validateLayer(id, parent); err != nil {
+		return nil, err
+	}
+	if !d.Exists(id) {
+		return nil, notFoundError(id)
+	}
+	changes, err := d.changedFiles(id, parent)
+	if err != nil {
+		return nil, err
+	}
+	s := &diffStat{}
+	layerDir, parentDir := path.Join(d.home, id), path.Join(d.home, parent)
+	for _, c := range changes {
+		if c.Kind == archive.ChangeDelete {
+			s.add(c, parentDir)
+		} else {
+			s.add(c, layerDir)
+		}
+	}
+	return s, nil
+}
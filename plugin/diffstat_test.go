@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+func TestDiffStat(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	for file, size := range map[string]int{
+		"base/removed": 300, "rw/added": 100, "rw/dir/changed": 20} {
+		p := path.Join(f.home, file)
+		os.MkdirAll(path.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layerChanges = func(d *Driver, id string) ([]archive.Change, error) {
+		return []archive.Change{
+			{Path: "/added", Kind: archive.ChangeAdd},
+			{Path: "/dir", Kind: archive.ChangeModify},
+			{Path: "/dir/changed", Kind: archive.ChangeModify},
+			{Path: "/removed", Kind: archive.ChangeDelete},
+		}, nil
+	}
+	defer func() { layerChanges = (*Driver).trackedChanges }()
+
+	s, err := d.DiffStat("rw", "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := diffStat{Added: 1, Modified: 2, Deleted: 1, AddedBytes: 100,
+		ModifiedBytes: 20, DeletedBytes: 300}
+	if *s != expected {
+		t.Errorf("diff stat %+v, expected %+v", *s, expected)
+	}
+	if _, err := d.DiffStat("missing", "base"); err == nil {
+		t.Error("diff stat of a missing layer")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+const (
+	// Changes archived into memory by a single goroutine
+	diffChunkFiles = 1024
+	diffChunkSize  = 8 << 20
+
+	// Size of the end of archive marker written when a tar writer is closed
+	tarTrailerSize = 1024
+)
+
+// diffChunk is a range of changes of a layer, archived in memory unless large
+// files are included.
+type diffChunk struct {
+	changes []archive.Change
+	large   bool
+}
+
+// diffResult is a chunk archived or being archived in memory.
+type diffResult struct {
+	chunk  diffChunk
+	result chan chunkArchive
+}
+
+// chunkArchive holds tar entries of a chunk without the end of archive marker.
+type chunkArchive struct {
+	data []byte
+	err  error
+}
+
+// exportChanges produces a tar archive of the changes in dir like
+// archive.ExportChanges, archiving ranges of changes with up to threads
+// goroutines, one per CPU if zero.  Tar entries of the ranges are
+// concatenated in order, so the archive is the same as the one archived
+// with a single goroutine.
+func exportChanges(dir string, changes []archive.Change, threads int) (io.ReadCloser, error) {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	var chunks []diffChunk
+	if threads > 1 {
+		chunks = splitChanges(dir, changes)
+	}
+	if len(chunks) < 2 {
+		return archive.ExportChanges(dir, changes, nil, nil)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeChunks(writer, dir, chunks, threads))
+	}()
+	return reader, nil
+}
+
+// splitChanges sorts changes the way those are archived and splits those into
+// ranges of up to diffChunkFiles files and diffChunkSize bytes.  Larger files
+// are placed in ranges of their own.  Nothing is returned if any of the files
+// is hard linked, as links are only detected within a range.
+func splitChanges(dir string, changes []archive.Change) []diffChunk {
+	var chunks []diffChunk
+	var chunk []archive.Change
+	var size int64
+
+	sorted := append([]archive.Change(nil), changes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Path < sorted[j].Path
+	})
+	flush := func() {
+		if len(chunk) > 0 {
+			chunks = append(chunks, diffChunk{changes: chunk})
+			chunk, size = nil, 0
+		}
+	}
+	for _, change := range sorted {
+		var fsize int64
+
+		if change.Kind != archive.ChangeDelete {
+			info, err := os.Lstat(filepath.Join(dir, change.Path))
+			if err == nil {
+				st, ok := info.Sys().(*syscall.Stat_t)
+				if ok && !info.IsDir() && st.Nlink > 1 {
+					return nil
+				}
+				if info.Mode().IsRegular() {
+					fsize = info.Size()
+				}
+			}
+		}
+		if fsize >= diffChunkSize {
+			flush()
+			chunks = append(chunks, diffChunk{
+				changes: []archive.Change{change},
+				large:   true,
+			})
+			continue
+		}
+		chunk = append(chunk, change)
+		size += fsize
+		if len(chunk) >= diffChunkFiles || size >= diffChunkSize {
+			flush()
+		}
+	}
+	flush()
+	return chunks
+}
+
+// writeChunks writes tar entries of all chunks in order followed by the end
+// of archive marker.  Chunks are archived in memory ahead by up to threads
+// goroutines while large ones are streamed.
+func writeChunks(w io.Writer, dir string, chunks []diffChunk, threads int) error {
+	slots := make(chan struct{}, threads)
+	queue := make(chan diffResult, threads)
+	go func() {
+		for _, c := range chunks {
+			r := diffResult{chunk: c}
+			if !c.large {
+				r.result = make(chan chunkArchive, 1)
+				slots <- struct{}{}
+				go func(changes []archive.Change, result chan<- chunkArchive) {
+					defer func() { <-slots }()
+					data, err := archiveChunk(dir, changes)
+					result <- chunkArchive{data: data, err: err}
+				}(c.changes, r.result)
+			}
+			queue <- r
+		}
+		close(queue)
+	}()
+
+	// Keep draining the queue after an error so archiving completes
+	var err error
+	for r := range queue {
+		if r.result != nil {
+			a := <-r.result
+			if err == nil {
+				err = a.err
+			}
+			if err == nil {
+				_, err = w.Write(a.data)
+			}
+		} else if err == nil {
+			err = streamChunk(w, dir, r.chunk.changes)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(make([]byte, tarTrailerSize))
+	return err
+}
+
+// archiveChunk returns tar entries of the changes.
+func archiveChunk(dir string, changes []archive.Change) ([]byte, error) {
+	r, err := archive.ExportChanges(dir, changes, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < tarTrailerSize {
+		return nil, fmt.Errorf("lcfs: truncated archive of %s", dir)
+	}
+	return data[:len(data)-tarTrailerSize], nil
+}
+
+// streamChunk writes tar entries of the changes as those are archived.
+func streamChunk(w io.Writer, dir string, changes []archive.Change) error {
+	r, err := archive.ExportChanges(dir, changes, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return copyTarEntries(w, r)
+}
+
+// copyTarEntries copies a tar archive leaving out the end of archive marker.
+func copyTarEntries(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 32<<10+tarTrailerSize)
+	held := 0
+	for {
+		n, err := r.Read(buf[held:])
+		held += n
+		if held > tarTrailerSize {
+			if _, err := w.Write(buf[:held-tarTrailerSize]); err != nil {
+				return err
+			}
+			held = copy(buf, buf[held-tarTrailerSize:held])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if held != tarTrailerSize {
+		return fmt.Errorf("lcfs: truncated archive")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+func TestExportChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-diff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var changes []archive.Change
+	for i := 0; i < 2*diffChunkFiles+100; i++ {
+		sub := fmt.Sprintf("/d%d", i%7)
+		if i < 7 {
+			os.Mkdir(filepath.Join(dir, sub), 0755)
+			changes = append(changes, archive.Change{Path: sub, Kind: archive.ChangeAdd})
+		}
+		name := fmt.Sprintf("%s/f%d", sub, i)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		changes = append(changes, archive.Change{Path: name, Kind: archive.ChangeModify})
+	}
+	large := filepath.Join(dir, "d3", "large")
+	if err := ioutil.WriteFile(large, make([]byte, diffChunkSize+1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes = append(changes, archive.Change{Path: "/d3/large", Kind: archive.ChangeAdd})
+
+	chunks := splitChanges(dir, changes)
+	if len(chunks) < 4 {
+		t.Fatalf("changes split into %d chunks", len(chunks))
+	}
+	read := func(threads int) []byte {
+		r, err := exportChanges(dir, changes, threads)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	if !bytes.Equal(read(4), read(1)) {
+		t.Errorf("archive differs from archive created serially")
+	}
+
+	// Hard links are only detected within a chunk
+	if err := os.Link(large, filepath.Join(dir, "d4", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := splitChanges(dir, changes); chunks != nil {
+		t.Errorf("changes with hard links split into %d chunks", len(chunks))
+	}
+}
+
+func TestCopyTarEntries(t *testing.T) {
+	data := append(bytes.Repeat([]byte("x"), 100000), make([]byte, tarTrailerSize)...)
+	var b bytes.Buffer
+	if err := copyTarEntries(&b, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), data[:100000]) {
+		t.Errorf("unexpected entries copied, %d bytes", b.Len())
+	}
+	if err := copyTarEntries(&b, bytes.NewReader(data[:100])); err == nil {
+		t.Errorf("truncated archive copied")
+	}
+}
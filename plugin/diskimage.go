@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+)
+
+// Formats of disk images layers are exported as
+const (
+	diskImageRaw   = "raw"
+	diskImageQcow2 = "qcow2"
+)
+
+// Space added to the size of files of a layer exported, for metadata of the
+// file system of the image and files written by the VM
+const (
+	diskImageInodeSize = 4096
+	diskImageHeadroom  = 64 * units.MiB
+)
+
+// diskImageRequest describes a disk image a layer is exported as, a file of
+// the host of the plugin.  The size defaults to the space of the files of the
+// layer with some headroom.
+type diskImageRequest struct {
+	Path   string `json:"path"`
+	Format string `json:"format,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Label  string `json:"label,omitempty"`
+}
+
+// diskImage is a disk image a layer was exported as.
+type diskImage struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+}
+
+// Runs a program making or converting disk images, replaced by tests
+var runImageTool = func(name string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("lcfs: %s: %v: %s", name, err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// validate checks a request for a disk image, setting the default format.
+func (r *diskImageRequest) validate() error {
+	if r.Format == "" {
+		r.Format = diskImageRaw
+	}
+	if r.Format != diskImageRaw && r.Format != diskImageQcow2 {
+		return fmt.Errorf("lcfs: unknown disk image format %q, expected %s or %s",
+			r.Format, diskImageRaw, diskImageQcow2)
+	}
+	if !path.IsAbs(r.Path) {
+		return fmt.Errorf("lcfs: path %q of disk image is not absolute", r.Path)
+	}
+	if r.Size < 0 {
+		return fmt.Errorf("lcfs: invalid size %d of disk image", r.Size)
+	}
+	if len(r.Label) > 16 {
+		return fmt.Errorf("lcfs: label %q of disk image longer than 16 bytes",
+			r.Label)
+	}
+	return nil
+}
+
+// filesSize returns the space taken by the files in a directory, counting
+// the blocks of each file once, and the space of an inode for every file.
+func filesSize(dir string) (int64, error) {
+	var size int64
+	seen := make(map[uint64]bool)
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if seen[st.Ino] {
+			return nil
+		}
+		seen[st.Ino] = true
+		size += st.Blocks*512 + diskImageInodeSize
+		return nil
+	})
+	return size, err
+}
+
+// ExportDiskImage writes the files of a layer, with those of all the layers
+// it was created from, to a disk image holding a single ext4 file system, for
+// running the image in a VM.  The image is not bootable by itself, it has no
+// partition table or boot loader, and boots with the kernel given to the VM
+// if the layer has an init.  Images are made with mkfs.ext4 populating the
+// file system from the layer, and converted to qcow2 with qemu-img, both
+// installed in the plugin.  The file of the image is replaced once complete,
+// and is not written if the export fails.
+func (d *Driver) ExportDiskImage(id string, req *diskImageRequest) (_ *diskImage, err error) {
+	logrus.Debugf("ExportDiskImage - id %s path %s format %s", id, req.Path,
+		req.Format)
+	defer d.trackOp("ExportDiskImage", id, "")(&err)
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if req.Path, err = d.hostPath(req.Path, "of disk image"); err != nil {
+		return nil, err
+	}
+	dir, err := d.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := d.Put(id); err != nil {
+			logrus.Errorf("Releasing layer %s exported, err %v\n", id, err)
+		}
+	}()
+	size := req.Size
+	if size == 0 {
+		if size, err = filesSize(dir); err != nil {
+			return nil, err
+		}
+		size += size/4 + diskImageHeadroom
+	}
+	size = (size + units.MiB - 1) / units.MiB * units.MiB
+
+	raw := path.Join(path.Dir(req.Path), "."+path.Base(req.Path)+".raw")
+	f, err := os.OpenFile(raw, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(raw)
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-q", "-F", "-d", dir}
+	if req.Label != "" {
+		args = append(args, "-L", req.Label)
+	}
+	if err := runImageTool("mkfs.ext4", append(args, raw)...); err != nil {
+		return nil, err
+	}
+	if req.Format == diskImageQcow2 {
+		tmp := path.Join(path.Dir(req.Path), "."+path.Base(req.Path)+".qcow2")
+		defer os.Remove(tmp)
+		err := runImageTool("qemu-img", "convert", "-f", diskImageRaw, "-O",
+			diskImageQcow2, raw, tmp)
+		if err != nil {
+			return nil, err
+		}
+		raw = tmp
+	}
+	if err := os.Rename(raw, req.Path); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Exported layer %s as %s disk image %s of %d bytes", id,
+		req.Format, req.Path, size)
+	return &diskImage{Path: req.Path, Format: req.Format, Size: size}, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-units"
+)
+
+func TestExportDiskImage(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	run := runImageTool
+	var ran []string
+	runImageTool = func(name string, args ...string) error {
+		ran = append(ran, name+" "+strings.Join(args, " "))
+		out := args[len(args)-1]
+		if name == "mkfs.ext4" {
+			return ioutil.WriteFile(out, []byte("ext4"), 0600)
+		}
+		data, err := ioutil.ReadFile(args[len(args)-2])
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(out, append([]byte("qcow2 "), data...), 0600)
+	}
+	defer func() { runImageTool = run }()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	if err := ioutil.WriteFile(path.Join(f.home, "base", "file"), []byte("data"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	out, cleanupMount := newPropagatedMount(t)
+	defer cleanupMount()
+
+	for _, req := range []*diskImageRequest{
+		{Path: "vm.img"},
+		{Path: os.TempDir() + "/vm.img"},
+		{Path: f.home + "/base/vm.img"},
+		{Path: out + "/vm.img", Format: "vmdk"},
+		{Path: out + "/vm.img", Size: -1},
+	} {
+		if _, err := d.ExportDiskImage("base", req); err == nil {
+			t.Errorf("disk image %+v exported", req)
+		}
+	}
+
+	img, err := d.ExportDiskImage("base", &diskImageRequest{Path: out + "/vm.img",
+		Label: "root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Format != diskImageRaw || img.Size < diskImageHeadroom ||
+		img.Size%units.MiB != 0 {
+		t.Errorf("unexpected disk image %+v", img)
+	}
+	if len(ran) != 1 || !strings.Contains(ran[0], "-d "+path.Join(f.home, "base")) ||
+		!strings.Contains(ran[0], "-L root") {
+		t.Errorf("unexpected programs run %v", ran)
+	}
+	img, err = d.ExportDiskImage("base", &diskImageRequest{Path: out + "/vm.qcow2",
+		Format: diskImageQcow2, Size: units.GiB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(img.Path); string(data) != "qcow2 ext4" ||
+		img.Size != units.GiB {
+		t.Errorf("unexpected disk image %+v holding %q", img, data)
+	}
+	files, _ := ioutil.ReadDir(out)
+	if len(files) != 2 {
+		t.Errorf("temporary files of disk images remain %d", len(files))
+	}
+	if d.mounts.active("base") {
+		t.Error("layer exported left mounted")
+	}
+}
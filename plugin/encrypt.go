@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Storage option encrypting data of a layer with a key of the kernel keyring,
+// given by the description of the key, or a reference to a key of a secret
+// provider
+const encryptionKeyStorageOpt = "encryption.key"
+
+// Longest description of a key, see LC_KEY_REF_MAX in layout.h
+const maxKeyRefLength = 63
+
+// Size of keys, two AES-256 keys used with XTS, see LC_KEY_SIZE in fs.h
+const encryptionKeySize = 64
+
+// parseKeyRef checks the value of the encryption.key storage option.  Keys
+// themselves are refused, as storage options are shown by docker inspect.
+func parseKeyRef(val string) (string, error) {
+	if isRawKey(val) {
+		return "", fmt.Errorf("lcfs: encryption key given instead of a " +
+			"reference, use the description of a key in the kernel keyring " +
+			"or a secret provider")
+	}
+	prefix, name := splitKeyRef(val)
+	if prefix != "" && prefix != keyringSecretPrefix {
+		if err := validateSecretName(name); err != nil {
+			return "", fmt.Errorf("lcfs: invalid encryption key %q, "+
+				"invalid secret name", val)
+		}
+		return val, nil
+	}
+	if name == "" || len(name) > maxKeyRefLength || strings.IndexByte(name, 0) >= 0 {
+		return "", fmt.Errorf("lcfs: invalid encryption key %q, expected "+
+			"the description of a key of up to %d bytes", val, maxKeyRefLength)
+	}
+	return val, nil
+}
+
+// encryptLayer makes the file system encrypt data written to a layer just
+// created, and layers created from it, with a user key of the kernel keyring
+// holding 64 bytes.  The file system loads the key itself and records only
+// its description, so the key is loaded again when the layer is mounted after
+// a restart, and layers cannot be mounted once the key is removed.
+func (d *Driver) encryptLayer(id, ref string) error {
+	buf := make([]byte, 0, len(id)+len(ref)+2)
+	buf = append(buf, id...)
+	buf = append(buf, 0)
+	buf = append(buf, ref...)
+	buf = append(buf, 0)
+	err := d.ioctlBuffer(LayerEncrypt, buf)
+	switch err {
+	case nil:
+		return nil
+	case unix.ENOSYS, unix.ENOTTY:
+		return fmt.Errorf("lcfs: file system does not support encryption: %v",
+			err)
+	case unix.ENOKEY:
+		return fmt.Errorf("lcfs: encryption key %q not found in the kernel "+
+			"keyring: %v", ref, err)
+	case unix.EKEYREJECTED:
+		return fmt.Errorf("lcfs: encryption key %q is not a user key of %d "+
+			"bytes: %v", ref, encryptionKeySize, err)
+	case unix.EKEYREVOKED, unix.EKEYEXPIRED, unix.EACCES:
+		return fmt.Errorf("lcfs: encryption key %q cannot be read: %v", ref,
+			err)
+	}
+	return err
+}
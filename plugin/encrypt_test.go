@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncryptLayer(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	opts := map[string]string{"encryption.key": "lcfs:tenant"}
+	if err := d.CreateReadWrite("rw", "base", "", opts); err != nil {
+		t.Fatal(err)
+	}
+	if f.keys["rw"] != "lcfs:tenant" || f.keys["base"] != "" {
+		t.Errorf("unexpected keys %v", f.keys)
+	}
+
+	for _, key := range []string{"", strings.Repeat("k", maxKeyRefLength+1)} {
+		opts = map[string]string{"encryption.key": key}
+		if err := d.CreateReadWrite("invalid", "base", "", opts); err == nil {
+			t.Errorf("layer created with invalid key %q", key)
+		}
+	}
+
+	// Layers failing to be encrypted are removed
+	opts = map[string]string{"encryption.key": "missing"}
+	err := d.CreateReadWrite("unencrypted", "base", "", opts)
+	if err == nil || !strings.Contains(err.Error(), "not found in the kernel keyring") {
+		t.Errorf("layer created with a missing key, err %v", err)
+	}
+	if _, ok := f.parents["unencrypted"]; ok {
+		t.Errorf("layer failing to be encrypted left behind")
+	}
+}
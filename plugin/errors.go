@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Errors of layers busy, out of space or pinned, matched with errors.Is
+var (
+	errLayerBusy   = errors.New("lcfs: layer busy")
+	errNoSpace     = errors.New("lcfs: no space left in the file system")
+	errLayerPinned = errors.New("lcfs: layer pinned")
+)
+
+// layerError is an errno returned by the file system for a layer, matching
+// the error of the condition with errors.Is, like os.ErrNotExist for a layer
+// not found, as well as the errno.  Docker only gets the message, which ends
+// with the text of the errno.
+type layerError struct {
+	errno    syscall.Errno
+	sentinel error
+	msg      string
+}
+
+func (e *layerError) Error() string {
+	return e.msg + ": " + e.errno.Error()
+}
+
+// Is matches the sentinel error of the condition.
+func (e *layerError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+// Unwrap returns the errno, so errors.Is matches it as well.
+func (e *layerError) Unwrap() error {
+	return e.errno
+}
+
+// mapError translates errnos returned by the file system for driver
+// operations into errors of the conditions, with messages naming those.
+// Errors with context like paths, as when applying a diff, are returned
+// unchanged.
+func mapError(err error) error {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return err
+	}
+	switch errno {
+	case syscall.ENOENT:
+		return &layerError{errno, os.ErrNotExist, "lcfs: layer not found"}
+	case syscall.EEXIST:
+		return &layerError{errno, os.ErrExist, "lcfs: layer already exists"}
+	case syscall.EBUSY:
+		return &layerError{errno, errLayerBusy, "lcfs: layer busy"}
+	case syscall.ENOSPC:
+		return &layerError{errno, errNoSpace, "lcfs: no space left"}
+	}
+	return err
+}
+
+// notFoundError returns the error of a layer which does not exist, or is being
+// removed, naming the layer.
+func notFoundError(id string) error {
+	return &layerError{syscall.ENOENT, os.ErrNotExist,
+		fmt.Sprintf("lcfs: layer %s not found", id)}
+}
+
+// existsError returns the error of creating a layer which exists already,
+// naming the layer.
+func existsError(id string) error {
+	return &layerError{syscall.EEXIST, os.ErrExist,
+		fmt.Sprintf("lcfs: layer %s already exists", id)}
+}
+
+// mountedError returns the error of a layer mounted, which is required not to
+// be for an operation, naming the layer.
+func mountedError(id string) error {
+	return &layerError{syscall.EBUSY, errLayerBusy,
+		fmt.Sprintf("lcfs: layer %s is mounted", id)}
+}
+
+// frozenError returns the error of a layer frozen, which is required not to
+// be for an operation changing it, naming the layer.
+func frozenError(id string) error {
+	return &layerError{syscall.EBUSY, errLayerBusy,
+		fmt.Sprintf("lcfs: layer %s is frozen", id)}
+}
+
+// prefetchingError returns the error of prefetching files of a layer being
+// prefetched already, naming the layer.
+func prefetchingError(id string) error {
+	return &layerError{syscall.EBUSY, errLayerBusy,
+		fmt.Sprintf("lcfs: layer %s is being prefetched", id)}
+}
+
+// removingError returns the error of creating a layer which is being removed,
+// or queued for removal, naming the layer.
+func removingError(id string) error {
+	return &layerError{syscall.EBUSY, errLayerBusy,
+		fmt.Sprintf("lcfs: layer %s is being removed", id)}
+}
+
+// pinnedError returns the error of removing a layer pinned, naming the layer.
+func pinnedError(id string) error {
+	return &layerError{syscall.EPERM, errLayerPinned,
+		fmt.Sprintf("lcfs: layer %s is pinned, unpin it to remove it", id)}
+}
+
+// opError is an error returned by a driver operation, naming the operation
+// and the layer, as dockerd logs only the message.  The error of the layer is
+// unwrapped by errors.Is and errors.As.
+type opError struct {
+	op     string
+	id     string
+	parent string
+	err    error
+}
+
+func (e *opError) Error() string {
+	msg := strings.TrimPrefix(e.err.Error(), "lcfs: ")
+	if e.parent != "" {
+		return fmt.Sprintf("lcfs: %s layer %s parent %s: %s", e.op, e.id,
+			e.parent, msg)
+	}
+	if e.id != "" {
+		return fmt.Sprintf("lcfs: %s layer %s: %s", e.op, e.id, msg)
+	}
+	return fmt.Sprintf("lcfs: %s: %s", e.op, msg)
+}
+
+// Unwrap returns the error of the layer.
+func (e *opError) Unwrap() error {
+	return e.err
+}
+
+// wrapOpError adds the context of a driver operation to an error, unless
+// added already by an operation calling another one.
+func wrapOpError(op, id, parent string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*opError); ok {
+		return err
+	}
+	return &opError{op, id, parent, err}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	graphPlugin "github.com/docker/go-plugins-helpers/graphdriver"
+)
+
+func TestMapError(t *testing.T) {
+	for _, c := range []struct {
+		errno    syscall.Errno
+		sentinel error
+	}{
+		{syscall.ENOENT, os.ErrNotExist},
+		{syscall.EEXIST, os.ErrExist},
+		{syscall.EBUSY, errLayerBusy},
+		{syscall.ENOSPC, errNoSpace},
+	} {
+		err := mapError(c.errno)
+		if !errors.Is(err, c.sentinel) || !errors.Is(err, c.errno) {
+			t.Errorf("%v mapped to %v, not matching %v", c.errno, err, c.sentinel)
+		}
+		if errnoOf(err) != c.errno {
+			t.Errorf("errno of %v is %v", err, errnoOf(err))
+		}
+	}
+	if err := mapError(syscall.EIO); err != syscall.EIO {
+		t.Errorf("EIO mapped to %v", err)
+	}
+	perr := &os.PathError{Op: "open", Path: "/file", Err: syscall.ENOENT}
+	if err := mapError(perr); err != perr {
+		t.Errorf("error with a path mapped to %v", err)
+	}
+}
+
+func TestOpErrorsMapped(t *testing.T) {
+	_, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	if err := d.Create("layer", "missing", "", nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("creating layer from missing parent returned %v", err)
+	}
+	createLayers(t, d, fakeLayer{"layer", "", false})
+	if err := d.Create("layer", "", "", nil); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("creating layer again returned %v", err)
+	}
+	if _, err := d.Get("layer", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove("layer"); !errors.Is(err, errLayerBusy) {
+		t.Fatalf("removing layer mounted returned %v", err)
+	}
+}
+
+func TestCreateExists(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"layer", "", false})
+	cmds := f.count(LayerCreate)
+	err := d.CreateReadWrite("layer", "", "", nil)
+	if !errors.Is(err, os.ErrExist) || !strings.Contains(err.Error(), "layer") {
+		t.Errorf("creating layer known to exist returned %v", err)
+	}
+	if f.count(LayerCreate)+f.count(LayerCreateRw) != cmds {
+		t.Errorf("layer known to exist created again")
+	}
+
+	// Layers created by someone else are reported by the file system
+	d.known.remove("layer")
+	err = d.Create("layer", "", "", nil)
+	if !errors.Is(err, os.ErrExist) || errnoOf(err) != syscall.EEXIST {
+		t.Errorf("creating layer existing returned %v", err)
+	}
+	if _, ok := f.parents["layer"]; !ok {
+		t.Errorf("layer existing removed creating it again")
+	}
+
+	// Layers queued for removal are not created again
+	d.reaper = &reaper{pending: map[string]int{"queued": 0}}
+	defer func() { d.reaper = nil }()
+	cmds = f.count(LayerCreate)
+	err = d.Create("queued", "", "", nil)
+	if !errors.Is(err, errLayerBusy) || f.count(LayerCreate) != cmds {
+		t.Errorf("creating layer queued for removal returned %v", err)
+	}
+}
+
+func TestOpErrorContext(t *testing.T) {
+	_, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	for _, c := range []struct {
+		err      error
+		msg      string
+		sentinel error
+	}{
+		{d.Create("layer", "missing", "", nil),
+			"Create layer layer parent missing:", os.ErrNotExist},
+		{d.Create("base", "", "", nil), "Create layer base:", os.ErrExist},
+		{d.Put("missing"), "Put layer missing:", syscall.ENOENT},
+		{d.Remove("a/b"), "Remove layer a/b:", nil},
+	} {
+		if c.err == nil || !strings.HasPrefix(c.err.Error(), "lcfs: "+c.msg) {
+			t.Errorf("error %v without context %q", c.err, c.msg)
+		}
+		if c.sentinel != nil && !errors.Is(c.err, c.sentinel) {
+			t.Errorf("error %v not matching %v", c.err, c.sentinel)
+		}
+	}
+	if err := wrapOpError("Get", "a", "", nil); err != nil {
+		t.Errorf("no error wrapped as %v", err)
+	}
+	err := wrapOpError("Get", "a", "", wrapOpError("Put", "a", "", syscall.EIO))
+	if err.Error() != "lcfs: Put layer a: input/output error" ||
+		errnoOf(err) != syscall.EIO {
+		t.Errorf("error wrapped twice as %v", err)
+	}
+}
+
+// Docker receives errors over the plugin protocol as messages only, which end
+// with the text of the errno of the condition
+func TestPluginErrorMessages(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	f.mounts["base"] = 1
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go graphPlugin.NewHandler(d).Serve(l)
+	url := "http://" + l.Addr().String()
+
+	check := func(op, msg string, errno syscall.Errno) {
+		if !strings.HasSuffix(msg, ": "+errno.Error()) {
+			t.Errorf("error %q of %s not ending with %q", msg, op, errno.Error())
+		}
+	}
+	for _, c := range []struct {
+		id, parent string
+		errno      syscall.Errno
+	}{
+		{"base", "", syscall.EEXIST},
+		{"layer", "missing", syscall.ENOENT},
+	} {
+		resp, err := graphPlugin.CallCreate(url, http.DefaultClient,
+			graphPlugin.CreateRequest{ID: c.id, Parent: c.parent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("Create", resp.Err, c.errno)
+	}
+	get, err := graphPlugin.CallGet(url, http.DefaultClient,
+		graphPlugin.GetRequest{ID: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("Get", get.Err, syscall.ENOENT)
+	remove, err := graphPlugin.CallRemove(url, http.DefaultClient,
+		graphPlugin.RemoveRequest{ID: "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("Remove", remove.Err, syscall.EBUSY)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Largest buffer passed with an ioctl checking layers exist
+const existsBufferSize = 8192
+
+// layerSet remembers layers known to exist, so checking those does not need
+// an ioctl.  The set is seeded with a single listing of the layer root at
+// Init, as Docker checks every layer it knows of when starting, and updated as
+// layers are created and removed.  Layers not in the set are looked up in the
+// file system.  Parents of layers created since Init are remembered as well.
+// Layers being removed are tracked until removed, so those are not reported to
+// exist while the file system still finds those.
+type layerSet struct {
+	lock     sync.Mutex
+	ids      map[string]knownLayer
+	removing map[string]knownLayer
+}
+
+// knownLayer is a layer known to exist, and its parent if created since Init.
+type knownLayer struct {
+	parent  string
+	created bool
+}
+
+// seed replaces the layers known with the ones listed.
+func (s *layerSet) seed(ids []string) {
+	s.lock.Lock()
+	s.ids = make(map[string]knownLayer, len(ids))
+	for _, id := range ids {
+		s.ids[id] = knownLayer{}
+	}
+	s.lock.Unlock()
+}
+
+// add records a layer created from parent.
+func (s *layerSet) add(id, parent string) {
+	s.lock.Lock()
+	if s.ids == nil {
+		s.ids = make(map[string]knownLayer)
+	}
+	s.ids[id] = knownLayer{parent: parent, created: true}
+	s.lock.Unlock()
+}
+
+// remove forgets a layer being removed.
+func (s *layerSet) remove(id string) {
+	s.lock.Lock()
+	delete(s.ids, id)
+	s.lock.Unlock()
+}
+
+// beginRemove records a layer being removed, returning its parent.
+func (s *layerSet) beginRemove(id string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.removing == nil {
+		s.removing = make(map[string]knownLayer)
+	}
+	l := s.ids[id]
+	delete(s.ids, id)
+	s.removing[id] = l
+	return l.parent
+}
+
+// endRemove records a layer no longer being removed, known to exist again if
+// removing it failed.
+func (s *layerSet) endRemove(id string, exists bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if l, ok := s.removing[id]; ok && exists {
+		if s.ids == nil {
+			s.ids = make(map[string]knownLayer)
+		}
+		s.ids[id] = l
+	}
+	delete(s.removing, id)
+}
+
+// isRemoving checks if a layer is being removed.
+func (s *layerSet) isRemoving(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.removing[id]
+	return ok
+}
+
+// has checks if a layer is known to exist.
+func (s *layerSet) has(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+// parentOf returns the parent of a layer, empty if not known.
+func (s *layerSet) parentOf(id string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.ids[id].parent
+}
+
+// createdFrom returns the parent of a layer created since Init, and false for
+// other layers, with parents not known.
+func (s *layerSet) createdFrom(id string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	l := s.ids[id]
+	return l.parent, l.created
+}
+
+// ExistsAll returns whether each of the layers exists, checking as many
+// layers as fit in a buffer with a single ioctl.
+func (d *Driver) ExistsAll(ids []string) (exists []bool, err error) {
+	logrus.Debugf("ExistsAll - %d ids", len(ids))
+	defer d.trackOp("ExistsAll", "", "")(&err)
+	exists = make([]bool, len(ids))
+
+	// Only look up layers not known to exist
+	var unknown []int
+	for i, id := range ids {
+		if validateID(id) != nil || d.removing(id) {
+			continue
+		}
+		if d.known.has(id) {
+			exists[i] = true
+		} else {
+			unknown = append(unknown, i)
+		}
+	}
+	names := make([]string, len(unknown))
+	for j, i := range unknown {
+		names[j] = ids[i]
+	}
+	bufp := batchBuffers.Get().(*[]byte)
+	defer batchBuffers.Put(bufp)
+	buf := *bufp
+	for start := 0; start < len(names); {
+		n, batch, next := packLayerNames(names, start, buf)
+		start = next
+		if len(batch) == 0 {
+			continue
+		}
+		if err := d.ioctlBuffer(LayersExist, buf[:n+1]); err != nil {
+			return nil, err
+		}
+		for j, i := range batch {
+			exists[unknown[i]] = buf[j] != 0 && !d.removing(names[i])
+		}
+	}
+	return exists, nil
+}
+
+// removing checks if a layer is being removed, or queued for removal.  Layers
+// are queued before those are no longer being removed, so checking in this
+// order never misses a layer.
+func (d *Driver) removing(id string) bool {
+	return d.known.isRemoving(id) || (d.reaper != nil && d.reaper.queued(id))
+}
+
+// packLayerNames copies names of layers starting with ids[start] into buf,
+// NUL separated and terminated by an empty name.  Returns the length of the
+// names copied, indexes of the layers copied and the index of the first layer
+// not considered.  Invalid names are skipped.
+func packLayerNames(ids []string, start int, buf []byte) (n int, batch []int, next int) {
+	for next = start; next < len(ids); next++ {
+		id := ids[next]
+		if id == "" || strings.ContainsRune(id, 0) || len(id)+2 > len(buf) {
+			continue
+		}
+		if n+len(id)+2 > len(buf) {
+			break
+		}
+		n += copy(buf[n:], id)
+		buf[n] = 0
+		n++
+		batch = append(batch, next)
+	}
+	buf[n] = 0
+	return n, batch, next
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackLayerNames(t *testing.T) {
+	ids := []string{"a", "", "bb", strings.Repeat("x", 20), "c\x00", "ddd", "e"}
+	buf := make([]byte, 10)
+
+	n, batch, next := packLayerNames(ids, 0, buf)
+	if !bytes.Equal(buf[:n+1], []byte("a\x00bb\x00ddd\x00\x00")) {
+		t.Errorf("unexpected names %q", buf[:n+1])
+	}
+	if !reflect.DeepEqual(batch, []int{0, 2, 5}) || next != 6 {
+		t.Errorf("unexpected batch %v next %d", batch, next)
+	}
+	n, batch, next = packLayerNames(ids, next, buf)
+	if !bytes.Equal(buf[:n+1], []byte("e\x00\x00")) {
+		t.Errorf("unexpected names %q", buf[:n+1])
+	}
+	if !reflect.DeepEqual(batch, []int{6}) || next != len(ids) {
+		t.Errorf("unexpected batch %v next %d", batch, next)
+	}
+}
+
+func TestLayerSet(t *testing.T) {
+	var s layerSet
+
+	s.add("a", "base")
+	if !s.has("a") || s.has("b") || s.parentOf("a") != "base" {
+		t.Errorf("unexpected layers after add")
+	}
+	s.seed([]string{"b", "c"})
+	if s.has("a") || !s.has("b") || !s.has("c") {
+		t.Errorf("unexpected layers after seed")
+	}
+	s.remove("b")
+	if s.has("b") || !s.has("c") {
+		t.Errorf("unexpected layers after remove")
+	}
+}
+
+func TestExistsWhileRemoving(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"layer", "", false})
+
+	// Check the layer exists while the file system removes it
+	removing := make(chan bool, 2)
+	ioctlSyscall = func(op uintptr, buf []byte) error {
+		if int(op&0xff) == LayerRemove {
+			removing <- d.Exists("layer")
+			exists, err := d.ExistsAll([]string{"layer"})
+			removing <- err == nil && exists[0]
+		}
+		return f.ioctl(op, buf)
+	}
+	if err := d.Remove("layer"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if <-removing {
+			t.Errorf("layer being removed exists")
+		}
+	}
+	if d.Exists("layer") {
+		t.Errorf("layer removed exists")
+	}
+
+	// Layers failing to be removed still exist
+	createLayers(t, d, fakeLayer{"busy", "", false})
+	f.mounts["busy"] = 1
+	if err := d.Remove("busy"); err == nil {
+		t.Fatal("removed layer mounted")
+	}
+	if !d.known.has("busy") || d.known.isRemoving("busy") {
+		t.Errorf("layer failing to be removed not known to exist")
+	}
+}
+
+func TestListLayers(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	for i := 0; i < 1000; i++ {
+		createLayers(t, d, fakeLayer{fmt.Sprintf("layer-%04d", i), "", false})
+	}
+	if err := os.Mkdir(path.Join(f.home, "stray"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	d.reaper = &reaper{pending: map[string]int{"layer-0001": 0}}
+	defer func() { d.reaper = nil }()
+
+	// Layers are listed by the file system, as many as fit with each ioctl
+	ids, err := d.listLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 999 || ids[0] != "layer-0000" || ids[1] != "layer-0002" {
+		t.Errorf("listed %d layers starting with %v", len(ids), ids[:2])
+	}
+	if n := f.count(LayersList); n != 2 {
+		t.Errorf("%d ioctls listing layers, expected 2", n)
+	}
+
+	// Directories are read if the command is not allowed
+	ioctlPolicy = &commandPolicy{allowed: map[int]bool{}}
+	defer func() { ioctlPolicy = nil }()
+	ids, err = d.listLayers()
+	if err != nil || len(ids) != 1000 || ids[999] != "stray" {
+		t.Errorf("listed %d layers reading directories, err %v", len(ids), err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/system"
+	"golang.org/x/sys/unix"
+)
+
+// Whence of lseek finding the next data or hole of a file at an offset
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// Request of ioctl cloning a file, sharing its data with another
+const ficlone = 0x40049409
+
+// Extended attribute of files preserved, as in archives of layers
+const capabilityXattr = "security.capability"
+
+// fileCopier applies changes of the files of a layer in a directory to the
+// same files of a layer in another directory, created from the same parent
+// on another file system.  Owners, modes, times, capabilities and hard links
+// of files are preserved, as exported for docker push, and only the data of
+// files is copied, not holes of sparse files.
+type fileCopier struct {
+	src, dst string
+
+	// Files copied with more than one link, by inode
+	links map[uint64]string
+
+	// Directories copied, with times set once their files are
+	dirs []string
+
+	// Directories of the destination found not to be links
+	checked map[string]bool
+}
+
+// copyLayerFiles applies changes of files in src to dst.
+func copyLayerFiles(src, dst string, changes []archive.Change) error {
+	c := &fileCopier{src: src, dst: dst, links: make(map[uint64]string),
+		checked: make(map[string]bool)}
+	for _, change := range changes {
+		p := path.Clean("/" + change.Path)
+		if err := c.checkDir(path.Dir(p)); err != nil {
+			return err
+		}
+		delete(c.checked, p)
+		if change.Kind == archive.ChangeDelete {
+			if err := os.RemoveAll(path.Join(dst, p)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.copy(p); err != nil {
+			return fmt.Errorf("lcfs: copying %s: %v", p, err)
+		}
+	}
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(path.Join(src, c.dirs[i]))
+		if err != nil {
+			continue
+		}
+		if err := setTimes(path.Join(dst, c.dirs[i]), fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDir checks a directory of the destination and the directories it is
+// in are not links, which would point files copied out of the layer.
+func (c *fileCopier) checkDir(dir string) error {
+	if dir == "/" || c.checked[dir] {
+		return nil
+	}
+	if err := c.checkDir(path.Dir(dir)); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(path.Join(c.dst, dir))
+	if os.IsNotExist(err) {
+		err = os.Mkdir(path.Join(c.dst, dir), 0755)
+	} else if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("lcfs: %s is not a directory", dir)
+	}
+	if err != nil {
+		return err
+	}
+	c.checked[dir] = true
+	return nil
+}
+
+// copy copies a file added or modified, if still present.  Links in the
+// directories of the file in the source are refused, as those would copy
+// files from out of the layer.
+func (c *fileCopier) copy(p string) error {
+	s, d := path.Join(c.src, p), path.Join(c.dst, p)
+	fi, err := lstatNoFollow(c.src, p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+
+	// Files replaced by directories, or directories by files
+	if dfi, err := os.Lstat(d); err == nil && dfi.IsDir() != fi.IsDir() {
+		if err := os.RemoveAll(d); err != nil {
+			return err
+		}
+	}
+	switch {
+	case fi.IsDir():
+		if err := os.Mkdir(d, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		c.dirs = append(c.dirs, p)
+
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(s)
+		if err != nil {
+			return err
+		}
+		if err := removeFile(d); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, d); err != nil {
+			return err
+		}
+
+	case fi.Mode().IsRegular():
+		if st.Nlink > 1 {
+			if l, ok := c.links[st.Ino]; ok {
+				if err := removeFile(d); err != nil {
+					return err
+				}
+				return os.Link(path.Join(c.dst, l), d)
+			}
+			c.links[st.Ino] = p
+		}
+		if err := copyFileExtents(s, d, fi.Size()); err != nil {
+			return err
+		}
+
+	default:
+		if err := removeFile(d); err != nil {
+			return err
+		}
+		if err := unix.Mknod(d, st.Mode, int(st.Rdev)); err != nil {
+			return err
+		}
+	}
+	if err := os.Lchown(d, int(st.Uid), int(st.Gid)); err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		if err := unix.Chmod(d, st.Mode&07777); err != nil {
+			return err
+		}
+	}
+	capability, err := system.Lgetxattr(s, capabilityXattr)
+	if err == nil && capability != nil {
+		if err := system.Lsetxattr(d, capabilityXattr, capability, 0); err != nil {
+			return err
+		}
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	return setTimes(d, fi)
+}
+
+// removeFile removes a file, if present.
+func removeFile(name string) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// setTimes sets the access and modification times of a file, not following
+// links, to those of another.
+func setTimes(name string, fi os.FileInfo) error {
+	st := fi.Sys().(*syscall.Stat_t)
+	ts := []unix.Timespec{
+		{Sec: st.Atim.Sec, Nsec: st.Atim.Nsec},
+		{Sec: st.Mtim.Sec, Nsec: st.Mtim.Nsec},
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// copyFileExtents replaces a file with a copy of another, sharing the data of
+// the file if the file system clones files, or copying only the ranges
+// holding data, so holes of sparse files stay holes.  Files of file systems
+// not finding holes are copied whole.
+func copyFileExtents(src, dst string, size int64) error {
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := removeFile(dst); err != nil {
+		return err
+	}
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, d.Fd(), ficlone, s.Fd())
+	if errno == 0 {
+		return d.Close()
+	}
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(int(s.Fd()), off, seekData)
+		if err == unix.ENXIO {
+			break
+		}
+		end := size
+		if err != nil {
+			data = off
+		} else if hole, err := unix.Seek(int(s.Fd()), data, seekHole); err == nil {
+			end = hole
+		}
+		if _, err := d.Seek(data, io.SeekStart); err != nil {
+			d.Close()
+			return err
+		}
+		_, err = io.Copy(d, io.NewSectionReader(s, data, end-data))
+		if err != nil {
+			d.Close()
+			return err
+		}
+		off = end
+	}
+	if err := d.Truncate(size); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
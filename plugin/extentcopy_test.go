@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+func TestCopyLayerFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst, outside := path.Join(dir, "src"), path.Join(dir, "dst"),
+		path.Join(dir, "outside")
+	for _, d := range []string{src + "/new/sub", dst, outside} {
+		os.MkdirAll(d, 0755)
+	}
+
+	// A sparse file, hard links, a link and a file removed from the parent
+	f, err := os.Create(path.Join(src, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("end"), 16<<20)
+	f.Close()
+	ioutil.WriteFile(path.Join(src, "new/sub/file"), []byte("data"), 0640)
+	os.Link(path.Join(src, "new/sub/file"), path.Join(src, "new/link"))
+	os.Symlink("sub/file", path.Join(src, "new/symlink"))
+	os.Chmod(path.Join(src, "new"), 0711)
+	ioutil.WriteFile(path.Join(dst, "removed"), nil, 0644)
+
+	changes := []archive.Change{
+		{Path: "/sparse", Kind: archive.ChangeAdd},
+		{Path: "/new", Kind: archive.ChangeAdd},
+		{Path: "/new/sub/file", Kind: archive.ChangeAdd},
+		{Path: "/new/link", Kind: archive.ChangeAdd},
+		{Path: "/new/symlink", Kind: archive.ChangeAdd},
+		{Path: "/removed", Kind: archive.ChangeDelete},
+	}
+	if err := copyLayerFiles(src, dst, changes); err != nil {
+		t.Fatal(err)
+	}
+	var sfi, dfi syscall.Stat_t
+	syscall.Stat(path.Join(src, "sparse"), &sfi)
+	if err := syscall.Stat(path.Join(dst, "sparse"), &dfi); err != nil {
+		t.Fatal(err)
+	}
+	if dfi.Size != sfi.Size || dfi.Blocks > sfi.Blocks+8 {
+		t.Errorf("sparse file copied with size %d and %d blocks, from %d "+
+			"blocks", dfi.Size, dfi.Blocks, sfi.Blocks)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(dst, "new/sub/file")); string(data) != "data" {
+		t.Errorf("unexpected data copied %q", data)
+	}
+	var l1, l2 syscall.Stat_t
+	syscall.Stat(path.Join(dst, "new/sub/file"), &l1)
+	syscall.Stat(path.Join(dst, "new/link"), &l2)
+	if l1.Ino != l2.Ino || l1.Mode&07777 != 0640 {
+		t.Errorf("hard link not kept, mode %o", l1.Mode&07777)
+	}
+	if target, _ := os.Readlink(path.Join(dst, "new/symlink")); target != "sub/file" {
+		t.Errorf("link copied to %q", target)
+	}
+	if fi, _ := os.Stat(path.Join(dst, "new")); fi == nil || fi.Mode().Perm() != 0711 {
+		t.Errorf("mode of directory not copied %v", fi)
+	}
+	if _, err := os.Lstat(path.Join(dst, "removed")); !os.IsNotExist(err) {
+		t.Error("file removed by the layer kept")
+	}
+
+	// Files are never copied through links of the destination
+	os.Symlink(outside, path.Join(dst, "escape"))
+	os.MkdirAll(path.Join(src, "escape"), 0755)
+	ioutil.WriteFile(path.Join(src, "escape/file"), nil, 0644)
+	err = copyLayerFiles(src, dst,
+		[]archive.Change{{Path: "/escape/file", Kind: archive.ChangeAdd}})
+	if err == nil {
+		t.Error("file copied through a link")
+	}
+	if _, err := os.Lstat(path.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Error("file copied out of the layer")
+	}
+
+	// Nor are files read through links of the source
+	ioutil.WriteFile(path.Join(outside, "secret"), []byte("secret"), 0600)
+	os.Symlink(outside, path.Join(src, "host"))
+	err = copyLayerFiles(src, dst,
+		[]archive.Change{{Path: "/host/secret", Kind: archive.ChangeAdd}})
+	if err == nil {
+		t.Error("file copied through a link of the source")
+	}
+	if _, err := os.Lstat(path.Join(dst, "host/secret")); !os.IsNotExist(err) {
+		t.Error("file out of the layer copied")
+	}
+}
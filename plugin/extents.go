@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Buffer used for querying extents of a layer, holding about 500 extents
+const extentsBufferSize = 8192
+
+// Size of the header of extents returned by the file system
+const layerExtentsHeaderSize = 16
+
+// blockExtent is a range of the device changed by a layer.
+type blockExtent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// ChangedExtents returns the ranges of the device holding blocks allocated in
+// a layer, which are the blocks changed by the layer relative to its parent,
+// including its metadata.  Data of a layer not written to disk yet is not
+// included, so the result is complete for layers committed or not being
+// modified.  Extents are returned in the order maintained by the file system.
+func (d *Driver) ChangedExtents(id string) (extents []blockExtent, err error) {
+	logrus.Debugf("ChangedExtents - id %s", id)
+	defer d.trackOp("ChangedExtents", id, "")(&err)
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	if len(id)+22 > extentsBufferSize {
+		return nil, unix.EINVAL
+	}
+	if d.reaper != nil && d.reaper.queued(id) {
+		return nil, unix.ENOENT
+	}
+	buf := make([]byte, extentsBufferSize)
+	for {
+		// Pass the index of the first extent needed after the name
+		n := copy(buf, id)
+		buf[n] = 0
+		n++
+		n += copy(buf[n:], strconv.Itoa(len(extents)))
+		buf[n] = 0
+		if err := d.ioctlBuffer(LayerExtents, buf); err != nil {
+			return nil, err
+		}
+		total, batch, err := decodeLayerExtents(buf)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, batch...)
+		if len(batch) == 0 || uint64(len(extents)) >= total {
+			return extents, nil
+		}
+	}
+}
+
+// decodeLayerExtents decodes extents returned by the file system, returning
+// the number of extents allocated in the layer along with those returned.
+func decodeLayerExtents(buf []byte) (uint64, []blockExtent, error) {
+	var hdr struct {
+		Total uint64
+		Count uint64
+	}
+
+	if len(buf) < layerExtentsHeaderSize {
+		return 0, nil, unix.EINVAL
+	}
+	r := bytes.NewReader(buf)
+	if err := binary.Read(r, nativeEndian, &hdr); err != nil {
+		return 0, nil, err
+	}
+	if hdr.Count > uint64(len(buf)-layerExtentsHeaderSize)/16 {
+		return 0, nil, unix.EINVAL
+	}
+	extents := make([]blockExtent, hdr.Count)
+	for i := range extents {
+		var e struct {
+			Start uint64
+			Count uint64
+		}
+		if err := binary.Read(r, nativeEndian, &e); err != nil {
+			return 0, nil, err
+		}
+		extents[i] = blockExtent{
+			Offset: int64(e.Start * lcfsBlockSize),
+			Length: int64(e.Count * lcfsBlockSize),
+		}
+	}
+	return hdr.Total, extents, nil
+}
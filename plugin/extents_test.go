@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeLayerExtents(t *testing.T) {
+	var b bytes.Buffer
+	for _, v := range []uint64{5, 2, 10, 1, 100, 3} {
+		binary.Write(&b, nativeEndian, v)
+	}
+	buf := make([]byte, 64)
+	copy(buf, b.Bytes())
+
+	total, extents, err := decodeLayerExtents(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []blockExtent{
+		{Offset: 10 * lcfsBlockSize, Length: lcfsBlockSize},
+		{Offset: 100 * lcfsBlockSize, Length: 3 * lcfsBlockSize},
+	}
+	if total != 5 || !reflect.DeepEqual(extents, exp) {
+		t.Errorf("unexpected total %d extents %v", total, extents)
+	}
+	if _, _, err := decodeLayerExtents(buf[:40]); err == nil {
+		t.Errorf("truncated extents decoded")
+	}
+	if _, _, err := decodeLayerExtents(buf[:8]); err == nil {
+		t.Errorf("truncated header decoded")
+	}
+}
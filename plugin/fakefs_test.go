@@ -0,0 +1,255 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeFS emulates the ioctls of the file system for tests of driver
+// operations.  Layers are directories in home, the file system presents files
+// of the parent in a new layer right away, so tests populate the directory of
+// a layer beforehand as needed.
+type fakeFS struct {
+	home string
+
+	lock    sync.Mutex
+	parents map[string]string
+	mounts  map[string]int
+	shifts  map[string]string
+	keys    map[string]string
+	options map[string]string
+	sealed  map[string]bool
+	cmds    []int
+
+	// Fail waiting for a commit like file systems not supporting it
+	noSync bool
+}
+
+// newFakeFS installs a fake file system and returns a driver using it.  The
+// returned function restores the real ioctls and removes the layers.
+func newFakeFS(t testing.TB) (*fakeFS, *Driver, func()) {
+	home, err := ioutil.TempDir("", "lcfs-fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFS{
+		home:    home,
+		parents: make(map[string]string),
+		mounts:  make(map[string]int),
+		shifts:  make(map[string]string),
+		keys:    make(map[string]string),
+		options: make(map[string]string),
+		sealed:  make(map[string]bool),
+	}
+	ioctlSyscall = f.ioctl
+	return f, &Driver{home: home}, func() {
+		ioctlSyscall = rootIoctl
+		os.RemoveAll(home)
+	}
+}
+
+// fakeLayer is a layer created for a test, from parent, writable if rw.
+type fakeLayer struct {
+	id, parent string
+	rw         bool
+}
+
+// createLayers creates layers in order, failing the test if any cannot be.
+func createLayers(t testing.TB, d *Driver, layers ...fakeLayer) {
+	for _, l := range layers {
+		create := d.Create
+		if l.rw {
+			create = d.CreateReadWrite
+		}
+		if err := create(l.id, l.parent, "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newPropagatedMount returns a directory standing in for the propagated
+// mount, where files named in requests are.
+func newPropagatedMount(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "lcfs-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	mount := propagatedMount
+	propagatedMount = dir
+	return dir, func() {
+		propagatedMount = mount
+		os.RemoveAll(dir)
+	}
+}
+
+// ioctl decodes an ioctl as the file system does and applies it.
+func (f *fakeFS) ioctl(op uintptr, buf []byte) error {
+	cmd := int(op & 0xff)
+	plen := int((op >> 8) & 0xff)
+	name := string(buf[:(op>>16)&0x3fff])
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.cmds = append(f.cmds, cmd)
+	switch cmd {
+	case LayerCreate, LayerCreateRw:
+		id, parent := name, ""
+		if plen > 0 {
+			parent, id = name[:plen], name[plen+1:]
+			if _, ok := f.parents[parent]; !ok {
+				return unix.ENOENT
+			}
+		}
+		if _, ok := f.parents[id]; ok {
+			return unix.EEXIST
+		}
+		err := os.Mkdir(path.Join(f.home, id), 0700)
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		f.parents[id] = parent
+		return nil
+
+	case LayerRemove:
+		if _, ok := f.parents[name]; !ok {
+			return unix.ENOENT
+		}
+		if f.mounts[name] > 0 {
+			return unix.EBUSY
+		}
+		delete(f.parents, name)
+		return os.RemoveAll(path.Join(f.home, name))
+
+	case LayerMount, LayerUmount, LayerStat:
+		options := ""
+		if cmd == LayerMount && plen > 0 {
+			options, name = name[:plen], name[plen+1:]
+		}
+		if _, ok := f.parents[name]; !ok {
+			return unix.ENOENT
+		}
+		if cmd == LayerMount {
+			f.options[name] = options
+			f.mounts[name]++
+		} else if cmd == LayerUmount && f.mounts[name] > 0 {
+			f.mounts[name]--
+		}
+		return nil
+
+	case LayersMounted:
+		names := strings.Split(string(buf), "\x00")
+		for i, id := range names {
+			if id == "" {
+				break
+			}
+			buf[i] = byte(f.mounts[id])
+		}
+		return nil
+
+	case LayersList:
+		start, err := strconv.Atoi(name[:strings.IndexByte(name, 0)])
+		if err != nil {
+			return unix.EINVAL
+		}
+		ids := make([]string, 0, len(f.parents))
+		for id := range f.parents {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		n, count := layerListHeaderSize, 0
+		for _, id := range ids[start:] {
+			if n+len(id)+1 > len(buf) {
+				break
+			}
+			n += copy(buf[n:], id)
+			buf[n] = 0
+			n++
+			count++
+		}
+		nativeEndian.PutUint64(buf, uint64(len(ids)))
+		nativeEndian.PutUint64(buf[8:], uint64(count))
+		return nil
+
+	case LcfsSync:
+		if f.noSync {
+			return unix.ENOTTY
+		}
+		return nil
+
+	case LcfsCommit:
+		return nil
+
+	case LayerShift:
+		args := strings.Split(string(buf), "\x00")
+		if _, ok := f.parents[args[0]]; !ok {
+			return unix.ENOENT
+		}
+		f.shifts[args[0]] = args[1]
+		return nil
+
+	case LayerEncrypt:
+		args := strings.Split(string(buf), "\x00")
+		if _, ok := f.parents[args[0]]; !ok {
+			return unix.ENOENT
+		}
+		if args[1] == "missing" {
+			return unix.ENOKEY
+		}
+		f.keys[args[0]] = args[1]
+		return nil
+
+	case LayerSeal:
+		if _, ok := f.parents[name]; !ok {
+			return unix.ENOENT
+		}
+		f.sealed[name] = true
+		return nil
+
+	case LayerStats:
+		id := name[:strings.IndexByte(name, 0)]
+		parent, ok := f.parents[id]
+		if !ok {
+			return unix.ENOENT
+		}
+		for i := range buf[:layerIOStatsSize] {
+			buf[i] = 0
+		}
+		depth := uint64(0)
+		for ; parent != ""; parent = f.parents[parent] {
+			depth++
+		}
+		if len(buf) >= layerStatsSize {
+			nativeEndian.PutUint64(buf[layerIOStatsSize:], depth)
+		}
+		return nil
+
+	case LcfsHandshake:
+		return daemonHandshake(op, buf, nativeEndian, ioctlRevision)
+	}
+	return unix.ENOTTY
+}
+
+// count returns the number of ioctls issued with the command.
+func (f *fakeFS) count(cmd int) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	n := 0
+	for _, c := range f.cmds {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
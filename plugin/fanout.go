@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Most writable layers created from a template in one call
+const maxFanOut = 1024
+
+// fanOutRequest asks for writable layers created from a template layer, with
+// the same storage options as Docker passes creating a layer.
+type fanOutRequest struct {
+	Count      int               `json:"count"`
+	StorageOpt map[string]string `json:"storage_opt,omitempty"`
+}
+
+// FanOut creates a number of writable layers from a template layer, like
+// containers of the same image, returning the ids generated for those.  The
+// file system is committed once for all layers created if lcfs.sync_create
+// is set, instead of once for each.  Either all layers are created, or none.
+func (d *Driver) FanOut(template string, req *fanOutRequest) (ids []string,
+	err error) {
+	logrus.Debugf("FanOut - template %s count %d", template, req.Count)
+	defer d.trackOp("FanOut", "", template)(&err)
+	if err := validateID(template); err != nil {
+		return nil, err
+	}
+	if req.Count < 1 || req.Count > maxFanOut {
+		return nil, fmt.Errorf("lcfs: count of layers %d not between 1 and %d",
+			req.Count, maxFanOut)
+	}
+	opts, err := parseLayerOptions(req.StorageOpt)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.checkParent(template); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			d.removeFannedOut(ids)
+			ids = nil
+		}
+	}()
+	for len(ids) < req.Count {
+		id, err := newLayerID()
+		if err != nil {
+			return ids, err
+		}
+		unlock := d.layers.lock(id)
+		err = d.createLayer(LayerCreateRw, id, template, opts, false)
+		unlock()
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	if d.opts != nil && d.opts.SyncCreate {
+		if err := d.syncLayers(); err != nil {
+			return ids, err
+		}
+	}
+	logrus.Infof("Created %d layers from %s", len(ids), template)
+	return ids, nil
+}
+
+// removeFannedOut removes layers created by a fan out failed.
+func (d *Driver) removeFannedOut(ids []string) {
+	for _, id := range ids {
+		if err := d.Remove(id); err != nil {
+			logrus.Errorf("Removing layer %s, err %v\n", id, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFanOut(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.opts = &driverOptions{SyncCreate: true}
+	createLayers(t, d, fakeLayer{"template", "", false})
+	syncs := f.count(LcfsSync)
+	ids, err := d.FanOut("template", &fanOutRequest{Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] == ids[1] || ids[1] == ids[2] {
+		t.Fatalf("unexpected layers created %v", ids)
+	}
+	for _, id := range ids {
+		if f.parents[id] != "template" || !d.Exists(id) {
+			t.Errorf("layer %s created from %q", id, f.parents[id])
+		}
+	}
+	if n := f.count(LcfsSync) - syncs; n != 1 {
+		t.Errorf("file system committed %d times, expected once", n)
+	}
+	for _, c := range []struct {
+		template string
+		req      fanOutRequest
+	}{
+		{"template", fanOutRequest{Count: 0}},
+		{"template", fanOutRequest{Count: maxFanOut + 1}},
+		{"missing", fanOutRequest{Count: 1}},
+		{"template", fanOutRequest{Count: 1,
+			StorageOpt: map[string]string{"label": "app"}}},
+	} {
+		if ids, err := d.FanOut(c.template, &c.req); err == nil {
+			t.Errorf("created layers %v from %s with %+v", ids, c.template,
+				c.req)
+		}
+	}
+	if len(f.parents) != 4 {
+		t.Errorf("layers left by fan outs failed %v", f.parents)
+	}
+}
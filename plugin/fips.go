@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/fips140"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Set by builds with the fips tag, which always run in FIPS 140-only mode
+var fipsBuild bool
+
+// Checks if the FIPS 140-3 module of Go is enabled, replaced by tests
+var fipsEnabled = fips140.Enabled
+
+// checkFIPS checks the plugin runs with the FIPS 140-3 module of Go, when
+// required by the fips option or the build.  Digests of diffs applied, of the
+// Merkle trees of layers and of the audit chain are SHA-256, signatures of
+// layers Ed25519, and the module limits TLS of the admin API to approved
+// algorithms, so nothing else changes once the module is enabled.
+func checkFIPS(opts *driverOptions) error {
+	if !opts.FIPS && !fipsBuild {
+		return nil
+	}
+	if !fipsEnabled() {
+		return fmt.Errorf("lcfs: fips requires the FIPS 140-3 module, run " +
+			"with GODEBUG=fips140=on or build with -tags fips")
+	}
+	if fips140.Enforced() {
+		logrus.Infof("Running in FIPS 140-only mode, module %s",
+			fips140.Version())
+	} else {
+		logrus.Infof("Running in FIPS 140 mode, module %s", fips140.Version())
+	}
+	return nil
+}
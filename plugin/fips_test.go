@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestCheckFIPS(t *testing.T) {
+	defer func(enabled func() bool, build bool) {
+		fipsEnabled, fipsBuild = enabled, build
+	}(fipsEnabled, fipsBuild)
+	enabled := false
+	fipsEnabled = func() bool { return enabled }
+	fipsBuild = false
+
+	opts := &driverOptions{}
+	if err := checkFIPS(opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.FIPS = true
+	if err := checkFIPS(opts); err == nil {
+		t.Error("fips accepted without the module")
+	}
+	enabled = true
+	if err := checkFIPS(opts); err != nil {
+		t.Error(err)
+	}
+
+	// Required by builds for FIPS whatever the options
+	opts.FIPS = false
+	fipsBuild = true
+	enabled = false
+	if err := checkFIPS(opts); err == nil {
+		t.Error("fips build accepted without the module")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Root of the proc file system, replaced by tests
+var procRoot = "/proc"
+
+// removeLayer removes a layer from the file system.  Layers busy, as when a
+// mount leaked, are unmounted and removed again if forced removal is enabled.
+func (d *Driver) removeLayer(id string) error {
+	err := d.ioctl(LayerRemove, "", id)
+	if err != unix.EBUSY || d.opts == nil || !d.opts.ForceRemove {
+		return err
+	}
+	dir := path.Join(d.home, id)
+	holders := "no process"
+	if h := layerHolders(dir); len(h) > 0 {
+		holders = strings.Join(h, ", ")
+	}
+	logrus.Warnf("Remove - layer %s busy, used by %s, forcing removal", id,
+		holders)
+
+	// Detach anything mounted on the layer, and drop mounts the file system
+	// counts, which no one tracks anymore
+	if err := unix.Unmount(dir, unix.MNT_DETACH); err != nil &&
+		err != unix.EINVAL && err != unix.ENOENT {
+		logrus.Errorf("Detaching mount of layer %s, err %v\n", id, err)
+	}
+	d.mounts.forget(id)
+	if counts, err := d.mountCounts([]string{id}); err == nil {
+		d.umountOrphan(id, counts[0])
+	}
+	return d.ioctl(LayerRemove, "", id)
+}
+
+// layerHolders lists processes with the current or root directory or a file
+// open in a layer, described by pid and command.
+func layerHolders(dir string) []string {
+	var holders []string
+
+	for _, pid := range layerPids(dir) {
+		comm, _ := ioutil.ReadFile(path.Join(procRoot, strconv.Itoa(pid), "comm"))
+		holders = append(holders, fmt.Sprintf("pid %d (%s)", pid,
+			strings.TrimSpace(string(comm))))
+	}
+	return holders
+}
+
+// layerPids returns processes with the current or root directory or a file
+// open in a layer.
+func layerPids(dir string) []int {
+	var pids []int
+
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		if usesLayer(path.Join(procRoot, e.Name()), dir) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// usesLayer checks if a process uses files in dir.
+func usesLayer(pdir, dir string) bool {
+	links := []string{path.Join(pdir, "cwd"), path.Join(pdir, "root")}
+	fds, _ := ioutil.ReadDir(path.Join(pdir, "fd"))
+	for _, fd := range fds {
+		links = append(links, path.Join(pdir, "fd", fd.Name()))
+	}
+	for _, link := range links {
+		target, err := os.Readlink(link)
+		if err == nil && (target == dir || strings.HasPrefix(target, dir+"/")) {
+			return true
+		}
+	}
+	return false
+}
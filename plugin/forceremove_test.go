@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestForceRemove(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.opts = &driverOptions{}
+	createLayers(t, d, fakeLayer{"layer", "", false})
+
+	// Mounts leaked by no one tracking those
+	f.mounts["layer"] = 2
+	if err := d.Remove("layer"); !errors.Is(err, errLayerBusy) {
+		t.Fatalf("removing busy layer returned %v", err)
+	}
+	d.opts.ForceRemove = true
+	if err := d.Remove("layer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.parents["layer"]; ok {
+		t.Fatal("busy layer not removed")
+	}
+}
+
+func TestLayerHolders(t *testing.T) {
+	proc, err := ioutil.TempDir("", "lcfs-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(proc)
+	defer func(root string) { procRoot = root }(procRoot)
+	procRoot = proc
+
+	dir := "/lcfs/layer"
+	for _, l := range []struct{ link, target string }{
+		{"123/cwd", dir + "/usr"},
+		{"456/fd/3", "/lcfs/layer2/file"},
+		{"789/fd/4", dir + "/etc/passwd"},
+		{"self/cwd", dir},
+	} {
+		link := path.Join(proc, l.link)
+		if err := os.MkdirAll(path.Dir(link), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(l.target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(path.Join(proc, "123", "comm"), []byte("sh\n"), 0644)
+	ioutil.WriteFile(path.Join(proc, "789", "comm"), []byte("nginx\n"), 0644)
+
+	holders := layerHolders(dir)
+	expected := []string{"pid 123 (sh)", "pid 789 (nginx)"}
+	if !reflect.DeepEqual(holders, expected) {
+		t.Fatalf("holders %v, expected %v", holders, expected)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// errNoFreezeState is returned for freezing layers without freeze_state set.
+var errNoFreezeState = errors.New("lcfs: freezing layers requires freeze_state")
+
+// frozenCgroup is a cgroup frozen, as recorded in the freeze state.
+type frozenCgroup struct {
+	Dir string `json:"dir"`
+	V1  bool   `json:"v1,omitempty"`
+}
+
+// freezeState records the cgroups frozen by the plugin in a file kept across
+// restarts, so cgroups left frozen by the plugin crashing or killed are
+// thawed when it starts again, instead of staying frozen with no layer
+// frozen to thaw.
+type freezeState struct {
+	file    string
+	lock    sync.Mutex
+	cgroups map[string]bool
+}
+
+// loadFreezeState reads the cgroups frozen recorded in file, if any.
+func loadFreezeState(file string) (*freezeState, error) {
+	s := &freezeState{file: file, cgroups: make(map[string]bool)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cgroups []frozenCgroup
+	if err := json.Unmarshal(data, &cgroups); err != nil {
+		return nil, fmt.Errorf("lcfs: reading cgroups frozen from %s: %v",
+			file, err)
+	}
+	for _, c := range cgroups {
+		s.cgroups[c.Dir] = c.V1
+	}
+	return s, nil
+}
+
+// set records a cgroup frozen, or thawed, replacing the file atomically.
+func (s *freezeState) set(f *cgroupFreezer, frozen bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if frozen {
+		s.cgroups[f.dir] = f.v1
+	} else {
+		delete(s.cgroups, f.dir)
+	}
+	cgroups := make([]frozenCgroup, 0, len(s.cgroups))
+	for dir, v1 := range s.cgroups {
+		cgroups = append(cgroups, frozenCgroup{dir, v1})
+	}
+	sort.Slice(cgroups, func(i, j int) bool { return cgroups[i].Dir < cgroups[j].Dir })
+	data, err := json.Marshal(cgroups)
+	if err == nil {
+		tmp := s.file + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, s.file)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("lcfs: recording cgroups frozen in %s: %v", s.file,
+			err)
+	}
+	return nil
+}
+
+// thawLeft thaws the cgroups recorded frozen.  Cgroups removed meanwhile, as
+// of containers stopped or a host rebooted, are forgotten.
+func (s *freezeState) thawLeft() {
+	s.lock.Lock()
+	var left []*cgroupFreezer
+	for dir, v1 := range s.cgroups {
+		left = append(left, &cgroupFreezer{dir, v1})
+	}
+	s.lock.Unlock()
+	for _, f := range left {
+		err := f.set(false)
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("Thawing cgroup %s left frozen, err %v\n", f.dir, err)
+			continue
+		}
+		if err == nil {
+			logrus.Warnf("Thawed cgroup %s left frozen", f.dir)
+		}
+		if err := s.set(f, false); err != nil {
+			logrus.Errorf("%v", err)
+		}
+	}
+}
+
+// recordFrozen records a cgroup frozen or thawed if the freeze state is kept.
+func (d *Driver) recordFrozen(f *cgroupFreezer, frozen bool) error {
+	if d.freezeState == nil {
+		return nil
+	}
+	return d.freezeState.set(f, frozen)
+}
+
+// frozenLayer is a layer frozen, with the function thawing the processes
+// using it.
+type frozenLayer struct {
+	thaw  func()
+	since time.Time
+}
+
+// frozenLayers tracks layers frozen until thawed.
+type frozenLayers struct {
+	lock   sync.Mutex
+	layers map[string]*frozenLayer
+}
+
+// add records a layer frozen, returning false if frozen already.
+func (f *frozenLayers) add(id string, thaw func()) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.layers == nil {
+		f.layers = make(map[string]*frozenLayer)
+	}
+	if f.layers[id] != nil {
+		return false
+	}
+	f.layers[id] = &frozenLayer{thaw, time.Now()}
+	return true
+}
+
+// remove forgets a layer frozen, returning the function thawing it, or nil
+// if not frozen.
+func (f *frozenLayers) remove(id string) func() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	l := f.layers[id]
+	if l == nil {
+		return nil
+	}
+	delete(f.layers, id)
+	return l.thaw
+}
+
+// has checks if a layer is frozen.
+func (f *frozenLayers) has(id string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.layers[id] != nil
+}
+
+// list returns the layers frozen, sorted, with the time each was frozen at.
+func (f *frozenLayers) list() []adminFrozen {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	frozen := make([]adminFrozen, 0, len(f.layers))
+	for id, l := range f.layers {
+		frozen = append(frozen, adminFrozen{ID: id, Since: l.since})
+	}
+	sort.Slice(frozen, func(i, j int) bool { return frozen[i].ID < frozen[j].ID })
+	return frozen
+}
+
+// thawAll thaws all layers frozen.
+func (f *frozenLayers) thawAll() {
+	f.lock.Lock()
+	layers := f.layers
+	f.layers = nil
+	f.lock.Unlock()
+	for id, l := range layers {
+		l.thaw()
+		logrus.Infof("Thawed layer %s", id)
+	}
+}
+
+// checkFrozen returns an error for a layer frozen, which is not changed until
+// thawed.
+func (d *Driver) checkFrozen(id string) error {
+	if d.frozen.has(id) {
+		return frozenError(id)
+	}
+	return nil
+}
+
+// Freeze stops all writes to a layer until Thaw is called, freezing the
+// processes using the layer and flushing data written to the file system.
+// Layers frozen are not mounted again, removed or changed otherwise, so a
+// backup or snapshot taken of the layer meanwhile is consistent.  The cgroups
+// frozen are recorded, and thawed when the plugin starts again if it stopped
+// without thawing those.
+func (d *Driver) Freeze(id string) (err error) {
+	logrus.Debugf("Freeze - id %s", id)
+	defer d.trackOp("Freeze", id, "")(&err)
+	if err := validateID(id); err != nil {
+		return err
+	}
+	defer d.layers.lock(id)()
+	if !d.Exists(id) {
+		return notFoundError(id)
+	}
+	if d.frozen.has(id) {
+		return fmt.Errorf("lcfs: layer %s is frozen already", id)
+	}
+	if d.freezeState == nil {
+		return errNoFreezeState
+	}
+	thaw, err := d.quiesce(id)
+	if err != nil {
+		return err
+	}
+	d.frozen.add(id, thaw)
+	logrus.Infof("Froze layer %s", id)
+	return nil
+}
+
+// Thaw resumes a layer frozen, thawing the processes frozen by Freeze.
+func (d *Driver) Thaw(id string) (err error) {
+	logrus.Debugf("Thaw - id %s", id)
+	defer d.trackOp("Thaw", id, "")(&err)
+	if err := validateID(id); err != nil {
+		return err
+	}
+	defer d.layers.lock(id)()
+	thaw := d.frozen.remove(id)
+	if thaw == nil {
+		return fmt.Errorf("lcfs: layer %s is not frozen", id)
+	}
+	thaw()
+	logrus.Infof("Thawed layer %s", id)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	defer func(proc, cgroup string) {
+		procRoot, cgroupRoot = proc, cgroup
+	}(procRoot, cgroupRoot)
+	procRoot = path.Join(f.home, "proc")
+	cgroupRoot = path.Join(f.home, "cgroup")
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A container using the layer
+	pdir := path.Join(procRoot, "123")
+	os.MkdirAll(pdir, 0755)
+	os.Symlink(path.Join(d.home, "rw"), path.Join(pdir, "cwd"))
+	ioutil.WriteFile(path.Join(pdir, "cgroup"), []byte("0::/docker/c\n"), 0644)
+	cdir := path.Join(cgroupRoot, "docker/c")
+	os.MkdirAll(cdir, 0755)
+	ioutil.WriteFile(path.Join(cdir, "cgroup.freeze"), []byte("0"), 0644)
+	ioutil.WriteFile(path.Join(cdir, "cgroup.events"),
+		[]byte("populated 1\nfrozen 1\n"), 0644)
+	state := func() string {
+		data, _ := ioutil.ReadFile(path.Join(cdir, "cgroup.freeze"))
+		return strings.TrimSpace(string(data))
+	}
+
+	if err := d.Freeze("rw"); !errors.Is(err, errNoFreezeState) {
+		t.Errorf("layer frozen without freeze_state, err %v", err)
+	}
+	file := path.Join(f.home, "frozen.json")
+	var err error
+	if d.freezeState, err = loadFreezeState(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Freeze("rw"); err != nil {
+		t.Fatal(err)
+	}
+	if state() != "1" {
+		t.Error("processes using the layer not frozen")
+	}
+	if err := d.Freeze("rw"); err == nil {
+		t.Error("layer frozen twice")
+	}
+	if frozen := d.frozen.list(); len(frozen) != 1 || frozen[0].ID != "rw" {
+		t.Errorf("unexpected layers frozen %v", frozen)
+	}
+
+	// Layers frozen are not changed
+	if _, err := d.Get("rw", ""); !errors.Is(err, errLayerBusy) {
+		t.Errorf("layer frozen mounted, err %v", err)
+	}
+	if _, err := d.ApplyDiff("rw", "base", nil); !errors.Is(err, errLayerBusy) {
+		t.Errorf("diff applied to layer frozen, err %v", err)
+	}
+	if err := d.Remove("rw"); !errors.Is(err, errLayerBusy) {
+		t.Errorf("layer frozen removed, err %v", err)
+	}
+
+	if err := d.Thaw("rw"); err != nil {
+		t.Fatal(err)
+	}
+	if state() != "0" {
+		t.Error("processes using the layer not thawed")
+	}
+	if err := d.Thaw("rw"); err == nil {
+		t.Error("layer thawed twice")
+	}
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Errorf("layer thawed not mounted, err %v", err)
+	}
+	if err := d.Freeze("missing"); err == nil {
+		t.Error("missing layer frozen")
+	}
+
+	// Cgroups left frozen by the plugin stopped without thawing those are
+	// thawed when it starts again
+	if err := d.Freeze("rw"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadFreezeState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.thawLeft()
+	if state() != "0" {
+		t.Error("cgroup left frozen not thawed")
+	}
+	if s, err = loadFreezeState(file); err != nil || len(s.cgroups) != 0 {
+		t.Errorf("cgroups thawed still recorded %v, err %v", s, err)
+	}
+}
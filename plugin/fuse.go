@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Directory the fuse control file system is mounted on
+var fuseConnections = "/sys/fs/fuse/connections"
+
+// Interval between sampling the fuse connection
+const fuseSampleInterval = time.Second
+
+// fuseStats describes the request queue of the fuse connection serving the
+// file system.
+type fuseStats struct {
+	Waiting             uint64 `json:"waiting"`
+	MaxWaiting          uint64 `json:"max_waiting"`
+	MaxBackground       uint64 `json:"max_background"`
+	CongestionThreshold uint64 `json:"congestion_threshold"`
+	Congested           bool   `json:"congested"`
+	CongestionEvents    uint64 `json:"congestion_events"`
+}
+
+// fuseMonitor samples the number of requests waiting on the fuse connection,
+// counting how often the connection became congested.  Requests waiting
+// include those queued in the kernel and those being processed by the file
+// system daemon.
+type fuseMonitor struct {
+	dir   string
+	lock  sync.Mutex
+	stats fuseStats
+	stop  chan struct{}
+}
+
+// fuseConnectionDir returns the directory of the fuse control file system
+// for the connection serving the file system mounted at dir.
+func fuseConnectionDir(dir string) (string, error) {
+	var st unix.Stat_t
+
+	if err := unix.Stat(dir, &st); err != nil {
+		return "", err
+	}
+	minor := (st.Dev & 0xff) | ((st.Dev >> 12) & 0xfff00)
+	return path.Join(fuseConnections, fmt.Sprintf("%d", minor)), nil
+}
+
+// newFuseMonitor starts sampling the fuse connection of the file system
+// mounted at dir every interval.
+func newFuseMonitor(dir string, interval time.Duration) (*fuseMonitor, error) {
+	conn, err := fuseConnectionDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &fuseMonitor{dir: conn, stop: make(chan struct{})}
+	if err := m.sample(); err != nil {
+		return nil, err
+	}
+	go m.run(interval)
+	logrus.Infof("Monitoring fuse connection %s", conn)
+	return m, nil
+}
+
+func (m *fuseMonitor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.sample(); err != nil {
+				logrus.Debugf("fuse: err %v", err)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// close stops sampling the connection.
+func (m *fuseMonitor) close() {
+	close(m.stop)
+}
+
+func readUint(file string) (uint64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// sample reads the current state of the connection.
+func (m *fuseMonitor) sample() error {
+	waiting, err := readUint(path.Join(m.dir, "waiting"))
+	if err != nil {
+		return err
+	}
+	background, err := readUint(path.Join(m.dir, "max_background"))
+	if err != nil {
+		return err
+	}
+	threshold, err := readUint(path.Join(m.dir, "congestion_threshold"))
+	if err != nil {
+		return err
+	}
+	m.update(waiting, background, threshold)
+	return nil
+}
+
+// update accounts a sample, counting a congestion event when the number of
+// waiting requests reaches the congestion threshold.
+func (m *fuseMonitor) update(waiting, background, threshold uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := &m.stats
+	s.Waiting = waiting
+	if waiting > s.MaxWaiting {
+		s.MaxWaiting = waiting
+	}
+	s.MaxBackground = background
+	s.CongestionThreshold = threshold
+	congested := threshold > 0 && waiting >= threshold
+	if congested && !s.Congested {
+		s.CongestionEvents++
+		logrus.Warnf("Fuse connection congested with %d requests waiting", waiting)
+	}
+	s.Congested = congested
+}
+
+// snapshot returns the current state of the connection.
+func (m *fuseMonitor) snapshot() *fuseStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s := m.stats
+	return &s
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFuseMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-fuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := &fuseMonitor{dir: dir}
+	write := func(waiting string) {
+		for file, value := range map[string]string{
+			"waiting":              waiting,
+			"max_background":       "12\n",
+			"congestion_threshold": "9\n",
+		} {
+			if err := ioutil.WriteFile(path.Join(dir, file), []byte(value), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := m.sample(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, waiting := range []string{"3\n", "10\n", "11\n", "2\n", "9\n", "1\n"} {
+		write(waiting)
+	}
+	s := m.snapshot()
+	expected := fuseStats{
+		Waiting:             1,
+		MaxWaiting:          11,
+		MaxBackground:       12,
+		CongestionThreshold: 9,
+		CongestionEvents:    2,
+	}
+	if *s != expected {
+		t.Errorf("expected %+v, got %+v", expected, *s)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+const (
+	// Data compressed by a single goroutine
+	gzipBlockSize = 1 << 20
+
+	// Data preceding a block its matches may refer to
+	gzipDictSize = 32 << 10
+)
+
+// gzipBlock is the result of compressing a block.
+type gzipBlock struct {
+	data []byte
+	err  error
+}
+
+// parallelGzip is a gzip writer compressing blocks of the input on all CPUs,
+// as compression is what limits the rate layers are exported at.  Each block
+// is compressed with the end of the block before it as dictionary and
+// flushed to a byte boundary, so the blocks form a single deflate stream
+// readable by any gzip implementation, compressing nearly as well as
+// compressing the input in one goroutine.
+type parallelGzip struct {
+	w     io.Writer
+	level int
+	buf   []byte
+	dict  []byte
+	crc   uint32
+	size  uint32
+	slots chan struct{}
+	queue chan chan gzipBlock
+	done  chan struct{}
+
+	lock sync.Mutex
+	err  error
+}
+
+// newParallelGzip creates a writer compressing data written to it at the
+// given level with up to threads goroutines, one per CPU if zero.
+func newParallelGzip(w io.Writer, level, threads int) (*parallelGzip, error) {
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		return nil, fmt.Errorf("lcfs: invalid compression level %d", level)
+	}
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	z := &parallelGzip{
+		w:     w,
+		level: level,
+		buf:   make([]byte, 0, gzipBlockSize),
+		slots: make(chan struct{}, threads),
+		queue: make(chan chan gzipBlock, threads),
+		done:  make(chan struct{}),
+	}
+	go z.writeBlocks()
+	return z, nil
+}
+
+// gzipHeader returns the header of a gzip stream without a name and time.
+func gzipHeader(level int) []byte {
+	hdr := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	if level == flate.BestCompression {
+		hdr[8] = 2
+	} else if level == flate.BestSpeed {
+		hdr[8] = 4
+	}
+	return hdr
+}
+
+// writeBlocks writes compressed blocks in the order those were queued.
+func (z *parallelGzip) writeBlocks() {
+	defer close(z.done)
+	_, err := z.w.Write(gzipHeader(z.level))
+	for result := range z.queue {
+		b := <-result
+		if err == nil {
+			err = b.err
+		}
+		if err == nil {
+			_, err = z.w.Write(b.data)
+		}
+		if err != nil {
+			z.lock.Lock()
+			z.err = err
+			z.lock.Unlock()
+		}
+	}
+}
+
+// failed returns the error writing compressed data failed with.
+func (z *parallelGzip) failed() error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return z.err
+}
+
+// Write queues data for compression.
+func (z *parallelGzip) Write(p []byte) (int, error) {
+	if err := z.failed(); err != nil {
+		return 0, err
+	}
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	z.size += uint32(len(p))
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+c]
+		p = p[c:]
+		if len(z.buf) == cap(z.buf) {
+			z.compress()
+		}
+	}
+	return n, nil
+}
+
+// compress starts compressing the data buffered, once a goroutine is free.
+func (z *parallelGzip) compress() {
+	block, dict := z.buf, z.dict
+	z.buf = make([]byte, 0, gzipBlockSize)
+	if len(block) >= gzipDictSize {
+		z.dict = block[len(block)-gzipDictSize:]
+	} else {
+		z.dict = append(append([]byte(nil), dict...), block...)
+		if len(z.dict) > gzipDictSize {
+			z.dict = z.dict[len(z.dict)-gzipDictSize:]
+		}
+	}
+	result := make(chan gzipBlock, 1)
+	z.slots <- struct{}{}
+	z.queue <- result
+	go func() {
+		defer func() { <-z.slots }()
+		result <- compressBlock(block, dict, z.level)
+	}()
+}
+
+// compressBlock compresses a block with the preceding data as dictionary,
+// ending the output at a byte boundary without ending the deflate stream.
+func compressBlock(block, dict []byte, level int) gzipBlock {
+	var b bytes.Buffer
+
+	fw, err := flate.NewWriterDict(&b, level, dict)
+	if err == nil {
+		_, err = fw.Write(block)
+	}
+	if err == nil {
+		err = fw.Flush()
+	}
+	return gzipBlock{data: b.Bytes(), err: err}
+}
+
+// Close compresses data still buffered and writes the end of the stream.
+// The underlying writer is not closed.
+func (z *parallelGzip) Close() error {
+	if len(z.buf) > 0 {
+		z.compress()
+	}
+	close(z.queue)
+	<-z.done
+	if err := z.failed(); err != nil {
+		return err
+	}
+
+	// End the deflate stream with an empty final block
+	var b bytes.Buffer
+	fw, err := flate.NewWriter(&b, z.level)
+	if err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	b.Write(trailer[:])
+	_, err = z.w.Write(b.Bytes())
+	return err
+}
+
+// writeCompressedDiff writes the diff of a layer compressed with gzip, at the
+// level and with the number of goroutines configured.
+func (d *Driver) writeCompressedDiff(w io.Writer, id, parent string) error {
+	archive := d.Diff(id, parent)
+	if archive == nil {
+		return fmt.Errorf("lcfs: diff of layer %s failed", id)
+	}
+	defer archive.Close()
+	z, err := newParallelGzip(w, d.opts.DiffCompressionLevel,
+		d.opts.DiffCompressionThreads)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(z, archive); err != nil {
+		z.Close()
+		return err
+	}
+	return z.Close()
+}
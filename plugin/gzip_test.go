@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestParallelGzip(t *testing.T) {
+	data := make([]byte, 3*gzipBlockSize+12345)
+	r := rand.New(rand.NewSource(1))
+	for i := range data {
+		// Compressible data with matches across blocks
+		data[i] = "lcfs"[r.Intn(4)]
+	}
+	for _, size := range []int{0, 100, gzipDictSize - 1, len(data)} {
+		var b bytes.Buffer
+		z, err := newParallelGzip(&b, 6, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write in pieces not aligned with blocks
+		for i := 0; i < size; i += 7777 {
+			end := i + 7777
+			if end > size {
+				end = size
+			}
+			if _, err := z.Write(data[i:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out, data[:size]) {
+			t.Errorf("size %d: data differs after decompression", size)
+		}
+	}
+}
+
+func TestParallelGzipLevel(t *testing.T) {
+	for _, level := range []int{0, 10, -1} {
+		if _, err := newParallelGzip(ioutil.Discard, level, 1); err == nil {
+			t.Errorf("level %d accepted", level)
+		}
+	}
+}
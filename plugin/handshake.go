@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Handshake with the file system, see struct lc_handshake in lcfs.h
+const (
+	handshakeMagic    = uint64(0x6c6366732d696f63)
+	ioctlRevision     = 2
+	handshakeType     = 0x5a
+	handshakeSize     = 24
+	handshakeWordSize = uint32(unsafe.Sizeof(uintptr(0)))
+)
+
+// handshakeError is returned by Init if the file system interprets requests
+// differently than the plugin.
+type handshakeError struct {
+	reason string
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("lcfs: file system interprets requests differently, "+
+		"%s; run the plugin and the lcfs daemon from the same release on the "+
+		"same architecture", e.reason)
+}
+
+// handshake exchanges a magic number with the file system, verifying both
+// sides agree on the byte order, the encoding of commands, the revision of the
+// ioctl interface and the size of a word.  The file system returns what it
+// decoded from the request, as a mismatch would otherwise corrupt layers
+// silently.  File systems predating the handshake are used as before.
+func (d *Driver) handshake() error {
+	var buf [handshakeSize]byte
+
+	nativeEndian.PutUint64(buf[0:], handshakeMagic)
+	nativeEndian.PutUint32(buf[8:], ioctlRevision)
+	op := uintptr((3 << 30) | (handshakeSize << 16) | (handshakeType << 8) |
+		LcfsHandshake)
+	err := ioctlSyscall(op, buf[:])
+	switch err {
+	case nil:
+	case unix.ENOSYS, unix.ENOTTY:
+		logrus.Warnf("Init - file system does not support a handshake: %v", err)
+		return nil
+	case unix.EPROTO, unix.EINVAL:
+		return &handshakeError{"request refused: " + err.Error()}
+	default:
+		return err
+	}
+	magic := nativeEndian.Uint64(buf[0:])
+	revision := nativeEndian.Uint32(buf[8:])
+	size := nativeEndian.Uint32(buf[12:])
+	typ := nativeEndian.Uint32(buf[16:])
+	wordSize := nativeEndian.Uint32(buf[20:])
+	switch {
+	case magic != ^handshakeMagic:
+		return &handshakeError{fmt.Sprintf("magic %#x returned", magic)}
+	case revision != ioctlRevision:
+		return &handshakeError{fmt.Sprintf("revision %d, expected %d",
+			revision, ioctlRevision)}
+	case size != handshakeSize || typ != handshakeType:
+		return &handshakeError{fmt.Sprintf("command decoded with size %d "+
+			"type %#x, expected %d %#x", size, typ, handshakeSize,
+			handshakeType)}
+	case wordSize != handshakeWordSize:
+		return &handshakeError{fmt.Sprintf("word size %d, expected %d",
+			wordSize, handshakeWordSize)}
+	}
+	logrus.Debugf("Init - handshake with revision %d", revision)
+	d.revision = revision
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// daemonHandshake answers a handshake as the file system daemon does, on a
+// host with the byte order and revision specified.
+func daemonHandshake(op uintptr, buf []byte, order binary.ByteOrder,
+	revision uint32) error {
+	if len(buf) != handshakeSize {
+		return unix.EINVAL
+	}
+	if order.Uint64(buf[0:]) != handshakeMagic ||
+		order.Uint32(buf[8:]) != revision {
+		return unix.EPROTO
+	}
+	order.PutUint64(buf[0:], ^handshakeMagic)
+	order.PutUint32(buf[8:], revision)
+	order.PutUint32(buf[12:], uint32((op>>16)&0x3fff))
+	order.PutUint32(buf[16:], uint32((op>>8)&0xff))
+	order.PutUint32(buf[20:], handshakeWordSize)
+	return nil
+}
+
+// foreignEndian returns the byte order other than the one of the host.
+func foreignEndian() binary.ByteOrder {
+	if nativeEndian == binary.LittleEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func TestHandshake(t *testing.T) {
+	defer func() { ioctlSyscall = rootIoctl }()
+	d := &Driver{home: "/lcfs"}
+	for _, c := range []struct {
+		name   string
+		ioctl  func(op uintptr, buf []byte) error
+		refuse bool
+	}{
+		{"matching", func(op uintptr, buf []byte) error {
+			return daemonHandshake(op, buf, nativeEndian, ioctlRevision)
+		}, false},
+		{"predating handshake", func(op uintptr, buf []byte) error {
+			return unix.ENOSYS
+		}, false},
+		{"other byte order", func(op uintptr, buf []byte) error {
+			return daemonHandshake(op, buf, foreignEndian(), ioctlRevision)
+		}, true},
+		{"other revision", func(op uintptr, buf []byte) error {
+			return daemonHandshake(op, buf, nativeEndian, ioctlRevision+1)
+		}, true},
+		{"other encoding", func(op uintptr, buf []byte) error {
+			return daemonHandshake(op&^0xff00, buf, nativeEndian,
+				ioctlRevision)
+		}, true},
+		{"magic not returned", func(op uintptr, buf []byte) error {
+			return nil
+		}, true},
+	} {
+		ioctlSyscall = c.ioctl
+		err := d.handshake()
+		if _, ok := err.(*handshakeError); ok != c.refuse {
+			t.Errorf("handshake with %s file system returned %v", c.name, err)
+		}
+	}
+}
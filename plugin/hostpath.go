@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Directory of the host mounted in the plugin at the same path, the only
+// files the plugin and the host agree on.  Replaced by tests.
+var propagatedMount = "/lcfs"
+
+// isBelow checks if a clean absolute path is dir or in it.
+func isBelow(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// hostPath checks a path named in a request is a path of the host, in the
+// propagated mount, as the plugin runs in its own mount namespace and would
+// otherwise write files or mount snapshots where nobody on the host finds
+// those.  Symbolic links are resolved, so none leads out of the mount, and
+// paths in the layer root are refused, as those are files of layers.
+// Returns the path resolved.
+func (d *Driver) hostPath(p, what string) (string, error) {
+	if !path.IsAbs(p) {
+		return "", fmt.Errorf("lcfs: path %q %s is not absolute", p, what)
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		resolved, err = filepath.EvalSymlinks(path.Dir(p))
+		resolved = path.Join(resolved, path.Base(p))
+	}
+	if err != nil {
+		return "", err
+	}
+	if resolved == propagatedMount || !isBelow(resolved, propagatedMount) ||
+		isBelow(resolved, d.home) {
+		return "", fmt.Errorf("lcfs: path %q %s is not in %s, outside of the "+
+			"layer root %s", p, what, propagatedMount, d.home)
+	}
+	return resolved, nil
+}
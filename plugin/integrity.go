@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/idtools"
+)
+
+// Prefix of whiteout files of a diff, and the name of the one marking an
+// opaque directory
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// integrityEntry is the hash of a file added or modified by a diff.
+type integrityEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// integrityRecord is what is recorded for a layer, the Merkle root of the
+// files a diff applied to the layer added or modified, along with those
+// files.  Layers created without a diff record only the parent, so the
+// ancestors of container layers are found after a restart.
+type integrityRecord struct {
+	Parent  string           `json:"parent"`
+	Root    string           `json:"root,omitempty"`
+	Entries []integrityEntry `json:"entries,omitempty"`
+	Removed []string         `json:"removed,omitempty"`
+
+	Signatures []layerSignature `json:"signatures,omitempty"`
+}
+
+// integrityError is returned when mounting a layer, a diff applied to which
+// changed on disk since.
+type integrityError struct {
+	id    string
+	paths []string
+}
+
+func (e *integrityError) Error() string {
+	paths := e.paths
+	if len(paths) > 5 {
+		paths = append(paths[:5:5], "...")
+	}
+	return fmt.Sprintf("lcfs: layer %s failed integrity verification, %d "+
+		"files changed on disk: %s", e.id, len(e.paths),
+		strings.Join(paths, ", "))
+}
+
+// integrity records hashes of files of diffs applied to layers in dir, and
+// verifies layers against those when mounted.  Each layer is verified once
+// while the plugin runs, as layers diffs are applied to are not modified
+// afterwards.  With trusted keys, diffs applied to layers need to be signed
+// by one of those as well.
+type integrity struct {
+	dir     string
+	uidMaps []idtools.IDMap
+	gidMaps []idtools.IDMap
+	keys    map[string]ed25519.PublicKey
+
+	lock     sync.Mutex
+	verified map[string]bool
+}
+
+// newIntegrity records hashes of layers in dir.  Owners of files in diffs are
+// mapped with the maps the diffs are applied with.
+func newIntegrity(dir string, uidMaps, gidMaps []idtools.IDMap) (*integrity, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &integrity{
+		dir:      dir,
+		uidMaps:  uidMaps,
+		gidMaps:  gidMaps,
+		verified: make(map[string]bool),
+	}, nil
+}
+
+// load reads the record of a layer, nil if none.
+func (t *integrity) load(id string) (*integrityRecord, error) {
+	data, err := ioutil.ReadFile(path.Join(t.dir, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := &integrityRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, fmt.Errorf("lcfs: invalid integrity record of layer %s: %v",
+			id, err)
+	}
+	return rec, nil
+}
+
+// store writes the record of a layer, replacing any recorded before.
+func (t *integrity) store(id string, rec *integrityRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	file := path.Join(t.dir, id)
+	if err := ioutil.WriteFile(file+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// created records the parent of a layer created.
+func (t *integrity) created(id, parent string) error {
+	return t.store(id, &integrityRecord{Parent: parent})
+}
+
+// forget drops the record of a layer removed.
+func (t *integrity) forget(id string) {
+	t.lock.Lock()
+	delete(t.verified, id)
+	t.lock.Unlock()
+	if err := os.Remove(path.Join(t.dir, id)); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("Removing integrity record of layer %s, err %v\n", id, err)
+	}
+}
+
+// diffHasher hashes the files of a diff while it is applied.
+type diffHasher struct {
+	t      *integrity
+	writer *io.PipeWriter
+	done   chan struct{}
+	rec    integrityRecord
+}
+
+// hashDiff returns a reader of a diff, the files of which are hashed as the
+// diff is read.
+func (t *integrity) hashDiff(archive io.Reader) (io.Reader, *diffHasher) {
+	reader, writer := io.Pipe()
+	h := &diffHasher{t: t, writer: writer, done: make(chan struct{})}
+	go func() {
+		defer close(h.done)
+		h.hash(reader)
+
+		// Do not block applying the diff on trailing data
+		io.Copy(ioutil.Discard, reader)
+	}()
+	return io.TeeReader(archive, writer), h
+}
+
+// hash hashes files of a diff in tar format.
+func (h *diffHasher) hash(r io.Reader) {
+	// Regular files of the diff, hard links share their content and size
+	contents := make(map[string]fileMeta)
+	leaves := make(map[string][32]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		base := path.Base(name)
+		if name == "/" || base == whiteoutOpaque {
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			removed := path.Join(path.Dir(name),
+				strings.TrimPrefix(base, whiteoutPrefix))
+			delete(leaves, removed)
+			h.rec.Removed = append(h.rec.Removed, removed)
+			continue
+		}
+		m := fileMeta{
+			typ:   hdr.Typeflag,
+			mode:  hdr.Mode & 07777,
+			uid:   h.t.hostID(hdr.Uid, h.t.uidMaps),
+			gid:   h.t.hostID(hdr.Gid, h.t.gidMaps),
+			link:  hdr.Linkname,
+			major: hdr.Devmajor,
+			minor: hdr.Devminor,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			m.typ = tar.TypeReg
+			m.size = hdr.Size
+			if m.content, err = hashContent(tr); err != nil {
+				continue
+			}
+			contents[name] = m
+		case tar.TypeLink:
+			// Hard links are files with the content of the target, the
+			// size of the header is zero
+			target, ok := contents[filepath.Clean("/"+hdr.Linkname)]
+			if !ok {
+				continue
+			}
+			m.typ = tar.TypeReg
+			m.link = ""
+			m.content = target.content
+			m.size = target.size
+		case tar.TypeSymlink:
+		case tar.TypeDir, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			m.link = ""
+		default:
+			continue
+		}
+		leaves[name] = m.leaf(name)
+	}
+	for name, leaf := range leaves {
+		h.rec.Entries = append(h.rec.Entries,
+			integrityEntry{name, hex.EncodeToString(leaf[:])})
+	}
+
+	// Files removed and added again exist
+	removed := h.rec.Removed[:0]
+	for _, name := range h.rec.Removed {
+		if _, ok := leaves[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	h.rec.Removed = removed
+	sort.Slice(h.rec.Entries, func(i, j int) bool {
+		return h.rec.Entries[i].Path < h.rec.Entries[j].Path
+	})
+}
+
+// finish records the hashes of a diff applied to a layer, unless applying it
+// failed.
+func (h *diffHasher) finish(id, parent string, applied bool) error {
+	h.writer.Close()
+	<-h.done
+	if !applied {
+		return nil
+	}
+	h.rec.Parent = parent
+	h.rec.Root = merkleRoot(h.rec.Entries)
+	return h.t.store(id, &h.rec)
+}
+
+// hostID maps an id of a file in a diff to the id on the host.
+func (t *integrity) hostID(id int, maps []idtools.IDMap) int {
+	if len(maps) == 0 {
+		return id
+	}
+	hostID, err := idtools.ToHost(id, maps)
+	if err != nil {
+		return id
+	}
+	return hostID
+}
+
+// fileMeta is what is hashed of a file, the same in a diff and on disk.
+// Sizes of files other than regular files, and times, are not hashed, as
+// those are not applied from the diff exactly.
+type fileMeta struct {
+	typ          byte
+	mode         int64
+	uid, gid     int
+	size         int64
+	link         string
+	major, minor int64
+	content      [32]byte
+}
+
+// leaf returns the hash of the file at name.
+func (m *fileMeta) leaf(name string) [32]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("%s\x00%c\x00%o\x00%d\x00%d\x00%d"+
+		"\x00%s\x00%d\x00%d\x00%x", name, m.typ, m.mode, m.uid, m.gid, m.size,
+		m.link, m.major, m.minor, m.content)))
+}
+
+// hashContent returns the hash of data read from r.
+func hashContent(r io.Reader) ([32]byte, error) {
+	var sum [32]byte
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// merkleRoot returns the root of the binary Merkle tree over hashes of
+// entries sorted by path, an odd hash is carried to the next level as is.
+func merkleRoot(entries []integrityEntry) string {
+	level := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		leaf, _ := hex.DecodeString(e.Hash)
+		level = append(level, leaf)
+	}
+	if len(level) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			sum := sha256.Sum256(append(append([]byte{}, level[i]...),
+				level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0])
+}
+
+// diskLeaf returns the hash of a file of a layer mounted at dir.
+func diskLeaf(dir, name string) ([32]byte, error) {
+	var m fileMeta
+
+	file := path.Join(dir, name)
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	m.mode = int64(st.Mode & 07777)
+	m.uid = int(st.Uid)
+	m.gid = int(st.Gid)
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		m.typ = tar.TypeReg
+		m.size = st.Size
+		f, err := os.Open(file)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		m.content, err = hashContent(f)
+		f.Close()
+		if err != nil {
+			return [32]byte{}, err
+		}
+	case syscall.S_IFLNK:
+		m.typ = tar.TypeSymlink
+		if m.link, err = os.Readlink(file); err != nil {
+			return [32]byte{}, err
+		}
+	case syscall.S_IFDIR:
+		m.typ = tar.TypeDir
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		m.typ = tar.TypeChar
+		if st.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			m.typ = tar.TypeBlock
+		}
+		dev := uint64(st.Rdev)
+		m.major = int64((dev>>8)&0xfff | (dev>>32)&^0xfff)
+		m.minor = int64(dev&0xff | (dev>>12)&^0xff)
+	case syscall.S_IFIFO:
+		m.typ = tar.TypeFifo
+	}
+	return m.leaf(name), nil
+}
+
+// verify checks files of the diff applied to a layer mounted at dir against
+// the record, recomputing the Merkle root from files on disk.
+func (rec *integrityRecord) verify(id, dir string) error {
+	var changed []string
+
+	entries := make([]integrityEntry, len(rec.Entries))
+	for i, e := range rec.Entries {
+		entries[i].Path = e.Path
+		leaf, err := diskLeaf(dir, e.Path)
+		if err == nil {
+			entries[i].Hash = hex.EncodeToString(leaf[:])
+		}
+		if entries[i].Hash != e.Hash {
+			changed = append(changed, e.Path)
+		}
+	}
+	for _, name := range rec.Removed {
+		if _, err := os.Lstat(path.Join(dir, name)); err == nil {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) == 0 && merkleRoot(entries) != rec.Root {
+		changed = append(changed, "/")
+	}
+	if len(changed) > 0 {
+		return &integrityError{id, changed}
+	}
+	return nil
+}
+
+// verifyLayers verifies a layer about to be mounted and its ancestors, each
+// once while the plugin runs, checking signatures before files.  Layers
+// without a record, created before verification was enabled, are skipped
+// unless signatures are required, as nothing attests those.
+func (d *Driver) verifyLayers(id string) error {
+	t := d.integrity
+	for layer := id; layer != ""; {
+		rec, err := t.load(layer)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			if t.keys != nil {
+				err := &signatureError{layer, "has no signed diff recorded"}
+				logrus.Errorf("Layer %s, err %v\n", layer, err)
+				return err
+			}
+			layer = d.known.parentOf(layer)
+			continue
+		}
+		t.lock.Lock()
+		verified := t.verified[layer]
+		t.lock.Unlock()
+		if !verified && rec.Root != "" {
+			if err := t.attested(layer, rec); err != nil {
+				logrus.Errorf("Layer %s, err %v\n", layer, err)
+				return err
+			}
+			if err := d.verifyLayer(layer, rec); err != nil {
+				logrus.Errorf("Layer %s, err %v\n", layer, err)
+				return err
+			}
+			t.lock.Lock()
+			t.verified[layer] = true
+			t.lock.Unlock()
+		}
+		layer = rec.Parent
+	}
+	return nil
+}
+
+// verifyLayer mounts a layer to check the files of the diff applied to it.
+func (d *Driver) verifyLayer(id string, rec *integrityRecord) error {
+	defer d.layers.lock(id)()
+	dir, err := d.get(id, "")
+	if err != nil {
+		return err
+	}
+	defer d.put(id)
+	return rec.verify(id, dir)
+}
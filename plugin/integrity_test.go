@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// integrityDiff returns a diff adding files with contents, a hard link to the
+// file a, and removing gone.
+func integrityDiff(t *testing.T, files map[string]string, gone string) []byte {
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+	hdrs := []*tar.Header{{Name: ".wh." + gone, Typeflag: tar.TypeReg}}
+	for name, content := range files {
+		hdrs = append(hdrs, &tar.Header{Name: name, Typeflag: tar.TypeReg,
+			Mode: 0640, Uid: os.Getuid(), Gid: os.Getgid(),
+			Size: int64(len(content))})
+	}
+	hdrs = append(hdrs, &tar.Header{Name: "link", Typeflag: tar.TypeSymlink,
+		Linkname: "a", Mode: 0777, Uid: os.Getuid(), Gid: os.Getgid()},
+		&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "a",
+			Mode: 0640, Uid: os.Getuid(), Gid: os.Getgid()})
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(files[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// applyIntegrityDiff records the hashes of a diff applied to a layer, and
+// creates its files in dir.
+func applyIntegrityDiff(t *testing.T, it *integrity, id, parent, dir string,
+	files map[string]string) {
+	r, h := it.hashDiff(bytes.NewReader(integrityDiff(t, files, "gone")))
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.finish(id, parent, true); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		file := path.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(file, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("a", path.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path.Join(dir, "a"), path.Join(dir, "hard")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "lcfs-integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d.integrity, err = newIntegrity(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createLayers(t, d, fakeLayer{"base", "", false})
+	files := map[string]string{"a": "alpha", "b": "beta", "c": ""}
+	applyIntegrityDiff(t, d.integrity, "base", "", path.Join(f.home, "base"),
+		files)
+	rec, err := d.integrity.load("base")
+	if err != nil || rec == nil || len(rec.Entries) != 5 ||
+		len(rec.Removed) != 1 || rec.Root != merkleRoot(rec.Entries) {
+		t.Fatalf("unexpected record %+v, err %v", rec, err)
+	}
+	createLayers(t, d, fakeLayer{"rw", "base", true})
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatalf("layer not verified: %v", err)
+	}
+	if err := d.Put("rw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers are verified once
+	file := path.Join(f.home, "base", "b")
+	if err := ioutil.WriteFile(file, []byte("bitrot"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatalf("layer verified again: %v", err)
+	}
+	if err := d.Put("rw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers modified on disk are refused after a restart
+	d.integrity, _ = newIntegrity(dir, nil, nil)
+	d.known.seed(nil)
+	ioutil.WriteFile(path.Join(f.home, "base", "gone"), nil, 0640)
+	_, err = d.Get("rw", "")
+	ierr, ok := err.(*opError)
+	if !ok {
+		t.Fatalf("layer modified on disk mounted, err %v", err)
+	}
+	if e, ok := ierr.err.(*integrityError); !ok || len(e.paths) != 2 ||
+		e.paths[0] != "/b" || e.paths[1] != "/gone" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if f.mounts["rw"] != 0 || f.mounts["base"] != 0 {
+		t.Errorf("layers left mounted %v", f.mounts)
+	}
+
+	// Records of layers removed are dropped
+	if err := d.Remove("rw"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := d.integrity.load("rw"); rec != nil || err != nil {
+		t.Errorf("record of layer removed kept %+v, err %v", rec, err)
+	}
+}
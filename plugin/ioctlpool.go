@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limit of ioctls issued concurrently, a *ioctlLimiter replaced at Init while
+// ioctls may be issued
+var ioctlSlots atomic.Value
+
+// ioctlLimit returns the limiter of ioctls issued concurrently, nil if not
+// limited.
+func ioctlLimit() *ioctlLimiter {
+	l, _ := ioctlSlots.Load().(*ioctlLimiter)
+	return l
+}
+
+// setIoctlLimit limits the number of ioctls issued concurrently, not limited
+// if limit is 0.  Ioctls issued already release the slot of the limiter
+// replaced.
+func setIoctlLimit(limit int) {
+	var l *ioctlLimiter
+	if limit > 0 {
+		l = newIoctlLimiter(limit)
+	}
+	ioctlSlots.Store(l)
+}
+
+// ioctlStats describes ioctls issued to the file system daemon and those
+// waiting for a slot.
+type ioctlStats struct {
+	Limit      int           `json:"limit"`
+	Active     int           `json:"active"`
+	Waiting    int           `json:"waiting"`
+	MaxWaiting int           `json:"max_waiting"`
+	Queued     uint64        `json:"queued"`
+	WaitTime   time.Duration `json:"wait_time"`
+}
+
+// ioctlLimiter bounds the number of ioctls the file system daemon processes
+// at the same time.  Ioctls beyond the limit wait for one in progress to
+// complete, so bursts of operations are queued in the plugin instead of
+// overloading the daemon and timing out.
+type ioctlLimiter struct {
+	slots chan struct{}
+	lock  sync.Mutex
+	stats ioctlStats
+}
+
+// newIoctlLimiter creates a limiter allowing limit concurrent ioctls.
+func newIoctlLimiter(limit int) *ioctlLimiter {
+	return &ioctlLimiter{
+		slots: make(chan struct{}, limit),
+		stats: ioctlStats{Limit: limit},
+	}
+}
+
+// acquire waits for a slot for issuing an ioctl.
+func (l *ioctlLimiter) acquire() {
+	select {
+	case l.slots <- struct{}{}:
+		l.lock.Lock()
+		l.stats.Active++
+		l.lock.Unlock()
+		return
+	default:
+	}
+
+	l.lock.Lock()
+	l.stats.Waiting++
+	l.stats.Queued++
+	if l.stats.Waiting > l.stats.MaxWaiting {
+		l.stats.MaxWaiting = l.stats.Waiting
+	}
+	l.lock.Unlock()
+	start := time.Now()
+	l.slots <- struct{}{}
+	l.lock.Lock()
+	l.stats.Waiting--
+	l.stats.Active++
+	l.stats.WaitTime += time.Since(start)
+	l.lock.Unlock()
+}
+
+// release frees the slot of a completed ioctl.
+func (l *ioctlLimiter) release() {
+	l.lock.Lock()
+	l.stats.Active--
+	l.lock.Unlock()
+	<-l.slots
+}
+
+// snapshot returns the current queueing stats.
+func (l *ioctlLimiter) snapshot() *ioctlStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	s := l.stats
+	return &s
+}
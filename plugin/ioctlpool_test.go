@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIoctlLimiter(t *testing.T) {
+	l := newIoctlLimiter(1)
+
+	l.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire()
+		close(acquired)
+	}()
+	for l.snapshot().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-acquired:
+		t.Fatalf("limit exceeded")
+	default:
+	}
+	l.release()
+	<-acquired
+	s := l.snapshot()
+	if s.Active != 1 || s.Waiting != 0 || s.Queued != 1 || s.MaxWaiting != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	l.release()
+	if s := l.snapshot(); s.Active != 0 {
+		t.Errorf("slot not released: %+v", s)
+	}
+}
+
+// Init replaces the limit while ioctls are issued
+func TestSetIoctlLimit(t *testing.T) {
+	defer setIoctlLimit(0)
+	setIoctlLimit(2)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fdIoctl(-1, 0, nil)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		setIoctlLimit(i % 3)
+	}
+	wg.Wait()
+	setIoctlLimit(1)
+	if l := ioctlLimit(); l == nil || l.snapshot().Limit != 1 {
+		t.Fatalf("ioctls not limited")
+	}
+	fdIoctl(-1, 0, nil)
+	if s := ioctlLimit().snapshot(); s.Active != 0 {
+		t.Errorf("slot not released: %+v", s)
+	}
+	setIoctlLimit(0)
+	if ioctlLimit() != nil {
+		t.Errorf("ioctls limited after removing the limit")
+	}
+}
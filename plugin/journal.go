@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Records appended to the journal before it is rewritten with the operations
+// in flight only
+const journalCompactRecords = 1024
+
+// Operations recorded in the journal
+const (
+	journalCreate   = "create"
+	journalRemove   = "remove"
+	journalRollback = "rollback"
+)
+
+// journalRecord is a single entry of the journal, recording an operation
+// started or completed.  Rollbacks record the layer the layer is created from
+// again as the parent.
+type journalRecord struct {
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	Parent string `json:"parent,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// opJournal records layers being created and removed in a file as JSON lines,
+// synced before the operation is issued to the file system.  Operations not
+// recorded as completed when the plugin starts were interrupted by a crash,
+// leaving layers created partially, which Docker does not know of, or layers
+// Docker removed still present.  Records are appended, the file is rewritten
+// with operations in flight only once it grows.
+type opJournal struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	records int
+	pending map[journalRecord]struct{}
+}
+
+// openJournal opens the journal, returning operations interrupted.
+func openJournal(path string) (*opJournal, []journalRecord, error) {
+	j := &opJournal{path: path, pending: make(map[journalRecord]struct{})}
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var r journalRecord
+
+			// The last record may be partial after a crash
+			if json.Unmarshal(scanner.Bytes(), &r) != nil {
+				continue
+			}
+			done := r.Done
+			r.Done = false
+			if done {
+				delete(j.pending, r)
+			} else {
+				j.pending[r] = struct{}{}
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := j.compact(); err != nil {
+		return nil, nil, err
+	}
+	interrupted := j.list()
+	logrus.Infof("Recording layer operations in flight in %s", path)
+	return j, interrupted, nil
+}
+
+// list returns operations in flight.
+func (j *opJournal) list() []journalRecord {
+	records := make([]journalRecord, 0, len(j.pending))
+	for r := range j.pending {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(a, b int) bool {
+		if records[a].ID != records[b].ID {
+			return records[a].ID < records[b].ID
+		}
+		return records[a].Op < records[b].Op
+	})
+	return records
+}
+
+// compact rewrites the journal with operations in flight.  Called with the
+// lock held.
+func (j *opJournal) compact() error {
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, r := range j.list() {
+		if err := enc.Encode(&r); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.records = len(j.pending)
+	_, err = file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// append writes a record and syncs it to disk.
+func (j *opJournal) append(r journalRecord) {
+	data, err := json.Marshal(&r)
+	if err != nil {
+		logrus.Errorf("journal: err %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return
+	}
+	done := r.Done
+	r.Done = false
+	if done {
+		delete(j.pending, r)
+	} else {
+		j.pending[r] = struct{}{}
+	}
+	if j.records >= journalCompactRecords {
+		if err = j.compact(); err == nil {
+			return
+		}
+		logrus.Errorf("journal: err %v\n", err)
+	}
+	if _, err = j.file.Write(data); err == nil {
+		err = unix.Fdatasync(int(j.file.Fd()))
+	}
+	if err != nil {
+		logrus.Errorf("journal: err %v\n", err)
+	}
+	j.records++
+}
+
+// begin records an operation on a layer started.
+func (j *opJournal) begin(op, id string) {
+	j.append(journalRecord{Op: op, ID: id})
+}
+
+// end records an operation on a layer completed, whether it failed or not.
+func (j *opJournal) end(op, id string) {
+	j.append(journalRecord{Op: op, ID: id, Done: true})
+}
+
+// close stops recording operations.
+func (j *opJournal) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// journalOp records an operation on a layer started, returning a function
+// recording it completed.
+func (d *Driver) journalOp(op, id string) func() {
+	j := d.journal
+	if j == nil {
+		return func() {}
+	}
+	j.begin(op, id)
+	return func() { j.end(op, id) }
+}
+
+// recoverJournal completes operations interrupted, removing layers created
+// partially and layers not removed completely, and completing rollbacks.
+// Operations failing again are kept in the journal and retried when the
+// plugin starts next.
+func (d *Driver) recoverJournal(interrupted []journalRecord) {
+	var repaired int
+
+	for _, r := range interrupted {
+		if r.Op == journalRollback {
+			if err := d.redoRollback(r.ID, r.Parent); err != nil {
+				logrus.Errorf("Journal - rollback of layer %s interrupted, "+
+					"completing it failed: %v", r.ID, err)
+				continue
+			}
+			logrus.Warnf("Journal - completed rollback of layer %s", r.ID)
+			repaired++
+			d.journal.append(journalRecord{Op: r.Op, ID: r.ID,
+				Parent: r.Parent, Done: true})
+			continue
+		}
+		err := d.ioctl(LayerRemove, "", r.ID)
+		switch {
+		case err == unix.ENOENT:
+			logrus.Infof("Journal - %s of layer %s interrupted, layer not present",
+				r.Op, r.ID)
+		case err != nil:
+			logrus.Errorf("Journal - %s of layer %s interrupted, removing layer failed: %v",
+				r.Op, r.ID, err)
+			continue
+		case r.Op == journalCreate:
+			logrus.Warnf("Journal - removed layer %s created partially", r.ID)
+			repaired++
+		default:
+			logrus.Warnf("Journal - completed removal of layer %s", r.ID)
+			repaired++
+		}
+		d.journal.end(r.Op, r.ID)
+	}
+	if len(interrupted) > 0 {
+		logrus.Infof("Journal - %d operations interrupted, %d layers repaired",
+			len(interrupted), repaired)
+	}
+}
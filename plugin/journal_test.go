@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	file := path.Join(f.home, "journal")
+
+	j, interrupted, err := openJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interrupted) != 0 {
+		t.Fatalf("new journal returned %v", interrupted)
+	}
+	d.journal = j
+	createLayers(t, d, fakeLayer{"a", "", false}, fakeLayer{"b", "", false},
+		fakeLayer{"c", "", false})
+	if err := d.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Crash while creating d and removing b, after the file system completed
+	// both, with a partial record at the end
+	j.begin(journalCreate, "d")
+	if err := d.ioctl(LayerCreate, "", "d"); err != nil {
+		t.Fatal(err)
+	}
+	j.begin(journalRemove, "b")
+	j.file.WriteString(`{"op":"remove","id":"c"`)
+	j.close()
+
+	j, interrupted, err = openJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []journalRecord{
+		{Op: journalRemove, ID: "b"},
+		{Op: journalCreate, ID: "d"},
+	}
+	if !reflect.DeepEqual(interrupted, expected) {
+		t.Fatalf("interrupted %v, expected %v", interrupted, expected)
+	}
+	d.journal = j
+	d.recoverJournal(interrupted)
+	for _, id := range []string{"b", "d"} {
+		if _, ok := f.parents[id]; ok {
+			t.Errorf("layer %s not removed", id)
+		}
+	}
+	if _, ok := f.parents["c"]; !ok {
+		t.Errorf("layer c removed")
+	}
+	j.close()
+
+	_, interrupted, err = openJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(interrupted) != 0 {
+		t.Fatalf("repaired operations returned again %v", interrupted)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	_, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	file := path.Join(d.home, "journal")
+
+	j, _, err := openJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	j.begin(journalCreate, "pending")
+	for i := 0; i < 2*journalCompactRecords; i++ {
+		j.begin(journalRemove, "layer")
+		j.end(journalRemove, "layer")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n > journalCompactRecords+1 {
+		t.Fatalf("journal not compacted, %d records", n)
+	}
+	if !strings.Contains(string(data), `"pending"`) {
+		t.Fatalf("operation in flight dropped when compacting")
+	}
+}
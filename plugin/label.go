@@ -0,0 +1,47 @@
+package main
+
+import "strings"
+
+// First revision of the ioctl interface accepting mount options with
+// LayerMount
+const mountOptionsRevision = 2
+
+// SELinux categories of labels of mounts
+const (
+	categoriesPrivate = "private"
+	categoriesShared  = "shared"
+)
+
+// mountOptions returns the options of mounting a layer with a label.  The file
+// system presents the label as the SELinux context of every file of the layer
+// and refuses relabeling those, like the context mount option overlay2 uses,
+// so files are never relabeled one by one, also in read-only layers.  File
+// systems predating mount options are not passed labels.
+func (d *Driver) mountOptions(mountLabel string) string {
+	if mountLabel == "" || d.revision < mountOptionsRevision {
+		return ""
+	}
+	if d.opts != nil && d.opts.SELinuxCategories == categoriesShared {
+		mountLabel = sharedLabel(mountLabel)
+	}
+	return `context="` + mountLabel + `"`
+}
+
+// sharedLabel returns a label without the categories of its level, like
+// "system_u:object_r:container_file_t:s0" for a label with the level
+// "s0:c1,c2", shared by all containers instead of private to one.  A range
+// of levels is kept as its sensitivities.  Labels without a level are
+// returned as they are.
+func sharedLabel(label string) string {
+	fields := strings.SplitN(label, ":", 4)
+	if len(fields) < 4 {
+		return label
+	}
+	levels := strings.Split(fields[3], "-")
+	for i, level := range levels {
+		if n := strings.IndexByte(level, ':'); n >= 0 {
+			levels[i] = level[:n]
+		}
+	}
+	return strings.Join(append(fields[:3], strings.Join(levels, "-")), ":")
+}
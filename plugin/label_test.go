@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestMountLabel(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"layer", "", false})
+	label := "system_u:object_r:container_file_t:s0:c1,c2"
+
+	// Labels are not passed to file systems predating mount options
+	if _, err := d.Get("layer", label); err != nil {
+		t.Fatal(err)
+	}
+	if o := f.options["layer"]; o != "" {
+		t.Errorf("options %q passed to file system without mount options", o)
+	}
+	if err := d.Put("layer"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("layer", label); err != nil {
+		t.Fatal(err)
+	}
+	if o := f.options["layer"]; o != `context="`+label+`"` {
+		t.Errorf("layer mounted with options %q", o)
+	}
+	if err := d.Put("layer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("layer", ""); err != nil {
+		t.Fatal(err)
+	}
+	if o := f.options["layer"]; o != "" {
+		t.Errorf("layer mounted without label with options %q", o)
+	}
+}
+
+func TestSharedLabel(t *testing.T) {
+	for _, test := range []struct{ label, shared string }{
+		{"system_u:object_r:container_file_t:s0:c1,c2",
+			"system_u:object_r:container_file_t:s0"},
+		{"system_u:object_r:container_file_t:s0-s0:c0.c1023",
+			"system_u:object_r:container_file_t:s0-s0"},
+		{"system_u:object_r:container_file_t:s0",
+			"system_u:object_r:container_file_t:s0"},
+		{"system_u:object_r:container_file_t",
+			"system_u:object_r:container_file_t"},
+	} {
+		if l := sharedLabel(test.label); l != test.shared {
+			t.Errorf("label %q shared as %q", test.label, l)
+		}
+	}
+
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	if err := d.handshake(); err != nil {
+		t.Fatal(err)
+	}
+	createLayers(t, d, fakeLayer{"rw", "", true})
+	d.opts = &driverOptions{SELinuxCategories: categoriesShared}
+	if _, err := d.Get("rw", "system_u:object_r:container_file_t:s0:c1,c2"); err != nil {
+		t.Fatal(err)
+	}
+	if o := f.options["rw"]; o != `context="system_u:object_r:container_file_t:s0"` {
+		t.Errorf("layer mounted with options %q", o)
+	}
+}
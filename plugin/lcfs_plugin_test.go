@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+// createFromParent sets up a parent layer with the number of files specified,
+// which the file system presents in a layer created from it right away, and
+// returns a function creating that layer n times.
+func createFromParent(t testing.TB, files int) (*fakeFS, func(n int), func()) {
+	f, d, cleanup := newFakeFS(t)
+	if err := d.Create("base", "", "", nil); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	dir := path.Join(f.home, "layer")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for i := 0; i < files; i++ {
+		file := path.Join(dir, fmt.Sprintf("file%d", i))
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	create := func(n int) {
+		for i := 0; i < n; i++ {
+			createLayers(t, d, fakeLayer{"layer", "base", true})
+			f.lock.Lock()
+			delete(f.parents, "layer")
+			f.lock.Unlock()
+			d.known.remove("layer")
+		}
+	}
+	return f, create, cleanup
+}
+
+func BenchmarkCreateSmallParent(b *testing.B) {
+	_, create, cleanup := createFromParent(b, 10)
+	defer cleanup()
+	b.ResetTimer()
+	create(b.N)
+}
+
+func BenchmarkCreateLargeParent(b *testing.B) {
+	_, create, cleanup := createFromParent(b, 10000)
+	defer cleanup()
+	b.ResetTimer()
+	create(b.N)
+}
+
+// Creating a layer must not issue requests for files of the layer, for
+// example for relabeling those, however large the parent is.
+func TestCreateLargeParent(t *testing.T) {
+	var cmds []int
+	for _, files := range []int{10, 1000} {
+		f, create, cleanup := createFromParent(t, files)
+		f.cmds = nil
+		create(1)
+		cmds = append(cmds, len(f.cmds))
+		cleanup()
+	}
+	if cmds[0] != cmds[1] {
+		t.Errorf("creating a layer issued %d ioctls with 10 files in its "+
+			"parent, %d with 1000 files", cmds[0], cmds[1])
+	}
+}
+
+// nopIoctls replaces ioctls with ones succeeding right away, so only the cost
+// of issuing those is measured.
+func nopIoctls() func() {
+	ioctlSyscall = func(op uintptr, buf []byte) error { return nil }
+	return func() { ioctlSyscall = rootIoctl }
+}
+
+// Ioctls issued by Get, Put and Exists must not allocate
+func TestIoctlAllocs(t *testing.T) {
+	defer nopIoctls()()
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, c := range []struct {
+		cmd        int
+		parent, id string
+	}{
+		{LayerMount, "", id},
+		{LayerCreate, id, id + "-init"},
+		{UmountAll, "", ""},
+	} {
+		n := testing.AllocsPerRun(100, func() {
+			ioctl(c.cmd, c.parent, c.id, "")
+		})
+		if n != 0 {
+			t.Errorf("ioctl %d parent %q id %q allocates %v times",
+				c.cmd, c.parent, c.id, n)
+		}
+	}
+}
+
+func BenchmarkIoctlName(b *testing.B) {
+	defer nopIoctls()()
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ioctl(LayerMount, "", id, "")
+	}
+}
+
+func BenchmarkIoctlNoName(b *testing.B) {
+	defer nopIoctls()()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ioctl(DcacheFlush, "", "", "")
+	}
+}
+
+func BenchmarkExistsAll(b *testing.B) {
+	defer nopIoctls()()
+	d := &Driver{}
+	ids := make([]string, 100)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%064d", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.ExistsAll(ids); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRemoveIdempotent(t *testing.T) {
+	_, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"layer", "", false})
+	for i := 0; i < 2; i++ {
+		if err := d.Remove("layer"); err != nil {
+			t.Fatalf("removing layer, attempt %d: %v", i+1, err)
+		}
+	}
+	if err := d.Remove("missing"); err != nil {
+		t.Fatalf("removing missing layer: %v", err)
+	}
+	d.opts = &driverOptions{StrictRemove: true}
+	if err := d.Remove("missing"); err == nil {
+		t.Fatal("removing missing layer succeeded with strict removal")
+	}
+}
+
+func TestRollbackCreate(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"layer", "", false})
+	if !d.rollbackCreate("layer") {
+		t.Fatal("rolling back layer created failed")
+	}
+	if _, ok := f.parents["layer"]; ok || d.known.has("layer") {
+		t.Fatal("layer rolled back still present")
+	}
+	if !d.rollbackCreate("layer") {
+		t.Fatal("rolling back layer removed failed")
+	}
+	if err := d.Create("layer", "", "", nil); err != nil {
+		t.Fatalf("creating layer rolled back again: %v", err)
+	}
+}
+
+// Get racing a Remove fails with the layer not found, without mounting it
+func TestGetRemoved(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"layer", "", false})
+	removing := make(chan struct{})
+	proceed := make(chan struct{})
+	ioctlSyscall = func(op uintptr, buf []byte) error {
+		if int(op&0xff) == LayerRemove {
+			close(removing)
+			<-proceed
+		}
+		return f.ioctl(op, buf)
+	}
+	done := make(chan error)
+	go func() { done <- d.Remove("layer") }()
+	<-removing
+	if _, err := d.Get("layer", ""); !errors.Is(err, os.ErrNotExist) ||
+		errnoOf(err) != syscall.ENOENT {
+		t.Errorf("Get of layer being removed returned %v", err)
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("layer", ""); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get of layer removed returned %v", err)
+	}
+	if n := f.count(LayerMount); n != 1 {
+		t.Errorf("%d mounts of layer being removed attempted", n)
+	}
+
+	// Layers queued for removal are not found either
+	createLayers(t, d, fakeLayer{"queued", "", false})
+	d.reaper = &reaper{pending: map[string]int{"queued": 0}}
+	defer func() { d.reaper = nil }()
+	if _, err := d.Get("queued", ""); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Get of layer queued for removal returned %v", err)
+	}
+}
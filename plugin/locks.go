@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+)
+
+// layerLock is a lock of a single layer, shared by the operations waiting on
+// it.
+type layerLock struct {
+	sync.Mutex
+	refs int
+}
+
+// layerLocks serializes operations on the same layer, while operations on
+// different layers proceed in parallel.  Locks are dropped once no operation
+// holds or waits on those.
+type layerLocks struct {
+	mapLock sync.Mutex
+	locks   map[string]*layerLock
+}
+
+// lock locks the layer with the given id, returning the function unlocking
+// it.
+func (l *layerLocks) lock(id string) func() {
+	l.mapLock.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*layerLock)
+	}
+	ll := l.locks[id]
+	if ll == nil {
+		ll = &layerLock{}
+		l.locks[id] = ll
+	}
+	ll.refs++
+	l.mapLock.Unlock()
+
+	ll.Lock()
+	return func() {
+		ll.Unlock()
+		l.mapLock.Lock()
+		ll.refs--
+		if ll.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mapLock.Unlock()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLayerLocks(t *testing.T) {
+	var l layerLocks
+	var wg sync.WaitGroup
+
+	// Operations on different layers do not wait on each other
+	unlock := l.lock("a")
+	done := make(chan struct{})
+	go func() {
+		l.lock("b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lock of another layer blocked")
+	}
+
+	// Operations on the same layer are serialized
+	count := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer l.lock("a")()
+			count++
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	if count != 0 {
+		t.Errorf("operations ran while layer locked")
+	}
+	unlock()
+	wg.Wait()
+	if count != 10 || len(l.locks) != 0 {
+		t.Errorf("unexpected count %d locks %v", count, l.locks)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Socket journald receives native protocol messages on
+var journaldSocket = "/run/systemd/journal/socket"
+
+// Message ids of operation records sent to journald, described in
+// lcfs.catalog
+const (
+	journalOpCompletedID = "6c1a9f3e0b7d4c52a8e4f2d19b3c7e01"
+	journalOpFailedID    = "6c1a9f3e0b7d4c52a8e4f2d19b3c7e02"
+)
+
+// logSink sends log entries of the driver to a log collector.
+type logSink interface {
+	write(entry *logrus.Entry) error
+	close() error
+}
+
+// logHook forwards log entries to the sinks configured in Init.  The hook is
+// registered with logrus once, sinks are replaced when the driver is
+// initialized again.
+type logHook struct {
+	lock  sync.RWMutex
+	sinks []logSink
+}
+
+var (
+	sinkHook     logHook
+	sinkHookOnce sync.Once
+)
+
+func (h *logHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire sends an entry to all sinks.  Failures are not logged to avoid
+// recursion, the entry is still written to the log of the plugin.
+func (h *logHook) Fire(entry *logrus.Entry) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var failed error
+	for _, s := range h.sinks {
+		if err := s.write(entry); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// setSinks replaces the sinks entries are sent to and closes the old ones.
+func (h *logHook) setSinks(sinks []logSink) {
+	h.lock.Lock()
+	old := h.sinks
+	h.sinks = sinks
+	h.lock.Unlock()
+	for _, s := range old {
+		s.close()
+	}
+}
+
+// journalOp records the result of a layer operation in the journal as a
+// structured entry, if logs are sent to journald.  Failures of all operations
+// are recorded, successful operations only if those modify layers.
+func journalOp(op, id, parent string, start time.Time, err error) {
+	if err == nil && !auditedOps[op] {
+		return
+	}
+	sinkHook.lock.RLock()
+	defer sinkHook.lock.RUnlock()
+	for _, s := range sinkHook.sinks {
+		if j, ok := s.(*journaldSink); ok {
+			j.writeOp(op, id, parent, start, err)
+		}
+	}
+}
+
+// closeLogSinks stops sending log entries to sinks.
+func closeLogSinks() {
+	sinkHook.setSinks(nil)
+}
+
+// setLogSinks opens the sinks selected in options and starts sending log
+// entries to those, replacing sinks opened before.
+func setLogSinks(opts *driverOptions) error {
+	var sinks []logSink
+
+	for _, name := range opts.LogSinks {
+		var s logSink
+		var err error
+
+		switch name {
+		case "journald":
+			s, err = newJournaldSink(journaldSocket, opts.SyslogTag)
+		case "syslog":
+			s, err = newSyslogSink(opts.SyslogAddress, opts.SyslogTag)
+		default:
+			err = fmt.Errorf("unknown log sink %q", name)
+		}
+		if err != nil {
+			for _, s := range sinks {
+				s.close()
+			}
+			return err
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) > 0 {
+		sinkHookOnce.Do(func() { logrus.AddHook(&sinkHook) })
+	}
+	sinkHook.setSinks(sinks)
+	return nil
+}
+
+// formatFields formats fields of an entry as sorted key=value pairs.
+func formatFields(fields logrus.Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+	return b.String()
+}
+
+// syslogPriority maps a logrus level to a syslog severity.
+func syslogPriority(level logrus.Level) syslog.Priority {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return syslog.LOG_CRIT
+	case logrus.ErrorLevel:
+		return syslog.LOG_ERR
+	case logrus.WarnLevel:
+		return syslog.LOG_WARNING
+	case logrus.InfoLevel:
+		return syslog.LOG_INFO
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
+
+// syslogSink sends entries to the local syslog daemon or to a remote syslog
+// server with address like udp://host:514 or tcp://host:514.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func newSyslogSink(address, tag string) (*syslogSink, error) {
+	var network, raddr string
+
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: w}, nil
+}
+
+func (s *syslogSink) write(entry *logrus.Entry) error {
+	msg := strings.TrimSuffix(entry.Message, "\n") + formatFields(entry.Data)
+	switch syslogPriority(entry.Level) {
+	case syslog.LOG_CRIT:
+		return s.writer.Crit(msg)
+	case syslog.LOG_ERR:
+		return s.writer.Err(msg)
+	case syslog.LOG_WARNING:
+		return s.writer.Warning(msg)
+	case syslog.LOG_INFO:
+		return s.writer.Info(msg)
+	default:
+		return s.writer.Debug(msg)
+	}
+}
+
+func (s *syslogSink) close() error {
+	return s.writer.Close()
+}
+
+// journaldSink sends entries to journald using its native protocol, with
+// fields of entries added as journal fields.
+type journaldSink struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+func newJournaldSink(socket, tag string) (*journaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn, tag: tag}, nil
+}
+
+func (s *journaldSink) write(entry *logrus.Entry) error {
+	var b bytes.Buffer
+
+	journalField(&b, "MESSAGE", strings.TrimSuffix(entry.Message, "\n"))
+	journalField(&b, "PRIORITY", fmt.Sprintf("%d", syslogPriority(entry.Level)))
+	journalField(&b, "SYSLOG_IDENTIFIER", s.tag)
+	for k, v := range entry.Data {
+		if name := journalFieldName(k); name != "" {
+			journalField(&b, name, fmt.Sprint(v))
+		}
+	}
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
+
+// writeOp sends a record of a layer operation with a catalog message id.
+func (s *journaldSink) writeOp(op, id, parent string, start time.Time, err error) error {
+	var b bytes.Buffer
+
+	elapsed := time.Since(start) / time.Microsecond
+	if err == nil {
+		journalField(&b, "MESSAGE_ID", journalOpCompletedID)
+		journalField(&b, "MESSAGE", fmt.Sprintf("%s of layer %s completed", op, id))
+		journalField(&b, "PRIORITY", fmt.Sprintf("%d", syslog.LOG_INFO))
+	} else {
+		journalField(&b, "MESSAGE_ID", journalOpFailedID)
+		journalField(&b, "MESSAGE", fmt.Sprintf("%s of layer %s failed: %v", op, id, err))
+		journalField(&b, "PRIORITY", fmt.Sprintf("%d", syslog.LOG_ERR))
+		journalField(&b, "ERROR", err.Error())
+		if errno := errnoOf(err); errno != 0 {
+			journalField(&b, "ERRNO", fmt.Sprintf("%d", errno))
+		}
+	}
+	journalField(&b, "SYSLOG_IDENTIFIER", s.tag)
+	journalField(&b, "OP", op)
+	journalField(&b, "LAYER_ID", id)
+	if parent != "" {
+		journalField(&b, "PARENT", parent)
+	}
+	journalField(&b, "ELAPSED_US", fmt.Sprintf("%d", elapsed))
+	_, werr := s.conn.Write(b.Bytes())
+	return werr
+}
+
+func (s *journaldSink) close() error {
+	return s.conn.Close()
+}
+
+// journalField appends a field to a native protocol message.  Values with
+// newlines are sent with an explicit length.
+func journalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if strings.ContainsRune(value, '\n') {
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	} else {
+		b.WriteByte('=')
+	}
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName converts a logrus field name to a valid journal field
+// name, made of upper case letters, digits and underscores not starting with
+// an underscore or digit.
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			name[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(name), "_0123456789")
+}
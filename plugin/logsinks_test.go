@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func TestJournalFieldName(t *testing.T) {
+	for key, expected := range map[string]string{
+		"id":        "ID",
+		"layer-id":  "LAYER_ID",
+		"_internal": "INTERNAL",
+		"1st":       "ST",
+	} {
+		if name := journalFieldName(key); name != expected {
+			t.Errorf("expected %q for %q, got %q", expected, key, name)
+		}
+	}
+}
+
+func TestJournaldSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "socket")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := newJournaldSink(socket, "lcfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	entry := &logrus.Entry{
+		Level:   logrus.WarnLevel,
+		Message: "two\nlines",
+		Data:    logrus.Fields{"layer": "abc"},
+	}
+	if err := s.write(entry); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := buf[:n]
+	expected := []byte("MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n")
+	if !bytes.HasPrefix(msg, expected) {
+		t.Errorf("unexpected message %q", msg)
+	}
+	for _, field := range []string{"PRIORITY=4\n", "SYSLOG_IDENTIFIER=lcfs\n", "LAYER=abc\n"} {
+		if !strings.Contains(string(msg), field) {
+			t.Errorf("field %q missing in %q", field, msg)
+		}
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := newSyslogSink("udp://"+l.LocalAddr().String(), "lcfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	entry := &logrus.Entry{
+		Level:   logrus.ErrorLevel,
+		Message: "remove failed\n",
+		Data:    logrus.Fields{"id": "abc", "err": "busy"},
+	}
+	if err := s.write(entry); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<27>") || !strings.Contains(msg, "lcfs") ||
+		!strings.HasSuffix(strings.TrimSpace(msg), "remove failed err=busy id=abc") {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestJournaldOp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "socket")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := newJournaldSink(socket, "lcfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if err := s.writeOp("Remove", "abc", "", time.Now(), syscall.EBUSY); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	for _, field := range []string{
+		"MESSAGE_ID=" + journalOpFailedID + "\n",
+		"OP=Remove\n",
+		"LAYER_ID=abc\n",
+		"ERRNO=16\n",
+		"PRIORITY=3\n",
+	} {
+		if !strings.Contains(msg, field) {
+			t.Errorf("field %q missing in %q", field, msg)
+		}
+	}
+	if strings.Contains(msg, "PARENT=") {
+		t.Errorf("unexpected parent in %q", msg)
+	}
+}
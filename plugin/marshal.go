@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Directions of ioctls, in the top bits of commands
+const (
+	ioctlWrite     = 1 << 30
+	ioctlReadWrite = 3 << 30
+)
+
+// Largest number of a command, encoded in 8 bits
+const maxIoctlCmd = 1<<8 - 1
+
+// ioctlOp returns the command of an ioctl passing n bytes, the first plen of
+// those a parent, failing if any of those does not fit its field, as it would
+// corrupt the others.
+func ioctlOp(dir uintptr, cmd, n, plen int) (uintptr, error) {
+	if cmd < 0 || cmd > maxIoctlCmd || n < 0 || n > maxIoctlName ||
+		plen < 0 || plen > maxIoctlParent || (plen > 0 && plen >= n) {
+		return 0, unix.EINVAL
+	}
+	return dir | uintptr(n)<<16 | uintptr(plen)<<8 | uintptr(cmd), nil
+}
+
+// marshalName appends the parent and id of an ioctl to buf as passed to the
+// file system, "parent/id" or either alone, and returns the command
+// describing those.  The file system reads exactly as many bytes as the
+// command says, so names not fitting the command, a parent without an id
+// the file system would look for past the parent, and names with a NUL byte,
+// which the file system would cut short, are refused before anything is
+// copied.  Only a trailing NUL byte terminating the value of a tunable is
+// accepted in an id.
+func marshalName(buf []byte, cmd int, parent, id string) ([]byte, uintptr, error) {
+	if len(parent) > maxIoctlParent {
+		return buf, 0, nameTooLong(parent, maxIoctlParent)
+	}
+	if len(parent) > 0 && len(parent)+len(id) >= maxIoctlName {
+		return buf, 0, nameTooLong(id, maxIoctlName-len(parent)-1)
+	}
+	if len(id) > maxIoctlName {
+		return buf, 0, nameTooLong(id, maxIoctlName)
+	}
+	if parent != "" && id == "" {
+		return buf, 0, &invalidIDError{parent, "parent without an id",
+			unix.EINVAL}
+	}
+	if strings.IndexByte(parent, 0) >= 0 {
+		return buf, 0, &invalidIDError{parent, "contains a NUL byte",
+			unix.EINVAL}
+	}
+	if i := strings.IndexByte(id, 0); i >= 0 && i != len(id)-1 {
+		return buf, 0, &invalidIDError{id, "contains a NUL byte", unix.EINVAL}
+	}
+	buf = append(buf[:0], parent...)
+	if parent != "" {
+		buf = append(buf, '/')
+	}
+	buf = append(buf, id...)
+	op, err := ioctlOp(ioctlWrite, cmd, len(buf), len(parent))
+	return buf, op, err
+}
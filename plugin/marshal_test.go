@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestMarshalName(t *testing.T) {
+	for _, test := range []struct{ parent, id string }{
+		{"base", ""},
+		{"ba\x00se", "layer"},
+		{"", "lay\x00er"},
+	} {
+		_, _, err := marshalName(nil, LayerCreate, test.parent, test.id)
+		if !errors.Is(err, syscall.EINVAL) {
+			t.Errorf("parent %q id %q returned %v", test.parent, test.id, err)
+		}
+	}
+	if _, err := ioctlOp(ioctlWrite, maxIoctlCmd+1, 1, 0); err == nil {
+		t.Error("command not fitting accepted")
+	}
+
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	if err := d.ioctl(LayerStat, "base", ""); err == nil {
+		t.Error("parent without an id passed to the file system")
+	}
+	if err := d.ioctlRead(LayerStats, "lay\x00er", make([]byte, 64)); err == nil {
+		t.Error("id with a NUL byte passed to the file system")
+	}
+	if len(f.cmds) != 0 {
+		t.Fatalf("%d ioctls issued with invalid names", len(f.cmds))
+	}
+	d.setTunable(SyncerTime, "30")
+	if n := f.count(SyncerTime); n != 1 {
+		t.Errorf("tunable terminated by a NUL byte issued %d times", n)
+	}
+}
+
+// FuzzMarshalName checks names are passed as the command describes those,
+// with the file system never reading past the name.
+func FuzzMarshalName(f *testing.F) {
+	f.Add(LayerCreate, "", "layer")
+	f.Add(LayerCreate, "base", "layer")
+	f.Add(LayerMount, `context="system_u:object_r:container_file_t:s0"`, "layer")
+	f.Add(SyncerTime, "", "30\x00")
+	f.Add(LayerStat, "base", "")
+	f.Add(LayerStat, strings.Repeat("p", maxIoctlParent+1), "layer")
+	f.Add(300, "", "layer")
+	f.Fuzz(func(t *testing.T, cmd int, parent, id string) {
+		buf, op, err := marshalName(nil, cmd, parent, id)
+		if err != nil {
+			return
+		}
+		n := int(op>>16) & maxIoctlName
+		plen := int(op>>8) & maxIoctlParent
+		if int(op&maxIoctlCmd) != cmd || op&^(ioctlWrite|0x3fffffff) != 0 ||
+			op&ioctlReadWrite != ioctlWrite {
+			t.Fatalf("command %d encoded as %#x", cmd, op)
+		}
+		if n != len(buf) || plen != len(parent) {
+			t.Fatalf("lengths %d and %d encoded for %q", n, plen, buf)
+		}
+		if plen > 0 && (plen >= n || buf[plen] != '/' ||
+			string(buf[plen+1:]) != id) {
+			t.Fatalf("parent %q id %q marshaled as %q", parent, id, buf)
+		}
+		if plen == 0 && string(buf) != id {
+			t.Fatalf("id %q marshaled as %q", id, buf)
+		}
+		if i := bytes.IndexByte(buf, 0); i >= 0 && i != len(buf)-1 {
+			t.Fatalf("NUL byte passed in %q", buf)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// opMetric tracks count, failures and time taken by a driver operation.
+type opMetric struct {
+	Count  uint64        `json:"count"`
+	Errors uint64        `json:"errors"`
+	Total  time.Duration `json:"total_ns"`
+	Max    time.Duration `json:"max_ns"`
+	Slow   uint64        `json:"slow"`
+}
+
+// opMetrics tracks all driver operations by name.
+type opMetrics struct {
+	lock sync.Mutex
+	ops  map[string]*opMetric
+}
+
+// record accounts an operation which started at the given time.
+func (m *opMetrics) record(op string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	m.lock.Lock()
+	if m.ops == nil {
+		m.ops = make(map[string]*opMetric)
+	}
+	o := m.ops[op]
+	if o == nil {
+		o = &opMetric{}
+		m.ops[op] = o
+	}
+	o.Count++
+	if err != nil {
+		o.Errors++
+	}
+	o.Total += elapsed
+	if elapsed > o.Max {
+		o.Max = elapsed
+	}
+	m.lock.Unlock()
+}
+
+// recordSlow accounts an operation which exceeded the watchdog threshold.
+func (m *opMetrics) recordSlow(op string) {
+	m.lock.Lock()
+	if o := m.ops[op]; o != nil {
+		o.Slow++
+	}
+	m.lock.Unlock()
+}
+
+// snapshot returns a copy of the current metrics.
+func (m *opMetrics) snapshot() map[string]opMetric {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ops := make(map[string]opMetric, len(m.ops))
+	for op, o := range m.ops {
+		ops[op] = *o
+	}
+	return ops
+}
+
+// trackOp starts tracking a driver operation.  The returned function is to
+// be deferred with the result of the operation, errnos of the file system are
+// translated to errors Docker checks for.  A panic in the operation is
+// recovered and fails the operation.
+func (d *Driver) trackOp(op, id, parent string) func(*error) {
+	var inflight *inflightOp
+
+	start := time.Now()
+	wd := d.watchdog
+	alerts := d.alerts
+	if wd != nil {
+		inflight = wd.begin(op, id)
+	}
+	return func(errp *error) {
+		var err error
+		if p := recover(); p != nil {
+			err = panicError(op, id, p)
+			if errp != nil {
+				*errp = err
+			}
+		}
+		if errp != nil {
+			*errp = wrapOpError(op, id, parent, mapError(*errp))
+			err = *errp
+		}
+		d.metrics.record(op, start, err)
+		if err == nil && capacityOps[op] {
+			d.status.invalidate()
+		}
+		if inflight != nil && wd.end(inflight) {
+			d.metrics.recordSlow(op)
+		}
+		d.auditOp(op, id, parent, start, err)
+		journalOp(op, id, parent, start, err)
+		if alerts != nil {
+			alerts.opResult(op, id, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/portworx/lcfs/plugin/migrate"
+)
+
+// Graph drivers of Docker layers are migrated from
+const (
+	migrateOverlay2     = "overlay2"
+	migrateDeviceMapper = "devicemapper"
+)
+
+// migrateRequest names the graph layers are migrated from, overlay2 unless
+// given, and the layer store of Docker for it, both directories of the host.
+// Devices of devicemapper are created in the thin pool named,
+// or in the pool devicemapper created.
+type migrateRequest struct {
+	From    string `json:"from,omitempty"`
+	Root    string `json:"root"`
+	LayerDB string `json:"layerdb"`
+	Pool    string `json:"pool,omitempty"`
+}
+
+// Migrate creates the layers of an overlay2 or devicemapper graph in the file
+// system with the same ids, for switching Docker to lcfs without pulling
+// images or losing containers again.  Docker needs to be stopped while
+// migrating, and started with the layer store copied as the layer store of
+// the driver once done.  Run by the CLI, with a driver of its own, as the
+// plugin is stopped along with Docker and does not see the graph.
+func (d *Driver) Migrate(req *migrateRequest) (_ *migrate.Result, err error) {
+	logrus.Debugf("Migrate - from %s root %s layerdb %s", req.From, req.Root,
+		req.LayerDB)
+	defer d.trackOp("Migrate", "", "")(&err)
+	for _, dir := range []string{req.Root, req.LayerDB} {
+		if !path.IsAbs(dir) {
+			return nil, fmt.Errorf("lcfs: path %q to migrate from is not "+
+				"absolute", dir)
+		}
+	}
+	s, err := migrate.ReadImageStore(req.LayerDB)
+	if err != nil {
+		return nil, err
+	}
+	var g *migrate.Graph
+	switch req.From {
+	case "", migrateOverlay2:
+		g, err = migrate.ReadGraph(req.Root)
+	case migrateDeviceMapper:
+		g, err = migrate.ReadDeviceMapperGraph(req.Root, s, req.Pool)
+	default:
+		err = fmt.Errorf("lcfs: unknown graph driver %q to migrate from, "+
+			"expected %s or %s", req.From, migrateOverlay2, migrateDeviceMapper)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := migrate.Migrate(d, g, s)
+	if err != nil {
+		return res, err
+	}
+	logrus.Infof("Migrated %d layers of %s, %d bytes, %d present",
+		len(res.Migrated), req.Root, res.Bytes, len(res.Skipped))
+	return res, nil
+}
@@ -0,0 +1,247 @@
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// Files of the metadata directory of devicemapper not describing devices of
+// layers
+var deviceMapperFiles = map[string]bool{
+	"base":                 true,
+	"deviceset-metadata":   true,
+	"transaction-metadata": true,
+}
+
+// Prefix of names of thin devices activated for migrating layers
+const thinDevicePrefix = "lcfs-migrate-"
+
+// thinDevice is a thin device of devicemapper holding all files of a layer,
+// as described by the metadata of the graph driver.
+type thinDevice struct {
+	hash     string
+	DeviceID int    `json:"device_id"`
+	Size     uint64 `json:"size"`
+	Deleted  bool   `json:"deleted"`
+}
+
+// thinPool is the thin pool devices of layers are created in, and the file
+// system of those.
+type thinPool struct {
+	name string
+	fs   string
+}
+
+// Activates a thin device read-only and mounts it, returning the directory of
+// the files of the layer, and a function unmounting and removing the device
+// again, replaced by tests
+var mountThin = (*thinPool).mount
+
+// dmsetup runs dmsetup, failing with its output.
+func dmsetup(args ...string) error {
+	out, err := exec.Command("dmsetup", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("migrate: dmsetup %s: %v: %s", args[0], err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (p *thinPool) mount(dev *thinDevice) (string, func() error, error) {
+	name := thinDevicePrefix + dev.hash
+	table := fmt.Sprintf("0 %d thin /dev/mapper/%s %d", dev.Size/512, p.name,
+		dev.DeviceID)
+	if err := dmsetup("create", "--readonly", name, "--table", table); err != nil {
+		return "", nil, err
+	}
+	dir, err := ioutil.TempDir("", name)
+	if err == nil {
+		opts := ""
+
+		// Devices of all layers have the file system of the base device,
+		// with the same UUID
+		if p.fs == "xfs" {
+			opts = "nouuid"
+		}
+		err = syscall.Mount("/dev/mapper/"+name, dir, p.fs, syscall.MS_RDONLY,
+			opts)
+		if err != nil {
+			os.Remove(dir)
+		}
+	}
+	if err != nil {
+		dmsetup("remove", name)
+		return "", nil, fmt.Errorf("migrate: mounting device of layer %s: %v",
+			dev.hash, err)
+	}
+	release := func() error {
+		if err := syscall.Unmount(dir, 0); err != nil {
+			return err
+		}
+		os.Remove(dir)
+		return dmsetup("remove", name)
+	}
+
+	// Files of a layer are in a directory of the file system of its device
+	return path.Join(dir, "rootfs"), release, nil
+}
+
+// poolName returns the name devicemapper gives to the thin pool it creates,
+// from the device and the inode of its root.
+func poolName(root string) (string, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	major := (st.Dev >> 8) & 0xfff
+	minor := (st.Dev & 0xff) | ((st.Dev >> 12) & 0xfff00)
+	return fmt.Sprintf("docker-%d:%d-%d-pool", major, minor, st.Ino), nil
+}
+
+// readThinDevices reads the devices of layers not deleted from the metadata
+// of devicemapper, and the file system of those.
+func readThinDevices(root string) (map[string]*thinDevice, string, error) {
+	dir := path.Join(root, "metadata")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	devices := make(map[string]*thinDevice)
+	for _, fi := range files {
+		if fi.IsDir() || deviceMapperFiles[fi.Name()] ||
+			strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, "", err
+		}
+		dev := &thinDevice{hash: fi.Name()}
+		if err := json.Unmarshal(data, dev); err != nil {
+			return nil, "", fmt.Errorf("migrate: invalid metadata of device "+
+				"%s: %v", fi.Name(), err)
+		}
+		if !dev.Deleted {
+			devices[dev.hash] = dev
+		}
+	}
+	var meta struct {
+		FS string `json:"BaseDeviceFilesystem"`
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "deviceset-metadata"))
+	if err == nil {
+		err = json.Unmarshal(data, &meta)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+
+	// Not recorded by versions of Docker creating ext4 only
+	if meta.FS == "" {
+		meta.FS = "ext4"
+	}
+	return devices, meta.FS, nil
+}
+
+// ReadDeviceMapperGraph reads the layers of a devicemapper graph, from its
+// root, like /var/lib/docker/devicemapper.  Devices of devicemapper hold all
+// files of a layer, not only those changed, and do not record the parents of
+// layers, so the layers are those the layer store knows of, with the parents
+// recorded there, and diffs are found comparing the files of a layer with
+// those of its parent, with both devices mounted read-only.  Devices are
+// created in the thin pool named by pool, or in the pool devicemapper created
+// if empty.  Devices of layers the layer store does not know of are left
+// behind.
+func ReadDeviceMapperGraph(root string, s *ImageStore, pool string) (*Graph, error) {
+	devices, fs, err := readThinDevices(root)
+	if err != nil {
+		return nil, err
+	}
+	if pool == "" {
+		if pool, err = poolName(root); err != nil {
+			return nil, err
+		}
+	}
+	p := &thinPool{name: pool, fs: fs}
+	g := &Graph{Root: root, Layers: make(map[string]*Layer)}
+	g.diff = func(l *Layer) (io.ReadCloser, error) {
+		return p.diff(devices, l)
+	}
+	add := func(id, parent string) {
+		if devices[id] != nil {
+			g.Layers[id] = &Layer{ID: id, Parent: parent}
+		}
+	}
+	for _, l := range s.Layers {
+		add(l.CacheID, s.cacheID(l.Parent))
+	}
+	for _, m := range s.Mounts {
+		parent := s.cacheID(m.Parent)
+		if m.InitID != "" {
+			add(m.InitID, parent)
+			parent = m.InitID
+		}
+		add(m.MountID, parent)
+	}
+	return g, nil
+}
+
+// mountedDiff is a diff read from devices mounted, released once closed.
+type mountedDiff struct {
+	io.ReadCloser
+	release []func() error
+}
+
+func (d *mountedDiff) Close() error {
+	err := d.ReadCloser.Close()
+	for _, release := range d.release {
+		if rerr := release(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// diff returns the changes of the files of a layer relative to those of its
+// parent, with the devices of both mounted until the diff is closed.
+func (p *thinPool) diff(devices map[string]*thinDevice, l *Layer) (io.ReadCloser, error) {
+	d := &mountedDiff{}
+	releaseAll := func() {
+		for _, release := range d.release {
+			release()
+		}
+	}
+	var dirs []string
+	for _, id := range []string{l.ID, l.Parent} {
+		if id == "" {
+			dirs = append(dirs, "")
+			continue
+		}
+		dir, release, err := mountThin(p, devices[id])
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+		d.release = append(d.release, release)
+	}
+	changes, err := archive.ChangesDirs(dirs[0], dirs[1])
+	if err == nil {
+		d.ReadCloser, err = archive.ExportChanges(dirs[0], changes, nil, nil)
+	}
+	if err != nil {
+		releaseAll()
+		return nil, err
+	}
+	return d, nil
+}
@@ -0,0 +1,111 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigrateDeviceMapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, db := path.Join(dir, "devicemapper"), path.Join(dir, "layerdb")
+
+	// Devices hold all files of layers, the container deleting a file
+	writeFiles(t, path.Join(root, "metadata"), map[string]string{
+		"base":               `{"device_id": 1, "size": 1024}`,
+		"deviceset-metadata": `{"BaseDeviceFilesystem": "xfs"}`,
+		"image":              `{"device_id": 2, "size": 1024}`,
+		"c-init":             `{"device_id": 3, "size": 1024}`,
+		"c":                  `{"device_id": 4, "size": 1024}`,
+		"gone":               `{"device_id": 5, "size": 1024, "deleted": true}`,
+		"orphan":             `{"device_id": 6, "size": 1024}`})
+	files := path.Join(dir, "files")
+	writeFiles(t, files, map[string]string{"image/bin/sh": "sh",
+		"image/etc/hosts": "hosts", "c-init/bin/sh": "sh",
+		"c-init/etc/hosts": "init", "c/bin/sh": "sh", "c/new": "new"})
+	if err := os.Mkdir(path.Join(files, "c", "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files not changed are found by their times, like files of devices
+	// snapshotted
+	now := time.Now()
+	err = filepath.Walk(files, func(name string, fi os.FileInfo, err error) error {
+		if err == nil {
+			err = os.Chtimes(name, now, now)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, db, map[string]string{"sha256/1/cache-id": "image",
+		"mounts/ctr/mount-id": "c", "mounts/ctr/init-id": "c-init",
+		"mounts/ctr/parent": "sha256:1"})
+	mounted := make(map[string]int)
+	mountThin = func(p *thinPool, dev *thinDevice) (string, func() error, error) {
+		if p.name != "pool" || p.fs != "xfs" {
+			return "", nil, fmt.Errorf("unexpected pool %+v", p)
+		}
+		mounted[dev.hash]++
+		return path.Join(files, dev.hash), func() error {
+			mounted[dev.hash]--
+			return nil
+		}, nil
+	}
+	defer func() { mountThin = (*thinPool).mount }()
+
+	s, err := ReadImageStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := ReadDeviceMapperGraph(root, s, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Layers) != 3 || g.Layers["c"].Parent != "c-init" ||
+		g.Layers["c-init"].Parent != "image" || g.Layers["image"].Parent != "" {
+		t.Errorf("unexpected layers read %v", g.Layers)
+	}
+	d := &fakeDriver{layers: make(map[string]*fakeLayer)}
+	res, err := Migrate(d, g, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Migrated, ",") != "image,c-init,c" {
+		t.Errorf("unexpected layers migrated %+v", res)
+	}
+	for id, expected := range map[string]string{"image": "bin,bin/sh,etc,etc/hosts",
+		"c-init": "etc,etc/hosts", "c": "etc,etc/.wh.hosts,new"} {
+		names := d.layers[id].files
+		for i := range names {
+			names[i] = strings.TrimSuffix(names[i], "/")
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != expected {
+			t.Errorf("layer %s migrated with %v, expected %s", id, names,
+				expected)
+		}
+	}
+	for id, n := range mounted {
+		if n != 0 {
+			t.Errorf("device of layer %s mounted %d times", id, n)
+		}
+	}
+
+	// Devices of layers of the layer store missing are found
+	delete(g.Layers, "c")
+	if err := Validate(d, g, s); err == nil {
+		t.Error("layer without device validated")
+	}
+}
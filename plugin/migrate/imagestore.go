@@ -0,0 +1,180 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Digest algorithm of chain ids of layers of the layer store
+const chainIDAlgorithm = "sha256"
+
+// StoreLayer is a layer of an image as recorded by the layer store of Docker,
+// the layer of the graph driver holding its files, and the chain id of the
+// layer below it, empty for the bottom layer of an image.
+type StoreLayer struct {
+	ChainID string `json:"chain_id"`
+	CacheID string `json:"cache_id"`
+	Parent  string `json:"parent,omitempty"`
+}
+
+// StoreMount is the writable layer of a container as recorded by the layer
+// store, created from its init layer, created from the top layer of the image
+// of the container.
+type StoreMount struct {
+	Container string `json:"container"`
+	MountID   string `json:"mount_id"`
+	InitID    string `json:"init_id,omitempty"`
+	Parent    string `json:"parent,omitempty"`
+}
+
+// ImageStore is what the layer store of Docker records of the layers of a
+// graph driver, read from its directory, like
+// /var/lib/docker/image/overlay2/layerdb.
+type ImageStore struct {
+	Layers map[string]*StoreLayer
+	Mounts map[string]*StoreMount
+}
+
+// readValue reads a file of the layer store holding a single value, empty if
+// the file does not exist.
+func readValue(dir, name string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// ReadImageStore reads the layers and the mounts of the layer store.
+func ReadImageStore(dir string) (*ImageStore, error) {
+	s := &ImageStore{Layers: make(map[string]*StoreLayer),
+		Mounts: make(map[string]*StoreMount)}
+	layers, err := ioutil.ReadDir(path.Join(dir, chainIDAlgorithm))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range layers {
+		if !fi.IsDir() {
+			continue
+		}
+		ldir := path.Join(dir, chainIDAlgorithm, fi.Name())
+		l := &StoreLayer{ChainID: chainIDAlgorithm + ":" + fi.Name()}
+		if l.CacheID, err = readValue(ldir, "cache-id"); err != nil {
+			return nil, err
+		}
+		if l.Parent, err = readValue(ldir, "parent"); err != nil {
+			return nil, err
+		}
+		if l.CacheID == "" {
+			return nil, fmt.Errorf("migrate: layer %s without cache-id",
+				l.ChainID)
+		}
+		s.Layers[l.ChainID] = l
+	}
+	mounts, err := ioutil.ReadDir(path.Join(dir, "mounts"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range mounts {
+		if !fi.IsDir() {
+			continue
+		}
+		mdir := path.Join(dir, "mounts", fi.Name())
+		m := &StoreMount{Container: fi.Name()}
+		if m.MountID, err = readValue(mdir, "mount-id"); err != nil {
+			return nil, err
+		}
+		if m.InitID, err = readValue(mdir, "init-id"); err != nil {
+			return nil, err
+		}
+		if m.Parent, err = readValue(mdir, "parent"); err != nil {
+			return nil, err
+		}
+		if m.MountID == "" {
+			return nil, fmt.Errorf("migrate: mount of container %s without "+
+				"mount-id", m.Container)
+		}
+		s.Mounts[m.Container] = m
+	}
+	return s, nil
+}
+
+// ReadWrite checks if a layer of the graph driver is a writable layer of a
+// container, or its init layer.
+func (s *ImageStore) ReadWrite(id string) bool {
+	for _, m := range s.Mounts {
+		if m.MountID == id || m.InitID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheID returns the layer of the graph driver of a layer of an image.
+func (s *ImageStore) cacheID(chainID string) string {
+	if l := s.Layers[chainID]; l != nil {
+		return l.CacheID
+	}
+	return ""
+}
+
+// ValidationError lists the layers of the layer store not matching the layers
+// migrated.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("migrate: %d layers not matching the layer store: %s",
+		len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// Validate checks every layer the layer store records is a layer of the
+// graph present in the driver, created from the layer the store records below
+// it, so Docker finds the images and the containers it knows of once started
+// with the driver.
+func Validate(d Driver, g *Graph, s *ImageStore) error {
+	var problems []string
+	check := func(what, id, parent string) {
+		l := g.Layers[id]
+		switch {
+		case l == nil:
+			problems = append(problems, fmt.Sprintf("%s: layer %s not in the "+
+				"graph", what, id))
+		case !d.Exists(id):
+			problems = append(problems, fmt.Sprintf("%s: layer %s not "+
+				"migrated", what, id))
+		case l.Parent != parent:
+			problems = append(problems, fmt.Sprintf("%s: layer %s created "+
+				"from %q, not from %q", what, id, l.Parent, parent))
+		}
+	}
+	for _, l := range s.Layers {
+		parent := ""
+		if l.Parent != "" {
+			if parent = s.cacheID(l.Parent); parent == "" {
+				problems = append(problems, fmt.Sprintf("layer %s: parent %s "+
+					"not in the layer store", l.ChainID, l.Parent))
+				continue
+			}
+		}
+		check("layer "+l.ChainID, l.CacheID, parent)
+	}
+	for _, m := range s.Mounts {
+		parent := s.cacheID(m.Parent)
+		if m.InitID != "" {
+			check("init layer of container "+m.Container, m.InitID, parent)
+			parent = m.InitID
+		}
+		check("container "+m.Container, m.MountID, parent)
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ValidationError{problems}
+	}
+	return nil
+}
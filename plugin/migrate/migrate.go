@@ -0,0 +1,84 @@
+// Package migrate moves the layers of the overlay2 or devicemapper graph
+// drivers of Docker to lcfs, keeping the ids of the layers, so the images and
+// the containers Docker knows of stay valid.  It is used by the lcfs plugin,
+// and may be embedded by installers migrating hosts, passing a Driver talking
+// to the plugin.
+package migrate
+
+import (
+	"fmt"
+	"io"
+)
+
+// Driver is the part of a graph driver layers are migrated to, satisfied by
+// the driver of the lcfs plugin.
+type Driver interface {
+	Create(id, parent, mountLabel string, storageOpt map[string]string) error
+	CreateReadWrite(id, parent, mountLabel string,
+		storageOpt map[string]string) error
+	ApplyDiff(id, parent string, diff io.Reader) (int64, error)
+	Exists(id string) bool
+	Remove(id string) error
+}
+
+// Result describes a migration, the layers created, with the bytes of their
+// diffs applied, and those skipped as present already.
+type Result struct {
+	Migrated []string `json:"migrated"`
+	Skipped  []string `json:"skipped,omitempty"`
+	Bytes    int64    `json:"bytes"`
+}
+
+// Migrate creates every layer of a graph not present in the driver with the
+// same id, created from the same parent, parents first, applying the changes
+// of the layer as a diff.  Layers of containers and their init layers,
+// found in the layer store, are created writable, all others read-only.  A
+// layer failing is removed again, layers migrated before are kept, so
+// migrating again completes the rest.  The layers migrated are validated
+// against the layer store once done.  Docker should not be running with the
+// graph while it is migrated.
+func Migrate(d Driver, g *Graph, s *ImageStore) (*Result, error) {
+	order, err := g.Order()
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, l := range order {
+		if d.Exists(l.ID) {
+			res.Skipped = append(res.Skipped, l.ID)
+			continue
+		}
+		size, err := migrateLayer(d, g, l, s.ReadWrite(l.ID))
+		if err != nil {
+			return res, fmt.Errorf("migrate: layer %s: %v", l.ID, err)
+		}
+		res.Migrated = append(res.Migrated, l.ID)
+		res.Bytes += size
+	}
+	return res, Validate(d, g, s)
+}
+
+// migrateLayer creates a layer and applies its files, removing it again if
+// that fails.
+func migrateLayer(d Driver, g *Graph, l *Layer, rw bool) (int64, error) {
+	create := d.Create
+	if rw {
+		create = d.CreateReadWrite
+	}
+	if err := create(l.ID, l.Parent, "", nil); err != nil {
+		return 0, err
+	}
+	diff, err := g.Diff(l.ID)
+	var size int64
+	if err == nil {
+		size, err = d.ApplyDiff(l.ID, l.Parent, diff)
+		diff.Close()
+	}
+	if err != nil {
+		if rerr := d.Remove(l.ID); rerr != nil {
+			return 0, fmt.Errorf("%v, removing the layer failed: %v", err, rerr)
+		}
+		return 0, err
+	}
+	return size, nil
+}
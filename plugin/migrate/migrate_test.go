@@ -0,0 +1,180 @@
+package migrate
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeLayer is a layer created by fakeDriver.
+type fakeLayer struct {
+	parent string
+	rw     bool
+	files  []string
+}
+
+// fakeDriver keeps layers created in memory, failing diffs applied to the
+// layer named by fail.
+type fakeDriver struct {
+	layers map[string]*fakeLayer
+	fail   string
+}
+
+func (d *fakeDriver) create(id, parent string, rw bool) error {
+	if d.layers[id] != nil {
+		return fmt.Errorf("layer %s exists", id)
+	}
+	if parent != "" && d.layers[parent] == nil {
+		return fmt.Errorf("parent %s not found", parent)
+	}
+	d.layers[id] = &fakeLayer{parent: parent, rw: rw}
+	return nil
+}
+
+func (d *fakeDriver) Create(id, parent, mountLabel string,
+	storageOpt map[string]string) error {
+	return d.create(id, parent, false)
+}
+
+func (d *fakeDriver) CreateReadWrite(id, parent, mountLabel string,
+	storageOpt map[string]string) error {
+	return d.create(id, parent, true)
+}
+
+func (d *fakeDriver) ApplyDiff(id, parent string, diff io.Reader) (int64, error) {
+	if id == d.fail {
+		return 0, errors.New("failed")
+	}
+	var size int64
+	r := tar.NewReader(diff)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		d.layers[id].files = append(d.layers[id].files, hdr.Name)
+		size += hdr.Size
+	}
+}
+
+func (d *fakeDriver) Exists(id string) bool {
+	return d.layers[id] != nil
+}
+
+func (d *fakeDriver) Remove(id string) error {
+	delete(d.layers, id)
+	return nil
+}
+
+// writeFiles writes files relative to a directory.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		name = path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, db := path.Join(dir, "overlay2"), path.Join(dir, "layerdb")
+
+	// An image of two layers and a container, as laid out by overlay2
+	for _, l := range []struct{ id, link, lower string }{
+		{"base", "B", ""}, {"top", "T", "l/B"}, {"c-init", "I", "l/T:l/B"},
+		{"c", "C", "l/I:l/T:l/B"}} {
+		files := map[string]string{"link": l.link, "diff/" + l.id: l.id}
+		if l.lower != "" {
+			files["lower"] = l.lower
+		}
+		writeFiles(t, path.Join(root, l.id), files)
+	}
+	writeFiles(t, root, map[string]string{"top/diff/etc/conf": "conf"})
+	if err := syscall.Mknod(path.Join(root, "top", "diff", "base"),
+		syscall.S_IFCHR, 0); err != nil {
+		t.Logf("Whiteout not created, err %v", err)
+	}
+	writeFiles(t, db, map[string]string{
+		"sha256/1/cache-id": "base", "sha256/2/cache-id": "top",
+		"sha256/2/parent": "sha256:1", "mounts/ctr/mount-id": "c",
+		"mounts/ctr/init-id": "c-init", "mounts/ctr/parent": "sha256:2"})
+
+	g, err := ReadGraph(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Layers["c"].Parent != "c-init" || g.Layers["base"].Parent != "" {
+		t.Errorf("unexpected parents of layers read")
+	}
+	s, err := ReadImageStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers failing are removed, those migrated before are kept
+	d := &fakeDriver{layers: make(map[string]*fakeLayer), fail: "c-init"}
+	if _, err := Migrate(d, g, s); err == nil || d.layers["c-init"] != nil {
+		t.Errorf("layer failing left behind, err %v", err)
+	}
+	if err := Validate(d, g, s); err == nil ||
+		len(err.(*ValidationError).Problems) != 2 {
+		t.Errorf("layers not migrated validated, err %v", err)
+	}
+	d.fail = ""
+	res, err := Migrate(d, g, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(res.Skipped, ",") != "base,top" ||
+		strings.Join(res.Migrated, ",") != "c-init,c" {
+		t.Errorf("unexpected layers migrated %+v", res)
+	}
+	for id, parent := range map[string]string{"top": "base", "c-init": "top",
+		"c": "c-init"} {
+		if d.layers[id].parent != parent {
+			t.Errorf("layer %s migrated from %q", id, d.layers[id].parent)
+		}
+	}
+	if d.layers["top"].rw || !d.layers["c-init"].rw || !d.layers["c"].rw {
+		t.Error("layers not created writable as containers")
+	}
+	files := d.layers["top"].files
+	sort.Strings(files)
+	expected := "etc/,etc/conf,top"
+	if _, err := os.Stat(path.Join(root, "top", "diff", "base")); err == nil {
+		expected = ".wh.base," + expected
+	}
+	if strings.Join(files, ",") != expected {
+		t.Errorf("unexpected files migrated %v, expected %s", files, expected)
+	}
+
+	// Layers not matching the layer store are found
+	g.Layers["c"].Parent = "top"
+	if err := Validate(d, g, s); err == nil {
+		t.Error("container created from its image validated")
+	}
+	delete(g.Layers, "c")
+	g.Layers["c-init"].Parent = "c-init"
+	if _, err := g.Order(); err == nil {
+		t.Error("layer below itself ordered")
+	}
+}
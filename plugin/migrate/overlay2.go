@@ -0,0 +1,131 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// Directory of an overlay2 graph holding the short links of layers
+const linkDir = "l"
+
+// Layer is a layer of a graph, named by the id Docker passes to the graph
+// driver.
+type Layer struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent,omitempty"`
+
+	// Short name of a layer of overlay2 in the link directory, found in lower
+	// files
+	Link string `json:"link,omitempty"`
+}
+
+// Graph is the layers of a graph driver, read from its root, like
+// /var/lib/docker/overlay2.
+type Graph struct {
+	Root   string
+	Layers map[string]*Layer
+
+	// Returns the diff of a layer of the graph driver
+	diff func(l *Layer) (io.ReadCloser, error)
+}
+
+// ReadGraph reads the layers of an overlay2 graph.  A layer created from
+// another lists the links of all the layers below it in its lower file,
+// nearest first, the first naming its parent.
+func ReadGraph(root string) (*Graph, error) {
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	g := &Graph{Root: root, Layers: make(map[string]*Layer)}
+	g.diff = g.overlayDiff
+	links := make(map[string]string)
+	lowers := make(map[string]string)
+	for _, fi := range dirs {
+		if !fi.IsDir() || fi.Name() == linkDir {
+			continue
+		}
+		id := fi.Name()
+		if _, err := os.Stat(path.Join(root, id, "diff")); err != nil {
+			return nil, fmt.Errorf("migrate: layer %s: %v", id, err)
+		}
+		link, err := ioutil.ReadFile(path.Join(root, id, "link"))
+		if err != nil {
+			return nil, fmt.Errorf("migrate: layer %s: %v", id, err)
+		}
+		l := &Layer{ID: id, Link: strings.TrimSpace(string(link))}
+		links[l.Link] = id
+		g.Layers[id] = l
+		lower, err := ioutil.ReadFile(path.Join(root, id, "lower"))
+		if err == nil {
+			lowers[id] = strings.TrimSpace(string(lower))
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("migrate: layer %s: %v", id, err)
+		}
+	}
+	for id, lower := range lowers {
+		first := strings.TrimPrefix(strings.Split(lower, ":")[0], linkDir+"/")
+		parent, ok := links[first]
+		if !ok {
+			return nil, fmt.Errorf("migrate: lower %s of layer %s not found",
+				first, id)
+		}
+		g.Layers[id].Parent = parent
+	}
+	return g, nil
+}
+
+// Order returns the layers of the graph, every layer after its parent.
+func (g *Graph) Order() ([]*Layer, error) {
+	ids := make([]string, 0, len(g.Layers))
+	for id := range g.Layers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var order []*Layer
+	done := make(map[string]bool)
+	for _, id := range ids {
+		var chain []*Layer
+		seen := make(map[string]bool)
+		for l := g.Layers[id]; l != nil && !done[l.ID]; l = g.Layers[l.Parent] {
+			if seen[l.ID] {
+				return nil, fmt.Errorf("migrate: layer %s is below itself", l.ID)
+			}
+			seen[l.ID] = true
+			chain = append(chain, l)
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			done[chain[i].ID] = true
+			order = append(order, chain[i])
+		}
+	}
+	return order, nil
+}
+
+// Diff returns the changes of a layer relative to its parent as an
+// uncompressed tar archive, the diff the layer was created with.
+func (g *Graph) Diff(id string) (io.ReadCloser, error) {
+	l := g.Layers[id]
+	if l == nil {
+		return nil, fmt.Errorf("migrate: layer %s not found", id)
+	}
+	return g.diff(l)
+}
+
+// overlayDiff returns the files of the diff directory of a layer of overlay2,
+// whiteouts and opaque directories of overlay converted to the whiteout files
+// of diffs.
+func (g *Graph) overlayDiff(l *Layer) (io.ReadCloser, error) {
+	return archive.TarWithOptions(path.Join(g.Root, l.ID, "diff"),
+		&archive.TarOptions{
+			Compression:    archive.Uncompressed,
+			WhiteoutFormat: archive.OverlayWhiteoutFormat,
+		})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// FUSE_SUPER_MAGIC, the type of file systems mounted through fuse like lcfs
+const fuseSuperMagic = 0x65735546
+
+// notMountedError is returned by Init if the layer root is not an lcfs mount,
+// as otherwise every later operation fails with errors hard to make sense of.
+type notMountedError struct {
+	dir    string
+	reason string
+}
+
+func (e *notMountedError) Error() string {
+	return fmt.Sprintf("lcfs: %s is not an lcfs mount, %s; start the file "+
+		"system with 'lcfs daemon <device> <host-mountpath> %s' before "+
+		"starting the plugin", e.dir, e.reason, e.dir)
+}
+
+// checkMount checks if the layer root is a fuse mount, before issuing any
+// ioctl to it.
+func checkMount(dir string) error {
+	var st unix.Statfs_t
+
+	if err := unix.Statfs(dir, &st); err != nil {
+		if err == unix.ENOTCONN {
+			return &notMountedError{dir, "the file system daemon is not running"}
+		}
+		return err
+	}
+	if int64(st.Type) != fuseSuperMagic {
+		return &notMountedError{dir,
+			fmt.Sprintf("file system type is 0x%x", st.Type)}
+	}
+	return nil
+}
+
+// probeLayerRoot issues an ioctl answered by the file system daemon, failing
+// if the layer root is another fuse file system or the daemon is gone.
+func (d *Driver) probeLayerRoot() error {
+	err := d.ioctl(LayerStat, "", ".")
+	switch err {
+	case unix.ENOTTY, unix.ENOSYS, unix.EINVAL, unix.EOPNOTSUPP:
+		return &notMountedError{d.home,
+			"the file system does not support lcfs requests"}
+	case unix.ENOTCONN:
+		return &notMountedError{d.home, "the file system daemon is not running"}
+	}
+	return err
+}
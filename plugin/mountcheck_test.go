@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCheckMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = checkMount(dir)
+	if _, ok := err.(*notMountedError); !ok {
+		t.Fatalf("checking %s returned %v", dir, err)
+	}
+	if !strings.Contains(err.Error(), "lcfs daemon") {
+		t.Fatalf("error %q does not explain mounting lcfs", err)
+	}
+}
+
+func TestProbeLayerRoot(t *testing.T) {
+	defer func() { ioctlSyscall = rootIoctl }()
+	d := &Driver{home: "/lcfs"}
+	for _, c := range []struct {
+		errno       error
+		notMounted  bool
+		expectedErr error
+	}{
+		{nil, false, nil},
+		{unix.ENOTTY, true, nil},
+		{unix.ENOTCONN, true, nil},
+		{unix.EIO, false, unix.EIO},
+	} {
+		errno := c.errno
+		ioctlSyscall = func(op uintptr, buf []byte) error { return errno }
+		err := d.probeLayerRoot()
+		if _, ok := err.(*notMountedError); ok != c.notMounted ||
+			(!ok && err != c.expectedErr) {
+			t.Errorf("ioctl failing with %v, probe returned %v", c.errno, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// mountTracker counts references of layers mounted through the driver, so only
+// the first Get and the last Put of a layer issue an ioctl to the file system.
+// Layers may be kept mounted without references for a while after the last
+// Put, those are idle until a Get takes a reference again or the timer
+// unmounting those fires.  Read-only layers may also be cached, staying
+// mounted until evicted as the least recently used one.  Layers found mounted
+// when the plugin started are restored, taken over by the next Get.
+type mountTracker struct {
+	lock     sync.Mutex
+	refs     map[string]int
+	idle     map[string]*idleMount
+	restored map[string]bool
+	readOnly map[string]bool
+	seq      uint64
+}
+
+// idleMount is a layer waiting to be unmounted, either when its timer fires
+// or when evicted from the cache.
+type idleMount struct {
+	timer *time.Timer
+	seq   uint64
+}
+
+// stop cancels unmounting an idle layer.
+func (i *idleMount) stop() {
+	if i.timer != nil {
+		i.timer.Stop()
+	}
+}
+
+// ref takes another reference of a layer if it is mounted already, cancelling
+// the unmount of an idle layer.
+func (m *mountTracker) ref(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if i := m.idle[id]; i != nil {
+		i.stop()
+		delete(m.idle, id)
+		m.refs[id] = 1
+		return true
+	}
+	if m.restored[id] {
+		delete(m.restored, id)
+		m.refs[id] = 1
+		return true
+	}
+	if m.refs[id] == 0 {
+		return false
+	}
+	m.refs[id]++
+	return true
+}
+
+// mounted records a layer mounted with a single reference.
+func (m *mountTracker) mounted(id string) {
+	m.lock.Lock()
+	if m.refs == nil {
+		m.refs = make(map[string]int)
+	}
+	m.refs[id] = 1
+	m.lock.Unlock()
+}
+
+// adopt records a layer mounted with the references specified, as when
+// mounted by a previous instance of the plugin.
+func (m *mountTracker) adopt(id string, refs int) {
+	m.lock.Lock()
+	if m.refs == nil {
+		m.refs = make(map[string]int)
+	}
+	m.refs[id] = refs
+	m.lock.Unlock()
+}
+
+// restore records a layer found mounted without references, taken over by the
+// next Get without mounting it again.
+func (m *mountTracker) restore(id string) {
+	m.lock.Lock()
+	if m.refs == nil {
+		m.refs = make(map[string]int)
+	}
+	if m.restored == nil {
+		m.restored = make(map[string]bool)
+	}
+	m.restored[id] = true
+	m.lock.Unlock()
+}
+
+// restart drops the references of all layers, as when Docker restarted and
+// takes references of layers in use again.  Layers stay mounted idle for
+// delay, unmounted by umount unless referenced again.  The layers are
+// returned.
+func (m *mountTracker) restart(delay time.Duration,
+	umount func(id string, i *idleMount)) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.refs) == 0 {
+		return nil
+	}
+	if m.idle == nil {
+		m.idle = make(map[string]*idleMount)
+	}
+	ids := make([]string, 0, len(m.refs))
+	for id := range m.refs {
+		i := &idleMount{}
+		id := id
+		i.timer = time.AfterFunc(delay, func() { umount(id, i) })
+		m.idle[id] = i
+		delete(m.refs, id)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// release drops a reference of a layer, returning true if the layer needs to
+// be unmounted.  Layers not tracked, like those mounted before the plugin was
+// restarted, are always unmounted.
+func (m *mountTracker) release(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.refs[id] > 1 {
+		m.refs[id]--
+		return false
+	}
+	delete(m.refs, id)
+	delete(m.restored, id)
+	return true
+}
+
+// park keeps a layer released for the last time mounted, calling umount after
+// delay unless the layer is referenced again.  The layer is passed to expire
+// by umount.
+func (m *mountTracker) park(id string, delay time.Duration,
+	umount func(i *idleMount)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.refs == nil {
+		m.refs = make(map[string]int)
+	}
+	if m.idle == nil {
+		m.idle = make(map[string]*idleMount)
+	}
+	i := &idleMount{}
+	i.timer = time.AfterFunc(delay, func() { umount(i) })
+	m.idle[id] = i
+}
+
+// cache keeps a read-only layer released for the last time mounted.  If
+// more than size layers are cached, the least recently used one is no longer
+// tracked and passed to umount in the background.
+func (m *mountTracker) cache(id string, size int, umount func(id string)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.refs == nil {
+		m.refs = make(map[string]int)
+	}
+	if m.idle == nil {
+		m.idle = make(map[string]*idleMount)
+	}
+	m.seq++
+	m.idle[id] = &idleMount{seq: m.seq}
+
+	var cached int
+	var lru string
+	for cid, i := range m.idle {
+		if i.timer != nil {
+			continue
+		}
+		cached++
+		if lru == "" || i.seq < m.idle[lru].seq {
+			lru = cid
+		}
+	}
+	if cached > size {
+		delete(m.idle, lru)
+		go umount(lru)
+	}
+}
+
+// markReadOnly records a layer created read-only, which may be cached.
+func (m *mountTracker) markReadOnly(id string) {
+	m.lock.Lock()
+	if m.readOnly == nil {
+		m.readOnly = make(map[string]bool)
+	}
+	m.readOnly[id] = true
+	m.lock.Unlock()
+}
+
+// isReadOnly checks if a layer was created read-only.  Layers created before
+// the plugin started are not known to be read-only.
+func (m *mountTracker) isReadOnly(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.readOnly[id]
+}
+
+// expire stops tracking an idle layer, returning true if the layer still needs
+// to be unmounted.
+func (m *mountTracker) expire(id string, i *idleMount) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.idle[id] != i {
+		return false
+	}
+	delete(m.idle, id)
+	return true
+}
+
+// forget stops tracking a layer, returning true if the layer was idle or
+// restored and is still mounted.
+func (m *mountTracker) forget(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.refs, id)
+	delete(m.readOnly, id)
+	if m.restored[id] {
+		delete(m.restored, id)
+		return true
+	}
+	if i := m.idle[id]; i != nil {
+		i.stop()
+		delete(m.idle, id)
+		return true
+	}
+	return false
+}
+
+// reset stops tracking all layers.
+func (m *mountTracker) reset() {
+	m.lock.Lock()
+	for _, i := range m.idle {
+		i.stop()
+	}
+	m.refs = nil
+	m.idle = nil
+	m.restored = nil
+	m.readOnly = nil
+	m.lock.Unlock()
+}
+
+// active checks if a layer is mounted, including idle and restored ones.
+func (m *mountTracker) active(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.refs[id] > 0 || m.idle[id] != nil || m.restored[id]
+}
+
+// referenced checks if a layer is mounted with references, or was found
+// mounted when the plugin started, and may be used.
+func (m *mountTracker) referenced(id string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.refs[id] > 0 || m.restored[id]
+}
+
+// count returns the number of layers mounted, including idle and restored
+// ones.
+func (m *mountTracker) count() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.refs) + len(m.idle) + len(m.restored)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMountTracker(t *testing.T) {
+	var m mountTracker
+
+	if m.ref("a") {
+		t.Fatalf("layer not mounted yet referenced")
+	}
+	m.mounted("a")
+	if !m.ref("a") || !m.ref("a") {
+		t.Fatalf("mounted layer not referenced")
+	}
+	if m.release("a") || m.release("a") {
+		t.Errorf("layer unmounted with references left")
+	}
+	if !m.release("a") {
+		t.Errorf("layer not unmounted on last reference")
+	}
+	if !m.release("b") {
+		t.Errorf("untracked layer not unmounted")
+	}
+	m.mounted("c")
+	m.forget("c")
+	if m.ref("c") || m.count() != 0 {
+		t.Errorf("removed layer still tracked")
+	}
+}
+
+func TestMountTrackerIdle(t *testing.T) {
+	var m mountTracker
+
+	expired := make(chan *idleMount, 1)
+	m.mounted("a")
+	if !m.release("a") {
+		t.Fatalf("layer not unmounted on last reference")
+	}
+	m.park("a", time.Hour, func(i *idleMount) { expired <- i })
+	if m.count() != 1 {
+		t.Errorf("idle layer not counted as mounted")
+	}
+	if !m.ref("a") {
+		t.Fatalf("idle layer not referenced again")
+	}
+	if !m.release("a") {
+		t.Fatalf("layer not unmounted on last reference")
+	}
+	m.park("a", time.Millisecond, func(i *idleMount) { expired <- i })
+	i := <-expired
+	if !m.expire("a", i) || m.expire("a", i) {
+		t.Errorf("idle layer not expired once")
+	}
+	if m.ref("a") || m.count() != 0 {
+		t.Errorf("expired layer still tracked")
+	}
+
+	m.mounted("b")
+	m.release("b")
+	m.park("b", time.Hour, func(i *idleMount) {})
+	if !m.forget("b") || m.forget("b") {
+		t.Errorf("idle layer not reported mounted once when forgotten")
+	}
+}
+
+func TestMountTrackerCache(t *testing.T) {
+	var m mountTracker
+
+	evicted := make(chan string, 3)
+	for _, id := range []string{"a", "b", "c"} {
+		m.markReadOnly(id)
+		m.mounted(id)
+		m.release(id)
+		m.cache(id, 2, func(id string) { evicted <- id })
+	}
+	if id := <-evicted; id != "a" {
+		t.Errorf("evicted %s instead of least recently used layer", id)
+	}
+	if !m.ref("b") || m.ref("a") {
+		t.Errorf("cached layers not tracked")
+	}
+	if !m.isReadOnly("c") || m.isReadOnly("d") {
+		t.Errorf("read-only layers not tracked")
+	}
+	if m.count() != 2 {
+		t.Errorf("unexpected %d layers mounted", m.count())
+	}
+}
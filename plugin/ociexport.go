@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Media types of an OCI image layout
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// Annotation of the index naming an image of an OCI image layout
+const ociRefAnnotation = "org.opencontainers.image.ref.name"
+
+// Version of OCI image layouts written
+const ociLayoutVersion = "1.0.0"
+
+// ociExportRequest describes an image exported as an OCI image layout in a
+// directory of the host of the plugin, the layers of the image, from the base
+// of the image up, and the file of the config of the image in the image store
+// of Docker, if any.
+type ociExportRequest struct {
+	Path   string   `json:"path"`
+	Layers []string `json:"layers"`
+	Config string   `json:"config,omitempty"`
+	Ref    string   `json:"ref,omitempty"`
+}
+
+// ociDescriptor describes a blob of an OCI image layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is the manifest of an image, naming its config and layers.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// ociIndex lists the manifests of the images of an OCI image layout.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociImage is an image exported, the descriptor of its manifest in the index
+// and the digests of its config and layers.
+type ociImage struct {
+	Path     string          `json:"path"`
+	Manifest ociDescriptor   `json:"manifest"`
+	Config   string          `json:"config"`
+	Layers   []ociDescriptor `json:"layers"`
+}
+
+// validate checks a request exporting an image.
+func (r *ociExportRequest) validate() error {
+	if !path.IsAbs(r.Path) {
+		return fmt.Errorf("lcfs: path %q of image layout is not absolute",
+			r.Path)
+	}
+	if r.Config != "" && !path.IsAbs(r.Config) {
+		return fmt.Errorf("lcfs: path %q of image config is not absolute",
+			r.Config)
+	}
+	if len(r.Layers) == 0 {
+		return fmt.Errorf("lcfs: no layers to export")
+	}
+	return nil
+}
+
+// ociLayout writes blobs to an OCI image layout, named by their digests.
+type ociLayout struct {
+	dir string
+}
+
+// blobs returns the directory of blobs of the layout.
+func (l *ociLayout) blobs() string {
+	return path.Join(l.dir, "blobs", "sha256")
+}
+
+// write stores a blob written by fn, returning its descriptor.  Blobs are
+// written to a temporary file renamed once complete, so a blob present is
+// always whole, and is kept if present already, like a layer shared by images.
+func (l *ociLayout) write(mediaType string, fn func(w io.Writer) error) (ociDescriptor, error) {
+	desc := ociDescriptor{MediaType: mediaType}
+	f, err := ioutil.TempFile(l.blobs(), ".blob")
+	if err != nil {
+		return desc, err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	n := &countingWriter{w: io.MultiWriter(f, h)}
+	err = fn(n)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return desc, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	desc.Digest, desc.Size = "sha256:"+sum, n.n
+	return desc, os.Rename(f.Name(), path.Join(l.blobs(), sum))
+}
+
+// writeJSON stores a blob holding a value as JSON.
+func (l *ociLayout) writeJSON(mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{MediaType: mediaType}, err
+	}
+	return l.write(mediaType, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// countingWriter counts bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exportLayer stores the changes of a layer relative to its parent as a
+// compressed blob, returning its descriptor and the digest of the changes
+// uncompressed, the diff id of the layer.
+func (d *Driver) exportLayer(l *ociLayout, id, parent string) (ociDescriptor, string, error) {
+	defer d.layers.lock(id)()
+	if !d.Exists(id) {
+		return ociDescriptor{}, "", notFoundError(id)
+	}
+	if d.mounts.active(id) && !d.mounts.isReadOnly(id) {
+		return ociDescriptor{}, "", mountedError(id)
+	}
+	var diffID hash.Hash
+	desc, err := l.write(ociLayerType, func(w io.Writer) error {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			z, err := gzip.NewReader(pr)
+			if err == nil {
+				diffID = sha256.New()
+				_, err = io.Copy(diffID, z)
+			}
+			pr.CloseWithError(err)
+			done <- err
+		}()
+		err := sendChanges(d, io.MultiWriter(w, pw), id, parent)
+		pw.CloseWithError(err)
+		if derr := <-done; err == nil {
+			err = derr
+		}
+		return err
+	})
+	if err != nil {
+		return desc, "", err
+	}
+	return desc, "sha256:" + hex.EncodeToString(diffID.Sum(nil)), nil
+}
+
+// imageConfig returns the config of an image read from the image store of
+// Docker, with the layers of the image replaced by those exported, as
+// changes of layers exported differ from those pulled byte for byte, or a
+// config with the layers only.
+func imageConfig(file string, diffIDs []string) (map[string]interface{}, error) {
+	config := map[string]interface{}{
+		"created":      time.Now().UTC().Format(time.RFC3339Nano),
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+	}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		config = nil
+		if err := json.Unmarshal(data, &config); err != nil || config == nil {
+			return nil, fmt.Errorf("lcfs: invalid image config %s: %v", file,
+				err)
+		}
+	}
+	config["rootfs"] = map[string]interface{}{
+		"type":     "layers",
+		"diff_ids": diffIDs,
+	}
+	return config, nil
+}
+
+// updateIndex adds the manifest of an image to the index of a layout,
+// replacing the one of the same name, and marks the directory as a layout.
+func (l *ociLayout) updateIndex(manifest ociDescriptor) error {
+	index := ociIndex{SchemaVersion: 2}
+	file := path.Join(l.dir, "index.json")
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("lcfs: invalid index of image layout %s: %v", l.dir,
+			err)
+	}
+	manifests := index.Manifests[:0]
+	ref := manifest.Annotations[ociRefAnnotation]
+	for _, m := range index.Manifests {
+		if m.Digest != manifest.Digest &&
+			(ref == "" || m.Annotations[ociRefAnnotation] != ref) {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = append(manifests, manifest)
+	layout, _ := json.Marshal(map[string]string{
+		"imageLayoutVersion": ociLayoutVersion})
+	t := &dirTarget{l.dir}
+	if err := t.put("oci-layout", bytes.NewReader(layout)); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(&index); err != nil {
+		return err
+	}
+	return t.put("index.json", bytes.NewReader(data))
+}
+
+// ExportOCI writes an image to an OCI image layout, for copying it to hosts
+// without access to a registry, without Docker saving the image.  Layers are
+// given from the base of the image up, each the parent of the next, the first
+// created from no layer, and their changes are stored as compressed blobs.
+// The config of the image is copied from the image store of Docker if given,
+// with the layers replaced by those exported.  The layout is created if
+// missing, and images already in it are kept, sharing blobs of the same
+// layers, with an image of the same name replaced in the index.
+func (d *Driver) ExportOCI(req *ociExportRequest) (_ *ociImage, err error) {
+	logrus.Debugf("ExportOCI - %d layers path %s", len(req.Layers), req.Path)
+	defer d.trackOp("ExportOCI", "", "")(&err)
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if req.Path, err = d.hostPath(req.Path, "of image layout"); err != nil {
+		return nil, err
+	}
+	if req.Config != "" {
+		req.Config, err = d.hostPath(req.Config, "of image config")
+		if err != nil {
+			return nil, err
+		}
+	}
+	parent, err := d.checkChain("", req.Layers)
+	if err != nil {
+		return nil, err
+	}
+	if parent != "" {
+		return nil, fmt.Errorf("lcfs: layer %s is created from %s, not the "+
+			"base of an image", req.Layers[0], parent)
+	}
+	l := &ociLayout{dir: req.Path}
+	if err := os.MkdirAll(l.blobs(), 0755); err != nil {
+		return nil, err
+	}
+	img := &ociImage{Path: req.Path}
+	var diffIDs []string
+	for _, id := range req.Layers {
+		desc, diffID, err := d.exportLayer(l, id, parent)
+		if err != nil {
+			return nil, err
+		}
+		img.Layers = append(img.Layers, desc)
+		diffIDs = append(diffIDs, diffID)
+		parent = id
+	}
+	config, err := imageConfig(req.Config, diffIDs)
+	if err != nil {
+		return nil, err
+	}
+	configDesc, err := l.writeJSON(ociConfigType, config)
+	if err != nil {
+		return nil, err
+	}
+	img.Config = configDesc.Digest
+	img.Manifest, err = l.writeJSON(ociManifestType, &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        configDesc,
+		Layers:        img.Layers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if req.Ref != "" {
+		img.Manifest.Annotations = map[string]string{ociRefAnnotation: req.Ref}
+	}
+	if err := l.updateIndex(img.Manifest); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Exported image of %d layers to %s as %s", len(req.Layers),
+		req.Path, img.Manifest.Digest)
+	return img, nil
+}
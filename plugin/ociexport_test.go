@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+// readBlob reads a blob of an OCI image layout, checking its digest.
+func readBlob(t *testing.T, dir, digest string) []byte {
+	data, err := ioutil.ReadFile(path.Join(dir, "blobs", "sha256",
+		strings.TrimPrefix(digest, "sha256:")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); sum != digest {
+		t.Errorf("blob %s holds %s", digest, sum)
+	}
+	return data
+}
+
+func TestExportOCI(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	sendChanges = func(d *Driver, w io.Writer, id, base string) error {
+		z := gzip.NewWriter(w)
+		fmt.Fprintf(z, "changes of %s relative to %s", id, base)
+		return z.Close()
+	}
+	defer func() { sendChanges = (*Driver).writeCompressedDiff }()
+	createLayers(t, d, fakeLayer{"base", "", false}, fakeLayer{"top", "base", false})
+	createLayers(t, d, fakeLayer{"rw", "top", true})
+	mount, cleanupMount := newPropagatedMount(t)
+	defer cleanupMount()
+	dir := path.Join(mount, "layout")
+	config := path.Join(mount, "config.json")
+	err := ioutil.WriteFile(config, []byte(`{"architecture": "arm64", "os": "linux",
+		"config": {"Cmd": ["sh"]}, "rootfs": {"type": "layers",
+		"diff_ids": ["sha256:pulled"]}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only whole images are exported, to layouts in the propagated mount
+	_, err = d.ExportOCI(&ociExportRequest{Path: dir, Layers: []string{"top"}})
+	if err == nil {
+		t.Error("image without its base layer exported")
+	}
+	_, err = d.ExportOCI(&ociExportRequest{Path: path.Join(f.home, "layout"),
+		Layers: []string{"base", "top"}})
+	if err == nil {
+		t.Error("image exported to the layer root")
+	}
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.ExportOCI(&ociExportRequest{Path: dir,
+		Layers: []string{"base", "top", "rw"}})
+	if err == nil {
+		t.Error("layer mounted writable exported")
+	}
+
+	img, err := d.ExportOCI(&ociExportRequest{Path: dir,
+		Layers: []string{"base", "top"}, Config: config, Ref: "app:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(readBlob(t, dir, img.Manifest.Digest),
+		&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 2 || manifest.Config.Digest != img.Config {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	var diffIDs []string
+	for i, l := range manifest.Layers {
+		z, err := gzip.NewReader(bytes.NewReader(readBlob(t, dir, l.Digest)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(z)
+		expected := []string{"changes of base relative to ",
+			"changes of top relative to base"}[i]
+		if string(data) != expected {
+			t.Errorf("layer %d holds %q, expected %q", i, data, expected)
+		}
+		diffIDs = append(diffIDs, fmt.Sprintf("sha256:%x", sha256.Sum256(data)))
+	}
+	var cfg struct {
+		Architecture string
+		Config       struct{ Cmd []string }
+		RootFS       struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(readBlob(t, dir, img.Config), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Architecture != "arm64" || len(cfg.Config.Cmd) != 1 ||
+		strings.Join(cfg.RootFS.DiffIDs, ",") != strings.Join(diffIDs, ",") {
+		t.Errorf("unexpected config %+v, expected diff ids %v", cfg, diffIDs)
+	}
+
+	// Images of the same name are replaced, others kept
+	for _, req := range []*ociExportRequest{
+		{Path: dir, Layers: []string{"base"}, Ref: "base:1"},
+		{Path: dir, Layers: []string{"base", "top"}, Ref: "app:1"}} {
+		if _, err := d.ExportOCI(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var index ociIndex
+	data, err := ioutil.ReadFile(path.Join(dir, "index.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for _, m := range index.Manifests {
+		refs = append(refs, m.Annotations[ociRefAnnotation])
+	}
+	if strings.Join(refs, ",") != "base:1,app:1" {
+		t.Errorf("unexpected images in the index %v", refs)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(dir, "oci-layout")); !bytes.Contains(
+		data, []byte(ociLayoutVersion)) {
+		t.Errorf("unexpected layout %q", data)
+	}
+}
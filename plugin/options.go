@@ -0,0 +1,777 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// driverOptions holds the storage options specified for the driver with
+// --storage-opt lcfs.<name>=<value>.
+type driverOptions struct {
+	// Unix socket for serving the admin API, admin API disabled if empty
+	AdminSocket string `json:"admin_socket,omitempty"`
+
+	// File containing the token admin API clients need to present
+	AdminTokenFile string `json:"admin_token_file,omitempty"`
+
+	// Unix socket for serving the admin RPC service, disabled if empty
+	AdminRPCSocket string `json:"admin_rpc_socket,omitempty"`
+
+	// TCP address for serving the admin RPC service over TLS, disabled if
+	// empty, with the certificates of the admin API
+	AdminRPCTLSAddress string `json:"admin_rpc_tls_address,omitempty"`
+
+	// Common names of client certificates allowed all calls of the admin
+	// RPC service over TLS, others are readers
+	AdminRPCTLSAdmins []string `json:"admin_rpc_tls_admins,omitempty"`
+
+	// File holding the bearer token of readers of the admin API, allowed
+	// requests not changing anything
+	AdminReadTokenFile string `json:"admin_read_token_file,omitempty"`
+
+	// TCP address for serving the admin API over TLS, disabled if empty
+	AdminTLSAddress string `json:"admin_tls_address,omitempty"`
+
+	// Certificate and key served over TLS, and the CA certificates of
+	// clients are verified with
+	AdminTLSCert     string `json:"admin_tls_cert,omitempty"`
+	AdminTLSKey      string `json:"admin_tls_key,omitempty"`
+	AdminTLSClientCA string `json:"admin_tls_client_ca,omitempty"`
+
+	// Users allowed to connect to the admin sockets
+	AdminUIDs []uint32 `json:"admin_uids"`
+
+	// Users allowed to connect to the admin sockets as readers
+	AdminReadUIDs []uint32 `json:"admin_read_uids,omitempty"`
+
+	// Address of statsd server metrics are sent to, disabled if empty
+	StatsdAddress string `json:"statsd_address,omitempty"`
+
+	// Prefix of metric names sent to statsd
+	StatsdPrefix string `json:"statsd_prefix"`
+
+	// DogStatsD tags added to metrics sent to statsd
+	StatsdTags []string `json:"statsd_tags,omitempty"`
+
+	// Interval between sending metrics to statsd
+	StatsdInterval time.Duration `json:"statsd_interval"`
+
+	// File layer operations are recorded in, disabled if empty
+	AuditLog string `json:"audit_log,omitempty"`
+
+	// Size at which the audit log is rotated
+	AuditLogMaxSize int64 `json:"audit_log_max_size"`
+
+	// Number of rotated audit logs kept
+	AuditLogMaxFiles int `json:"audit_log_max_files"`
+
+	// Interval between anchors of the hash chain of the audit log, disabled
+	// if zero
+	AuditLogAnchorInterval time.Duration `json:"audit_log_anchor_interval"`
+
+	// Operations taking longer are reported, disabled if zero
+	SlowOpThreshold time.Duration `json:"slow_op_threshold"`
+
+	// Sinks driver logs are sent to, journald or syslog
+	LogSinks []string `json:"log_sinks,omitempty"`
+
+	// Address of remote syslog server, local syslog daemon used if empty
+	SyslogAddress string `json:"syslog_address,omitempty"`
+
+	// Identifier of log messages sent to syslog or journald
+	SyslogTag string `json:"syslog_tag"`
+
+	// Unix socket or loopback address profiles are served on, disabled if empty
+	PprofAddress string `json:"pprof_address,omitempty"`
+
+	// Script run when an alert fires
+	AlertExec string `json:"alert_exec,omitempty"`
+
+	// URL alerts are posted to
+	AlertWebhook string `json:"alert_webhook,omitempty"`
+
+	// Percentage of space used firing an alert, disabled if zero
+	AlertSpaceUsed uint64 `json:"alert_space_used,omitempty"`
+
+	// Percentage of inodes used firing an alert, disabled if zero
+	AlertInodesUsed uint64 `json:"alert_inodes_used,omitempty"`
+
+	// Consecutive unmount failures of a layer firing an alert
+	AlertUmountFailures int `json:"alert_umount_failures"`
+
+	// Memory a cache flush is expected to reclaim, disabled if zero
+	AlertGCMinReclaim int64 `json:"alert_gc_min_reclaim,omitempty"`
+
+	// Interval between checking usage of space and inodes
+	AlertInterval time.Duration `json:"alert_interval"`
+
+	// Address Prometheus metrics are served on, disabled if empty
+	PrometheusAddress string `json:"prometheus_address,omitempty"`
+
+	// File the file system daemon publishes its stats in, stats queried
+	// with an ioctl if empty
+	StatsPage string `json:"stats_page,omitempty"`
+
+	// Directory stats snapshots are written to, disabled if empty
+	StatsSnapshotDir string `json:"stats_snapshot_dir,omitempty"`
+
+	// Interval between writing stats snapshots
+	StatsSnapshotInterval time.Duration `json:"stats_snapshot_interval"`
+
+	// Number of stats snapshots kept
+	StatsSnapshotRetention int `json:"stats_snapshot_retention"`
+
+	// Ioctls issued to the file system at the same time, not limited if zero
+	MaxIoctls int `json:"max_ioctls"`
+
+	// Time layers are kept mounted after the last Put, unmounted right away if
+	// zero
+	UmountDelay time.Duration `json:"umount_delay"`
+
+	// Prefetch layers when first mounted
+	Prefetch bool `json:"prefetch"`
+
+	// Data read per layer when prefetching
+	PrefetchMaxSize int64 `json:"prefetch_max_size"`
+
+	// Read-only layers kept mounted after the last Put, not cached if zero
+	MountCache int `json:"mount_cache"`
+
+	// Remove layers in the background
+	DeferredRemoval bool `json:"deferred_removal"`
+
+	// Unmount layers busy when removed and remove those again
+	ForceRemove bool `json:"force_remove"`
+
+	// Fail removing layers not found instead of succeeding
+	StrictRemove bool `json:"strict_remove"`
+
+	// Commit layers to disk before Create and ApplyDiff return
+	SyncCreate bool `json:"sync_create"`
+
+	// Make the file system refuse changes to image layers once diffs applied
+	WriteProtect bool `json:"write_protect"`
+
+	// Interval between retrying removal of busy layers
+	DeferredRemovalInterval time.Duration `json:"deferred_removal_interval"`
+
+	// Time status of the driver is cached for, not cached if zero
+	StatusCacheTTL time.Duration `json:"status_cache_ttl"`
+
+	// Interval between commits of the file system to disk, setting of the
+	// file system kept if zero
+	CommitInterval time.Duration `json:"commit_interval,omitempty"`
+
+	// File recording layers being created and removed, to complete those
+	// at start after a crash
+	Journal string `json:"journal,omitempty"`
+
+	// Handling of layers found mounted at Init, unmount, adopt or keep
+	OrphanMounts string `json:"orphan_mounts"`
+
+	// SELinux categories of labels of mounts, private or shared
+	SELinuxCategories string `json:"selinux_categories"`
+
+	// File recording layers mounted, to mount those again at start
+	RemountState string `json:"remount_state,omitempty"`
+
+	// File recording layers pinned, which are not removed until unpinned
+	PinState string `json:"pin_state,omitempty"`
+
+	// File recording cgroups frozen, to thaw those at start after a crash
+	FreezeState string `json:"freeze_state,omitempty"`
+
+	// Directory recording hashes of files of diffs applied, verified when
+	// layers are mounted
+	IntegrityDir string `json:"integrity_dir,omitempty"`
+
+	// File listing public keys trusted to sign diffs applied to layers,
+	// required to be signed before those are mounted
+	TrustedKeys string `json:"trusted_keys,omitempty"`
+
+	// Directory recording snapshots of layers by name and tag
+	SnapshotDir string `json:"snapshot_dir,omitempty"`
+
+	// File of policies taking snapshots of layers by label periodically
+	SnapshotPolicies string `json:"snapshot_policies,omitempty"`
+
+	// Directory backups of snapshots are stored in
+	BackupDir string `json:"backup_dir,omitempty"`
+
+	// URL of a bucket of an S3 compatible object store backups are stored
+	// in instead, as https://<host>/<bucket>[/<prefix>], and its region
+	BackupS3URL    string `json:"backup_s3_url,omitempty"`
+	BackupS3Region string `json:"backup_s3_region,omitempty"`
+
+	// Secret holding "<access key id>:<secret access key>" for the bucket,
+	// taken from the environment if not set
+	BackupS3Credentials string `json:"backup_s3_credentials,omitempty"`
+
+	// Size of parts of backups uploaded, and number uploaded in parallel
+	BackupS3ChunkSize int64 `json:"backup_s3_chunk_size,omitempty"`
+	BackupS3Parallel  int   `json:"backup_s3_parallel,omitempty"`
+
+	// Encryption of backups stored in the bucket, sse-s3, sse-kms[:<key id>]
+	// or client:<secret>
+	BackupS3Encryption string `json:"backup_s3_encryption,omitempty"`
+
+	// File listing commands the driver is allowed to issue to the file system
+	CommandPolicy string `json:"command_policy,omitempty"`
+
+	// Require the FIPS 140-3 module of Go for all digests and signatures
+	FIPS bool `json:"fips"`
+
+	// Layers mounted at a time at start
+	RemountThreads int `json:"remount_threads"`
+
+	// Drop files unchanged from the parent from diffs applied
+	ApplyDiffDedup bool `json:"apply_diff_dedup"`
+
+	// Goroutines archiving changes of a layer, one per CPU if zero
+	DiffThreads int `json:"diff_threads"`
+
+	// Ancestors of layers created warned about past, never if zero
+	ChainDepthWarning int `json:"chain_depth_warning"`
+
+	// Ancestors of writable layers created flattened past, never if zero
+	ChainFlattenDepth int `json:"chain_flatten_depth"`
+
+	// Level of gzip compression of layers exported
+	DiffCompressionLevel int `json:"diff_compression_level"`
+
+	// Goroutines compressing layers exported, one per CPU if zero
+	DiffCompressionThreads int `json:"diff_compression_threads"`
+
+	// Directory of secrets referenced as file:<name> by encryption keys
+	SecretsDir string `json:"secrets_dir,omitempty"`
+
+	// Program printing secrets referenced as helper:<name> by encryption
+	// keys, run with the name
+	SecretHelper string `json:"secret_helper,omitempty"`
+
+	// User and group the plugin runs as once set up, as uid[:gid], keeping
+	// only capabilities needed, root if empty
+	User string `json:"user,omitempty"`
+}
+
+// parseOptions parses the options passed to Init.  Names are accepted with
+// either the lcfs. or the dfs. prefix.
+func parseOptions(options []string) (*driverOptions, error) {
+	opts := &driverOptions{
+		AdminUIDs:      []uint32{0},
+		StatsdPrefix:   "lcfs.",
+		StatsdInterval: 10 * time.Second,
+
+		AuditLogMaxSize:  100 * units.MiB,
+		AuditLogMaxFiles: 5,
+
+		AuditLogAnchorInterval: time.Hour,
+
+		SyslogTag: "lcfs",
+
+		AlertUmountFailures: 3,
+		AlertInterval:       time.Minute,
+
+		StatsSnapshotInterval:  5 * time.Minute,
+		StatsSnapshotRetention: 288,
+
+		MaxIoctls:               32,
+		PrefetchMaxSize:         256 * units.MiB,
+		DeferredRemovalInterval: 10 * time.Second,
+
+		StatusCacheTTL: 2 * time.Second,
+
+		OrphanMounts:   orphanUnmount,
+		RemountThreads: 8,
+
+		SELinuxCategories: categoriesPrivate,
+
+		DiffCompressionLevel: 6,
+
+		ChainDepthWarning: 64,
+
+		BackupS3Region:    "us-east-1",
+		BackupS3ChunkSize: 16 * units.MiB,
+		BackupS3Parallel:  4,
+	}
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("lcfs: invalid option %q, expected key=value", option)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		val := strings.TrimSpace(kv[1])
+		if strings.HasPrefix(key, "lcfs.") {
+			key = strings.TrimPrefix(key, "lcfs.")
+		} else if strings.HasPrefix(key, "dfs.") {
+			key = strings.TrimPrefix(key, "dfs.")
+		} else {
+			return nil, fmt.Errorf("lcfs: unknown option %q", option)
+		}
+		switch key {
+		case "admin_socket":
+			opts.AdminSocket = val
+		case "admin_token_file":
+			opts.AdminTokenFile = val
+		case "admin_read_token_file":
+			opts.AdminReadTokenFile = val
+		case "admin_tls_address":
+			opts.AdminTLSAddress = val
+		case "admin_tls_cert":
+			opts.AdminTLSCert = val
+		case "admin_tls_key":
+			opts.AdminTLSKey = val
+		case "admin_tls_client_ca":
+			opts.AdminTLSClientCA = val
+		case "admin_rpc_socket":
+			opts.AdminRPCSocket = val
+		case "admin_rpc_tls_address":
+			opts.AdminRPCTLSAddress = val
+		case "admin_rpc_tls_admins":
+			opts.AdminRPCTLSAdmins = strings.Split(val, ",")
+		case "admin_uids", "admin_read_uids":
+			var uids []uint32
+			for _, s := range strings.Split(val, ",") {
+				uid, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("lcfs: invalid uid in %q", option)
+				}
+				uids = append(uids, uint32(uid))
+			}
+			if key == "admin_uids" {
+				opts.AdminUIDs = uids
+			} else {
+				opts.AdminReadUIDs = uids
+			}
+		case "statsd_address":
+			opts.StatsdAddress = val
+		case "statsd_prefix":
+			opts.StatsdPrefix = val
+		case "statsd_tags":
+			opts.StatsdTags = strings.Split(val, ",")
+		case "statsd_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("lcfs: invalid interval in %q", option)
+			}
+			opts.StatsdInterval = interval
+		case "audit_log":
+			opts.AuditLog = val
+		case "audit_log_max_size":
+			size, err := units.RAMInBytes(val)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("lcfs: invalid size in %q", option)
+			}
+			opts.AuditLogMaxSize = size
+		case "audit_log_max_files":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.AuditLogMaxFiles = n
+		case "audit_log_anchor_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval < 0 {
+				return nil, fmt.Errorf("lcfs: invalid interval in %q", option)
+			}
+			opts.AuditLogAnchorInterval = interval
+		case "slow_op_threshold":
+			threshold, err := time.ParseDuration(val)
+			if err != nil || threshold < 0 {
+				return nil, fmt.Errorf("lcfs: invalid threshold in %q", option)
+			}
+			opts.SlowOpThreshold = threshold
+		case "log_sinks":
+			opts.LogSinks = nil
+			for _, sink := range strings.Split(val, ",") {
+				sink = strings.TrimSpace(sink)
+				if sink != "journald" && sink != "syslog" {
+					return nil, fmt.Errorf("lcfs: invalid log sink in %q", option)
+				}
+				opts.LogSinks = append(opts.LogSinks, sink)
+			}
+		case "syslog_address":
+			opts.SyslogAddress = val
+		case "syslog_tag":
+			opts.SyslogTag = val
+		case "pprof_address":
+			if _, _, err := parsePprofAddress(val); err != nil {
+				return nil, err
+			}
+			opts.PprofAddress = val
+		case "alert_exec":
+			opts.AlertExec = val
+		case "alert_webhook":
+			opts.AlertWebhook = val
+		case "alert_space_used", "alert_inodes_used":
+			percent, err := strconv.ParseUint(val, 10, 64)
+			if err != nil || percent > 100 {
+				return nil, fmt.Errorf("lcfs: invalid percentage in %q", option)
+			}
+			if key == "alert_space_used" {
+				opts.AlertSpaceUsed = percent
+			} else {
+				opts.AlertInodesUsed = percent
+			}
+		case "alert_umount_failures":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.AlertUmountFailures = n
+		case "alert_gc_min_reclaim":
+			size, err := units.RAMInBytes(val)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("lcfs: invalid size in %q", option)
+			}
+			opts.AlertGCMinReclaim = size
+		case "alert_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("lcfs: invalid interval in %q", option)
+			}
+			opts.AlertInterval = interval
+		case "prometheus_address":
+			host, port, err := net.SplitHostPort(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid address in %q", option)
+			}
+			if host == "" {
+				val = net.JoinHostPort("127.0.0.1", port)
+			}
+			opts.PrometheusAddress = val
+		case "stats_page":
+			opts.StatsPage = val
+		case "stats_snapshot_dir":
+			opts.StatsSnapshotDir = val
+		case "stats_snapshot_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("lcfs: invalid interval in %q", option)
+			}
+			opts.StatsSnapshotInterval = interval
+		case "stats_snapshot_retention":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.StatsSnapshotRetention = n
+		case "max_ioctls":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.MaxIoctls = n
+		case "umount_delay":
+			delay, err := time.ParseDuration(val)
+			if err != nil || delay < 0 {
+				return nil, fmt.Errorf("lcfs: invalid delay in %q", option)
+			}
+			opts.UmountDelay = delay
+		case "prefetch":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.Prefetch = enable
+		case "prefetch_max_size":
+			size, err := units.RAMInBytes(val)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("lcfs: invalid size in %q", option)
+			}
+			opts.PrefetchMaxSize = size
+		case "mount_cache":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.MountCache = n
+		case "deferred_removal":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.DeferredRemoval = enable
+		case "force_remove":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.ForceRemove = enable
+		case "strict_remove":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.StrictRemove = enable
+		case "sync_create":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.SyncCreate = enable
+		case "write_protect":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.WriteProtect = enable
+		case "deferred_removal_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("lcfs: invalid interval in %q", option)
+			}
+			opts.DeferredRemovalInterval = interval
+		case "status_cache_ttl":
+			ttl, err := time.ParseDuration(val)
+			if err != nil || ttl < 0 {
+				return nil, fmt.Errorf("lcfs: invalid ttl in %q", option)
+			}
+			opts.StatusCacheTTL = ttl
+		case "commit_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil || interval < time.Second {
+				return nil, fmt.Errorf("lcfs: invalid interval in %q", option)
+			}
+			opts.CommitInterval = interval
+		case "journal":
+			opts.Journal = val
+		case "orphan_mounts":
+			switch val {
+			case orphanUnmount, orphanAdopt, orphanKeep:
+				opts.OrphanMounts = val
+			default:
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+		case "selinux_categories":
+			switch val {
+			case categoriesPrivate, categoriesShared:
+				opts.SELinuxCategories = val
+			default:
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+		case "remount_state":
+			opts.RemountState = val
+		case "pin_state":
+			opts.PinState = val
+		case "freeze_state":
+			opts.FreezeState = val
+		case "integrity_dir":
+			opts.IntegrityDir = val
+		case "trusted_keys":
+			opts.TrustedKeys = val
+		case "snapshot_dir":
+			opts.SnapshotDir = val
+		case "snapshot_policies":
+			opts.SnapshotPolicies = val
+		case "backup_dir":
+			opts.BackupDir = val
+		case "backup_s3_url":
+			if _, _, _, err := parseS3URL(val); err != nil {
+				return nil, err
+			}
+			opts.BackupS3URL = val
+		case "backup_s3_region":
+			opts.BackupS3Region = val
+		case "backup_s3_credentials":
+			prefix, name := splitKeyRef(val)
+			if (prefix != fileSecretPrefix && prefix != helperSecretPrefix) ||
+				validateSecretName(name) != nil {
+				return nil, fmt.Errorf("lcfs: invalid secret in %q, expected "+
+					"file:<name> or helper:<name>", option)
+			}
+			opts.BackupS3Credentials = val
+		case "backup_s3_chunk_size":
+			size, err := units.RAMInBytes(val)
+			if err != nil || size < minS3ChunkSize {
+				return nil, fmt.Errorf("lcfs: invalid size in %q, expected at "+
+					"least 5MiB", option)
+			}
+			opts.BackupS3ChunkSize = size
+		case "backup_s3_parallel":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.BackupS3Parallel = n
+		case "backup_s3_encryption":
+			if err := parseS3Encryption(val); err != nil {
+				return nil, err
+			}
+			opts.BackupS3Encryption = val
+		case "command_policy":
+			opts.CommandPolicy = val
+		case "fips":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.FIPS = enable
+		case "remount_threads":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.RemountThreads = n
+		case "apply_diff_dedup":
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value in %q", option)
+			}
+			opts.ApplyDiffDedup = enable
+		case "diff_threads":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.DiffThreads = n
+		case "chain_depth_warning":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid depth in %q", option)
+			}
+			opts.ChainDepthWarning = n
+		case "chain_flatten_depth":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid depth in %q", option)
+			}
+			opts.ChainFlattenDepth = n
+		case "diff_compression_level":
+			level, err := strconv.Atoi(val)
+			if err != nil || level < 1 || level > 9 {
+				return nil, fmt.Errorf("lcfs: invalid level in %q", option)
+			}
+			opts.DiffCompressionLevel = level
+		case "secrets_dir":
+			opts.SecretsDir = val
+		case "secret_helper":
+			opts.SecretHelper = val
+		case "user":
+			if _, _, err := parseUser(val); err != nil {
+				return nil, err
+			}
+			opts.User = val
+		case "diff_compression_threads":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("lcfs: invalid count in %q", option)
+			}
+			opts.DiffCompressionThreads = n
+		default:
+			return nil, fmt.Errorf("lcfs: unknown option %q", option)
+		}
+	}
+	if opts.AdminSocket != "" && opts.AdminTokenFile == "" {
+		return nil, fmt.Errorf("lcfs: admin_socket requires admin_token_file")
+	}
+	if opts.AdminTLSAddress != "" && opts.AdminTokenFile == "" {
+		return nil, fmt.Errorf("lcfs: admin_tls_address requires admin_token_file")
+	}
+	if opts.AdminTLSAddress != "" && (opts.AdminTLSCert == "" ||
+		opts.AdminTLSKey == "" || opts.AdminTLSClientCA == "") {
+		return nil, fmt.Errorf("lcfs: admin_tls_address requires " +
+			"admin_tls_cert, admin_tls_key and admin_tls_client_ca")
+	}
+	if opts.AdminRPCTLSAddress != "" && (opts.AdminTLSCert == "" ||
+		opts.AdminTLSKey == "" || opts.AdminTLSClientCA == "") {
+		return nil, fmt.Errorf("lcfs: admin_rpc_tls_address requires " +
+			"admin_tls_cert, admin_tls_key and admin_tls_client_ca")
+	}
+	if opts.PrometheusAddress != "" && !isLoopback(opts.PrometheusAddress) &&
+		opts.AdminTokenFile == "" {
+		return nil, fmt.Errorf("lcfs: prometheus_address off localhost " +
+			"requires admin_token_file")
+	}
+	if opts.TrustedKeys != "" && opts.IntegrityDir == "" {
+		return nil, fmt.Errorf("lcfs: trusted_keys requires integrity_dir")
+	}
+	if opts.SnapshotPolicies != "" && opts.SnapshotDir == "" {
+		return nil, fmt.Errorf("lcfs: snapshot_policies requires snapshot_dir")
+	}
+	if (opts.BackupDir != "" || opts.BackupS3URL != "") && opts.SnapshotDir == "" {
+		return nil, fmt.Errorf("lcfs: backup_dir and backup_s3_url require " +
+			"snapshot_dir")
+	}
+	if opts.BackupDir != "" && opts.BackupS3URL != "" {
+		return nil, fmt.Errorf("lcfs: backup_dir and backup_s3_url are " +
+			"exclusive")
+	}
+	return opts, nil
+}
+
+// layerOptions holds the storage options specified for a container with
+// --storage-opt <name>=<value>.
+type layerOptions struct {
+	// Prefetch the layer whenever mounted
+	Prefetch bool
+
+	// Shift user and group ids presented by the layer
+	Shift    bool
+	ShiftUID uint32
+	ShiftGID uint32
+
+	// Description of the key in the kernel keyring encrypting the layer
+	EncryptionKey string
+
+	// Labels matched by snapshot policies
+	Labels map[string]string
+
+	// Ancestor of the parent a writable layer is created from
+	Ancestor string
+
+	// Pin the layer once created
+	Pin bool
+}
+
+// parseLayerOptions parses the storage options passed to Create and
+// CreateReadWrite.  Unknown options are ignored as before, like size which
+// the file system does not support.
+func parseLayerOptions(storageOpt map[string]string) (*layerOptions, error) {
+	opts := &layerOptions{}
+	for key, val := range storageOpt {
+		switch strings.ToLower(key) {
+		case prefetchStorageOpt:
+			enable, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("lcfs: invalid value %q for storage option %s",
+					val, key)
+			}
+			opts.Prefetch = enable
+		case shiftStorageOpt:
+			uid, gid, err := parseShift(val)
+			if err != nil {
+				return nil, err
+			}
+			opts.Shift = true
+			opts.ShiftUID = uid
+			opts.ShiftGID = gid
+		case encryptionKeyStorageOpt:
+			ref, err := parseKeyRef(val)
+			if err != nil {
+				return nil, err
+			}
+			opts.EncryptionKey = ref
+		case labelStorageOpt:
+			labels, err := parseLabels(val)
+			if err != nil {
+				return nil, err
+			}
+			opts.Labels = labels
+		case ancestorStorageOpt:
+			opts.Ancestor = val
+		case pinStorageOpt:
+			pinned, err := parsePin(val)
+			if err != nil {
+				return nil, err
+			}
+			opts.Pin = pinned
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions([]string{
+		"lcfs.admin_socket=/run/docker/plugins/lcfs-admin.sock",
+		"dfs.admin_token_file = /lcfs/admin.token",
+	})
+	if err != nil {
+		t.Fatalf("parseOptions failed: %v", err)
+	}
+	if opts.AdminSocket != "/run/docker/plugins/lcfs-admin.sock" {
+		t.Errorf("unexpected admin socket %q", opts.AdminSocket)
+	}
+	if opts.AdminTokenFile != "/lcfs/admin.token" {
+		t.Errorf("unexpected admin token file %q", opts.AdminTokenFile)
+	}
+	opts, err = parseOptions([]string{"lcfs.prometheus_address=:9090"})
+	if err != nil || opts.PrometheusAddress != "127.0.0.1:9090" {
+		t.Errorf("metrics served on %q, err %v", opts.PrometheusAddress, err)
+	}
+}
+
+func TestParseOptionsInvalid(t *testing.T) {
+	for _, option := range []string{
+		"lcfs.admin_socket",
+		"overlay2.size=10G",
+		"lcfs.unknown=1",
+		"lcfs.commit_interval=500ms",
+		"lcfs.prometheus_address=0.0.0.0:9090",
+	} {
+		if _, err := parseOptions([]string{option}); err == nil {
+			t.Errorf("expected error for option %q", option)
+		}
+	}
+	if _, err := parseOptions([]string{"lcfs.admin_socket=/tmp/a.sock"}); err == nil {
+		t.Errorf("expected error for admin socket without token file")
+	}
+}
+
+func TestParseLogSinks(t *testing.T) {
+	opts, err := parseOptions([]string{"lcfs.log_sinks=journald, syslog"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts.LogSinks) != 2 || opts.LogSinks[1] != "syslog" || opts.SyslogTag != "lcfs" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if _, err := parseOptions([]string{"lcfs.log_sinks=file"}); err == nil {
+		t.Errorf("expected error for unknown log sink")
+	}
+}
+
+func TestParseLayerOptions(t *testing.T) {
+	opts, err := parseLayerOptions(map[string]string{"prefetch": "true", "size": "10G"})
+	if err != nil {
+		t.Fatalf("parseLayerOptions failed: %v", err)
+	}
+	if !opts.Prefetch {
+		t.Errorf("prefetch not enabled")
+	}
+	if _, err := parseLayerOptions(map[string]string{"prefetch": "maybe"}); err == nil {
+		t.Errorf("expected error for invalid prefetch option")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Handling of layers found mounted at Init
+const (
+	orphanUnmount = "unmount"
+	orphanAdopt   = "adopt"
+	orphanKeep    = "keep"
+)
+
+// mountCounts returns how many times each of the layers is mounted in the
+// file system, checking as many layers as fit in a buffer with a single ioctl.
+func (d *Driver) mountCounts(ids []string) ([]int, error) {
+	counts := make([]int, len(ids))
+	bufp := batchBuffers.Get().(*[]byte)
+	defer batchBuffers.Put(bufp)
+	buf := *bufp
+	for start := 0; start < len(ids); {
+		n, batch, next := packLayerNames(ids, start, buf)
+		start = next
+		if len(batch) == 0 {
+			continue
+		}
+		if err := d.ioctlBuffer(LayersMounted, buf[:n+1]); err != nil {
+			return nil, err
+		}
+		for j, i := range batch {
+			counts[i] = int(buf[j])
+		}
+	}
+	return counts, nil
+}
+
+// cleanupOrphanMounts looks for layers left mounted by a previous instance of
+// the plugin, which crashed or was restarted without Docker putting those.
+// No reference of those is tracked, so those would stay mounted forever.
+// Layers expected to be mounted again at start are kept mounted until a Get
+// takes a reference, others are unmounted, or adopted with the references
+// counted by the file system or kept mounted for the next Get if configured.
+func (d *Driver) cleanupOrphanMounts(ids []string, mode string) {
+	counts, err := d.mountCounts(ids)
+	if err == unix.ENOTTY || err == unix.ENOSYS || err == unix.EINVAL {
+		logrus.Debugf("Not checking layers mounted: %v", err)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Checking layers mounted, err %v\n", err)
+		return
+	}
+	expected := make(map[string]bool)
+	if d.mountState != nil {
+		for _, id := range d.mountState.remount() {
+			expected[id] = true
+		}
+	}
+	var orphans, unmounted, adopted int
+	for i, id := range ids {
+		count := counts[i]
+		if count == 0 || d.mounts.active(id) {
+			continue
+		}
+		orphans++
+		switch {
+		case mode == orphanAdopt:
+			// The plugin mounts a layer once however many references
+			// are taken
+			d.umountOrphan(id, count-1)
+			d.mounts.adopt(id, count)
+			adopted++
+		case mode == orphanKeep:
+			// Containers kept running, as with live restore, Get
+			// their layers again
+			d.umountOrphan(id, count-1)
+			d.mounts.restore(id)
+			adopted++
+		case expected[id]:
+			// Keep a single mount, as layers mounted again at start
+			d.mounts.park(id, remountWindow, func(i *idleMount) {
+				d.umountIdle(id, i)
+			})
+			adopted++
+			d.umountOrphan(id, count-1)
+		default:
+			if d.umountOrphan(id, count) {
+				unmounted++
+			}
+		}
+	}
+	if orphans > 0 {
+		logrus.Warnf("Init - %d layers left mounted, %d adopted, %d unmounted",
+			orphans, adopted, unmounted)
+	}
+}
+
+// restartMounts drops references of layers taken before Docker restarted,
+// while the plugin kept running.  Docker restarted with live restore Gets the
+// layers of containers still running again, those find the layers mounted
+// and take a single reference.  Layers not referenced again within delay are
+// unmounted.
+func (d *Driver) restartMounts(delay time.Duration) {
+	ids := d.mounts.restart(delay, d.umountIdle)
+	if len(ids) > 0 {
+		logrus.Infof("Init - %d layers mounted before Docker restarted",
+			len(ids))
+	}
+}
+
+// umountOrphan unmounts a layer mounted count times.
+func (d *Driver) umountOrphan(id string, count int) bool {
+	for ; count > 0; count-- {
+		if err := d.ioctl(LayerUmount, "", id); err != nil {
+			logrus.Errorf("Unmounting orphaned layer %s, err %v\n", id, err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCleanupOrphanMounts(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	defer d.mounts.reset()
+
+	var err error
+	d.mountState, err = loadMountState(path.Join(f.home, "mounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"expected", "idle", "orphan", "tracked"}
+	for _, id := range ids {
+		if err := d.Create(id, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Get("tracked", ""); err != nil {
+		t.Fatal(err)
+	}
+	f.mounts["expected"] = 2
+	f.mounts["orphan"] = 3
+	d.mountState.mounted("expected")
+
+	d.cleanupOrphanMounts(ids, orphanUnmount)
+	for id, count := range map[string]int{
+		"expected": 1,
+		"idle":     0,
+		"orphan":   0,
+		"tracked":  1,
+	} {
+		if f.mounts[id] != count {
+			t.Errorf("layer %s mounted %d times, expected %d", id,
+				f.mounts[id], count)
+		}
+	}
+	if !d.mounts.active("expected") {
+		t.Errorf("layer expected to be mounted not adopted")
+	}
+}
+
+// Docker restarted with live restore while the plugin kept running
+func TestRestartMounts(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	defer d.mounts.reset()
+
+	for _, id := range []string{"running", "exited"} {
+		if err := d.Create(id, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := d.Get(id, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	d.restartMounts(time.Hour)
+	if _, err := d.Get("running", ""); err != nil {
+		t.Fatal(err)
+	}
+	if f.mounts["running"] != 1 {
+		t.Errorf("layer mounted %d times after Get again", f.mounts["running"])
+	}
+	if err := d.Put("running"); err != nil {
+		t.Fatal(err)
+	}
+	if f.mounts["running"] != 0 {
+		t.Errorf("layer mounted %d times after last Put", f.mounts["running"])
+	}
+
+	// Layers not referenced again are unmounted after a while
+	if _, err := d.Get("exited", ""); err != nil {
+		t.Fatal(err)
+	}
+	d.restartMounts(time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for d.mounts.active("exited") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if f.count(LayerUmount) != 2 || d.mounts.active("exited") {
+		t.Errorf("layer not referenced again still mounted")
+	}
+}
+
+// Plugin restarted while containers kept running, the references of those
+// adopted, or taken again by Docker with live restore
+func TestKeepOrphanMounts(t *testing.T) {
+	for _, c := range []struct {
+		mode       string
+		gets, puts int
+	}{
+		{orphanAdopt, 0, 2},
+		{orphanKeep, 1, 1},
+	} {
+		f, d, cleanup := newFakeFS(t)
+		createLayers(t, d, fakeLayer{"layer", "", false})
+		f.mounts["layer"] = 2
+		d.cleanupOrphanMounts([]string{"layer"}, c.mode)
+		if f.mounts["layer"] != 1 || !d.mounts.active("layer") {
+			t.Errorf("%s: layer mounted %d times not kept", c.mode,
+				f.mounts["layer"])
+		}
+		for i := 0; i < c.gets; i++ {
+			if _, err := d.Get("layer", ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < c.puts; i++ {
+			if err := d.Put("layer"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.count(LayerMount) != 0 || f.mounts["layer"] != 0 {
+			t.Errorf("%s: layer mounted %d times after last Put, %d mounts "+
+				"issued", c.mode, f.mounts["layer"], f.count(LayerMount))
+		}
+		d.mounts.reset()
+		cleanup()
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// peerCredListener accepts connections on a unix socket only from processes
+// running as one of the allowed users, with the role of the user.
+type peerCredListener struct {
+	*net.UnixListener
+	uids map[uint32]adminRole
+}
+
+// listenUnixPeerCred listens on a unix socket accessible only by the owner,
+// accepting connections from the given uids.
+func listenUnixPeerCred(socket string, uids []uint32) (net.Listener, error) {
+	return listenUnixRoles(socket, uids, nil)
+}
+
+// listenUnixRoles listens on a unix socket accessible only by the owner,
+// accepting connections from admin uids, and from read uids limited to
+// requests not changing anything.
+func listenUnixRoles(socket string, uids, readUIDs []uint32) (net.Listener, error) {
+	l, err := listenUnix(socket)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make(map[uint32]adminRole, len(uids)+len(readUIDs))
+	for _, uid := range readUIDs {
+		allowed[uid] = roleRead
+	}
+	for _, uid := range uids {
+		allowed[uid] = roleAdmin
+	}
+	return &peerCredListener{UnixListener: l.(*net.UnixListener), uids: allowed}, nil
+}
+
+// Accept waits for the next connection from an allowed user, closing
+// connections from others.
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		cred, err := peerCred(conn)
+		if err != nil {
+			logrus.Errorf("err %v\n", err)
+			conn.Close()
+			continue
+		}
+		role := l.uids[cred.Uid]
+		if role == roleNone {
+			logrus.Warnf("Rejected connection on %s from uid %d pid %d",
+				l.Addr(), cred.Uid, cred.Pid)
+			conn.Close()
+			continue
+		}
+		return &roleConn{conn, role}, nil
+	}
+}
+
+// peerCred returns the credentials of the process connected to the socket.
+func peerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	var cred *unix.Ucred
+	var cerr error
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET,
+			unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, fmt.Errorf("lcfs: peer credentials: %v", cerr)
+	}
+	return cred, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Storage option pinning a layer created
+const pinStorageOpt = "pin"
+
+// errNoPinState is returned for pinning layers without pin_state set.
+var errNoPinState = errors.New("lcfs: pinning layers requires pin_state")
+
+// pinnedLayers records layers pinned, which are not removed until unpinned,
+// in a file kept across restarts.
+type pinnedLayers struct {
+	file string
+	lock sync.Mutex
+	ids  map[string]bool
+}
+
+// loadPinnedLayers reads the layers pinned recorded in file, if any.
+func loadPinnedLayers(file string) (*pinnedLayers, error) {
+	p := &pinnedLayers{file: file, ids: make(map[string]bool)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("lcfs: reading layers pinned from %s: %v", file,
+			err)
+	}
+	for _, id := range ids {
+		p.ids[id] = true
+	}
+	return p, nil
+}
+
+// set pins or unpins a layer, replacing the file atomically.
+func (p *pinnedLayers) set(id string, pinned bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.ids[id] == pinned {
+		return nil
+	}
+	if pinned {
+		p.ids[id] = true
+	} else {
+		delete(p.ids, id)
+	}
+	data, err := json.Marshal(p.sorted())
+	if err == nil {
+		tmp := p.file + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, p.file)
+		}
+	}
+	if err != nil {
+		if pinned {
+			delete(p.ids, id)
+		} else {
+			p.ids[id] = true
+		}
+		return fmt.Errorf("lcfs: recording layers pinned in %s: %v", p.file,
+			err)
+	}
+	return nil
+}
+
+// has checks if a layer is pinned.
+func (p *pinnedLayers) has(id string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.ids[id]
+}
+
+// list returns the layers pinned, sorted.
+func (p *pinnedLayers) list() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.sorted()
+}
+
+func (p *pinnedLayers) sorted() []string {
+	ids := make([]string, 0, len(p.ids))
+	for id := range p.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// pinned checks if a layer is pinned.
+func (d *Driver) pinned(id string) bool {
+	return d.pins != nil && d.pins.has(id)
+}
+
+// Pin pins a layer, or unpins it.  Removing a layer pinned fails, so base
+// images are not removed by docker rmi or pruning by accident.
+func (d *Driver) Pin(id string, pinned bool) (err error) {
+	logrus.Debugf("Pin - id %s pinned %v", id, pinned)
+	defer d.trackOp("Pin", id, "")(&err)
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if d.pins == nil {
+		return errNoPinState
+	}
+	defer d.layers.lock(id)()
+	if pinned && !d.Exists(id) {
+		return notFoundError(id)
+	}
+	if err := d.pins.set(id, pinned); err != nil {
+		return err
+	}
+	logrus.Infof("Layer %s pinned %v", id, pinned)
+	return nil
+}
+
+// parsePin parses the value of the pin storage option.
+func parsePin(val string) (bool, error) {
+	pinned, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("lcfs: invalid value %q for storage option %s",
+			val, pinStorageOpt)
+	}
+	return pinned, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestPin(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	if err := d.Pin("base", true); err == nil {
+		t.Error("layer pinned without pin_state")
+	}
+	if err := d.Create("golden", "", "",
+		map[string]string{"pin": "true"}); err == nil {
+		t.Error("layer created pinned without pin_state")
+	}
+
+	file := path.Join(f.home, "pinned")
+	d.pins, _ = loadPinnedLayers(file)
+	if err := d.Pin("base", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("golden", "", "",
+		map[string]string{"pin": "true"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Pin("missing", true); err == nil {
+		t.Error("missing layer pinned")
+	}
+	for _, id := range []string{"base", "golden"} {
+		if err := d.Remove(id); !errors.Is(err, errLayerPinned) {
+			t.Errorf("layer %s pinned removed, err %v", id, err)
+		}
+		if !d.Exists(id) {
+			t.Errorf("layer %s pinned not kept", id)
+		}
+	}
+	if m, _ := d.GetMetadata("base"); m["Pinned"] != "true" {
+		t.Errorf("layer pinned not shown in metadata %v", m)
+	}
+
+	// Pins are kept across restarts
+	d.pins, _ = loadPinnedLayers(file)
+	if err := d.Pin("base", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove("base"); err != nil {
+		t.Errorf("layer unpinned not removed, err %v", err)
+	}
+	d.pins, _ = loadPinnedLayers(file)
+	if ids := d.pins.list(); len(ids) != 1 || ids[0] != "golden" {
+		t.Errorf("unexpected layers pinned %v", ids)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Names of commands of the file system as in lcfs.h, used by command policies
+var commandNames = map[string]int{
+	"LAYER_CREATE":    LayerCreate,
+	"LAYER_CREATE_RW": LayerCreateRw,
+	"LAYER_REMOVE":    LayerRemove,
+	"LAYER_MOUNT":     LayerMount,
+	"LAYER_UMOUNT":    LayerUmount,
+	"LAYER_STAT":      LayerStat,
+	"UMOUNT_ALL":      UmountAll,
+	"CLEAR_STAT":      ClearStat,
+	"SYNCER_TIME":     SyncerTime,
+	"DCACHE_MEMORY":   DcacheMemory,
+	"DCACHE_FLUSH":    DcacheFlush,
+	"LCFS_COMMIT":     LcfsCommit,
+	"LCFS_GROW":       LcfsGrow,
+	"LCFS_PROFILE":    LcfsProfile,
+	"LCFS_VERBOSE":    LcfsVerbose,
+	"LAYER_STATS":     LayerStats,
+	"LCFS_STATS":      LcfsStats,
+	"LAYERS_EXIST":    LayersExist,
+	"LAYER_EXTENTS":   LayerExtents,
+	"LAYERS_UMOUNT":   LayersUmount,
+	"LAYERS_MOUNTED":  LayersMounted,
+	"LCFS_SYNC":       LcfsSync,
+	"LCFS_HANDSHAKE":  LcfsHandshake,
+	"LAYER_SHIFT":     LayerShift,
+	"LAYER_ENCRYPT":   LayerEncrypt,
+	"LAYER_SEAL":      LayerSeal,
+	"LAYERS_LIST":     LayersList,
+}
+
+// commandName returns the name of a command of the file system.
+func commandName(cmd int) string {
+	for name, c := range commandNames {
+		if c == cmd {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", cmd)
+}
+
+// commandPolicy restricts the commands the driver issues to the file system
+// to those allowed, so hosts where storage is managed by others can forbid
+// commands like UMOUNT_ALL or LCFS_GROW.
+type commandPolicy struct {
+	file    string
+	allowed map[int]bool
+}
+
+// Commands allowed to be issued to the file system, all if nil
+var ioctlPolicy *commandPolicy
+
+// commandError is returned for commands not allowed by the policy.
+type commandError struct {
+	cmd int
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("lcfs: command %s not allowed by the command policy",
+		commandName(e.cmd))
+}
+
+// allows checks if a command is allowed, without warning if it is not.
+func (p *commandPolicy) allows(cmd int) bool {
+	return p == nil || p.allowed[cmd]
+}
+
+// loadCommandPolicy reads the commands allowed from a file, a name of a
+// command per line.  Empty lines and lines starting with '#' are ignored.
+func loadCommandPolicy(file string) (*commandPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := &commandPolicy{file: file, allowed: make(map[int]bool)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, ok := commandNames[strings.ToUpper(line)]
+		if !ok {
+			return nil, fmt.Errorf("lcfs: %s:%d: unknown command %q", file, n,
+				line)
+		}
+		p.allowed[cmd] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.allowed) == 0 {
+		return nil, fmt.Errorf("lcfs: no commands allowed in %s", file)
+	}
+	return p, nil
+}
+
+// check returns an error for a command not allowed, logging the violation.
+func (p *commandPolicy) check(cmd int) error {
+	if p.allows(cmd) {
+		return nil
+	}
+	logrus.Warnf("Command %s denied by the command policy %s",
+		commandName(cmd), p.file)
+	return &commandError{cmd}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestCommandPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "policy")
+	data := "# Layers only\nLAYER_CREATE\n\nlayer_remove\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadCommandPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	ioctlPolicy = p
+	defer func() { ioctlPolicy = nil }()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	err = d.ioctl(UmountAll, "", "")
+	if _, ok := err.(*commandError); !ok {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if errnoOf(err) != syscall.EPERM {
+		t.Errorf("unexpected errno %v", errnoOf(err))
+	}
+	if n := f.count(UmountAll); n != 0 {
+		t.Errorf("%d commands denied issued", n)
+	}
+	if err := d.ioctlBuffer(LcfsGrow, make([]byte, 8)); err == nil {
+		t.Error("command not allowed issued")
+	}
+
+	for _, data := range []string{"LAYER_CREATE\nLAYER_FORMAT\n", "# none\n"} {
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadCommandPolicy(file); err == nil {
+			t.Errorf("invalid policy %q accepted", data)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// pprofServer serves runtime profiles of the plugin process for debugging.
+type pprofServer struct {
+	listener net.Listener
+}
+
+// parsePprofAddress checks the address profiles are served on is either a
+// unix socket specified as unix://<path> or a loopback host:port, returning
+// the network and address to listen on.
+func parsePprofAddress(address string) (string, string, error) {
+	if strings.HasPrefix(address, "unix://") {
+		socket := strings.TrimPrefix(address, "unix://")
+		if socket == "" {
+			return "", "", fmt.Errorf("lcfs: invalid pprof address %q", address)
+		}
+		return "unix", socket, nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", fmt.Errorf("lcfs: invalid pprof address %q", address)
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return "", "", fmt.Errorf("lcfs: pprof address %q is not a loopback address",
+				address)
+		}
+	}
+	return "tcp", address, nil
+}
+
+// newPprofServer starts serving profiles on the given address.  Only users
+// listed are served when listening on a unix socket.
+func newPprofServer(address string, uids []uint32) (*pprofServer, error) {
+	var l net.Listener
+
+	network, addr, err := parsePprofAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		l, err = listenUnixPeerCred(addr, uids)
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		err := http.Serve(l, mux)
+		logrus.Infof("Profiling on %s stopped: %v", address, err)
+	}()
+	logrus.Infof("Serving profiles on %s", address)
+	return &pprofServer{listener: l}, nil
+}
+
+// close stops serving profiles.
+func (p *pprofServer) close() error {
+	return p.listener.Close()
+}
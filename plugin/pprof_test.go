@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParsePprofAddress(t *testing.T) {
+	for _, address := range []string{
+		"unix:///run/lcfs-pprof.sock",
+		"localhost:6060",
+		"127.0.0.1:6060",
+		"[::1]:6060",
+	} {
+		if _, _, err := parsePprofAddress(address); err != nil {
+			t.Errorf("unexpected error for %q: %v", address, err)
+		}
+	}
+	for _, address := range []string{
+		"unix://",
+		"6060",
+		"0.0.0.0:6060",
+		"example.com:6060",
+	} {
+		if _, _, err := parsePprofAddress(address); err == nil {
+			t.Errorf("expected error for %q", address)
+		}
+	}
+}
+
+func TestPprofServer(t *testing.T) {
+	p, err := newPprofServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	resp, err := http.Get("http://" + p.listener.Addr().String() +
+		"/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+}
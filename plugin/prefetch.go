@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Storage option of a container enabling prefetching its layer when mounted
+const prefetchStorageOpt = "prefetch"
+
+var errPrefetchStopped = errors.New("prefetch stopped")
+
+// prefetcher warms the cache for a layer in the background, so processes
+// started in a freshly pulled image do not stall on cold reads.  Metadata of
+// all files in the layer is read, along with data of executables and shared
+// libraries up to a limit.
+type prefetcher struct {
+	d        *Driver
+	maxBytes int64
+
+	lock    sync.Mutex
+	layers  map[string]bool
+	running map[string]bool
+	done    sync.WaitGroup
+	stop    chan struct{}
+}
+
+// newPrefetcher creates a prefetcher reading up to maxBytes of data per layer.
+func newPrefetcher(d *Driver, maxBytes int64) *prefetcher {
+	return &prefetcher{
+		d:        d,
+		maxBytes: maxBytes,
+		layers:   make(map[string]bool),
+		running:  make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+}
+
+// close stops prefetching and waits for layers being prefetched.
+func (p *prefetcher) close() {
+	close(p.stop)
+	p.done.Wait()
+}
+
+// enable marks a layer for prefetching whenever it is mounted.
+func (p *prefetcher) enable(id string) {
+	p.lock.Lock()
+	p.layers[id] = true
+	p.lock.Unlock()
+}
+
+// enabled checks if a layer is prefetched when mounted.
+func (p *prefetcher) enabled(id string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.layers[id]
+}
+
+// forget stops tracking a layer removed.
+func (p *prefetcher) forget(id string) {
+	p.lock.Lock()
+	delete(p.layers, id)
+	p.lock.Unlock()
+}
+
+// start prefetches a layer in the background, failing if it is being
+// prefetched already, rather than dropping the files listed.  Listed files
+// are read if paths are given, executables and shared libraries otherwise.
+func (p *prefetcher) start(id string, paths []string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.running[id] {
+		return prefetchingError(id)
+	}
+	p.running[id] = true
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		var files int
+		var bytes int64
+		var err error
+
+		start := time.Now()
+		root := path.Join(p.d.home, id)
+		if paths == nil {
+			files, bytes, err = prefetchTree(root, p.maxBytes, p.stop)
+		} else {
+			files, bytes, err = prefetchFiles(root, paths, p.maxBytes, p.stop)
+		}
+		if err != nil {
+			logrus.Debugf("Prefetch of layer %s stopped: %v", id, err)
+		} else {
+			logrus.Debugf("Prefetched %d files and %d bytes of layer %s in %v",
+				files, bytes, id, time.Since(start))
+		}
+		p.lock.Lock()
+		delete(p.running, id)
+		p.lock.Unlock()
+	}()
+	return nil
+}
+
+// Prefetch starts reading the listed files of a layer into the cache, for
+// example files recorded while a container of the image was starting.  Paths
+// are relative to the root of the layer, files missing are skipped.  Without
+// paths, metadata of all files and data of executables and shared libraries
+// are read.  Fails with errLayerBusy while the layer is being prefetched.
+func (d *Driver) Prefetch(id string, paths []string) (err error) {
+	logrus.Debugf("Prefetch - id %s paths %d", id, len(paths))
+	defer d.trackOp("Prefetch", id, "")(&err)
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if d.prefetch == nil {
+		return fmt.Errorf("lcfs: driver not initialized")
+	}
+	for _, name := range paths {
+		if err := checkPrefetchPath(name); err != nil {
+			return err
+		}
+	}
+	return d.prefetch.start(id, paths)
+}
+
+// checkPrefetchPath checks a path does not lead out of a layer.
+func checkPrefetchPath(name string) error {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return fmt.Errorf("lcfs: invalid path %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return fmt.Errorf("lcfs: invalid path %q", name)
+		}
+	}
+	return nil
+}
+
+// prefetchable checks if data of a file is likely needed for starting a
+// container, as it is an executable or a shared library.
+func prefetchable(info os.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	return info.Mode()&0111 != 0 || strings.HasSuffix(info.Name(), ".so") ||
+		strings.Contains(info.Name(), ".so.")
+}
+
+// prefetchTree reads metadata of all files under root and data of
+// executables and shared libraries, returning the number of files and bytes
+// read.  Reading data stops once maxBytes have been read.
+func prefetchTree(root string, maxBytes int64,
+	stop <-chan struct{}) (files int, bytes int64, err error) {
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		select {
+		case <-stop:
+			return errPrefetchStopped
+		default:
+		}
+		if err != nil {
+			return err
+		}
+		files++
+		if bytes >= maxBytes || !prefetchable(info) {
+			return nil
+		}
+		n, err := prefetchFile(name, maxBytes-bytes)
+		bytes += n
+		return err
+	})
+	return files, bytes, err
+}
+
+// prefetchFiles reads metadata and data of the listed files under root,
+// returning the number of files and bytes read.  Symbolic links are not
+// followed, reading data stops once maxBytes have been read.
+func prefetchFiles(root string, paths []string, maxBytes int64,
+	stop <-chan struct{}) (files int, bytes int64, err error) {
+	for _, name := range paths {
+		select {
+		case <-stop:
+			return files, bytes, errPrefetchStopped
+		default:
+		}
+		info, err := lstatNoFollow(root, name)
+		if err != nil {
+			continue
+		}
+		files++
+		if bytes >= maxBytes || !info.Mode().IsRegular() {
+			continue
+		}
+		n, err := prefetchFile(path.Join(root, name), maxBytes-bytes)
+		bytes += n
+		if err != nil {
+			return files, bytes, err
+		}
+	}
+	return files, bytes, nil
+}
+
+// lstatNoFollow returns information of a file under root, failing if any
+// directory on the way is a symbolic link.
+func lstatNoFollow(root, name string) (os.FileInfo, error) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	dir := root
+	for i, part := range parts {
+		dir = path.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return nil, err
+		}
+		if i == len(parts)-1 {
+			return info, nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("lcfs: %s is a symbolic link", dir)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("lcfs: %s is not a directory", dir)
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// prefetchFile reads up to limit bytes of a file, not following a symbolic
+// link replacing it.
+func prefetchFile(name string, limit int64) (int64, error) {
+	f, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, io.LimitReader(f, limit))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPrefetchTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "bin"), 0755)
+	os.MkdirAll(path.Join(dir, "lib"), 0755)
+	ioutil.WriteFile(path.Join(dir, "bin", "sh"), make([]byte, 100), 0755)
+	ioutil.WriteFile(path.Join(dir, "lib", "libc.so.6"), make([]byte, 50), 0644)
+	ioutil.WriteFile(path.Join(dir, "data"), make([]byte, 1000), 0644)
+
+	files, bytes, err := prefetchTree(dir, 1<<20, nil)
+	if err != nil {
+		t.Fatalf("prefetchTree failed: %v", err)
+	}
+	if files != 6 || bytes != 150 {
+		t.Errorf("unexpected %d files and %d bytes prefetched", files, bytes)
+	}
+	if _, bytes, _ = prefetchTree(dir, 120, nil); bytes != 120 {
+		t.Errorf("prefetched %d bytes beyond limit", bytes)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if _, _, err := prefetchTree(dir, 1<<20, stop); err != errPrefetchStopped {
+		t.Errorf("prefetch not stopped: %v", err)
+	}
+}
+
+func TestPrefetchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(path.Join(dir, "etc"), 0755)
+	ioutil.WriteFile(path.Join(dir, "etc", "hosts"), make([]byte, 100), 0644)
+	os.Symlink("/", path.Join(dir, "host"))
+
+	files, bytes, err := prefetchFiles(dir,
+		[]string{"/etc/hosts", "etc", "missing", "host/etc/hosts"}, 1<<20, nil)
+	if err != nil {
+		t.Fatalf("prefetchFiles failed: %v", err)
+	}
+	if files != 2 || bytes != 100 {
+		t.Errorf("unexpected %d files and %d bytes prefetched", files, bytes)
+	}
+}
+
+func TestCheckPrefetchPath(t *testing.T) {
+	for _, name := range []string{"/bin/sh", "lib/libc.so.6", "a..b"} {
+		if err := checkPrefetchPath(name); err != nil {
+			t.Errorf("valid path %q rejected: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "../etc/passwd", "/a/../../b", "a\x00b"} {
+		if err := checkPrefetchPath(name); err == nil {
+			t.Errorf("invalid path %q accepted", name)
+		}
+	}
+}
+
+func TestPrefetchBusy(t *testing.T) {
+	d := &Driver{home: "/lcfs"}
+	d.prefetch = newPrefetcher(d, 1<<20)
+	d.prefetch.running["layer"] = true
+	err := d.Prefetch("layer", []string{"/bin/sh"})
+	if !errors.Is(err, errLayerBusy) {
+		t.Errorf("paths of layer being prefetched accepted, err %v", err)
+	}
+}
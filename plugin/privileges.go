@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Capabilities kept when running as another user, mounting layers and
+// issuing ioctls needing CAP_SYS_ADMIN, and applying diffs creating files
+// owned by any user in a chroot the others
+const (
+	capChown       = 0
+	capDacOverride = 1
+	capFowner      = 3
+	capFsetid      = 4
+	capSysChroot   = 18
+	capSysAdmin    = 21
+	capMknod       = 27
+	capSetfcap     = 31
+)
+
+var keptCaps = []uint{capChown, capDacOverride, capFowner, capFsetid,
+	capSysChroot, capSysAdmin, capMknod, capSetfcap}
+
+// Not defined by the syscall package
+const (
+	prCapAmbient      = 47
+	prCapAmbientRaise = 2
+	linuxCapVersion3  = 0x20080522
+)
+
+// parseUser parses the value of the user option, as "uid" or "uid:gid".
+func parseUser(val string) (uid, gid uint32, err error) {
+	parts := strings.Split(val, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("lcfs: invalid user %q", val)
+	}
+	ids := make([]uint32, len(parts))
+	for i, p := range parts {
+		id, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("lcfs: invalid user %q", val)
+		}
+		ids[i] = uint32(id)
+	}
+	if len(ids) == 1 {
+		return ids[0], ids[0], nil
+	}
+	return ids[0], ids[1], nil
+}
+
+// capMask returns the capabilities kept as the two words of a capability set.
+func capMask() [2]uint32 {
+	var mask [2]uint32
+	for _, c := range keptCaps {
+		mask[c/32] |= 1 << (c % 32)
+	}
+	return mask
+}
+
+// lastCap returns the highest capability known to the kernel.
+func lastCap() uint {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err == nil {
+		n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 8)
+		if err == nil {
+			return uint(n)
+		}
+	}
+	return 63
+}
+
+// threadsPrctl issues a prctl on every thread.
+func threadsPrctl(option, arg2, arg3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, option, arg2, arg3)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropPrivileges switches the plugin to run as another user once set up,
+// keeping only the capabilities it needs, so a compromise of the plugin does
+// not give full control of the host.  Capabilities dropped are removed from
+// the bounding set, and those kept are raised in the ambient set, so the
+// processes applying diffs get those as well but nothing more, even when
+// executing a program with file capabilities or set-user-id.
+func dropPrivileges(uid, gid uint32) error {
+	if uint32(syscall.Getuid()) == uid && uid != 0 {
+		return nil
+	}
+	mask := capMask()
+	for c := uint(0); c <= lastCap(); c++ {
+		if mask[c/32]&(1<<(c%32)) != 0 {
+			continue
+		}
+		err := threadsPrctl(unix.PR_CAPBSET_DROP, uintptr(c), 0)
+		if err == syscall.ENOTSUP {
+			return fmt.Errorf("lcfs: cannot drop privileges of a binary " +
+				"built with cgo, build with CGO_ENABLED=0")
+		}
+		if err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("lcfs: dropping capability %d: %v", c, err)
+		}
+	}
+	if err := threadsPrctl(unix.PR_SET_KEEPCAPS, 1, 0); err != nil {
+		return fmt.Errorf("lcfs: keeping capabilities: %v", err)
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("lcfs: dropping groups: %v", err)
+	}
+	if err := syscall.Setgid(int(gid)); err != nil {
+		return fmt.Errorf("lcfs: switching to group %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(int(uid)); err != nil {
+		return fmt.Errorf("lcfs: switching to user %d: %v", uid, err)
+	}
+	hdr := struct {
+		version uint32
+		pid     int32
+	}{linuxCapVersion3, 0}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	for i := range data {
+		data[i].effective = mask[i]
+		data[i].permitted = mask[i]
+		data[i].inheritable = mask[i]
+	}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("lcfs: setting capabilities: %v", errno)
+	}
+	for _, c := range keptCaps {
+		if err := threadsPrctl(prCapAmbient, prCapAmbientRaise,
+			uintptr(c)); err != nil {
+			return fmt.Errorf("lcfs: raising ambient capability %d: %v", c, err)
+		}
+	}
+	if err := threadsPrctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("lcfs: setting no new privileges: %v", err)
+	}
+	logrus.Infof("Running as user %d group %d", uid, gid)
+	return nil
+}
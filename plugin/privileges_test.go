@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestParseUser(t *testing.T) {
+	for val, ids := range map[string][2]uint32{
+		"1000":      {1000, 1000},
+		"1000:1001": {1000, 1001},
+		"0:0":       {0, 0},
+	} {
+		uid, gid, err := parseUser(val)
+		if err != nil || uid != ids[0] || gid != ids[1] {
+			t.Errorf("user %q parsed as %d:%d, err %v", val, uid, gid, err)
+		}
+	}
+	for _, val := range []string{"", "lcfs", "1:2:3", "-1", "1000:"} {
+		if _, _, err := parseUser(val); err == nil {
+			t.Errorf("invalid user %q parsed", val)
+		}
+	}
+	if _, err := parseOptions([]string{"lcfs.user=nobody"}); err == nil {
+		t.Errorf("invalid user option accepted")
+	}
+}
+
+func TestCapMask(t *testing.T) {
+	mask := capMask()
+	if mask[0] != 1<<capChown|1<<capDacOverride|1<<capFowner|1<<capFsetid|
+		1<<capSysChroot|1<<capSysAdmin|1<<capMknod|1<<capSetfcap || mask[1] != 0 {
+		t.Errorf("unexpected capabilities %#x %#x", mask[0], mask[1])
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// prometheusExporter serves metrics of the driver and the file system in the
+// Prometheus text format on /metrics.  Metrics served off localhost require
+// a token of the admin API, of the admin or of readers.
+type prometheusExporter struct {
+	d         *Driver
+	listener  net.Listener
+	token     []byte
+	readToken []byte
+}
+
+// isLoopback checks if the host of an address is only reachable locally.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// newPrometheusExporter starts serving metrics on the configured host:port.
+func newPrometheusExporter(d *Driver, opts *driverOptions) (*prometheusExporter, error) {
+	var err error
+
+	address := opts.PrometheusAddress
+	p := &prometheusExporter{d: d}
+	if !isLoopback(address) {
+		if p.token, err = readToken(opts.AdminTokenFile); err != nil {
+			return nil, err
+		}
+		if opts.AdminReadTokenFile != "" {
+			p.readToken, err = readToken(opts.AdminReadTokenFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.listener, err = net.Listen("tcp", address); err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.metrics)
+	go func() {
+		err := http.Serve(p.listener, mux)
+		logrus.Infof("Prometheus metrics on %s stopped: %v", address, err)
+	}()
+	logrus.Infof("Serving Prometheus metrics on %s", address)
+	return p, nil
+}
+
+// close stops serving metrics.
+func (p *prometheusExporter) close() error {
+	return p.listener.Close()
+}
+
+func (p *prometheusExporter) metrics(w http.ResponseWriter, r *http.Request) {
+	if p.token != nil && tokenRole(r.Header.Get("Authorization"), p.token,
+		p.readToken) == roleNone {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s, err := p.d.stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(formatPrometheus(s))
+}
+
+// promWriter formats metric families in the Prometheus text format.
+type promWriter struct {
+	bytes.Buffer
+}
+
+func (b *promWriter) family(name, kind, help string) {
+	fmt.Fprintf(b, "# HELP lcfs_%s %s\n# TYPE lcfs_%s %s\n", name, help, name, kind)
+}
+
+func (b *promWriter) sample(name, label, value string, v interface{}) {
+	if label == "" {
+		fmt.Fprintf(b, "lcfs_%s %v\n", name, v)
+	} else {
+		fmt.Fprintf(b, "lcfs_%s{%s=\"%s\"} %v\n", name, label,
+			strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value), v)
+	}
+}
+
+// formatPrometheus formats stats of the driver as Prometheus metrics.
+func formatPrometheus(s *driverStats) []byte {
+	var b promWriter
+
+	ops := make([]string, 0, len(s.Operations))
+	for op := range s.Operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	opFamilies := []struct {
+		name, help string
+		value      func(o opMetric) interface{}
+	}{
+		{"operations_total", "Driver operations processed.",
+			func(o opMetric) interface{} { return o.Count }},
+		{"operation_errors_total", "Driver operations failed.",
+			func(o opMetric) interface{} { return o.Errors }},
+		{"operation_slow_total", "Driver operations exceeding the slow operation threshold.",
+			func(o opMetric) interface{} { return o.Slow }},
+		{"operation_seconds_total", "Time spent processing driver operations.",
+			func(o opMetric) interface{} { return o.Total.Seconds() }},
+	}
+	for _, f := range opFamilies {
+		b.family(f.name, "counter", f.help)
+		for _, op := range ops {
+			b.sample(f.name, "op", op, f.value(s.Operations[op]))
+		}
+	}
+
+	if c := s.Capacity; c != nil {
+		b.family("space_total_bytes", "gauge", "Size of the file system.")
+		b.sample("space_total_bytes", "", "", c.TotalBytes)
+		b.family("space_free_bytes", "gauge", "Space available in the file system.")
+		b.sample("space_free_bytes", "", "", c.FreeBytes)
+		b.family("inodes_total", "gauge", "Inodes of the file system.")
+		b.sample("inodes_total", "", "", c.TotalInodes)
+		b.family("inodes_free", "gauge", "Inodes available in the file system.")
+		b.sample("inodes_free", "", "", c.FreeInodes)
+		b.family("layers", "gauge", "Layers present in the file system.")
+		b.sample("layers", "", "", c.Layers)
+	}
+
+	if d := s.Daemon; d != nil {
+		b.family("daemon_resident_bytes", "gauge", "Resident memory of the file system daemon.")
+		b.sample("daemon_resident_bytes", "", "", d.ResidentMemory)
+		b.family("page_cache_bytes", "gauge", "Memory used for caching data pages.")
+		b.sample("page_cache_bytes", "", "", d.PageMemory)
+		b.family("page_cache_limit_bytes", "gauge", "Memory targeted for caching data pages.")
+		b.sample("page_cache_limit_bytes", "", "", d.PageMemoryLimit)
+		b.family("dirty_pages", "gauge", "Pages not written to disk yet.")
+		b.sample("dirty_pages", "", "", d.DirtyPages)
+	}
+
+	if f := s.Fuse; f != nil {
+		b.family("fuse_requests_waiting", "gauge", "Requests queued or being processed on the fuse connection.")
+		b.sample("fuse_requests_waiting", "", "", f.Waiting)
+		b.family("fuse_requests_waiting_max", "gauge", "Maximum requests waiting on the fuse connection.")
+		b.sample("fuse_requests_waiting_max", "", "", f.MaxWaiting)
+		b.family("fuse_congestion_threshold", "gauge", "Requests waiting at which the fuse connection is congested.")
+		b.sample("fuse_congestion_threshold", "", "", f.CongestionThreshold)
+		b.family("fuse_congestion_events_total", "counter", "Times the fuse connection became congested.")
+		b.sample("fuse_congestion_events_total", "", "", f.CongestionEvents)
+	}
+
+	if i := s.Ioctls; i != nil {
+		b.family("ioctls_limit", "gauge", "Ioctls issued to the file system at the same time at most.")
+		b.sample("ioctls_limit", "", "", i.Limit)
+		b.family("ioctls_active", "gauge", "Ioctls being processed by the file system.")
+		b.sample("ioctls_active", "", "", i.Active)
+		b.family("ioctls_waiting", "gauge", "Ioctls waiting for others to complete.")
+		b.sample("ioctls_waiting", "", "", i.Waiting)
+		b.family("ioctls_queued_total", "counter", "Ioctls which had to wait for others to complete.")
+		b.sample("ioctls_queued_total", "", "", i.Queued)
+		b.family("ioctl_wait_seconds_total", "counter", "Time ioctls waited for others to complete.")
+		b.sample("ioctl_wait_seconds_total", "", "", i.WaitTime.Seconds())
+	}
+
+	if p := s.Pruned; p != nil {
+		b.family("snapshots_pruned_total", "counter", "Snapshots removed by retention rules of snapshot policies.")
+		b.sample("snapshots_pruned_total", "", "", p.Snapshots)
+		b.family("snapshots_pruned_bytes_total", "counter", "Space of changes of snapshots removed by retention rules.")
+		b.sample("snapshots_pruned_bytes_total", "", "", p.Bytes)
+	}
+
+	layers := make([]string, 0, len(s.Layers))
+	for id := range s.Layers {
+		layers = append(layers, id)
+	}
+	sort.Strings(layers)
+	layerFamilies := []struct {
+		name, help string
+		value      func(l *layerIOStats) uint64
+	}{
+		{"layer_read_bytes_total", "Bytes read from files in a layer.",
+			func(l *layerIOStats) uint64 { return l.ReadBytes }},
+		{"layer_write_bytes_total", "Bytes written to files in a layer.",
+			func(l *layerIOStats) uint64 { return l.WriteBytes }},
+		{"layer_reads_total", "Read requests on files in a layer.",
+			func(l *layerIOStats) uint64 { return l.ReadOps }},
+		{"layer_writes_total", "Write requests on files in a layer.",
+			func(l *layerIOStats) uint64 { return l.WriteOps }},
+		{"layer_cache_hits_total", "Pages of a layer found in cache.",
+			func(l *layerIOStats) uint64 { return l.CacheHits }},
+		{"layer_cache_misses_total", "Pages of a layer read from disk.",
+			func(l *layerIOStats) uint64 { return l.CacheMisses }},
+	}
+	if len(layers) > 0 {
+		for _, f := range layerFamilies {
+			b.family(f.name, "counter", f.help)
+			for _, id := range layers {
+				b.sample(f.name, "layer", id, f.value(s.Layers[id]))
+			}
+		}
+	}
+	return b.Bytes()
+}
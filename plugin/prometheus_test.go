@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatPrometheus(t *testing.T) {
+	s := &driverStats{
+		Capacity: &capacityStats{TotalBytes: 1000, FreeBytes: 400, Layers: 2},
+		Operations: map[string]opMetric{
+			"Get": {Count: 3, Errors: 1, Total: 1500 * time.Millisecond},
+		},
+		Fuse: &fuseStats{Waiting: 4, CongestionEvents: 1},
+		Layers: map[string]*layerIOStats{
+			"abc": {CacheHits: 90, CacheMisses: 10},
+		},
+	}
+	out := string(formatPrometheus(s))
+	for _, line := range []string{
+		"# TYPE lcfs_operations_total counter",
+		`lcfs_operations_total{op="Get"} 3`,
+		`lcfs_operation_errors_total{op="Get"} 1`,
+		`lcfs_operation_seconds_total{op="Get"} 1.5`,
+		"lcfs_space_free_bytes 400",
+		"lcfs_layers 2",
+		"lcfs_fuse_requests_waiting 4",
+		"lcfs_fuse_congestion_events_total 1",
+		`lcfs_layer_cache_hits_total{layer="abc"} 90`,
+		`lcfs_layer_cache_misses_total{layer="abc"} 10`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "daemon_resident_bytes") {
+		t.Errorf("unexpected daemon metrics without daemon stats")
+	}
+}
+
+func TestPrometheusAuth(t *testing.T) {
+	home, err := ioutil.TempDir("", "lcfs-prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	token := path.Join(home, "read.token")
+	ioutil.WriteFile(token, []byte("reader\n"), 0600)
+	d := &Driver{home: home}
+
+	// Metrics served off localhost require a token
+	p, err := newPrometheusExporter(d, &driverOptions{PrometheusAddress: ":0",
+		AdminTokenFile: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	_, port, _ := net.SplitHostPort(p.listener.Addr().String())
+	url := "http://127.0.0.1:" + port + "/metrics"
+	for _, auth := range []string{"", "Bearer reader"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if (resp.StatusCode == http.StatusOK) != (auth != "") {
+			t.Errorf("metrics with authorization %q returned %d", auth,
+				resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Root of the cgroup hierarchies processes using a layer are frozen in
+var cgroupRoot = "/sys/fs/cgroup"
+
+// Time processes using a layer are given to be frozen
+const freezeTimeout = 10 * time.Second
+
+// cgroupFreezer freezes the processes of a cgroup, with the freezer of cgroup
+// v2, or of the freezer hierarchy of cgroup v1, like docker pause does.
+type cgroupFreezer struct {
+	dir string
+	v1  bool
+}
+
+// processFreezer returns the freezer of the cgroup of a process, nil if the
+// process is in the root cgroup, which is never frozen.
+func processFreezer(pid int) (*cgroupFreezer, error) {
+	f, err := os.Open(path.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var freezer *cgroupFreezer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 || fields[2] == "/" {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" && freezer == nil {
+			freezer = &cgroupFreezer{dir: path.Join(cgroupRoot, fields[2])}
+		}
+		for _, c := range strings.Split(fields[1], ",") {
+			if c == "freezer" {
+				return &cgroupFreezer{path.Join(cgroupRoot, "freezer",
+					fields[2]), true}, scanner.Err()
+			}
+		}
+	}
+	return freezer, scanner.Err()
+}
+
+// frozen checks if the processes of the cgroup are frozen, or asked to be
+// if requested is set.
+func (f *cgroupFreezer) frozen(requested bool) (bool, error) {
+	if f.v1 {
+		state, err := ioutil.ReadFile(path.Join(f.dir, "freezer.state"))
+		if err != nil {
+			return false, err
+		}
+		s := strings.TrimSpace(string(state))
+		return s == "FROZEN" || (requested && s == "FREEZING"), nil
+	}
+	if requested {
+		state, err := ioutil.ReadFile(path.Join(f.dir, "cgroup.freeze"))
+		return strings.TrimSpace(string(state)) == "1", err
+	}
+	events, err := ioutil.ReadFile(path.Join(f.dir, "cgroup.events"))
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if line == "frozen 1" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// set freezes or thaws the processes of the cgroup.
+func (f *cgroupFreezer) set(freeze bool) error {
+	if f.v1 {
+		state := "THAWED"
+		if freeze {
+			state = "FROZEN"
+		}
+		return ioutil.WriteFile(path.Join(f.dir, "freezer.state"),
+			[]byte(state), 0644)
+	}
+	state := "0"
+	if freeze {
+		state = "1"
+	}
+	return ioutil.WriteFile(path.Join(f.dir, "cgroup.freeze"), []byte(state),
+		0644)
+}
+
+// freeze freezes the processes of the cgroup, waiting until those are.
+func (f *cgroupFreezer) freeze() error {
+	if err := f.set(true); err != nil {
+		return err
+	}
+	delay := time.Millisecond
+	for start := time.Now(); time.Since(start) < freezeTimeout; {
+		frozen, err := f.frozen(false)
+		if err != nil || frozen {
+			return err
+		}
+		time.Sleep(delay)
+		if delay < 100*time.Millisecond {
+			delay *= 2
+		}
+	}
+	return fmt.Errorf("lcfs: processes of cgroup %s not frozen in %v", f.dir,
+		freezeTimeout)
+}
+
+// quiesce stops writes to a layer mounted, freezing the cgroups of processes
+// using the layer and flushing data written to the file system, returning a
+// function thawing those again.  Cgroups frozen already, like those of
+// containers paused, are left frozen.  Processes stay frozen until thawed,
+// for snapshots while the changes of the layer are copied, as the file system
+// cannot snapshot a writable layer without copying those.  Processes are
+// found in the pid namespace of the plugin, which needs to be the one of the
+// host, so a layer referenced with no process found using it fails instead
+// of nothing being frozen.
+func (d *Driver) quiesce(id string) (func(), error) {
+	var frozen []*cgroupFreezer
+
+	thaw := func() {
+		for _, f := range frozen {
+			if err := f.set(false); err != nil {
+				logrus.Errorf("Thawing cgroup %s, err %v\n", f.dir, err)
+			} else if err := d.recordFrozen(f, false); err != nil {
+				logrus.Errorf("%v", err)
+			}
+		}
+	}
+	dir := path.Join(d.home, id)
+	seen := make(map[string]bool)
+
+	// Never freeze the plugin itself
+	if own, err := processFreezer(os.Getpid()); err == nil && own != nil {
+		seen[own.dir] = true
+	}
+	pids := layerPids(dir)
+	if len(pids) == 0 && d.mounts.referenced(id) {
+		return nil, fmt.Errorf("lcfs: quiescing layer %s, no process found "+
+			"using the layer mounted, the plugin needs the pid namespace of "+
+			"the host", id)
+	}
+	for _, pid := range pids {
+		if pid == os.Getpid() {
+			continue
+		}
+		f, err := processFreezer(pid)
+		if err == nil && f == nil {
+			err = fmt.Errorf("process not in a cgroup")
+		}
+		if err != nil {
+			thaw()
+			return nil, fmt.Errorf("lcfs: quiescing layer %s, pid %d: %v", id,
+				pid, err)
+		}
+		if seen[f.dir] {
+			continue
+		}
+		seen[f.dir] = true
+		if paused, err := f.frozen(true); err == nil && paused {
+			continue
+		}
+
+		// Recorded before frozen, so never left frozen unrecorded
+		if err := d.recordFrozen(f, true); err != nil {
+			thaw()
+			return nil, err
+		}
+		if err := f.freeze(); err != nil {
+			if f.set(false) == nil {
+				d.recordFrozen(f, false)
+			}
+			thaw()
+			return nil, err
+		}
+		frozen = append(frozen, f)
+	}
+	logrus.Infof("Quiesced layer %s, froze %d cgroups", id, len(frozen))
+	if err := syncDir(dir); err != nil {
+		thaw()
+		return nil, err
+	}
+	return thaw, nil
+}
+
+// syncDir writes data cached by the kernel for the file system of a directory.
+func syncDir(dir string) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	_, _, errno := unix.Syscall(unix.SYS_SYNCFS, uintptr(fd), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
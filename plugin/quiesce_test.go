@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestOnlineSnapshot(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	defer func(proc, cgroup string) {
+		procRoot, cgroupRoot = proc, cgroup
+	}(procRoot, cgroupRoot)
+	procRoot = path.Join(f.home, "proc")
+	cgroupRoot = path.Join(f.home, "cgroup")
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A running container and a paused one using the layer
+	for _, p := range []struct{ pid, cgroup, state string }{
+		{"123", "/docker/running", "0"},
+		{"456", "/docker/paused", "1"},
+	} {
+		pdir := path.Join(procRoot, p.pid)
+		os.MkdirAll(pdir, 0755)
+		os.Symlink(path.Join(d.home, "rw"), path.Join(pdir, "cwd"))
+		ioutil.WriteFile(path.Join(pdir, "cgroup"), []byte("0::"+p.cgroup+"\n"),
+			0644)
+		cdir := path.Join(cgroupRoot, p.cgroup)
+		os.MkdirAll(cdir, 0755)
+		ioutil.WriteFile(path.Join(cdir, "cgroup.freeze"), []byte(p.state), 0644)
+		ioutil.WriteFile(path.Join(cdir, "cgroup.events"),
+			[]byte("populated 1\nfrozen 1\n"), 0644)
+	}
+	state := func(cgroup string) string {
+		data, _ := ioutil.ReadFile(path.Join(cgroupRoot, cgroup, "cgroup.freeze"))
+		return strings.TrimSpace(string(data))
+	}
+	var during []string
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		during = []string{state("/docker/running"), state("/docker/paused")}
+		return nil
+	}
+	defer func() { copyChanges = (*Driver).copyChanges }()
+
+	_, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "offline"})
+	if !errors.Is(err, errLayerBusy) {
+		t.Errorf("layer mounted snapshotted without online set, err %v", err)
+	}
+	syncs := f.count(LcfsSync)
+	rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "live",
+		Online: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Online {
+		t.Error("snapshot not recorded online")
+	}
+	if len(during) != 2 || during[0] != "1" || during[1] != "1" {
+		t.Errorf("processes not frozen during snapshot %v", during)
+	}
+	if f.count(LcfsSync) != syncs+1 {
+		t.Error("file system not committed before the snapshot")
+	}
+	if state("/docker/running") != "0" || state("/docker/paused") != "1" {
+		t.Errorf("cgroups not restored, running %s paused %s",
+			state("/docker/running"), state("/docker/paused"))
+	}
+
+	// Processes not in a cgroup are not frozen
+	ioutil.WriteFile(path.Join(procRoot, "123", "cgroup"), []byte("0::/\n"),
+		0644)
+	if _, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "root",
+		Online: true}); err == nil {
+		t.Error("layer used by a process not in a cgroup snapshotted")
+	}
+
+	// Layers mounted by a container are not snapshotted without finding its
+	// processes, as in a pid namespace other than the one of the host
+	os.RemoveAll(procRoot)
+	if _, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "namespace",
+		Online: true}); err == nil {
+		t.Error("layer mounted snapshotted without processes found")
+	}
+}
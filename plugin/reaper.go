@@ -0,0 +1,182 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// reaper removes layers in the background when deferred removal is enabled.
+// Remove only queues a layer, layers busy when removed are retried every
+// interval.  Layers are removed before their parent, as when an image with a
+// deep chain of layers is deleted, ordered by the number of ancestors the file
+// system reports, or the parents queued with layers if it does not.
+type reaper struct {
+	d       *Driver
+	remove  func(id string) error
+	depth   func(id string) (int, error)
+	lock    sync.Mutex
+	pending map[string]int
+	parents map[string]string
+	wakeup  chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newReaper starts removing queued layers, retrying failed ones every
+// interval.
+func newReaper(d *Driver, interval time.Duration) *reaper {
+	r := &reaper{
+		d:       d,
+		pending: make(map[string]int),
+		parents: make(map[string]string),
+		wakeup:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	r.remove = r.removeLayer
+	r.depth = d.layerDepth
+	go r.run(interval)
+	logrus.Infof("Deferred removal of layers enabled")
+	return r
+}
+
+func (r *reaper) run(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.wakeup:
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+		r.reap()
+	}
+}
+
+// close stops removing layers after a last attempt at removing queued ones.
+func (r *reaper) close() {
+	close(r.stop)
+	<-r.done
+	r.reap()
+	if n := r.count(); n > 0 {
+		logrus.Warnf("%d layers queued for removal not removed", n)
+	}
+}
+
+// queue marks a layer for removal, with its parent if known.
+func (r *reaper) queue(id, parent string) {
+	r.lock.Lock()
+	if _, ok := r.pending[id]; !ok {
+		r.pending[id] = 0
+	}
+	if parent != "" {
+		if r.parents == nil {
+			r.parents = make(map[string]string)
+		}
+		r.parents[id] = parent
+	}
+	r.lock.Unlock()
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// queued checks if a layer is waiting to be removed.
+func (r *reaper) queued(id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.pending[id]
+	return ok
+}
+
+// count returns the number of layers waiting to be removed.
+func (r *reaper) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.pending)
+}
+
+// reap attempts removing all queued layers, children before their parents.
+func (r *reaper) reap() {
+	r.lock.Lock()
+	ids := make([]string, 0, len(r.pending))
+	for id := range r.pending {
+		ids = append(ids, id)
+	}
+	r.lock.Unlock()
+	depths := make(map[string]int, len(ids))
+	if r.depth != nil {
+		for _, id := range ids {
+			if n, err := r.depth(id); err == nil && n >= 0 {
+				depths[id] = n
+			}
+		}
+	}
+	r.lock.Lock()
+	ids = childrenFirst(ids, r.parents, depths)
+	r.lock.Unlock()
+	for _, id := range ids {
+		err := r.remove(id)
+		r.lock.Lock()
+		if err == nil || err == unix.ENOENT {
+			delete(r.pending, id)
+			delete(r.parents, id)
+		} else {
+			r.pending[id]++
+			if r.pending[id] == 1 || err != unix.EBUSY {
+				logrus.Warnf("Deferred removal of layer %s failed, retrying: %v",
+					id, err)
+			}
+		}
+		r.lock.Unlock()
+	}
+}
+
+// removeLayer removes a layer from the file system.
+func (r *reaper) removeLayer(id string) error {
+	defer r.d.layers.lock(id)()
+	err := r.d.removeLayer(id)
+	if err == nil {
+		r.d.status.invalidate()
+	}
+	if (err == nil || err == unix.ENOENT) && r.d.journal != nil {
+		r.d.journal.end(journalRemove, id)
+	}
+	return err
+}
+
+// childrenFirst orders layers so layers are after their children, by the
+// number of ancestors in depths, or counted walking parents up to a layer in
+// depths for layers not in depths.  Layers of the same depth are sorted by id.
+func childrenFirst(ids []string, parents map[string]string,
+	depths map[string]int) []string {
+	depth := make(map[string]int, len(ids))
+	for _, id := range ids {
+		n := 0
+		for l := id; n <= len(parents); l = parents[l] {
+			if d, ok := depths[l]; ok {
+				n += d
+				break
+			}
+			if parents[l] == "" {
+				break
+			}
+			n++
+		}
+		depth[id] = n
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if depth[ids[i]] != depth[ids[j]] {
+			return depth[ids[i]] > depth[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReaper(t *testing.T) {
+	var removed []string
+
+	busy := 2
+	r := &reaper{pending: make(map[string]int)}
+	r.remove = func(id string) error {
+		if id == "busy" && busy > 0 {
+			busy--
+			return syscall.EBUSY
+		}
+		removed = append(removed, id)
+		return nil
+	}
+	r.wakeup = make(chan struct{}, 1)
+	r.queue("a", "")
+	r.queue("busy", "")
+	if !r.queued("a") || !r.queued("busy") || r.queued("b") {
+		t.Fatalf("unexpected queue %v", r.pending)
+	}
+	r.reap()
+	if r.queued("a") || !r.queued("busy") || r.pending["busy"] != 1 {
+		t.Errorf("unexpected queue after first attempt %v", r.pending)
+	}
+	r.reap()
+	r.reap()
+	if r.count() != 0 || len(removed) != 2 {
+		t.Errorf("layers not removed, queue %v removed %v", r.pending, removed)
+	}
+}
+
+func TestReaperRun(t *testing.T) {
+	r := newReaper(&Driver{}, time.Hour)
+	done := make(chan string, 1)
+	r.remove = func(id string) error {
+		done <- id
+		return nil
+	}
+	r.queue("a", "")
+	select {
+	case id := <-done:
+		if id != "a" {
+			t.Errorf("unexpected layer %s removed", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("queued layer not removed")
+	}
+	r.close()
+}
+
+func TestReaperChildrenFirst(t *testing.T) {
+	var removed []string
+
+	r := &reaper{pending: make(map[string]int)}
+	r.remove = func(id string) error {
+		removed = append(removed, id)
+		return nil
+	}
+	r.wakeup = make(chan struct{}, 1)
+	r.queue("a", "")
+	r.queue("c", "b")
+	r.queue("b", "a")
+	r.queue("z", "y")
+	r.queue("d", "c")
+	r.reap()
+	expected := []string{"d", "c", "b", "z", "a"}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("layers removed in order %v, expected %v", removed, expected)
+	}
+	if len(r.parents) != 0 {
+		t.Errorf("parents of layers removed remembered %v", r.parents)
+	}
+}
+
+// Layers created before the plugin started are queued without parents, and
+// are ordered by the ancestors the file system reports, also when closing
+func TestReaperFileSystemDepth(t *testing.T) {
+	var removed []string
+
+	_, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"a", "", false}, fakeLayer{"b", "a", false},
+		fakeLayer{"c", "b", true})
+	r := newReaper(d, time.Hour)
+	r.remove = func(id string) error {
+		removed = append(removed, id)
+		return nil
+	}
+	r.lock.Lock()
+	for _, id := range []string{"a", "b", "c"} {
+		r.pending[id] = 0
+	}
+	r.lock.Unlock()
+	r.close()
+	expected := []string{"c", "b", "a"}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("layers removed in order %v, expected %v", removed, expected)
+	}
+}
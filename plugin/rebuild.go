@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// rebuiltLayer is a layer created again from backups by Rebuild.
+type rebuiltLayer struct {
+	Layer  string `json:"layer"`
+	Parent string `json:"parent,omitempty"`
+	Backup string `json:"backup"`
+
+	// Snapshot a writable layer backed up as snapshots was rolled back to
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// rebuildPlan returns the latest backup of every layer backed up, and the
+// layers in the order those are created, parents first.  Parents of layers
+// need to be backed up or present.
+func (d *Driver) rebuildPlan(all []*backupManifest) (map[string]*backupManifest,
+	[]string, error) {
+	latest := make(map[string]*backupManifest)
+	for _, m := range all {
+		latest[m.Layer] = m
+	}
+	var order []string
+	done := make(map[string]bool)
+	var visit func(id string, seen map[string]bool) error
+	visit = func(id string, seen map[string]bool) error {
+		if done[id] {
+			return nil
+		}
+		if seen[id] {
+			return fmt.Errorf("lcfs: backups of layer %s are created from "+
+				"the layer itself", id)
+		}
+		seen[id] = true
+		parent := backupParent(latest[id])
+		if parent != "" {
+			if latest[parent] != nil {
+				if err := visit(parent, seen); err != nil {
+					return err
+				}
+			} else if !d.Exists(parent) {
+				return fmt.Errorf("lcfs: parent %s of layer %s neither backed "+
+					"up nor present", parent, id)
+			}
+		}
+		done[id] = true
+		order = append(order, id)
+		return nil
+	}
+	ids := make([]string, 0, len(latest))
+	for id := range latest {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := visit(id, make(map[string]bool)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return latest, order, nil
+}
+
+// backupParent returns the parent of the layer of a backup.
+func backupParent(m *backupManifest) string {
+	if m.Snapshot != nil {
+		return m.Snapshot.Parent
+	}
+	return m.Parent
+}
+
+// Rebuild creates the layers backed up not present again, with the ids and
+// parents those had, from the latest backup of each, for recovering the
+// layers Docker knows of into a new home after losing the old one.  Layers
+// backed up as layers are created from their streams, read-only unless those
+// were writable.  Layers only backed up as snapshots, like those of
+// containers, are created writable and rolled back to the snapshot of the
+// latest backup, received first.  Streams of all the backups needed are
+// verified before any layer is created.  Layers created before a failure are
+// kept, so running Rebuild again completes the rest.
+func (d *Driver) Rebuild() (_ []*rebuiltLayer, err error) {
+	logrus.Debugf("Rebuild")
+	defer d.trackOp("Rebuild", "", "")(&err)
+	b, err := d.backupsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	all, err := b.list("")
+	if err != nil {
+		return nil, err
+	}
+	latest, order, err := d.rebuildPlan(all)
+	if err != nil {
+		return nil, err
+	}
+	var todo []string
+	chains := make(map[string][]*backupManifest)
+	for _, id := range order {
+		if d.Exists(id) {
+			continue
+		}
+		chain, err := b.chain(latest[id].ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.verifyChain(chain); err != nil {
+			return nil, err
+		}
+		todo = append(todo, id)
+		chains[id] = chain
+	}
+
+	rebuilt := make([]*rebuiltLayer, 0, len(todo))
+	for _, id := range todo {
+		m := latest[id]
+		l := &rebuiltLayer{Layer: id, Parent: backupParent(m), Backup: m.ID}
+		if m.Snapshot == nil {
+			err = d.rebuildLayer(b, m)
+		} else {
+			l.Snapshot, err = d.rebuildFromSnapshot(b, s, chains[id])
+		}
+		if err != nil {
+			return rebuilt, fmt.Errorf("lcfs: rebuilding layer %s from backup "+
+				"%s: %v", id, m.ID, err)
+		}
+		rebuilt = append(rebuilt, l)
+	}
+	logrus.Infof("Rebuilt %d layers from backups", len(rebuilt))
+	return rebuilt, nil
+}
+
+// rebuildLayer creates a layer from the stream of a backup of the layer,
+// removing it again if applying the stream fails.
+func (d *Driver) rebuildLayer(b *backupStore, m *backupManifest) error {
+	create := d.Create
+	if m.ReadWrite {
+		create = d.CreateReadWrite
+	}
+	if err := create(m.Layer, m.Parent, "", nil); err != nil {
+		return err
+	}
+	f, err := b.target.open(m.ID + backupStreamSuffix)
+	if err == nil {
+		r := newDigestReader(f)
+		err = receiveChanges(d, m.Layer, m.Parent, r)
+		if err == nil {
+			err = r.check(m)
+		}
+		f.Close()
+	}
+	if err != nil {
+		if rerr := d.Remove(m.Layer); rerr != nil {
+			logrus.Errorf("Removing layer %s rebuilt, err %v\n", m.Layer, rerr)
+		}
+	}
+	return err
+}
+
+// rebuildFromSnapshot receives the snapshots of backups, then creates the
+// layer of those writable and rolls it back to the snapshot of the last.
+func (d *Driver) rebuildFromSnapshot(b *backupStore, s *snapshotStore,
+	chain []*backupManifest) (string, error) {
+	rec, err := d.receiveChain(b, s, chain, "")
+	if err != nil {
+		return "", err
+	}
+	if err := d.CreateReadWrite(rec.Layer, rec.Parent, "", nil); err != nil {
+		return "", err
+	}
+	if err := d.Rollback(rec.Layer, rec.ID); err != nil {
+		if rerr := d.Remove(rec.Layer); rerr != nil {
+			logrus.Errorf("Removing layer %s rebuilt, err %v\n", rec.Layer, rerr)
+		}
+		return "", err
+	}
+	return rec.Name, nil
+}
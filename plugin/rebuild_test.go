@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestRebuild(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	target, err := newDirTarget(path.Join(f.home, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backups = &backupStore{target: target}
+	received := make(map[string]string)
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	sendChanges = func(d *Driver, w io.Writer, id, base string) error {
+		_, err := fmt.Fprintf(w, "changes of %s relative to %s", id, base)
+		return err
+	}
+	receiveChanges = func(d *Driver, id, base string, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		received[id] = string(data)
+		return err
+	}
+	defer func() {
+		copyChanges = (*Driver).copyChanges
+		sendChanges = (*Driver).writeCompressedDiff
+		receiveChanges = (*Driver).receiveChanges
+	}()
+	createLayers(t, d, fakeLayer{"base", "", false}, fakeLayer{"top", "base", false})
+	createLayers(t, d, fakeLayer{"init", "top", true},
+		fakeLayer{"rw", "init", true})
+
+	// Layers mounted writable are backed up as snapshots instead
+	if _, err := d.Get("init", ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Backup(&backupRequest{Layer: "init", ReadWrite: true})
+	if err == nil {
+		t.Error("layer mounted writable backed up")
+	}
+	if err := d.Put("init"); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []*backupRequest{{Layer: "base"}, {Layer: "top"},
+		{Layer: "init", Parent: "top", ReadWrite: true}} {
+		if _, err := d.Backup(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Backup(&backupRequest{Layer: "top", Full: true}); err == nil {
+		t.Error("backup of a layer requested incremental")
+	}
+	rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "daily"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Backup(&backupRequest{Snapshot: "daily"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is rebuilt while all layers are present
+	if rebuilt, err := d.Rebuild(); err != nil || len(rebuilt) != 0 {
+		t.Errorf("layers present rebuilt %v, err %v", rebuilt, err)
+	}
+	if err := d.RemoveSnapshot(rec.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"rw", "init", "top", "base"} {
+		if err := d.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rebuilt, err := d.Rebuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, l := range rebuilt {
+		order = append(order, l.Layer)
+	}
+	if fmt.Sprint(order) != "[base top init rw]" || rebuilt[3].Snapshot != "daily" {
+		t.Errorf("unexpected layers rebuilt %v", rebuilt)
+	}
+	for id, parent := range map[string]string{"top": "base", "init": "top",
+		rec.ID: "init", "rw": rec.ID} {
+		if !d.Exists(id) || f.parents[id] != parent {
+			t.Errorf("layer %s rebuilt from %q, expected %q", id, f.parents[id],
+				parent)
+		}
+	}
+	if !d.mounts.isReadOnly("top") || d.mounts.isReadOnly("init") {
+		t.Error("layers not rebuilt read-only as backed up")
+	}
+	if received["top"] != "changes of top relative to base" {
+		t.Errorf("unexpected changes received %q", received["top"])
+	}
+	if rebuilt, err := d.Rebuild(); err != nil || len(rebuilt) != 0 {
+		t.Errorf("layers rebuilt again %v, err %v", rebuilt, err)
+	}
+}
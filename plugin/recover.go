@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// panicError logs a panic recovered while handling a request of Docker with
+// the stack, and returns the error the request fails with.  A bug hit by a
+// single request fails that request, instead of killing the plugin serving
+// the storage of every container.  Layers locked by the request are unlocked
+// as the stack unwinds.
+func panicError(op, id string, p interface{}) error {
+	logrus.Errorf("Panic in %s of layer %s: %v\n%s", op, id, p, debug.Stack())
+	return fmt.Errorf("lcfs: internal error: %v", p)
+}
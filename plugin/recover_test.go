@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	graphPlugin "github.com/docker/go-plugins-helpers/graphdriver"
+)
+
+// A panic handling a request fails the request, the plugin keeps serving
+// others and the layer is not left locked
+func TestRecoverPanic(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"layer", "", false})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go graphPlugin.NewHandler(d).Serve(l)
+	url := "http://" + l.Addr().String()
+
+	ioctlSyscall = func(op uintptr, buf []byte) error {
+		if int(op&0xff) == LayerMount {
+			panic("bug mounting layer")
+		}
+		return f.ioctl(op, buf)
+	}
+	resp, err := graphPlugin.CallGet(url, http.DefaultClient,
+		graphPlugin.GetRequest{ID: "layer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resp.Err, "Get layer layer") ||
+		!strings.Contains(resp.Err, "bug mounting layer") {
+		t.Errorf("panic in Get returned %q", resp.Err)
+	}
+
+	ioctlSyscall = f.ioctl
+	resp, err = graphPlugin.CallGet(url, http.DefaultClient,
+		graphPlugin.GetRequest{ID: "layer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Err != "" || f.mounts["layer"] != 1 {
+		t.Errorf("Get after a panic returned %q", resp.Err)
+	}
+}
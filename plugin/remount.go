@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Layers unmounted within this time of the last unmount recorded are mounted
+// again at start, as Docker puts all layers of running containers when it
+// stops.  Layers mounted again stay mounted this long without references.
+const remountWindow = 5 * time.Minute
+
+// mountState records layers mounted in a file, so those can be mounted again
+// in parallel when the plugin starts after the host or Docker was restarted,
+// before Docker restarts containers configured with a restart policy one by
+// one.  Layers are recorded with the time those were unmounted, zero while
+// mounted, and dropped once unmounted for longer than remountWindow.
+type mountState struct {
+	file string
+	lock sync.Mutex
+	ids  map[string]int64
+}
+
+// loadMountState reads the layers recorded in file, if any.
+func loadMountState(file string) (*mountState, error) {
+	s := &mountState{file: file, ids: make(map[string]int64)}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.ids); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// remount returns the layers mounted when the state was last recorded, or
+// unmounted within remountWindow of the last unmount.
+func (s *mountState) remount() []string {
+	var last int64
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, unmounted := range s.ids {
+		if unmounted > last {
+			last = unmounted
+		}
+	}
+	ids := make([]string, 0, len(s.ids))
+	for id, unmounted := range s.ids {
+		if unmounted == 0 ||
+			time.Duration(last-unmounted)*time.Second <= remountWindow {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// mounted records a layer mounted.
+func (s *mountState) mounted(id string) {
+	s.update(func() bool {
+		if unmounted, ok := s.ids[id]; ok && unmounted == 0 {
+			return false
+		}
+		s.ids[id] = 0
+		return true
+	})
+}
+
+// unmounted records a layer unmounted.
+func (s *mountState) unmounted(id string) {
+	s.update(func() bool {
+		if _, ok := s.ids[id]; !ok {
+			return false
+		}
+		s.ids[id] = time.Now().Unix()
+		return true
+	})
+}
+
+// forget stops recording a layer, as when removed.
+func (s *mountState) forget(id string) {
+	s.update(func() bool {
+		if _, ok := s.ids[id]; !ok {
+			return false
+		}
+		delete(s.ids, id)
+		return true
+	})
+}
+
+// update applies a change, replacing the file atomically if changed.
+func (s *mountState) update(change func() bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !change() {
+		return
+	}
+	oldest := time.Now().Add(-remountWindow).Unix()
+	for id, unmounted := range s.ids {
+		if unmounted != 0 && unmounted < oldest {
+			delete(s.ids, id)
+		}
+	}
+	data, err := json.Marshal(s.ids)
+	if err == nil {
+		tmp := s.file + ".tmp"
+		err = ioutil.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, s.file)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("Recording mounted layers in %s, err %v\n", s.file, err)
+	}
+}
+
+// remountLayers mounts layers up to threads at a time, in the background of
+// Init.  Layers stay mounted for remountWindow without references, so Get of
+// a container restarted only takes a reference.  Layers no longer present or
+// mounted by a Get meanwhile are skipped.
+func (d *Driver) remountLayers(ids []string, threads int) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var mounted int
+
+	start := time.Now()
+	slots := make(chan struct{}, threads)
+	for _, id := range ids {
+		if !d.known.has(id) {
+			d.mountState.forget(id)
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer d.layers.lock(id)()
+			if d.mounts.active(id) {
+				return
+			}
+			if err := d.ioctl(LayerMount, "", id); err != nil {
+				logrus.Errorf("Mounting layer %s again, err %v\n", id, err)
+				d.mountState.forget(id)
+				return
+			}
+			d.mounts.park(id, remountWindow, func(i *idleMount) {
+				d.umountIdle(id, i)
+			})
+			lock.Lock()
+			mounted++
+			lock.Unlock()
+		}(id)
+	}
+	wg.Wait()
+	logrus.Infof("Mounted %d of %d layers mounted before in %v", mounted,
+		len(ids), time.Since(start))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMountState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-remount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "mounts.json")
+
+	s, err := loadMountState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mounted("a")
+	s.mounted("b")
+	s.mounted("c")
+	s.unmounted("b")
+	s.forget("c")
+
+	s, err = loadMountState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := s.remount(); !reflect.DeepEqual(ids, []string{"a", "b"}) {
+		t.Fatalf("remount %v, expected [a b]", ids)
+	}
+
+	// Layers unmounted long before the last one are not mounted again
+	now := time.Now().Unix()
+	s.ids = map[string]int64{
+		"a": 0,
+		"b": now,
+		"c": now - int64(remountWindow/time.Second) + 10,
+		"d": now - int64(remountWindow/time.Second) - 10,
+	}
+	if ids := s.remount(); !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+		t.Fatalf("remount %v, expected [a b c]", ids)
+	}
+}
+
+func TestRemountLayers(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+
+	var err error
+	d.mountState, err = loadMountState(path.Join(f.home, "mounts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"a", "b", "c", "d"}
+	for _, id := range ids {
+		if err := d.Create(id, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Get("b", ""); err != nil {
+		t.Fatal(err)
+	}
+	d.mountState.mounted("missing")
+	d.remountLayers(append(ids, "missing"), 2)
+
+	for _, id := range ids {
+		if f.mounts[id] != 1 {
+			t.Fatalf("layer %s mounted %d times", id, f.mounts[id])
+		}
+	}
+	if ids := d.mountState.remount(); !reflect.DeepEqual(ids, []string{"b"}) {
+		t.Fatalf("recorded %v, expected [b]", ids)
+	}
+
+	// Get takes a reference of a layer mounted again
+	if _, err := d.Get("a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(LayerMount); n != 4 {
+		t.Fatalf("%d mounts, expected 4", n)
+	}
+	if err := d.Put("a"); err != nil {
+		t.Fatal(err)
+	}
+	if f.mounts["a"] != 0 {
+		t.Fatalf("layer a not unmounted")
+	}
+	d.mounts.reset()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+)
+
+// restoreResult counts files restored from a snapshot, and files removed not
+// found in the snapshot.
+type restoreResult struct {
+	Restored int `json:"restored"`
+	Removed  int `json:"removed"`
+}
+
+// restoreChanges returns the changes making paths of a layer in dir like those
+// of a snapshot in snap.  Directories are restored with all files in those,
+// and files not in the snapshot are removed.  Paths are looked up in the
+// snapshot without following links in any directory on the way, which would
+// point out of the snapshot, and are refused if those are links.
+func restoreChanges(snap, dir string, paths []string) ([]archive.Change, error) {
+	var changes []archive.Change
+	for _, p := range paths {
+		if _, err := lstatNoFollow(snap, p); os.IsNotExist(err) {
+			changes = append(changes, archive.Change{Path: p,
+				Kind: archive.ChangeDelete})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Files added since, removed first
+		err := filepath.Walk(path.Join(dir, p), func(name string,
+			fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rel := p + name[len(path.Join(dir, p)):]
+			if _, err := lstatNoFollow(snap, rel); err != nil {
+				changes = append(changes, archive.Change{Path: rel,
+					Kind: archive.ChangeDelete})
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(path.Join(snap, p), func(name string,
+			fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := p + name[len(path.Join(snap, p)):]
+			changes = append(changes, archive.Change{Path: rel,
+				Kind: archive.ChangeModify})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// RestoreFiles copies files and directories of a snapshot of a writable layer
+// back to the layer, replacing those in the layer, for undoing changes of a
+// few files without rolling back the layer.  Files not found in the snapshot
+// are removed from the layer.  Data is shared with the snapshot where the
+// file system clones files, and only the data of files is copied otherwise.
+// The layer may be mounted, processes using it see the files restored.
+func (d *Driver) RestoreFiles(layer, ref string, paths []string) (_ *restoreResult, err error) {
+	logrus.Debugf("RestoreFiles - layer %s snapshot %s paths %v", layer, ref,
+		paths)
+	defer d.trackOp("RestoreFiles", layer, "")(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateID(layer); err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("lcfs: no paths to restore")
+	}
+	cleaned := make([]string, len(paths))
+	for i, p := range paths {
+		cleaned[i] = path.Clean("/" + p)
+		if cleaned[i] == "/" {
+			return nil, fmt.Errorf("lcfs: restoring all files of layer %s, "+
+				"roll back the layer instead", layer)
+		}
+	}
+	rec, err := s.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Layer != layer {
+		return nil, fmt.Errorf("lcfs: snapshot %s is of layer %s, not of %s",
+			rec.Name, rec.Layer, layer)
+	}
+	defer d.layers.lock(layer)()
+	if !d.Exists(layer) {
+		return nil, notFoundError(layer)
+	}
+	if d.mounts.isReadOnly(layer) {
+		return nil, fmt.Errorf("lcfs: layer %s is read-only", layer)
+	}
+	if err := d.checkFrozen(layer); err != nil {
+		return nil, err
+	}
+	if !d.Exists(rec.ID) {
+		return nil, fmt.Errorf("lcfs: layer %s of snapshot %s not found", rec.ID,
+			rec.Name)
+	}
+	snap, dir := path.Join(d.home, rec.ID), path.Join(d.home, layer)
+	changes, err := restoreChanges(snap, dir, cleaned)
+	if err != nil {
+		return nil, err
+	}
+	defer d.sizes.invalidate(layer)
+	if err := copyLayerFiles(snap, dir, changes); err != nil {
+		return nil, err
+	}
+	var res restoreResult
+	for _, c := range changes {
+		if c.Kind == archive.ChangeDelete {
+			res.Removed++
+		} else {
+			res.Restored++
+		}
+	}
+	logrus.Infof("Restored %d files of layer %s from snapshot %s, removed %d",
+		res.Restored, layer, rec.Name, res.Removed)
+	return &res, nil
+}
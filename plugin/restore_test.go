@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRestoreFiles(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	defer func() { copyChanges = (*Driver).copyChanges }()
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "good"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, dir := path.Join(f.home, rec.ID), path.Join(f.home, "rw")
+	for _, root := range []string{snap, dir} {
+		if err := os.MkdirAll(path.Join(root, "etc/app"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		snap + "/etc/app/config": "good",
+		snap + "/etc/hosts":      "hosts",
+		dir + "/etc/app/config":  "bad",
+		dir + "/etc/app/added":   "added",
+		dir + "/etc/hosts":       "changed",
+		dir + "/new":             "new",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := d.RestoreFiles("rw", "good", []string{"/"}); err == nil {
+		t.Error("all files of a layer restored")
+	}
+	if _, err := d.RestoreFiles("base", "good", []string{"etc"}); err == nil {
+		t.Error("files restored from a snapshot of another layer")
+	}
+	res, err := d.RestoreFiles("rw", "good", []string{"etc/app", "/new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Restored != 2 || res.Removed != 2 {
+		t.Errorf("unexpected files restored %+v", res)
+	}
+	if data, err := ioutil.ReadFile(dir + "/etc/app/config"); err != nil ||
+		string(data) != "good" {
+		t.Errorf("file not restored, %q err %v", data, err)
+	}
+	for _, name := range []string{"/etc/app/added", "/new"} {
+		if _, err := os.Lstat(dir + name); !os.IsNotExist(err) {
+			t.Errorf("%s not in the snapshot not removed, err %v", name, err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(dir + "/etc/hosts"); string(data) != "changed" {
+		t.Errorf("file not restored changed, %q", data)
+	}
+
+	// Files are not restored through links of the snapshot
+	if err := os.Symlink("/etc", snap+"/var"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RestoreFiles("rw", "good", []string{"/var/hostname"}); err == nil {
+		t.Error("file restored through a link of the snapshot")
+	}
+	if _, err := os.Lstat(dir + "/var/hostname"); !os.IsNotExist(err) {
+		t.Errorf("file out of the snapshot restored, err %v", err)
+	}
+}
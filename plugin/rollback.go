@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// File of the snapshot directory recording layers rolled back
+const snapshotRollbacksFile = "rollbacks"
+
+// loadRollbacks reads the layers rolled back to snapshots.
+func (s *snapshotStore) loadRollbacks() error {
+	s.rollbacks = make(map[string]string)
+	data, err := ioutil.ReadFile(path.Join(s.dir, snapshotRollbacksFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.rollbacks)
+}
+
+// setRollback records a layer rolled back to the layer of a snapshot, or
+// forgets the layer if snapshot is empty.
+func (s *snapshotStore) setRollback(id, snapshot string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.rollbacks[id] == snapshot {
+		return nil
+	}
+	prev, ok := s.rollbacks[id]
+	if snapshot == "" {
+		delete(s.rollbacks, id)
+	} else {
+		s.rollbacks[id] = snapshot
+	}
+	if err := s.writeFile(snapshotRollbacksFile, s.rollbacks); err != nil {
+		if ok {
+			s.rollbacks[id] = prev
+		} else {
+			delete(s.rollbacks, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// rolledBack checks if a layer was rolled back to a snapshot.
+func (s *snapshotStore) rolledBack(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.rollbacks[id]
+	return ok
+}
+
+// rolledBack checks if a layer was rolled back to a snapshot.  The file system
+// tracks changes of such a layer relative to the layer of the snapshot it was
+// created from again, not to the parent Docker knows of.
+func (d *Driver) rolledBack(id string) bool {
+	return d.snapshots != nil && d.snapshots.rolledBack(id)
+}
+
+// Rollback reverts a writable layer not mounted, like that of a stopped
+// container, to a snapshot of the layer, discarding changes made since.  The
+// layer is replaced with a writable layer of the same id created from the
+// layer of the snapshot, with the layer locked against other operations of
+// the driver until done.  With the journal enabled, a rollback interrupted by
+// a crash is completed when the plugin starts next.
+func (d *Driver) Rollback(id, snapshot string) (err error) {
+	logrus.Debugf("Rollback - id %s snapshot %s", id, snapshot)
+	defer d.trackOp("Rollback", id, "")(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return err
+	}
+	if err := validateID(id); err != nil {
+		return err
+	}
+	rec, err := s.resolve(snapshot)
+	if err != nil {
+		return err
+	}
+	if rec.Layer != id {
+		return fmt.Errorf("lcfs: snapshot %s is of layer %s, not of %s",
+			rec.Name, rec.Layer, id)
+	}
+	defer d.layers.lock(id)()
+	if !d.Exists(id) {
+		return notFoundError(id)
+	}
+	if d.mounts.active(id) {
+		return mountedError(id)
+	}
+	if err := d.checkFrozen(id); err != nil {
+		return err
+	}
+	if !d.Exists(rec.ID) {
+		return fmt.Errorf("lcfs: layer %s of snapshot %s not found", rec.ID,
+			rec.Name)
+	}
+
+	// Recorded first, diffs of the layer are correct either way, only slower
+	// if the layer remains
+	if err := s.setRollback(id, rec.ID); err != nil {
+		return err
+	}
+	r := journalRecord{Op: journalRollback, ID: id, Parent: rec.ID}
+	if d.journal != nil {
+		d.journal.append(r)
+	}
+	parent := d.known.parentOf(id)
+	d.known.remove(id)
+	if err := d.removeLayer(id); err != nil && err != unix.ENOENT {
+		d.known.add(id, parent)
+		if d.journal != nil {
+			r.Done = true
+			d.journal.append(r)
+		}
+		return err
+	}
+	if d.prefetch != nil {
+		d.prefetch.forget(id)
+	}
+	d.sizes.forget(id)
+	if d.integrity != nil {
+		d.integrity.forget(id)
+	}
+
+	// Left in the journal if this fails, to be retried when the plugin
+	// starts next
+	if err := d.create(LayerCreateRw, id, rec.ID, nil); err != nil {
+		return fmt.Errorf("lcfs: layer %s removed, creating it from snapshot "+
+			"%s failed: %v", id, rec.Name, err)
+	}
+	if d.journal != nil {
+		r.Done = true
+		d.journal.append(r)
+	}
+	logrus.Infof("Layer %s rolled back to snapshot %s", id, rec.Name)
+	return nil
+}
+
+// redoRollback completes a rollback of a layer interrupted, creating the
+// layer from the layer of the snapshot again.
+func (d *Driver) redoRollback(id, parent string) error {
+	err := d.ioctl(LayerRemove, "", id)
+	if err != nil && err != unix.ENOENT {
+		return err
+	}
+	return d.ioctl(LayerCreateRw, parent, id)
+}
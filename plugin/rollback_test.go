@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	d.journal, _, _ = openJournal(path.Join(f.home, "journal"))
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	defer func() { copyChanges = (*Driver).copyChanges }()
+	createLayers(t, d, fakeLayer{"base", "", false}, fakeLayer{"other", "", false})
+	createLayers(t, d, fakeLayer{"rw", "base", true})
+	rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "good",
+		Tags: []string{"pre-upgrade"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := path.Join(f.home, "rw", "bad")
+	ioutil.WriteFile(bad, []byte("bad"), 0600)
+
+	// Refused for snapshots of other layers and layers mounted
+	if err := d.Rollback("other", "good"); err == nil {
+		t.Error("layer rolled back to a snapshot of another layer")
+	}
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rollback("rw", "good"); !errors.Is(err, errLayerBusy) {
+		t.Errorf("layer mounted rolled back, err %v", err)
+	}
+	if err := d.Put("rw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rollback("rw", "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("layer rolled back to a snapshot not found, err %v", err)
+	}
+
+	if err := d.Rollback("rw", "pre-upgrade"); err != nil {
+		t.Fatal(err)
+	}
+	if f.parents["rw"] != rec.ID || !d.Exists("rw") {
+		t.Errorf("layer not created from the snapshot, parent %q", f.parents["rw"])
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Errorf("changes since the snapshot remain, err %v", err)
+	}
+	if !d.rolledBack("rw") {
+		t.Error("rollback not recorded")
+	}
+	if interrupted := d.journal.list(); len(interrupted) != 0 {
+		t.Errorf("rollback left in the journal %v", interrupted)
+	}
+
+	// Rollbacks are remembered until the layer is removed
+	s, err := openSnapshotStore(path.Join(f.home, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.rolledBack("rw") {
+		t.Error("rollback not recorded on disk")
+	}
+	if err := d.Remove("rw"); err != nil {
+		t.Fatal(err)
+	}
+	if d.rolledBack("rw") {
+		t.Error("rollback of layer removed remembered")
+	}
+}
+
+func TestRecoverRollback(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	file := path.Join(f.home, "journal")
+	j, _, err := openJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createLayers(t, d, fakeLayer{"base", "", false}, fakeLayer{"snap", "", false})
+
+	// Crash after the layer was removed
+	j.append(journalRecord{Op: journalRollback, ID: "rw", Parent: "snap"})
+	j.close()
+	j, interrupted, err := openJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.journal = j
+	d.recoverJournal(interrupted)
+	if f.parents["rw"] != "snap" {
+		t.Errorf("rollback not completed, parent %q", f.parents["rw"])
+	}
+	if interrupted := j.list(); len(interrupted) != 0 {
+		t.Errorf("rollback completed left in the journal %v", interrupted)
+	}
+}
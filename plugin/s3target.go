@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// Smallest part of a multipart upload but the last, as required by S3
+const minS3ChunkSize = 5 * units.MiB
+
+// Most parts of a multipart upload S3 completes.  Replaced by tests.
+var maxS3Parts = 10000
+
+// Encryption of objects of backups, by S3 with its own keys or keys of KMS,
+// or by the plugin before upload with a key of a secret provider
+const (
+	s3EncryptionS3     = "sse-s3"
+	s3EncryptionKMS    = "sse-kms"
+	s3EncryptionClient = "client"
+)
+
+// Metadata of objects encrypted by the plugin, the size of chunks encrypted
+const s3ChunkSizeMeta = "X-Amz-Meta-Lcfs-Chunk-Size"
+
+// Size of keys encrypting objects on the client, for AES-256-GCM
+const s3ClientKeySize = 32
+
+// Time allowed for a request to S3
+const s3RequestTimeout = 5 * time.Minute
+
+// Time format of dates of signatures
+const s3DateFormat = "20060102T150405Z"
+
+// s3Credentials are the keys requests to S3 are signed with.
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// s3Target stores files of backups as objects of a bucket of an S3 compatible
+// object store, under a prefix.  Files are uploaded in chunks, a number of
+// those in parallel, and are encrypted by the store or by the plugin.
+type s3Target struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+	creds    s3Credentials
+	client   *http.Client
+
+	chunkSize int64
+	parallel  int
+
+	// Server-side encryption, and the KMS key if any
+	sse    string
+	kmsKey string
+
+	// Key encrypting objects on the client, if set
+	aead cipher.AEAD
+
+	now func() time.Time
+}
+
+// parseS3URL splits a URL of a bucket, as https://<host>/<bucket>[/<prefix>],
+// addressing buckets by path.
+func parseS3URL(val string) (*url.URL, string, string, error) {
+	u, err := url.Parse(val)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, "", "", fmt.Errorf("lcfs: invalid S3 URL %q, expected "+
+			"https://<host>/<bucket>[/<prefix>]", val)
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return nil, "", "", fmt.Errorf("lcfs: no bucket in S3 URL %q", val)
+	}
+	prefix := ""
+	if len(parts) == 2 {
+		prefix = parts[1] + "/"
+	}
+	return &url.URL{Scheme: u.Scheme, Host: u.Host}, parts[0], prefix, nil
+}
+
+// parseS3Encryption checks the encryption of backups given as sse-s3,
+// sse-kms[:<key id>] or client:<secret reference>.
+func parseS3Encryption(val string) error {
+	kv := strings.SplitN(val, ":", 2)
+	switch {
+	case val == s3EncryptionS3, kv[0] == s3EncryptionKMS:
+		return nil
+	case kv[0] == s3EncryptionClient && len(kv) == 2:
+		prefix, name := splitKeyRef(kv[1])
+		if (prefix == fileSecretPrefix || prefix == helperSecretPrefix) &&
+			validateSecretName(name) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("lcfs: invalid backup encryption %q, expected %s, "+
+		"%s[:<key id>] or %s:<file:|helper:secret>", val, s3EncryptionS3,
+		s3EncryptionKMS, s3EncryptionClient)
+}
+
+// secretOf returns a secret of a provider configured by reference.
+func (d *Driver) secretOf(ref string) ([]byte, error) {
+	prefix, name := splitKeyRef(ref)
+	provider := d.secrets[prefix]
+	if provider == nil {
+		return nil, fmt.Errorf("lcfs: no secret provider configured for %q", ref)
+	}
+	return provider.secret(name)
+}
+
+// newS3Target returns a target storing backups in the bucket configured by
+// driver options.  Credentials are a secret of a provider holding
+// "<access key id>:<secret access key>", or taken from the environment.
+func (d *Driver) newS3Target(opts *driverOptions) (*s3Target, error) {
+	endpoint, bucket, prefix, err := parseS3URL(opts.BackupS3URL)
+	if err != nil {
+		return nil, err
+	}
+	t := &s3Target{
+		endpoint:  endpoint,
+		bucket:    bucket,
+		prefix:    prefix,
+		region:    opts.BackupS3Region,
+		client:    &http.Client{Timeout: s3RequestTimeout},
+		chunkSize: opts.BackupS3ChunkSize,
+		parallel:  opts.BackupS3Parallel,
+		now:       time.Now,
+	}
+	if opts.BackupS3Credentials != "" {
+		secret, err := d.secretOf(opts.BackupS3Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("lcfs: S3 credentials: %v", err)
+		}
+		kv := strings.SplitN(strings.TrimSpace(string(secret)), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("lcfs: S3 credentials %q, expected "+
+				"<access key id>:<secret access key>", opts.BackupS3Credentials)
+		}
+		t.creds = s3Credentials{accessKey: kv[0], secretKey: kv[1]}
+	} else {
+		t.creds = s3Credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if t.creds.accessKey == "" || t.creds.secretKey == "" {
+		return nil, fmt.Errorf("lcfs: no S3 credentials, set " +
+			"backup_s3_credentials or AWS_ACCESS_KEY_ID and " +
+			"AWS_SECRET_ACCESS_KEY")
+	}
+	kv := strings.SplitN(opts.BackupS3Encryption, ":", 2)
+	switch kv[0] {
+	case s3EncryptionS3:
+		t.sse = "AES256"
+	case s3EncryptionKMS:
+		t.sse = "aws:kms"
+		if len(kv) == 2 {
+			t.kmsKey = kv[1]
+		}
+	case s3EncryptionClient:
+		secret, err := d.secretOf(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("lcfs: backup encryption key: %v", err)
+		}
+		key := secret
+		if len(secret) != s3ClientKeySize {
+			key, err = hex.DecodeString(strings.TrimSpace(string(secret)))
+			if err != nil || len(key) != s3ClientKeySize {
+				return nil, fmt.Errorf("lcfs: backup encryption key %q, "+
+					"expected %d bytes, or those hex encoded", kv[1],
+					s3ClientKeySize)
+			}
+		}
+		if t.aead, err = newGCM(key); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// newGCM returns AES-256-GCM with a key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// s3Error is an error returned by S3.
+type s3Error struct {
+	status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("lcfs: S3: %d %s: %s", e.status, e.Code, e.Message)
+}
+
+// s3Escape escapes a string as S3 does in canonical requests.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') ||
+			('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' ||
+			c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign signs a request with AWS Signature Version 4, signing the host, the
+// range and all x-amz- headers.
+func (t *s3Target) sign(req *http.Request, payloadHash string) {
+	now := t.now().UTC()
+	date := now.Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if t.creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", t.creds.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" ||
+			lk == "content-md5" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	canonical := strings.Join([]string{req.Method,
+		s3Escape(req.URL.Path, true), strings.Join(params, "&"),
+		canonicalHeaders.String(), signed, payloadHash}, "\n")
+
+	scope := now.Format("20060102") + "/" + t.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" +
+		hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+t.creds.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, t.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		t.creds.accessKey+"/"+scope+", SignedHeaders="+signed+", Signature="+
+		hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+// do sends a signed request for an object, or the bucket if key is empty,
+// returning the response if successful.
+func (t *s3Target) do(method, key string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	u := *t.endpoint
+	u.Path = "/" + t.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	t.sign(req, hex.EncodeToString(sum[:]))
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &s3Error{status: resp.StatusCode}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusNotFound && e.Code != "NoSuchBucket" {
+		return nil, &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+	}
+	return nil, e
+}
+
+// encryptChunk encrypts a chunk of an object, authenticating the object, the
+// index of the chunk and whether it is the last one, so chunks are neither
+// reordered nor dropped.
+func (t *s3Target) encryptChunk(name string, i uint64, last bool,
+	chunk []byte) ([]byte, error) {
+	nonce := make([]byte, t.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(nonce, nonce, chunk, chunkAD(name, i, last)), nil
+}
+
+// chunkAD returns the data authenticated with a chunk of an object.
+func chunkAD(name string, i uint64, last bool) []byte {
+	ad := make([]byte, 9, 9+len(name))
+	binary.BigEndian.PutUint64(ad, i)
+	if last {
+		ad[8] = 1
+	}
+	return append(ad, name...)
+}
+
+// objectHeader returns headers of an object uploaded.
+func (t *s3Target) objectHeader() http.Header {
+	h := make(http.Header)
+	if t.sse != "" {
+		h.Set("X-Amz-Server-Side-Encryption", t.sse)
+	}
+	if t.kmsKey != "" {
+		h.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", t.kmsKey)
+	}
+	if t.aead != nil {
+		h.Set(s3ChunkSizeMeta, strconv.FormatInt(t.chunkSize, 10))
+	}
+	return h
+}
+
+// readChunk reads up to a chunk, returning whether the end of r was reached.
+func (t *s3Target) readChunk(r io.Reader) ([]byte, bool, error) {
+	chunk := make([]byte, t.chunkSize)
+	n, err := io.ReadFull(r, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return chunk[:n], true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return chunk, false, nil
+}
+
+// put uploads a file, as a single object if it fits a chunk, or with a
+// multipart upload of chunks uploaded in parallel.  Multipart uploads
+// failing are aborted.
+func (t *s3Target) put(name string, r io.Reader) error {
+	key := t.prefix + name
+	chunk, eof, err := t.readChunk(r)
+	if err != nil {
+		return err
+	}
+
+	// A chunk more is read to tell the last chunk, which is encrypted as such
+	var next []byte
+	if !eof {
+		if next, eof, err = t.readChunk(r); err != nil {
+			return err
+		}
+		if len(next) == 0 {
+			next = nil
+		}
+	}
+	if next == nil {
+		if t.aead != nil {
+			if chunk, err = t.encryptChunk(key, 0, true, chunk); err != nil {
+				return err
+			}
+		}
+		resp, err := t.do(http.MethodPut, key, nil, t.objectHeader(), chunk)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	resp, err := t.do(http.MethodPost, key, url.Values{"uploads": {""}},
+		t.objectHeader(), nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("lcfs: S3: starting upload of %s: %v", key, err)
+	}
+	upload := initiated.UploadID
+	err = t.uploadParts(key, upload, chunk, next, eof, r)
+	if err != nil {
+		if resp, aerr := t.do(http.MethodDelete, key,
+			url.Values{"uploadId": {upload}}, nil, nil); aerr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+// s3Part is a part of a multipart upload.
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+// uploadParts uploads the chunks of a file as parts of a multipart upload,
+// with a number of uploads in parallel, and completes the upload.  Files
+// needing more parts than S3 completes fail before uploading the last part
+// allowed, rather than once all parts are uploaded.
+func (t *s3Target) uploadParts(key, upload string, chunk, next []byte,
+	eof bool, r io.Reader) error {
+	type job struct {
+		n     int
+		chunk []byte
+	}
+	jobs := make(chan job)
+	var (
+		lock  sync.Mutex
+		parts []s3Part
+		ferr  error
+		wg    sync.WaitGroup
+	)
+	failed := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		return ferr
+	}
+	for i := 0; i < t.parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				resp, err := t.do(http.MethodPut, key, url.Values{
+					"partNumber": {strconv.Itoa(j.n)},
+					"uploadId":   {upload},
+				}, nil, j.chunk)
+				lock.Lock()
+				if err != nil && ferr == nil {
+					ferr = err
+				}
+				if err == nil {
+					parts = append(parts, s3Part{j.n, resp.Header.Get("ETag")})
+					resp.Body.Close()
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	var err error
+	for n := 1; chunk != nil && failed() == nil; n++ {
+		last := next == nil
+		if n == maxS3Parts && !last {
+			err = fmt.Errorf("lcfs: S3: %s larger than %d parts of %s, "+
+				"raise backup_s3_chunk_size", key, maxS3Parts,
+				units.BytesSize(float64(t.chunkSize)))
+			break
+		}
+		data := chunk
+		if t.aead != nil {
+			if data, err = t.encryptChunk(key, uint64(n-1), last, chunk); err != nil {
+				break
+			}
+		}
+		jobs <- job{n, data}
+		chunk = next
+		next = nil
+		if chunk != nil && !eof {
+			if next, eof, err = t.readChunk(r); err != nil {
+				break
+			}
+			if len(next) == 0 {
+				next = nil
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return err
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(http.MethodPost, key, url.Values{"uploadId": {upload}},
+		nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Failures completing an upload are reported with status 200
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.NewDecoder(resp.Body).Decode(&result) == nil &&
+		result.XMLName.Local == "Error" {
+		return &s3Error{resp.StatusCode, result.Code, result.Message}
+	}
+	return nil
+}
+
+// open downloads an object, decrypting it if encrypted by the plugin.
+func (t *s3Target) open(name string) (io.ReadCloser, error) {
+	key := t.prefix + name
+	resp, err := t.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.aead == nil {
+		return resp.Body, nil
+	}
+	size, err := strconv.ParseInt(resp.Header.Get(s3ChunkSizeMeta), 10, 64)
+	if err != nil || size <= 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("lcfs: S3: object %s not encrypted by lcfs", key)
+	}
+	return &s3Decrypter{t: t, key: key, body: resp.Body,
+		size: size + int64(t.aead.NonceSize()+t.aead.Overhead())}, nil
+}
+
+// s3Decrypter decrypts an object encrypted by the plugin chunk by chunk,
+// failing if any chunk was changed, reordered or dropped.
+type s3Decrypter struct {
+	t    *s3Target
+	key  string
+	body io.ReadCloser
+	size int64
+	i    uint64
+	buf  []byte
+	done bool
+}
+
+func (r *s3Decrypter) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, r.size)
+		n, err := io.ReadFull(r.body, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, err
+		}
+		chunk = chunk[:n]
+
+		// The last chunk is shorter, or followed by the end of the object
+		last := int64(n) < r.size || r.atEOF()
+		ns := r.t.aead.NonceSize()
+		if len(chunk) < ns {
+			return 0, fmt.Errorf("lcfs: S3: object %s truncated", r.key)
+		}
+		data, err := r.t.aead.Open(nil, chunk[:ns], chunk[ns:],
+			chunkAD(r.key, r.i, last))
+		if err != nil {
+			return 0, fmt.Errorf("lcfs: S3: object %s corrupted or not "+
+				"encrypted with the key configured", r.key)
+		}
+		r.buf, r.done = data, last
+		r.i++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// atEOF checks if the body has no more data, keeping a byte read if it has.
+func (r *s3Decrypter) atEOF() bool {
+	var b [1]byte
+	n, err := io.ReadFull(r.body, b[:])
+	if n == 1 {
+		r.body = &prefixedBody{io.MultiReader(bytes.NewReader(b[:]), r.body),
+			r.body}
+		return false
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+func (r *s3Decrypter) Close() error {
+	return r.body.Close()
+}
+
+// prefixedBody is a body with data read ahead put back.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// list lists the files of backups under the prefix.
+func (t *s3Target) list() ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {t.prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := t.listPage(q)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range resp.Contents {
+			name := strings.TrimPrefix(c.Key, t.prefix)
+			if !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !resp.IsTruncated {
+			return names, nil
+		}
+		token = resp.NextContinuationToken
+	}
+}
+
+// s3ListResult is a page of objects listed.
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listPage lists a page of objects of the bucket.
+func (t *s3Target) listPage(q url.Values) (*s3ListResult, error) {
+	resp, err := t.do(http.MethodGet, "", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("lcfs: S3: listing bucket %s: %v", t.bucket, err)
+	}
+	return &result, nil
+}
+
+// remove deletes an object, succeeding if not found.
+func (t *s3Target) remove(name string) error {
+	resp, err := t.do(http.MethodDelete, t.prefix+name, nil, nil, nil)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Prefixes of encryption key references naming the provider of the key.
+// References without a known prefix are descriptions of keys in the kernel
+// keyring, as before providers were added.
+const (
+	keyringSecretPrefix = "keyring:"
+	fileSecretPrefix    = "file:"
+	helperSecretPrefix  = "helper:"
+)
+
+// Time a secret helper is given to return a secret
+const secretHelperTimeout = 10 * time.Second
+
+// Keyrings and operations of keyctl(2).  Keys of secrets from providers are
+// added to the user keyring of root, searched by the file system daemon
+// running as root.
+const (
+	keySpecProcessKeyring = -2
+	keySpecUserKeyring    = -4
+	keyctlGetKeyringID    = 0
+	keyctlLink            = 8
+)
+
+// secretProvider returns secrets by name, as keys for encrypting layers.
+// Providers other than the kernel keyring are configured with driver options,
+// and the secrets those return are added to the kernel keyring, as the file
+// system loads keys from there itself.
+type secretProvider interface {
+	secret(name string) ([]byte, error)
+}
+
+// fileSecrets returns secrets stored as files of a directory, like secrets
+// mounted by an orchestrator or written by a secret manager agent.
+type fileSecrets struct {
+	dir string
+}
+
+func (p *fileSecrets) secret(name string) ([]byte, error) {
+	return ioutil.ReadFile(path.Join(p.dir, name))
+}
+
+// helperSecrets returns secrets printed by a program run with the name of a
+// secret, for integrating a secret manager without changing the plugin.
+type helperSecrets struct {
+	program string
+}
+
+func (p *helperSecrets) secret(name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretHelperTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.program, name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// newSecretProviders returns the providers configured by driver options, by
+// prefix of references.
+func newSecretProviders(opts *driverOptions) map[string]secretProvider {
+	providers := make(map[string]secretProvider)
+	if opts.SecretsDir != "" {
+		providers[fileSecretPrefix] = &fileSecrets{opts.SecretsDir}
+	}
+	if opts.SecretHelper != "" {
+		providers[helperSecretPrefix] = &helperSecrets{opts.SecretHelper}
+	}
+	return providers
+}
+
+// splitKeyRef returns the prefix of the provider of a key reference, if any,
+// and the name of the key.
+func splitKeyRef(ref string) (string, string) {
+	for _, prefix := range []string{keyringSecretPrefix, fileSecretPrefix,
+		helperSecretPrefix} {
+		if strings.HasPrefix(ref, prefix) {
+			return prefix, strings.TrimPrefix(ref, prefix)
+		}
+	}
+	return "", ref
+}
+
+// isRawKey checks if a value looks like a key itself rather than a reference,
+// hex or base64 encoding of an AES-128 to AES-256-XTS key.  Values of storage
+// options are shown by docker inspect, so keys are never accepted there.
+func isRawKey(val string) bool {
+	if n := len(val); n == 32 || n == 64 || n == 128 {
+		if _, err := hex.DecodeString(val); err == nil {
+			return true
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding,
+		base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		key, err := enc.DecodeString(val)
+		if err == nil && (len(key) == 16 || len(key) == 32 || len(key) == 64) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSecret returns a key of encryptionKeySize bytes from a secret, either
+// the raw key or its hex encoding.
+func decodeSecret(secret []byte) ([]byte, error) {
+	if len(secret) == encryptionKeySize {
+		return append([]byte(nil), secret...), nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(secret)))
+	if err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("expected %d bytes, or those hex encoded",
+		encryptionKeySize)
+}
+
+// Adds a key to the kernel keyring, replaced by tests
+var addKey = keyringAddKey
+
+// keyringAddKey adds a user key to a keyring, replacing a key with the same
+// description.
+func keyringAddKey(keyring int, desc string, key []byte) error {
+	typ, err := unix.BytePtrFromString("user")
+	if err != nil {
+		return err
+	}
+	d, err := unix.BytePtrFromString(desc)
+	if err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_ADD_KEY, uintptr(unsafe.Pointer(typ)),
+		uintptr(unsafe.Pointer(d)), uintptr(unsafe.Pointer(&key[0])),
+		uintptr(len(key)), uintptr(keyring), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// possessRootKeyring returns the serial number of the user keyring of root,
+// linked to the keyring of the plugin process, so keys can still be added to
+// it once the plugin switched to another user, whose own user keyring the
+// file system daemon does not search.  Called as root.
+func possessRootKeyring() (int, error) {
+	user, process := keySpecUserKeyring, keySpecProcessKeyring
+	id, _, errno := unix.Syscall(unix.SYS_KEYCTL, keyctlGetKeyringID,
+		uintptr(user), 1)
+	if errno != 0 {
+		return 0, errno
+	}
+	keyring := int(int32(id))
+	_, _, errno = unix.Syscall(unix.SYS_KEYCTL, keyctlLink, uintptr(keyring),
+		uintptr(process))
+	if errno != 0 {
+		return 0, errno
+	}
+	return keyring, nil
+}
+
+// secretKeyring returns the keyring keys of secrets are added to.
+func (d *Driver) secretKeyring() int {
+	if d.keyring != 0 {
+		return d.keyring
+	}
+	return keySpecUserKeyring
+}
+
+// Prefix of descriptions of keys added to the kernel keyring by the plugin
+const secretKeyPrefix = "lcfs:"
+
+// providerKeyDesc returns the description of the key of a secret of a
+// provider in the kernel keyring, the reference with a prefix.  Layers record
+// the description, so keys are found again by the reference.
+func providerKeyDesc(ref string) string {
+	return secretKeyPrefix + ref
+}
+
+// resolveKey returns the description of the key in the kernel keyring a
+// reference resolves to.  Secrets of other providers are added to the kernel
+// keyring.
+func (d *Driver) resolveKey(ref string) (string, error) {
+	prefix, name := splitKeyRef(ref)
+	if prefix == "" || prefix == keyringSecretPrefix {
+		return name, nil
+	}
+	provider := d.secrets[prefix]
+	if provider == nil {
+		return "", fmt.Errorf("lcfs: no secret provider configured for "+
+			"encryption key %q", ref)
+	}
+	return providerKeyDesc(ref), d.loadSecret(provider, ref, name)
+}
+
+// loadSecret adds a secret of a provider to the kernel keyring.
+func (d *Driver) loadSecret(provider secretProvider, ref, name string) error {
+	secret, err := provider.secret(name)
+	if err != nil {
+		return fmt.Errorf("lcfs: encryption key %q: %v", ref, err)
+	}
+	key, err := decodeSecret(secret)
+	for i := range secret {
+		secret[i] = 0
+	}
+	if err != nil {
+		return fmt.Errorf("lcfs: encryption key %q: %v", ref, err)
+	}
+	err = addKey(d.secretKeyring(), providerKeyDesc(ref), key)
+	for i := range key {
+		key[i] = 0
+	}
+	if err != nil {
+		return fmt.Errorf("lcfs: adding encryption key %q to the kernel "+
+			"keyring: %v", ref, err)
+	}
+	return nil
+}
+
+// preloadSecrets adds all secrets of the secrets directory to the kernel
+// keyring, so layers encrypted with those can be mounted after the host
+// restarted, before any layer is created with a reference to those.
+func (d *Driver) preloadSecrets(dir string) {
+	provider := d.secrets[fileSecretPrefix]
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("Loading secrets from %s, err %v\n", dir, err)
+		return
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || validateSecretName(f.Name()) != nil {
+			continue
+		}
+		ref := fileSecretPrefix + f.Name()
+		if err := d.loadSecret(provider, ref, f.Name()); err != nil {
+			logrus.Warnf("Loading secret %s, err %v", f.Name(), err)
+		}
+	}
+}
+
+// validateSecretName checks the name of a secret of a provider is a plain
+// name, which fits in the description of a key with the prefixes.
+func validateSecretName(name string) error {
+	if err := validateID(name); err != nil {
+		return err
+	}
+	if len(providerKeyDesc(helperSecretPrefix+name)) > maxKeyRefLength {
+		return nameTooLong(name, maxKeyRefLength-
+			len(providerKeyDesc(helperSecretPrefix)))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestIsRawKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xa5}, encryptionKeySize)
+	for _, val := range []string{hex.EncodeToString(key),
+		hex.EncodeToString(key[:32]), base64.StdEncoding.EncodeToString(key),
+		base64.RawURLEncoding.EncodeToString(key[:32])} {
+		if !isRawKey(val) {
+			t.Errorf("key %q not detected", val)
+		}
+		opts := map[string]string{"encryption.key": val}
+		if _, err := parseLayerOptions(opts); err == nil {
+			t.Errorf("key %q accepted as a reference", val)
+		}
+	}
+	for _, val := range []string{"lcfs:tenant", "missing", "file:tenant-a",
+		"helper:prod.db"} {
+		if isRawKey(val) {
+			t.Errorf("reference %q taken for a key", val)
+		}
+	}
+}
+
+func TestResolveKey(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "lcfs-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := bytes.Repeat([]byte{0x5a}, encryptionKeySize)
+	if err := ioutil.WriteFile(path.Join(dir, "tenant"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	helper := path.Join(dir, "helper.sh")
+	script := "#!/bin/sh\n[ \"$1\" = prod ] && echo " + hex.EncodeToString(key) +
+		" && exit 0\necho unknown secret $1 >&2; exit 1\n"
+	if err := ioutil.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	keyring := make(map[string][]byte)
+	d.keyring = 42
+	addKey = func(ring int, desc string, key []byte) error {
+		if ring != 42 {
+			t.Errorf("key %s added to keyring %d", desc, ring)
+		}
+		keyring[desc] = append([]byte(nil), key...)
+		return nil
+	}
+	defer func() { addKey = keyringAddKey }()
+	d.secrets = newSecretProviders(&driverOptions{SecretsDir: dir,
+		SecretHelper: helper})
+
+	createLayers(t, d, fakeLayer{"base", "", false})
+	for ref, desc := range map[string]string{
+		"keyring:tenant": "tenant",
+		"file:tenant":    "lcfs:file:tenant",
+		"helper:prod":    "lcfs:helper:prod",
+	} {
+		id := strings.Replace(ref, ":", "-", 1)
+		opts := map[string]string{"encryption.key": ref}
+		if err := d.CreateReadWrite(id, "base", "", opts); err != nil {
+			t.Fatalf("layer with key %s not created: %v", ref, err)
+		}
+		if f.keys[id] != desc {
+			t.Errorf("layer with key %s encrypted with %q", ref, f.keys[id])
+		}
+		if desc != "tenant" && !bytes.Equal(keyring[desc], key) {
+			t.Errorf("key %s not added to the keyring", ref)
+		}
+	}
+
+	for _, ref := range []string{"file:missing", "helper:missing",
+		"file:../tenant"} {
+		opts := map[string]string{"encryption.key": ref}
+		if err := d.CreateReadWrite("invalid", "base", "", opts); err == nil {
+			t.Errorf("layer created with key %s", ref)
+		}
+	}
+
+	// Secrets of the directory are loaded at start
+	keyring = make(map[string][]byte)
+	d.preloadSecrets(dir)
+	if !bytes.Equal(keyring["lcfs:file:tenant"], key) || len(keyring) != 1 {
+		t.Errorf("unexpected keys loaded %v", keyring)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// First line of a send stream, naming the format and its version
+const sendStreamMagic = "lcfs-send-1\n"
+
+// Longest header of a send stream
+const maxSendHeaderSize = 64 * 1024
+
+// sendHeader follows the first line of a send stream, as a line of JSON,
+// describing the snapshot sent and the layer its changes are relative to,
+// the layer of an older snapshot of the same layer for an incremental stream,
+// or the parent of the layer of the snapshot.  The changes follow the header
+// as a gzip compressed tar archive, like diffs of layers pushed.
+type sendHeader struct {
+	Snapshot *snapshotRecord `json:"snapshot"`
+	Base     string          `json:"base,omitempty"`
+}
+
+// Writes the changes of a layer relative to base compressed, replaced by tests
+var sendChanges = (*Driver).writeCompressedDiff
+
+// Applies changes received compressed to a layer created from base, replaced
+// by tests
+var receiveChanges = (*Driver).receiveChanges
+
+// receiveChanges decompresses changes received and applies those to a layer.
+func (d *Driver) receiveChanges(id, base string, r io.Reader) error {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	if _, err := d.ApplyDiff(id, base, z); err != nil {
+		return err
+	}
+
+	// Read the end of the stream, so a stream corrupted or cut short fails
+	_, err = io.Copy(ioutil.Discard, z)
+	return err
+}
+
+// Send writes a stream of a snapshot to w, to be received by another host.
+// The stream holds the changes of the snapshot relative to an older snapshot
+// of the same layer the other host received before if since is given, or
+// relative to the parent of the layer of the snapshot.  Snapshots of a layer
+// sent one after another since the previous one transfer only files changed
+// in between, like zfs send -i.
+func (d *Driver) Send(w io.Writer, ref, since string) (err error) {
+	logrus.Debugf("Send - snapshot %s since %s", ref, since)
+	defer d.trackOp("Send", ref, since)(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return err
+	}
+	rec, err := s.resolve(ref)
+	if err != nil {
+		return err
+	}
+	hdr := sendHeader{Snapshot: rec, Base: rec.Parent}
+	if since != "" {
+		base, err := s.resolve(since)
+		if err != nil {
+			return err
+		}
+		if base.Layer != rec.Layer || !base.Created.Before(rec.Created) {
+			return fmt.Errorf("lcfs: snapshot %s is not an older snapshot of "+
+				"layer %s", base.Name, rec.Layer)
+		}
+		hdr.Base = base.ID
+	}
+	defer d.layers.lock(rec.ID)()
+	for _, l := range []string{rec.ID, hdr.Base} {
+		if l != "" && !d.Exists(l) {
+			return notFoundError(l)
+		}
+	}
+	data, err := json.Marshal(&hdr)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, sendStreamMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := sendChanges(d, w, rec.ID, hdr.Base); err != nil {
+		return err
+	}
+	logrus.Infof("Sent snapshot %s of layer %s relative to %q", rec.Name,
+		rec.Layer, hdr.Base)
+	return nil
+}
+
+// readSendHeader reads the first line and the header of a send stream.
+func readSendHeader(r *bufio.Reader) (*sendHeader, error) {
+	magic := make([]byte, len(sendStreamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil ||
+		string(magic) != sendStreamMagic {
+		return nil, fmt.Errorf("lcfs: not a send stream")
+	}
+	var line []byte
+	for {
+		part, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("lcfs: reading send stream: %v", err)
+		}
+		line = append(line, part...)
+		if len(line) > maxSendHeaderSize {
+			return nil, fmt.Errorf("lcfs: header of send stream too long")
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	var hdr sendHeader
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		return nil, fmt.Errorf("lcfs: invalid header of send stream: %v", err)
+	}
+	if hdr.Snapshot == nil {
+		return nil, fmt.Errorf("lcfs: send stream without a snapshot")
+	}
+	rec := hdr.Snapshot
+	req := snapshotRequest{Layer: rec.Layer, Parent: hdr.Base, Name: rec.Name,
+		Tags: rec.Tags, Description: rec.Description}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateLayer(rec.ID, hdr.Base); err != nil {
+		return nil, err
+	}
+	return &hdr, nil
+}
+
+// Receive applies a send stream, recording the snapshot sent with the same
+// id, name, tags and description as a read-only layer created from the base
+// of the stream, which has to be present, as received before for an
+// incremental stream.  Base replaces the base of a stream sent relative to
+// the parent of a layer, with a layer of the same image, as ids of layers of
+// images differ between hosts.
+func (d *Driver) Receive(r io.Reader, base string) (_ *snapshotRecord, err error) {
+	logrus.Debugf("Receive - base %s", base)
+	defer d.trackOp("Receive", "", base)(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(r)
+	hdr, err := readSendHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	rec := *hdr.Snapshot
+	if hdr.Base != rec.Parent && base != "" {
+		return nil, fmt.Errorf("lcfs: base of incremental stream of snapshot "+
+			"%s cannot be replaced", rec.Name)
+	}
+	if base == "" {
+		base = hdr.Base
+	}
+	if base != "" && !d.Exists(base) {
+		return nil, fmt.Errorf("lcfs: base %s of snapshot %s not found, "+
+			"receive the snapshot sent before first", base, rec.Name)
+	}
+	rec.Parent = base
+	rec.Policy = ""
+	if err := s.reserve(&rec); err != nil {
+		return nil, err
+	}
+	if err := d.receiveSnapshot(&rec, base, br); err != nil {
+		s.drop(rec.ID)
+		return nil, err
+	}
+	logrus.Infof("Received snapshot %s of layer %s as %s", rec.Name, rec.Layer,
+		rec.ID)
+	c := rec
+	return &c, nil
+}
+
+// receiveSnapshot creates the layer of a snapshot received and records it.
+func (d *Driver) receiveSnapshot(rec *snapshotRecord, base string,
+	r io.Reader) error {
+	if err := d.Create(rec.ID, base, "", nil); err != nil {
+		return err
+	}
+	err := receiveChanges(d, rec.ID, base, r)
+	if err == nil {
+		err = d.snapshots.commit(rec)
+	}
+	if err != nil {
+		if rerr := d.Remove(rec.ID); rerr != nil {
+			logrus.Errorf("Removing snapshot layer %s, err %v\n", rec.ID, rerr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSendReceive(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(f.home + "/snapshots")
+	received := make(map[string]string)
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	sendChanges = func(d *Driver, w io.Writer, id, base string) error {
+		_, err := fmt.Fprintf(w, "changes of %s relative to %s", id, base)
+		return err
+	}
+	receiveChanges = func(d *Driver, id, base string, r io.Reader) error {
+		data, err := ioutil.ReadAll(r)
+		received[id] = string(data)
+		return err
+	}
+	defer func() {
+		copyChanges = (*Driver).copyChanges
+		sendChanges = (*Driver).writeCompressedDiff
+		receiveChanges = (*Driver).receiveChanges
+	}()
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	var recs []*snapshotRecord
+	for _, name := range []string{"first", "second"} {
+		rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+
+	var full, incremental bytes.Buffer
+	if err := d.Send(&full, "first", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Send(&incremental, "second", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Send(ioutil.Discard, "first", "second"); err == nil {
+		t.Error("sent snapshot relative to a newer one")
+	}
+	for _, rec := range recs {
+		if err := d.RemoveSnapshot(rec.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Incremental streams need the snapshot sent before
+	if _, err := d.Receive(bytes.NewReader(incremental.Bytes()), ""); err == nil {
+		t.Fatal("received incremental stream without its base")
+	}
+	if _, err := d.Receive(strings.NewReader("not a stream\n"), ""); err == nil {
+		t.Fatal("received invalid stream")
+	}
+	first, err := d.Receive(&full, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.Receive(&incremental, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != recs[0].ID || second.ID != recs[1].ID ||
+		second.Name != "second" || second.Layer != "rw" {
+		t.Errorf("unexpected snapshots received %+v %+v", first, second)
+	}
+	if f.parents[first.ID] != "base" || f.parents[second.ID] != first.ID {
+		t.Errorf("snapshots received created from %q and %q",
+			f.parents[first.ID], f.parents[second.ID])
+	}
+	expected := fmt.Sprintf("changes of %s relative to %s", second.ID, first.ID)
+	if received[second.ID] != expected {
+		t.Errorf("received %q, expected %q", received[second.ID], expected)
+	}
+	if rec, err := d.LookupSnapshot("second"); err != nil || rec.ID != second.ID {
+		t.Errorf("snapshot received not recorded, err %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Storage option shifting user and group ids of a layer, as "uid:gid" or a
+// single shift for both
+const shiftStorageOpt = "shift"
+
+// parseShift parses the value of the shift storage option.
+func parseShift(val string) (uid, gid uint32, err error) {
+	parts := strings.Split(val, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("lcfs: invalid shift %q", val)
+	}
+	shifts := make([]uint32, len(parts))
+	for i, p := range parts {
+		shift, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("lcfs: invalid shift %q", val)
+		}
+		shifts[i] = uint32(shift)
+	}
+	if len(shifts) == 1 {
+		return shifts[0], shifts[0], nil
+	}
+	return shifts[0], shifts[1], nil
+}
+
+// shiftLayer makes the file system present user and group ids of files in a
+// layer just created shifted, as for a container in a user namespace.  Files
+// shared with the parent are not changed, so this takes the same time however
+// large the parent is, instead of walking the files and changing the owner of
+// each.  Ids set in the layer are shifted back when stored.
+func (d *Driver) shiftLayer(id string, uid, gid uint32) error {
+	buf := make([]byte, 0, len(id)+24)
+	buf = append(buf, id...)
+	buf = append(buf, 0)
+	buf = append(buf, fmt.Sprintf("%d:%d", uid, gid)...)
+	buf = append(buf, 0)
+	err := d.ioctlBuffer(LayerShift, buf)
+	if err == unix.ENOSYS || err == unix.ENOTTY {
+		return fmt.Errorf("lcfs: file system does not support shifting ids: %v",
+			err)
+	}
+	return err
+}
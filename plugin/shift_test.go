@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseShift(t *testing.T) {
+	for _, c := range []struct {
+		val      string
+		uid, gid uint32
+		valid    bool
+	}{
+		{"100000", 100000, 100000, true},
+		{"100000:200000", 100000, 200000, true},
+		{"0:0", 0, 0, true},
+		{"", 0, 0, false},
+		{"-1", 0, 0, false},
+		{"1:2:3", 0, 0, false},
+		{"4294967296", 0, 0, false},
+	} {
+		uid, gid, err := parseShift(c.val)
+		if (err == nil) != c.valid || uid != c.uid || gid != c.gid {
+			t.Errorf("shift %q parsed as %d:%d, err %v", c.val, uid, gid, err)
+		}
+	}
+}
+
+func TestShiftLayer(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	opts := map[string]string{"shift": "100000:100000"}
+	if err := d.CreateReadWrite("rw", "base", "", opts); err != nil {
+		t.Fatal(err)
+	}
+	if f.shifts["rw"] != "100000:100000" || f.shifts["base"] != "" {
+		t.Errorf("unexpected shifts %v", f.shifts)
+	}
+	if err := d.CreateReadWrite("bad", "base", "", map[string]string{"shift": "x"}); err == nil {
+		t.Errorf("layer created with invalid shift")
+	}
+
+	// Layers failing to be shifted are removed
+	ioctlSyscall = func(op uintptr, buf []byte) error {
+		if int(op&0xff) == LayerShift {
+			return unix.ENOSYS
+		}
+		return f.ioctl(op, buf)
+	}
+	if err := d.CreateReadWrite("unshifted", "base", "", opts); err == nil {
+		t.Errorf("layer created without shifting ids")
+	}
+	if _, ok := f.parents["unshifted"]; ok || f.parents["bad"] != "" {
+		t.Errorf("layers failing to be shifted left behind")
+	}
+}
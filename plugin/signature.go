@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of the message signed for a layer, followed by the Merkle root of
+// the diff applied to the layer
+const signaturePrefix = "lcfs-layer-v1\n"
+
+// layerSignature is a signature of the diff applied to a layer, by the
+// trusted key with the name.
+type layerSignature struct {
+	Key       string `json:"key"`
+	Signature string `json:"signature"`
+}
+
+// signatureError is returned when mounting a layer not signed by a trusted
+// key, or when recording a signature which does not verify.
+type signatureError struct {
+	id     string
+	reason string
+}
+
+func (e *signatureError) Error() string {
+	return fmt.Sprintf("lcfs: layer %s %s", e.id, e.reason)
+}
+
+// loadTrustedKeys reads ed25519 public keys trusted to sign layers from a
+// file, a name and a base64 encoded key per line.  Empty lines and lines
+// starting with '#' are ignored.
+func loadTrustedKeys(file string) (map[string]ed25519.PublicKey, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(map[string]ed25519.PublicKey)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("lcfs: %s:%d: expected a name and a key",
+				file, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("lcfs: %s:%d: invalid ed25519 public key %q",
+				file, n, fields[0])
+		}
+		keys[fields[0]] = ed25519.PublicKey(key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("lcfs: no trusted keys in %s", file)
+	}
+	return keys, nil
+}
+
+// signedMessage returns the message signed for a diff with the Merkle root.
+// Layer ids are not signed, as those differ between hosts, while the same
+// diff has the same root anywhere.
+func signedMessage(root string) []byte {
+	return []byte(signaturePrefix + root)
+}
+
+// checkSignature verifies a signature of a diff with the Merkle root.
+func (t *integrity) checkSignature(id, root string, sig layerSignature) error {
+	key, ok := t.keys[sig.Key]
+	if !ok {
+		return &signatureError{id, fmt.Sprintf("signed by unknown key %q",
+			sig.Key)}
+	}
+	data, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil || !ed25519.Verify(key, signedMessage(root), data) {
+		return &signatureError{id, fmt.Sprintf("signature by key %q invalid",
+			sig.Key)}
+	}
+	return nil
+}
+
+// attested checks that the diff applied to a layer carries a valid signature
+// by a trusted key.  Layers created without a diff are not checked, as the
+// contents of those are not imported.
+func (t *integrity) attested(id string, rec *integrityRecord) error {
+	if t.keys == nil || rec.Root == "" {
+		return nil
+	}
+	for _, sig := range rec.Signatures {
+		if t.checkSignature(id, rec.Root, sig) == nil {
+			return nil
+		}
+	}
+	return &signatureError{id, "not signed by a trusted key"}
+}
+
+// layerRecord returns the record of the diff applied to a layer to be signed.
+func (d *Driver) layerRecord(id string) (*integrityRecord, error) {
+	t := d.integrity
+	if t == nil || t.keys == nil {
+		return nil, fmt.Errorf("lcfs: layer signatures not enabled")
+	}
+	rec, err := t.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil || rec.Root == "" {
+		return nil, &signatureError{id, "has no diff recorded"}
+	}
+	return rec, nil
+}
+
+// signLayer records a signature of the diff applied to a layer, after
+// verifying it, replacing any recorded before by the same key.
+func (d *Driver) signLayer(id string, sig layerSignature) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	defer d.layers.lock(id)()
+	rec, err := d.layerRecord(id)
+	if err != nil {
+		return err
+	}
+	t := d.integrity
+	if err := t.checkSignature(id, rec.Root, sig); err != nil {
+		return err
+	}
+	sigs := []layerSignature{sig}
+	for _, s := range rec.Signatures {
+		if s.Key != sig.Key {
+			sigs = append(sigs, s)
+		}
+	}
+	rec.Signatures = sigs
+	return t.store(id, rec)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// signDiff returns a signature of a layer by a key.
+func signDiff(t *testing.T, it *integrity, id, name string,
+	key ed25519.PrivateKey) layerSignature {
+	rec, err := it.load(id)
+	if err != nil || rec == nil {
+		t.Fatalf("no record of layer %s, err %v", id, err)
+	}
+	sig := ed25519.Sign(key, signedMessage(rec.Root))
+	return layerSignature{name, base64.StdEncoding.EncodeToString(sig)}
+}
+
+func TestSignature(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "lcfs-signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pub, key, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	keys := path.Join(dir, "keys")
+	err = ioutil.WriteFile(keys, []byte(fmt.Sprintf("# Release key\nrelease %s\n",
+		base64.StdEncoding.EncodeToString(pub))), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.integrity, err = newIntegrity(path.Join(dir, "records"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.integrity.keys, err = loadTrustedKeys(keys)
+	if err != nil || len(d.integrity.keys) != 1 {
+		t.Fatalf("unexpected keys %v, err %v", d.integrity.keys, err)
+	}
+	createLayers(t, d, fakeLayer{"base", "", false})
+	applyIntegrityDiff(t, d.integrity, "base", "", path.Join(f.home, "base"),
+		map[string]string{"a": "alpha"})
+	createLayers(t, d, fakeLayer{"rw", "base", true})
+
+	// Layers not signed are not mounted
+	_, err = d.Get("rw", "")
+	if e, ok := err.(*opError); !ok {
+		t.Fatalf("layer not signed mounted, err %v", err)
+	} else if _, ok := e.err.(*signatureError); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+	if f.mounts["rw"] != 0 || f.mounts["base"] != 0 {
+		t.Errorf("layers left mounted %v", f.mounts)
+	}
+
+	// Signatures by keys not trusted or of other diffs are refused
+	if err := d.signLayer("base", signDiff(t, d.integrity, "base", "release",
+		other)); err == nil {
+		t.Errorf("signature by another key recorded")
+	}
+	if err := d.signLayer("base", signDiff(t, d.integrity, "base", "other",
+		key)); err == nil {
+		t.Errorf("signature by unknown key recorded")
+	}
+	if err := d.signLayer("rw", signDiff(t, d.integrity, "base", "release",
+		key)); err == nil {
+		t.Errorf("signature of layer without a diff recorded")
+	}
+
+	if err := d.signLayer("base", signDiff(t, d.integrity, "base", "release",
+		key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatalf("layer signed not mounted: %v", err)
+	}
+	if err := d.Put("rw"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Layers without a record, as created before enabling verification, are
+	// not mounted either
+	d.integrity.forget("base")
+	_, err = d.Get("rw", "")
+	if e, ok := err.(*opError); !ok {
+		t.Fatalf("layer without a record mounted, err %v", err)
+	} else if _, ok := e.err.(*signatureError); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestLoadTrustedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, content := range []string{"", "# none\n", "release\n",
+		"release bm90IGEga2V5\n", "release !\n"} {
+		file := path.Join(dir, "keys")
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadTrustedKeys(file); err == nil {
+			t.Errorf("keys %q loaded", content)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Suffix of files of snapshot records
+const snapshotRecordSuffix = ".json"
+
+// Longest name or tag of a snapshot, and description
+const (
+	maxSnapshotNameLength        = 128
+	maxSnapshotDescriptionLength = 1024
+)
+
+// snapshotRecord describes a snapshot of a layer, a read-only layer created
+// from the parent of the layer with the changes of the layer applied, and
+// the name, tags and description it is found by.
+type snapshotRecord struct {
+	ID          string    `json:"id"`
+	Layer       string    `json:"layer"`
+	Parent      string    `json:"parent,omitempty"`
+	Name        string    `json:"name"`
+	Tags        []string  `json:"tags,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+
+	// Set if taken of the layer mounted
+	Online bool `json:"online,omitempty"`
+
+	// Snapshot policy taking the snapshot, if any
+	Policy string `json:"policy,omitempty"`
+
+	// Group of snapshots taken with the snapshot, if any
+	Group string `json:"group,omitempty"`
+
+	// Set while the layer of the snapshot is being created
+	pending bool
+}
+
+// snapshotRequest describes a snapshot to be taken of a layer.  The parent
+// defaults to the parent the layer was created from, if known.  Layers
+// mounted are snapshotted only if online is set.
+type snapshotRequest struct {
+	Layer       string   `json:"layer"`
+	Parent      string   `json:"parent,omitempty"`
+	Name        string   `json:"name"`
+	Tags        []string `json:"tags,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Online      bool     `json:"online,omitempty"`
+
+	// Snapshot policy taking the snapshot
+	policy string
+}
+
+// snapshotStore records snapshots of layers in dir, a file per snapshot.
+// Names and tags of snapshots are unique, a tag given to a snapshot is taken
+// from any other snapshot, so a tag like "pre-upgrade" always names the
+// latest snapshot tagged so.
+type snapshotStore struct {
+	dir string
+
+	lock    sync.Mutex
+	records map[string]*snapshotRecord
+
+	// Layers rolled back to a snapshot, and the layer of the snapshot
+	rollbacks map[string]string
+
+	// Labels of layers matched by snapshot policies
+	labels map[string]map[string]string
+}
+
+// openSnapshotStore loads the snapshots recorded in dir.
+func openSnapshotStore(dir string) (*snapshotStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshotStore{dir: dir, records: make(map[string]*snapshotRecord)}
+	if err := s.loadRollbacks(); err != nil {
+		return nil, err
+	}
+	if err := s.loadLabels(); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), snapshotRecordSuffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var rec snapshotRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			logrus.Warnf("Ignoring snapshot record %s, err %v", f.Name(), err)
+			continue
+		}
+		s.records[rec.ID] = &rec
+	}
+	return s, nil
+}
+
+// write stores a record, replacing the file atomically.
+func (s *snapshotStore) write(rec *snapshotRecord) error {
+	return s.writeFile(rec.ID+snapshotRecordSuffix, rec)
+}
+
+// writeFile stores a value as JSON in a file of the directory, replacing the
+// file atomically.
+func (s *snapshotStore) writeFile(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// reserve adds a snapshot being taken, failing if its name is taken.
+func (s *snapshotStore) reserve(rec *snapshotRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range s.records {
+		if r.Name == rec.Name {
+			return snapshotExistsError(rec.Name)
+		}
+	}
+	rec.pending = true
+	s.records[rec.ID] = rec
+	return nil
+}
+
+// commit records a snapshot taken, taking its tags from other snapshots.
+func (s *snapshotStore) commit(rec *snapshotRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	rec.pending = false
+	for _, r := range s.records {
+		if r == rec || !r.hasTag(rec.Tags...) {
+			continue
+		}
+		tags := r.Tags[:0:0]
+		for _, t := range r.Tags {
+			if !rec.hasTag(t) {
+				tags = append(tags, t)
+			}
+		}
+		r.Tags = tags
+		if err := s.write(r); err != nil {
+			logrus.Errorf("Updating tags of snapshot %s, err %v\n", r.ID, err)
+		}
+	}
+	return nil
+}
+
+// drop forgets a snapshot, removing its record.
+func (s *snapshotStore) drop(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.records, id)
+	err := os.Remove(path.Join(s.dir, id+snapshotRecordSuffix))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// promote records a snapshot moved to another layer created from no parent.
+func (s *snapshotStore) promote(id, layer string) (*snapshotRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rec := s.records[id]
+	if rec == nil {
+		return nil, snapshotNotFoundError(id)
+	}
+	c := *rec
+	c.ID = layer
+	c.Parent = ""
+	if err := s.write(&c); err != nil {
+		return nil, err
+	}
+	delete(s.records, id)
+	s.records[layer] = &c
+	if err := os.Remove(path.Join(s.dir, id+snapshotRecordSuffix)); err != nil {
+		logrus.Errorf("Removing record of snapshot %s, err %v\n", id, err)
+	}
+	p := c
+	return &p, nil
+}
+
+// parentOf returns the layer the layer of a snapshot was created from, and
+// false if the layer is not of a snapshot.
+func (s *snapshotStore) parentOf(id string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rec := s.records[id]
+	if rec == nil {
+		return "", false
+	}
+	return rec.Parent, true
+}
+
+// resolve returns the snapshot with the id, name or tag.
+func (s *snapshotStore) resolve(ref string) (*snapshotRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if rec := s.records[ref]; rec != nil && !rec.pending {
+		c := *rec
+		return &c, nil
+	}
+	for _, match := range []func(*snapshotRecord) bool{
+		func(r *snapshotRecord) bool { return r.Name == ref },
+		func(r *snapshotRecord) bool { return r.hasTag(ref) },
+	} {
+		for _, rec := range s.records {
+			if !rec.pending && match(rec) {
+				c := *rec
+				return &c, nil
+			}
+		}
+	}
+	return nil, snapshotNotFoundError(ref)
+}
+
+// list returns snapshots of a layer, or tagged with tag, or all of those if
+// both are empty, oldest first.
+func (s *snapshotStore) list(layer, tag string) []*snapshotRecord {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	recs := make([]*snapshotRecord, 0, len(s.records))
+	for _, rec := range s.records {
+		if rec.pending || (layer != "" && rec.Layer != layer) ||
+			(tag != "" && !rec.hasTag(tag)) {
+			continue
+		}
+		c := *rec
+		recs = append(recs, &c)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Created.Equal(recs[j].Created) {
+			return recs[i].ID < recs[j].ID
+		}
+		return recs[i].Created.Before(recs[j].Created)
+	})
+	return recs
+}
+
+// hasTag checks if a snapshot is tagged with any of the tags.
+func (r *snapshotRecord) hasTag(tags ...string) bool {
+	for _, t := range r.Tags {
+		for _, tag := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// snapshotNotFoundError returns the error of a snapshot not found.
+func snapshotNotFoundError(ref string) error {
+	return &layerError{syscall.ENOENT, os.ErrNotExist,
+		fmt.Sprintf("lcfs: snapshot %s not found", ref)}
+}
+
+// snapshotExistsError returns the error of a name of a snapshot taken.
+func snapshotExistsError(name string) error {
+	return &layerError{syscall.EEXIST, os.ErrExist,
+		fmt.Sprintf("lcfs: snapshot %s already exists", name)}
+}
+
+// validateSnapshotName checks a name or tag of a snapshot, restricted like
+// ids of layers.
+func validateSnapshotName(kind, name string) error {
+	if len(name) > maxSnapshotNameLength || validateID(name) != nil {
+		return fmt.Errorf("lcfs: invalid snapshot %s %q, expected up to %d "+
+			"letters, digits, '_', '.' and '-' starting with a letter or a "+
+			"digit", kind, name, maxSnapshotNameLength)
+	}
+	return nil
+}
+
+// validate checks a request for a snapshot.
+func (r *snapshotRequest) validate() error {
+	if err := validateLayer(r.Layer, r.Parent); err != nil {
+		return err
+	}
+	if err := validateSnapshotName("name", r.Name); err != nil {
+		return err
+	}
+	for _, t := range r.Tags {
+		if err := validateSnapshotName("tag", t); err != nil {
+			return err
+		}
+	}
+	if len(r.Description) > maxSnapshotDescriptionLength {
+		return fmt.Errorf("lcfs: snapshot description longer than %d bytes",
+			maxSnapshotDescriptionLength)
+	}
+	return nil
+}
+
+// newLayerID returns a random id for a layer created by the driver, like the
+// ids Docker generates for layers.
+func newLayerID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Copies the changes of a layer relative to parent to the layer of a
+// snapshot created from parent, replaced by tests
+var copyChanges = (*Driver).copyChanges
+
+// copyChanges applies the changes of a layer relative to parent, as exported
+// for docker commit, to a layer created from parent.
+func (d *Driver) copyChanges(id, layer, parent string) error {
+	diff := d.Diff(layer, parent)
+	if diff == nil {
+		return fmt.Errorf("lcfs: exporting changes of layer %s failed", layer)
+	}
+	defer diff.Close()
+	_, err := d.ApplyDiff(id, parent, diff)
+	return err
+}
+
+// snapshotsEnabled returns the store of snapshots, failing if not configured.
+func (d *Driver) snapshotsEnabled() (*snapshotStore, error) {
+	if d.snapshots == nil {
+		return nil, fmt.Errorf("lcfs: snapshots not enabled, set snapshot_dir")
+	}
+	return d.snapshots, nil
+}
+
+// Snapshot takes a snapshot of a layer not mounted, like the writable layer
+// of a stopped container, as a read-only layer created from the parent of the
+// layer with the changes of the layer copied to it.  Layers snapshotted are
+// not changed, and snapshots remain when those are removed.  Layers mounted
+// are snapshotted if requested online, with the processes using those frozen
+// and data written committed first, so the snapshot is consistent like the
+// layer after a crash.
+func (d *Driver) Snapshot(req *snapshotRequest) (_ *snapshotRecord, err error) {
+	logrus.Debugf("Snapshot - layer %s name %s", req.Layer, req.Name)
+	defer d.trackOp("Snapshot", req.Layer, req.Parent)(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	parent := req.Parent
+	if parent == "" {
+		parent = d.known.parentOf(req.Layer)
+	}
+	id, err := newLayerID()
+	if err != nil {
+		return nil, err
+	}
+	rec := &snapshotRecord{
+		ID:          id,
+		Layer:       req.Layer,
+		Parent:      parent,
+		Name:        req.Name,
+		Tags:        req.Tags,
+		Description: req.Description,
+		Online:      req.Online,
+		Policy:      req.policy,
+		Created:     time.Now().UTC(),
+	}
+	if err := s.reserve(rec); err != nil {
+		return nil, err
+	}
+	err = d.takeSnapshot(rec)
+	if err != nil {
+		s.drop(id)
+		return nil, err
+	}
+	logrus.Infof("Snapshot %s of layer %s taken as %s", rec.Name, rec.Layer, id)
+	c := *rec
+	return &c, nil
+}
+
+// takeSnapshot creates the layer of a snapshot reserved and records it.
+func (d *Driver) takeSnapshot(rec *snapshotRecord) error {
+	unlock := d.layers.lock(rec.Layer)
+	defer unlock()
+	if !d.Exists(rec.Layer) {
+		return notFoundError(rec.Layer)
+	}
+	if d.mounts.active(rec.Layer) {
+		if !rec.Online {
+			return mountedError(rec.Layer)
+		}
+		thaw, err := d.quiesce(rec.Layer)
+		if err != nil {
+			return err
+		}
+		defer thaw()
+		if err := d.syncLayers(); err != nil {
+			return err
+		}
+	}
+	if err := d.createSnapshot(rec); err != nil {
+		return err
+	}
+	err := d.snapshots.commit(rec)
+	if err != nil {
+		d.removeSnapshotLayer(rec)
+	}
+	return err
+}
+
+// createSnapshot creates the layer of a snapshot with the changes of the layer
+// snapshotted, removing it if copying those fails.
+func (d *Driver) createSnapshot(rec *snapshotRecord) error {
+	if err := d.Create(rec.ID, rec.Parent, "", nil); err != nil {
+		return err
+	}
+	err := copyChanges(d, rec.ID, rec.Layer, rec.Parent)
+	if err != nil {
+		d.removeSnapshotLayer(rec)
+	}
+	return err
+}
+
+// removeSnapshotLayer removes the layer of a snapshot not taken.
+func (d *Driver) removeSnapshotLayer(rec *snapshotRecord) {
+	if err := d.Remove(rec.ID); err != nil {
+		logrus.Errorf("Removing snapshot layer %s, err %v\n", rec.ID, err)
+	}
+}
+
+// Snapshots lists snapshots of a layer, or tagged with tag, or all of those.
+func (d *Driver) Snapshots(layer, tag string) ([]*snapshotRecord, error) {
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	return s.list(layer, tag), nil
+}
+
+// LookupSnapshot returns the snapshot with the id, name or tag.
+func (d *Driver) LookupSnapshot(ref string) (*snapshotRecord, error) {
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	return s.resolve(ref)
+}
+
+// PromoteSnapshot detaches a snapshot from the parent of its layer, copying
+// all files of the layer to a new layer created from no parent, and removing
+// the layer of the snapshot.  Layers the snapshot was taken of or created from
+// can be removed and their space reclaimed, while the snapshot remains, found
+// by the same name and tags.  Layers rolled back to the snapshot keep the
+// previous layer of the snapshot until removed.
+func (d *Driver) PromoteSnapshot(ref string) (_ *snapshotRecord, err error) {
+	logrus.Debugf("PromoteSnapshot - %s", ref)
+	defer d.trackOp("PromoteSnapshot", ref, "")(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	rec, err := s.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Parent == "" {
+		return rec, nil
+	}
+	id, err := newLayerID()
+	if err != nil {
+		return nil, err
+	}
+	unlock := d.layers.lock(rec.ID)
+	err = d.promoteSnapshot(rec, id)
+	unlock()
+	if err != nil {
+		if rerr := d.Remove(id); rerr != nil {
+			logrus.Errorf("Removing layer %s, err %v\n", id, rerr)
+		}
+		return nil, err
+	}
+	promoted, err := s.promote(rec.ID, id)
+	if err != nil {
+		if rerr := d.Remove(id); rerr != nil {
+			logrus.Errorf("Removing layer %s, err %v\n", id, rerr)
+		}
+		return nil, err
+	}
+	if err := d.Remove(rec.ID); err != nil {
+		logrus.Errorf("Removing previous layer %s of snapshot %s, err %v\n",
+			rec.ID, rec.Name, err)
+	}
+	logrus.Infof("Snapshot %s promoted to layer %s", rec.Name, id)
+	return promoted, nil
+}
+
+// promoteSnapshot copies all files of the layer of a snapshot to a layer
+// created from no parent.
+func (d *Driver) promoteSnapshot(rec *snapshotRecord, id string) error {
+	if !d.Exists(rec.ID) {
+		return fmt.Errorf("lcfs: layer %s of snapshot %s not found", rec.ID,
+			rec.Name)
+	}
+	if err := d.Create(id, "", "", nil); err != nil {
+		return err
+	}
+	return squashChanges(d, id, rec.ID, "")
+}
+
+// RemoveSnapshot removes the snapshot with the id, name or tag, and its layer.
+func (d *Driver) RemoveSnapshot(ref string) (err error) {
+	logrus.Debugf("RemoveSnapshot - %s", ref)
+	defer d.trackOp("RemoveSnapshot", ref, "")(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return err
+	}
+	rec, err := s.resolve(ref)
+	if err != nil {
+		return err
+	}
+	if d.snapshotMounts.using(rec.ID) {
+		return mountedError(rec.ID)
+	}
+	if err := d.Remove(rec.ID); err != nil {
+		return err
+	}
+	return s.drop(rec.ID)
+}
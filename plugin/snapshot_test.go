@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshotStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []*snapshotRecord{
+		{ID: "s1", Layer: "a", Name: "first", Tags: []string{"pre-upgrade", "x"}},
+		{ID: "s2", Layer: "a", Name: "second", Tags: []string{"pre-upgrade"}},
+	} {
+		if err := s.reserve(rec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.resolve(rec.Name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("pending snapshot %s resolved, err %v", rec.Name, err)
+		}
+		if err := s.commit(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.reserve(&snapshotRecord{ID: "s3", Name: "first"}); !errors.Is(err, os.ErrExist) {
+		t.Errorf("name of a snapshot taken twice, err %v", err)
+	}
+
+	// Tags move to the latest snapshot tagged
+	s, err = openSnapshotStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, id := range map[string]string{"s1": "s1", "first": "s1",
+		"x": "s1", "second": "s2", "pre-upgrade": "s2"} {
+		rec, err := s.resolve(ref)
+		if err != nil {
+			t.Errorf("resolving %s: %v", ref, err)
+		} else if rec.ID != id {
+			t.Errorf("%s resolved to %s, expected %s", ref, rec.ID, id)
+		}
+	}
+	if recs := s.list("", "pre-upgrade"); len(recs) != 1 || recs[0].ID != "s2" {
+		t.Errorf("unexpected snapshots with tag %v", recs)
+	}
+	if recs := s.list("a", ""); len(recs) != 2 {
+		t.Errorf("unexpected snapshots of layer %v", recs)
+	}
+	if err := s.drop("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.resolve("pre-upgrade"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("tag of a snapshot removed resolved, err %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(f.home + "/snapshots")
+	var copied []string
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		copied = append(copied, id, layer, parent)
+		return nil
+	}
+	defer func() { copyChanges = (*Driver).copyChanges }()
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "before",
+		Tags: []string{"pre-upgrade"}, Description: "before upgrading"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.parents[rec.ID] != "base" || !d.Exists(rec.ID) {
+		t.Errorf("snapshot layer %s not created from the parent", rec.ID)
+	}
+	if len(copied) != 3 || copied[0] != rec.ID || copied[1] != "rw" ||
+		copied[2] != "base" {
+		t.Errorf("unexpected changes copied %v", copied)
+	}
+	if r, err := d.LookupSnapshot("pre-upgrade"); err != nil || r.ID != rec.ID {
+		t.Errorf("snapshot not found by tag, err %v", err)
+	}
+
+	// Invalid or conflicting requests
+	for _, req := range []*snapshotRequest{
+		{Layer: "rw", Name: "before"},
+		{Layer: "rw", Name: "bad/name"},
+		{Layer: "rw", Name: "other", Tags: []string{""}},
+		{Layer: "missing", Name: "other"},
+	} {
+		if _, err := d.Snapshot(req); err == nil {
+			t.Errorf("snapshot %+v taken", req)
+		}
+	}
+	if recs, _ := d.Snapshots("", ""); len(recs) != 1 {
+		t.Errorf("unexpected snapshots %v", recs)
+	}
+
+	if err := d.RemoveSnapshot("before"); err != nil {
+		t.Fatal(err)
+	}
+	if d.Exists(rec.ID) {
+		t.Error("layer of snapshot removed not removed")
+	}
+	if _, err := d.LookupSnapshot("before"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("snapshot removed found, err %v", err)
+	}
+}
+
+func TestPromoteSnapshot(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(f.home + "/snapshots")
+	var copied []string
+	defer func() {
+		copyChanges = (*Driver).copyChanges
+		squashChanges = (*Driver).squashChanges
+	}()
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	squashChanges = func(d *Driver, id, layer, parent string) error {
+		copied = []string{layer, parent}
+		return nil
+	}
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"rw", "base", true})
+	rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "old",
+		Tags: []string{"keep"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	promoted, err := d.PromoteSnapshot("keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted.ID == rec.ID || promoted.Parent != "" ||
+		f.parents[promoted.ID] != "" {
+		t.Errorf("snapshot not detached %+v", promoted)
+	}
+	if len(copied) != 2 || copied[0] != rec.ID || copied[1] != "" {
+		t.Errorf("unexpected files copied %v", copied)
+	}
+	if d.Exists(rec.ID) {
+		t.Error("previous layer of snapshot not removed")
+	}
+
+	// Found by name and tag once reloaded, base can be removed
+	s, err := openSnapshotStore(f.home + "/snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"old", "keep"} {
+		if r, err := s.resolve(ref); err != nil || r.ID != promoted.ID {
+			t.Errorf("promoted snapshot not found by %s, err %v", ref, err)
+		}
+	}
+	if err := d.Remove("rw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove("base"); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := d.PromoteSnapshot("old"); err != nil ||
+		again.ID != promoted.ID {
+		t.Errorf("snapshot promoted twice, err %v", err)
+	}
+}
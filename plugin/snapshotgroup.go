@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// snapshotGroupLayer is a layer of a group of snapshots, and the parent its
+// snapshot is taken relative to, defaulting to the parent the layer was
+// created from.
+type snapshotGroupLayer struct {
+	Layer  string `json:"layer"`
+	Parent string `json:"parent,omitempty"`
+}
+
+// snapshotGroupRequest describes snapshots to be taken of a set of layers at
+// once, like the writable layers of the containers of an application, named
+// after the group.
+type snapshotGroupRequest struct {
+	Name        string               `json:"name"`
+	Layers      []snapshotGroupLayer `json:"layers"`
+	Description string               `json:"description,omitempty"`
+	Online      bool                 `json:"online,omitempty"`
+}
+
+// validate checks a request for a group of snapshots.
+func (r *snapshotGroupRequest) validate() error {
+	if err := validateSnapshotName("group", r.Name); err != nil {
+		return err
+	}
+	if len(r.Layers) == 0 {
+		return fmt.Errorf("lcfs: no layers in snapshot group %s", r.Name)
+	}
+	seen := make(map[string]bool)
+	for i, l := range r.Layers {
+		req := snapshotRequest{Layer: l.Layer, Parent: l.Parent,
+			Name: groupSnapshotName(r.Name, i), Description: r.Description}
+		if err := req.validate(); err != nil {
+			return err
+		}
+		if seen[l.Layer] {
+			return fmt.Errorf("lcfs: layer %s given twice in snapshot group %s",
+				l.Layer, r.Name)
+		}
+		seen[l.Layer] = true
+	}
+	return nil
+}
+
+// groupSnapshotName returns the name of a snapshot of a group, by the index of
+// its layer in the group.
+func groupSnapshotName(group string, i int) string {
+	return fmt.Sprintf("%s-%d", group, i+1)
+}
+
+// group returns the snapshots of a group, in the order of their layers.
+func (s *snapshotStore) group(name string) []*snapshotRecord {
+	var recs []*snapshotRecord
+	for _, rec := range s.list("", "") {
+		if rec.Group == name {
+			recs = append(recs, rec)
+		}
+	}
+	sort.SliceStable(recs, func(i, j int) bool {
+		return len(recs[i].Name) < len(recs[j].Name) ||
+			(len(recs[i].Name) == len(recs[j].Name) && recs[i].Name < recs[j].Name)
+	})
+	return recs
+}
+
+// SnapshotGroup takes snapshots of a set of layers consistent with each other,
+// named "<group>-1", "<group>-2" and so on in the order of the layers.  All the
+// layers are locked, and the processes using those mounted are frozen together
+// before any change is copied, and thawed once the changes of all are, so the
+// snapshots are of the same point in time, like the layers after a crash.
+// Either all the snapshots are taken or none is.
+func (d *Driver) SnapshotGroup(req *snapshotGroupRequest) (_ []*snapshotRecord, err error) {
+	logrus.Debugf("SnapshotGroup - name %s layers %d", req.Name, len(req.Layers))
+	defer d.trackOp("SnapshotGroup", req.Name, "")(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if len(s.group(req.Name)) > 0 {
+		return nil, snapshotExistsError(req.Name)
+	}
+	created := time.Now().UTC()
+	recs := make([]*snapshotRecord, 0, len(req.Layers))
+	defer func() {
+		if err != nil {
+			for _, rec := range recs {
+				s.drop(rec.ID)
+			}
+		}
+	}()
+	for i, l := range req.Layers {
+		parent := l.Parent
+		if parent == "" {
+			parent = d.known.parentOf(l.Layer)
+		}
+		id, err := newLayerID()
+		if err != nil {
+			return nil, err
+		}
+		rec := &snapshotRecord{
+			ID:          id,
+			Layer:       l.Layer,
+			Parent:      parent,
+			Name:        groupSnapshotName(req.Name, i),
+			Description: req.Description,
+			Online:      req.Online,
+			Group:       req.Name,
+			Created:     created,
+		}
+		if err := s.reserve(rec); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	if err := d.takeSnapshotGroup(recs); err != nil {
+		return nil, err
+	}
+	taken := make([]*snapshotRecord, len(recs))
+	for i, rec := range recs {
+		c := *rec
+		taken[i] = &c
+	}
+	logrus.Infof("Snapshot group %s of %d layers taken", req.Name, len(recs))
+	return taken, nil
+}
+
+// takeSnapshotGroup creates the layers of the snapshots of a group reserved
+// and records those, removing all if any fails.
+func (d *Driver) takeSnapshotGroup(recs []*snapshotRecord) error {
+	// Locked in order, so groups sharing layers do not deadlock
+	layers := make([]string, len(recs))
+	for i, rec := range recs {
+		layers[i] = rec.Layer
+	}
+	sort.Strings(layers)
+	for _, l := range layers {
+		defer d.layers.lock(l)()
+	}
+	mounted := false
+	for _, rec := range recs {
+		if !d.Exists(rec.Layer) {
+			return notFoundError(rec.Layer)
+		}
+		if d.mounts.active(rec.Layer) {
+			if !rec.Online {
+				return mountedError(rec.Layer)
+			}
+			mounted = true
+		}
+	}
+	if mounted {
+		for _, l := range layers {
+			if !d.mounts.active(l) {
+				continue
+			}
+			thaw, err := d.quiesce(l)
+			if err != nil {
+				return err
+			}
+			defer thaw()
+		}
+		if err := d.syncLayers(); err != nil {
+			return err
+		}
+	}
+	var err error
+	for i, rec := range recs {
+		if err = d.createSnapshot(rec); err != nil {
+			recs = recs[:i]
+			break
+		}
+	}
+	if err == nil {
+		for _, rec := range recs {
+			if err = d.snapshots.commit(rec); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		for _, rec := range recs {
+			d.removeSnapshotLayer(rec)
+		}
+	}
+	return err
+}
+
+// SnapshotGroupMembers returns the snapshots of a group.
+func (d *Driver) SnapshotGroupMembers(name string) ([]*snapshotRecord, error) {
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	recs := s.group(name)
+	if len(recs) == 0 {
+		return nil, snapshotNotFoundError(name)
+	}
+	return recs, nil
+}
+
+// RemoveSnapshotGroup removes the snapshots of a group and their layers.
+// Snapshots failing to be removed are kept in the group, and the first error
+// is returned.
+func (d *Driver) RemoveSnapshotGroup(name string) (err error) {
+	logrus.Debugf("RemoveSnapshotGroup - %s", name)
+	defer d.trackOp("RemoveSnapshotGroup", name, "")(&err)
+	recs, err := d.SnapshotGroupMembers(name)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if rerr := d.RemoveSnapshot(rec.ID); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// RollbackGroup reverts each layer of a group of snapshots to its snapshot,
+// restoring the layers of an application to the same point in time.  No layer
+// is rolled back unless all are found and not mounted.
+func (d *Driver) RollbackGroup(name string) (err error) {
+	logrus.Debugf("RollbackGroup - %s", name)
+	defer d.trackOp("RollbackGroup", name, "")(&err)
+	recs, err := d.SnapshotGroupMembers(name)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if !d.Exists(rec.Layer) {
+			return notFoundError(rec.Layer)
+		}
+		if d.mounts.active(rec.Layer) {
+			return mountedError(rec.Layer)
+		}
+		if err := d.checkFrozen(rec.Layer); err != nil {
+			return err
+		}
+	}
+	for _, rec := range recs {
+		if err := d.Rollback(rec.Layer, rec.ID); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Layers of snapshot group %s rolled back", name)
+	return nil
+}
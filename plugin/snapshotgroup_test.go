@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSnapshotGroup(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(f.home + "/snapshots")
+	failing := ""
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		if layer == failing {
+			return fmt.Errorf("copying changes of %s failed", layer)
+		}
+		return nil
+	}
+	defer func() { copyChanges = (*Driver).copyChanges }()
+	createLayers(t, d, fakeLayer{"base", "", false},
+		fakeLayer{"web", "base", true}, fakeLayer{"db", "base", true})
+	req := &snapshotGroupRequest{Name: "app", Description: "nightly",
+		Layers: []snapshotGroupLayer{{Layer: "web"}, {Layer: "db"}}}
+
+	// Nothing remains of a group failing for any layer
+	failing = "db"
+	if _, err := d.SnapshotGroup(req); err == nil {
+		t.Fatal("snapshot group taken with changes failing to be copied")
+	}
+	if recs, _ := d.Snapshots("", ""); len(recs) != 0 {
+		t.Errorf("snapshots of group failing remain %v", recs)
+	}
+	if len(f.parents) != 3 {
+		t.Errorf("layers of snapshots of group failing remain %v", f.parents)
+	}
+	failing = ""
+	if _, err := d.Get("db", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SnapshotGroup(req); !errors.Is(err, errLayerBusy) {
+		t.Errorf("layer mounted snapshotted offline, err %v", err)
+	}
+
+	// Groups are not taken online without the processes using layers
+	// mounted found to be frozen
+	defer func(proc string) { procRoot = proc }(procRoot)
+	procRoot = path.Join(f.home, "proc")
+	online := *req
+	online.Online = true
+	if _, err := d.SnapshotGroup(&online); err == nil {
+		t.Error("snapshot group taken online without processes found")
+	}
+	if recs, _ := d.Snapshots("", ""); len(recs) != 0 {
+		t.Errorf("snapshots of group failing remain %v", recs)
+	}
+	if err := d.Put("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := d.SnapshotGroup(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || recs[0].Name != "app-1" || recs[0].Layer != "web" ||
+		recs[1].Name != "app-2" || recs[1].Layer != "db" ||
+		!recs[0].Created.Equal(recs[1].Created) || recs[1].Group != "app" {
+		t.Errorf("unexpected snapshots of group %+v %+v", recs[0], recs[1])
+	}
+	if _, err := d.SnapshotGroup(req); !errors.Is(err, os.ErrExist) {
+		t.Errorf("snapshot group taken twice, err %v", err)
+	}
+	for _, r := range []*snapshotGroupRequest{
+		{Name: "empty"},
+		{Name: "twice", Layers: []snapshotGroupLayer{{Layer: "web"},
+			{Layer: "web"}}},
+		{Name: "bad/name", Layers: []snapshotGroupLayer{{Layer: "web"}}},
+	} {
+		if _, err := d.SnapshotGroup(r); err == nil {
+			t.Errorf("snapshot group %+v taken", r)
+		}
+	}
+	members, err := d.SnapshotGroupMembers("app")
+	if err != nil || len(members) != 2 || members[0].ID != recs[0].ID {
+		t.Errorf("unexpected snapshots of group %v, err %v", members, err)
+	}
+
+	if err := d.RollbackGroup("app"); err != nil {
+		t.Fatal(err)
+	}
+	if f.parents["web"] != recs[0].ID || f.parents["db"] != recs[1].ID {
+		t.Errorf("layers not rolled back to the group, parents %q %q",
+			f.parents["web"], f.parents["db"])
+	}
+	if err := d.RemoveSnapshotGroup("app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SnapshotGroupMembers("app"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("snapshot group removed found, err %v", err)
+	}
+}
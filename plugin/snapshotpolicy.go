@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Storage option labelling the layer of a container for snapshot policies, as
+// "<key>=<value>[,<key>=<value>]..."
+const labelStorageOpt = "label"
+
+// File of the snapshot directory recording labels of layers
+const snapshotLabelsFile = "labels"
+
+// Longest time between checking snapshot policies for snapshots due
+const snapshotPolicyTick = time.Minute
+
+// Format of the time in names of snapshots taken by policies
+const snapshotPolicyTimeFormat = "20060102T150405Z"
+
+// parseLabels parses labels given as "<key>=<value>[,<key>=<value>]...".
+func parseLabels(val string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, l := range strings.Split(val, ",") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("lcfs: invalid label %q, expected "+
+				"<key>=<value>", l)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, validateLabels(labels)
+}
+
+// validateLabels checks labels can be given as a storage option.
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if k == "" || strings.ContainsAny(k, "=,") || strings.Contains(v, ",") {
+			return fmt.Errorf("lcfs: invalid label %q=%q", k, v)
+		}
+	}
+	return nil
+}
+
+// loadLabels reads the labels of layers.
+func (s *snapshotStore) loadLabels() error {
+	s.labels = make(map[string]map[string]string)
+	data, err := ioutil.ReadFile(path.Join(s.dir, snapshotLabelsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.labels)
+}
+
+// setLabels replaces the labels of a layer, forgetting the layer if labels
+// is empty.
+func (s *snapshotStore) setLabels(id string, labels map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prev, ok := s.labels[id]
+	if !ok && len(labels) == 0 {
+		return nil
+	}
+	if len(labels) == 0 {
+		delete(s.labels, id)
+	} else {
+		s.labels[id] = labels
+	}
+	if err := s.writeFile(snapshotLabelsFile, s.labels); err != nil {
+		if ok {
+			s.labels[id] = prev
+		} else {
+			delete(s.labels, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// labelsOf returns the labels of a layer.
+func (s *snapshotStore) labelsOf(id string) map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	labels := make(map[string]string, len(s.labels[id]))
+	for k, v := range s.labels[id] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// labeled returns the layers with labels, sorted.
+func (s *snapshotStore) labeled() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]string, 0, len(s.labels))
+	for id := range s.labels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// lastTaken returns when the latest snapshot of a layer was taken by a
+// policy, zero if never.
+func (s *snapshotStore) lastTaken(layer, policy string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var last time.Time
+	for _, rec := range s.records {
+		if rec.Layer == layer && rec.Policy == policy &&
+			rec.Created.After(last) {
+			last = rec.Created
+		}
+	}
+	return last
+}
+
+// Labels returns the labels of a layer snapshot policies are matched with.
+func (d *Driver) Labels(id string) (map[string]string, error) {
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	return s.labelsOf(id), nil
+}
+
+// SetLabels replaces the labels of a layer, like those given to the layer of
+// a container with the label storage option when created.
+func (d *Driver) SetLabels(id string, labels map[string]string) error {
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return err
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	defer d.layers.lock(id)()
+	if !d.Exists(id) {
+		return notFoundError(id)
+	}
+	return s.setLabels(id, labels)
+}
+
+// snapshotPolicy snapshots layers with all the labels of its selector every
+// interval.  Layers mounted are snapshotted only if online is set.  Snapshots
+// taken are pruned by the retention rules of the policy.
+type snapshotPolicy struct {
+	name     string
+	selector map[string]string
+	interval time.Duration
+	online   bool
+	keep     retention
+}
+
+// matches checks if a layer with labels is selected by the policy.
+func (p *snapshotPolicy) matches(labels map[string]string) bool {
+	for k, v := range p.selector {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotName returns the name of a snapshot of a layer taken by the policy.
+func (p *snapshotPolicy) snapshotName(layer string, now time.Time) string {
+	return fmt.Sprintf("%s-%.12s-%s", p.name, layer,
+		now.UTC().Format(snapshotPolicyTimeFormat))
+}
+
+// loadSnapshotPolicies reads snapshot policies from a file, a policy per
+// line as "<name> <key>=<value>[,<key>=<value>]... <interval> [online]
+// [<rule>=<value>]...", with rules of retention.  Empty lines and lines
+// starting with '#' are ignored.
+func loadSnapshotPolicies(file string) ([]*snapshotPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var policies []*snapshotPolicy
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseSnapshotPolicy(strings.Fields(line))
+		if err == nil && names[p.name] {
+			err = fmt.Errorf("policy %s defined again", p.name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("lcfs: %s:%d: %v", file, n, err)
+		}
+		names[p.name] = true
+		policies = append(policies, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(policies) == 0 {
+		return nil, fmt.Errorf("lcfs: no snapshot policies in %s", file)
+	}
+	return policies, nil
+}
+
+// parseSnapshotPolicy parses the fields of a line of a policy file.
+func parseSnapshotPolicy(fields []string) (*snapshotPolicy, error) {
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expected <name> <key>=<value>[,...] " +
+			"<interval> [online] [<rule>=<value>]...")
+	}
+	p := &snapshotPolicy{name: fields[0]}
+	if err := validateSnapshotName("policy", p.name); err != nil {
+		return nil, err
+	}
+	if err := validateSnapshotName("name",
+		p.snapshotName(strings.Repeat("0", 12), time.Time{})); err != nil {
+		return nil, fmt.Errorf("policy name %s too long", p.name)
+	}
+	var err error
+	if p.selector, err = parseLabels(fields[1]); err != nil {
+		return nil, err
+	}
+	p.interval, err = time.ParseDuration(fields[2])
+	if err != nil || p.interval < time.Second {
+		return nil, fmt.Errorf("invalid interval %q", fields[2])
+	}
+	for _, f := range fields[3:] {
+		if f == "online" {
+			p.online = true
+			continue
+		}
+		if err := p.keep.parse(f); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// snapshotScheduler takes snapshots of layers selected by snapshot policies
+// in the background, a snapshot of a layer by a policy once the last one is
+// older than the interval of the policy.  Snapshots failing are retried when
+// the policies are checked next.  Snapshots not kept by the retention rules
+// of their policy are removed once snapshots due are taken.
+type snapshotScheduler struct {
+	d        *Driver
+	policies []*snapshotPolicy
+	pruner   *pruner
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newSnapshotScheduler starts taking snapshots by policies.
+func newSnapshotScheduler(d *Driver, policies []*snapshotPolicy) *snapshotScheduler {
+	tick := snapshotPolicyTick
+	for _, p := range policies {
+		if p.interval < tick {
+			tick = p.interval
+		}
+	}
+	s := &snapshotScheduler{
+		d:        d,
+		policies: policies,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.pruner = newPruner(d, policies)
+	go s.run(tick)
+	logrus.Infof("Snapshot policies enabled, %d policies", len(policies))
+	return s
+}
+
+func (s *snapshotScheduler) run(tick time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.check(now)
+			s.pruner.prune(now)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops taking snapshots, waiting for snapshots being taken.
+func (s *snapshotScheduler) close() {
+	close(s.stop)
+	<-s.done
+}
+
+// check takes the snapshots due, returning the number taken.
+func (s *snapshotScheduler) check(now time.Time) int {
+	store := s.d.snapshots
+	taken := 0
+	for _, id := range store.labeled() {
+		labels := store.labelsOf(id)
+		for _, p := range s.policies {
+			if !p.matches(labels) ||
+				now.Sub(store.lastTaken(id, p.name)) < p.interval {
+				continue
+			}
+			select {
+			case <-s.stop:
+				return taken
+			default:
+			}
+			// Layers removed are forgotten by Remove
+			if !s.d.Exists(id) {
+				break
+			}
+			if s.d.mounts.active(id) && !p.online {
+				logrus.Debugf("Snapshot policy %s - layer %s mounted", p.name,
+					id)
+				continue
+			}
+			_, err := s.d.Snapshot(&snapshotRequest{
+				Layer:       id,
+				Name:        p.snapshotName(id, now),
+				Description: "taken by snapshot policy " + p.name,
+				Online:      p.online,
+				policy:      p.name,
+			})
+			if err != nil {
+				logrus.Errorf("Snapshot policy %s - layer %s, err %v\n",
+					p.name, id, err)
+				continue
+			}
+			taken++
+		}
+	}
+	return taken
+}
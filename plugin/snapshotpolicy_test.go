@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLoadSnapshotPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "policies")
+	data := "# name selector interval\nhourly app=db,tier=data 1h online\n\n" +
+		"daily app=web 24h\n"
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	policies, err := loadSnapshotPolicies(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || policies[0].name != "hourly" ||
+		!policies[0].online || policies[1].online ||
+		policies[1].interval != 24*time.Hour ||
+		policies[0].selector["tier"] != "data" {
+		t.Errorf("unexpected policies %+v %+v", policies[0], policies[1])
+	}
+	for _, data := range []string{
+		"hourly app=db 1h\nhourly app=web 1h\n",
+		"hourly app 1h\n",
+		"hourly app=db 1x\n",
+		"hourly app=db 1h offline\n",
+		"-hourly app=db 1h\n",
+		"# nothing\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSnapshotPolicies(file); err == nil {
+			t.Errorf("loaded policies %q", data)
+		}
+	}
+}
+
+func TestSnapshotPolicies(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(f.home + "/snapshots")
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	defer func() { copyChanges = (*Driver).copyChanges }()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	for id, label := range map[string]string{"db": "app=db", "web": "app=web"} {
+		if err := d.CreateReadWrite(id, "base", "",
+			map[string]string{"label": label}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &snapshotScheduler{d: d, policies: []*snapshotPolicy{
+		{name: "hourly", selector: map[string]string{"app": "db"},
+			interval: time.Hour},
+	}}
+
+	now := time.Now()
+	if n := s.check(now); n != 1 {
+		t.Fatalf("%d snapshots taken, expected 1", n)
+	}
+	recs, _ := d.Snapshots("db", "")
+	if len(recs) != 1 || recs[0].Policy != "hourly" {
+		t.Errorf("unexpected snapshots %v", recs)
+	}
+	if n := s.check(now.Add(30 * time.Minute)); n != 0 {
+		t.Errorf("%d snapshots taken before due", n)
+	}
+
+	// Layers mounted are snapshotted by online policies only
+	if _, err := d.Get("db", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.check(now.Add(2 * time.Hour)); n != 0 {
+		t.Errorf("%d snapshots taken of a layer mounted", n)
+	}
+	if err := d.Put("db"); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.check(now.Add(2 * time.Hour)); n != 1 {
+		t.Errorf("%d snapshots taken, expected 1", n)
+	}
+
+	// Labels are replaced, and forgotten with the layer
+	if err := d.SetLabels("web", map[string]string{"app": "db"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.check(now.Add(4 * time.Hour)); n != 2 {
+		t.Errorf("%d snapshots taken, expected 2", n)
+	}
+	if err := d.Remove("web"); err != nil {
+		t.Fatal(err)
+	}
+	d.snapshots, _ = openSnapshotStore(f.home + "/snapshots")
+	if labels, _ := d.Labels("web"); len(labels) != 0 {
+		t.Errorf("labels of a layer removed kept %v", labels)
+	}
+	if labels, _ := d.Labels("db"); labels["app"] != "db" {
+		t.Errorf("labels of a layer not kept %v", labels)
+	}
+}
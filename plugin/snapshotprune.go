@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// retention selects snapshots of a layer taken by a policy to be kept, the
+// latest ones, those taken within a time, and the latest one of each of a
+// number of hours, days, weeks and months with snapshots, as "keep_last=24
+// keep_daily=7".  All snapshots are kept if none is set.
+type retention struct {
+	last    int
+	hourly  int
+	daily   int
+	weekly  int
+	monthly int
+	within  time.Duration
+}
+
+// parse parses a rule of retention given as "<rule>=<value>".
+func (r *retention) parse(rule string) error {
+	kv := strings.SplitN(rule, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("invalid retention rule %q, expected <rule>=<value>",
+			rule)
+	}
+	if kv[0] == "keep_within" {
+		within, err := time.ParseDuration(kv[1])
+		if err != nil || within <= 0 {
+			return fmt.Errorf("invalid duration in %q", rule)
+		}
+		r.within = within
+		return nil
+	}
+	counts := map[string]*int{
+		"keep_last":    &r.last,
+		"keep_hourly":  &r.hourly,
+		"keep_daily":   &r.daily,
+		"keep_weekly":  &r.weekly,
+		"keep_monthly": &r.monthly,
+	}
+	count, ok := counts[kv[0]]
+	if !ok {
+		return fmt.Errorf("unknown retention rule %q", kv[0])
+	}
+	n, err := strconv.Atoi(kv[1])
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid count in %q", rule)
+	}
+	*count = n
+	return nil
+}
+
+// enabled checks if any rule is set.
+func (r *retention) enabled() bool {
+	return r.last > 0 || r.hourly > 0 || r.daily > 0 || r.weekly > 0 ||
+		r.monthly > 0 || r.within > 0
+}
+
+// keeps returns which of the snapshots, newest first, are kept at a time.
+func (r *retention) keeps(recs []*snapshotRecord, now time.Time) []bool {
+	kept := make([]bool, len(recs))
+	for i, rec := range recs {
+		kept[i] = i < r.last || (r.within > 0 && now.Sub(rec.Created) < r.within)
+	}
+	for _, b := range []struct {
+		count  int
+		bucket func(t time.Time) string
+	}{
+		{r.hourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{r.daily, func(t time.Time) string { return t.Format("20060102") }},
+		{r.weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{r.monthly, func(t time.Time) string { return t.Format("200601") }},
+	} {
+		last := ""
+		n := 0
+		for i, rec := range recs {
+			if n == b.count {
+				break
+			}
+			if bucket := b.bucket(rec.Created.UTC()); bucket != last {
+				kept[i] = true
+				last = bucket
+				n++
+			}
+		}
+	}
+	return kept
+}
+
+// pruneStats counts snapshots removed by retention rules, and the space of
+// changes of those.
+type pruneStats struct {
+	Snapshots uint64 `json:"snapshots"`
+	Bytes     uint64 `json:"bytes"`
+}
+
+// add accounts a snapshot removed.
+func (s *pruneStats) add(size int64) {
+	atomic.AddUint64(&s.Snapshots, 1)
+	atomic.AddUint64(&s.Bytes, uint64(size))
+}
+
+// snapshot returns a copy of the counters.
+func (s *pruneStats) snapshot() *pruneStats {
+	return &pruneStats{
+		Snapshots: atomic.LoadUint64(&s.Snapshots),
+		Bytes:     atomic.LoadUint64(&s.Bytes),
+	}
+}
+
+// Returns the size of changes of the layer of a snapshot, replaced by tests
+var snapshotSize = (*Driver).snapshotSize
+
+// snapshotSize returns the size of the changes of the layer of a snapshot,
+// the space freed when the snapshot is removed.
+func (d *Driver) snapshotSize(rec *snapshotRecord) (int64, error) {
+	return d.DiffSize(rec.ID, rec.Parent)
+}
+
+// pruner removes snapshots taken by policies not kept by the retention rules
+// of those.  Snapshots of policies no longer defined are kept.
+type pruner struct {
+	d        *Driver
+	policies map[string]*snapshotPolicy
+	stats    pruneStats
+}
+
+// newPruner returns a pruner of snapshots of policies with retention rules.
+func newPruner(d *Driver, policies []*snapshotPolicy) *pruner {
+	p := &pruner{d: d, policies: make(map[string]*snapshotPolicy)}
+	for _, policy := range policies {
+		if policy.keep.enabled() {
+			p.policies[policy.name] = policy
+		}
+	}
+	return p
+}
+
+// prune removes snapshots not kept at a time, returning the number removed.
+// Snapshots are pruned for each layer and policy, also of layers removed.
+func (p *pruner) prune(now time.Time) int {
+	if len(p.policies) == 0 {
+		return 0
+	}
+	groups := make(map[string][]*snapshotRecord)
+	for _, rec := range p.d.snapshots.list("", "") {
+		if p.policies[rec.Policy] != nil {
+			key := rec.Policy + "/" + rec.Layer
+			groups[key] = append(groups[key], rec)
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	removed := 0
+	for _, key := range keys {
+		recs := groups[key]
+
+		// Newest first
+		for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+			recs[i], recs[j] = recs[j], recs[i]
+		}
+		kept := p.policies[recs[0].Policy].keep.keeps(recs, now)
+		for i, rec := range recs {
+			if kept[i] {
+				continue
+			}
+			size, err := snapshotSize(p.d, rec)
+			if err != nil {
+				logrus.Warnf("Size of snapshot %s not known, err %v", rec.Name,
+					err)
+				size = 0
+			}
+			if err := p.d.RemoveSnapshot(rec.ID); err != nil {
+				logrus.Errorf("Pruning snapshot %s, err %v\n", rec.Name, err)
+				continue
+			}
+			p.stats.add(size)
+			removed++
+			logrus.Infof("Pruned snapshot %s of layer %s, %d bytes", rec.Name,
+				rec.Layer, size)
+		}
+	}
+	return removed
+}
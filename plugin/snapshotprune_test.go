@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	// Snapshots every 6 hours for 10 days, newest first
+	var recs []*snapshotRecord
+	for i := 0; i < 40; i++ {
+		recs = append(recs, &snapshotRecord{
+			Created: now.Add(-time.Duration(i) * 6 * time.Hour)})
+	}
+	for _, c := range []struct {
+		rules    []string
+		expected []int
+	}{
+		{[]string{"keep_last=3"}, []int{0, 1, 2}},
+		{[]string{"keep_within=13h"}, []int{0, 1, 2}},
+		{[]string{"keep_daily=3"}, []int{0, 3, 7}},
+		{[]string{"keep_last=2", "keep_daily=2"}, []int{0, 1, 3}},
+		{[]string{"keep_monthly=2"}, []int{0, 39}},
+	} {
+		var r retention
+		for _, rule := range c.rules {
+			if err := r.parse(rule); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var kept []int
+		for i, k := range r.keeps(recs, now) {
+			if k {
+				kept = append(kept, i)
+			}
+		}
+		if !reflect.DeepEqual(kept, c.expected) {
+			t.Errorf("%v kept %v, expected %v", c.rules, kept, c.expected)
+		}
+	}
+	var r retention
+	for _, rule := range []string{"keep_last", "keep_last=0", "keep_yearly=1",
+		"keep_within=1x"} {
+		if err := r.parse(rule); err == nil {
+			t.Errorf("parsed %q", rule)
+		}
+	}
+	if r.enabled() {
+		t.Error("retention enabled without rules")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(f.home + "/snapshots")
+	snapshotSize = func(d *Driver, rec *snapshotRecord) (int64, error) {
+		return 100, nil
+	}
+	defer func() { snapshotSize = (*Driver).snapshotSize }()
+	now := time.Now().UTC()
+	for i, policy := range []string{"hourly", "hourly", "hourly", "manual"} {
+		id := fmt.Sprintf("s%d", i)
+		if err := d.Create(id, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+		rec := &snapshotRecord{ID: id, Layer: "db", Name: id, Policy: policy,
+			Created: now.Add(-time.Duration(i) * time.Hour)}
+		if err := d.snapshots.reserve(rec); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.snapshots.commit(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := &snapshotPolicy{name: "hourly", interval: time.Hour}
+	policy.keep.last = 2
+	p := newPruner(d, []*snapshotPolicy{policy})
+	if n := p.prune(now); n != 1 {
+		t.Fatalf("%d snapshots pruned, expected 1", n)
+	}
+	var names []string
+	for _, rec := range d.snapshots.list("db", "") {
+		names = append(names, rec.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"s3", "s1", "s0"}) {
+		t.Errorf("unexpected snapshots kept %v", names)
+	}
+	if _, ok := f.parents["s2"]; ok {
+		t.Error("layer of snapshot pruned not removed")
+	}
+	if s := p.stats.snapshot(); s.Snapshots != 1 || s.Bytes != 100 {
+		t.Errorf("unexpected prune stats %+v", s)
+	}
+	if n := p.prune(now); n != 0 {
+		t.Errorf("%d snapshots pruned again", n)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Prefix and suffix of stats snapshot files
+const (
+	statsSnapshotPrefix = "stats-"
+	statsSnapshotSuffix = ".json"
+)
+
+// statsSnapshot is a stats record written to disk.
+type statsSnapshot struct {
+	Time time.Time `json:"time"`
+	driverStats
+}
+
+// statsCollector periodically writes stats of the driver to files in a
+// directory, keeping the given number of most recent files, so history is
+// available for analysis after a crash or when the file system filled up.
+type statsCollector struct {
+	d         *Driver
+	dir       string
+	retention int
+	stop      chan struct{}
+}
+
+// newStatsCollector starts writing stats snapshots every interval.
+func newStatsCollector(d *Driver, dir string, interval time.Duration,
+	retention int) (*statsCollector, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &statsCollector{
+		d:         d,
+		dir:       dir,
+		retention: retention,
+		stop:      make(chan struct{}),
+	}
+	go c.run(interval)
+	logrus.Infof("Writing stats snapshots to %s every %v", dir, interval)
+	return c, nil
+}
+
+func (c *statsCollector) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s, err := c.d.stats()
+			if err == nil {
+				err = c.write(time.Now(), s)
+			}
+			if err != nil {
+				logrus.Errorf("stats snapshot: err %v\n", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// close stops writing snapshots.
+func (c *statsCollector) close() {
+	close(c.stop)
+}
+
+// write writes a snapshot and removes snapshots beyond retention.
+func (c *statsCollector) write(now time.Time, s *driverStats) error {
+	data, err := json.Marshal(&statsSnapshot{Time: now.UTC(), driverStats: *s})
+	if err != nil {
+		return err
+	}
+	name := statsSnapshotPrefix + now.UTC().Format("20060102T150405.000000000Z") +
+		statsSnapshotSuffix
+	tmp := path.Join(c.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(c.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return c.prune()
+}
+
+// prune removes the oldest snapshots beyond retention.
+func (c *statsCollector) prune() error {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), statsSnapshotPrefix) &&
+			strings.HasSuffix(e.Name(), statsSnapshotSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > c.retention {
+		if err := os.Remove(path.Join(c.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
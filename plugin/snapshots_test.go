@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestStatsCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &statsCollector{dir: dir, retention: 2}
+	start := time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		s := &driverStats{Capacity: &capacityStats{Layers: i}}
+		if err := c.write(start.Add(time.Duration(i)*time.Minute), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Name() != "stats-20170501T100200.000000000Z.json" {
+		t.Fatalf("unexpected snapshots %v", entries)
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, entries[1].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s statsSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Time.Equal(start.Add(3*time.Minute)) || s.Capacity.Layers != 3 {
+		t.Errorf("unexpected snapshot %s", data)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// isParent checks if a layer is known to be created from parent in the file
+// system, so the changes the file system tracks for the layer are relative to
+// parent.  Parents of snapshots are recorded and those of layers created since
+// the plugin started remembered, other layers are not assumed to be created
+// from parent, and their changes are found comparing files.
+func (d *Driver) isParent(id, parent string) bool {
+	if p, ok := d.known.createdFrom(id); ok {
+		return p == parent
+	}
+	if d.snapshots != nil {
+		if p, ok := d.snapshots.parentOf(id); ok {
+			return p == parent
+		}
+	}
+	return false
+}
+
+// mayBeParent checks if parent may be the parent of a layer in the file
+// system.  Parents of layers not created since the plugin started are not
+// known, and are assumed to be.
+func (d *Driver) mayBeParent(id, parent string) bool {
+	p, ok := d.known.createdFrom(id)
+	return !ok || p == parent
+}
+
+// checkChain checks layers are each the parent of the next, returning the
+// parent of the first, looked up if not given and known.
+func (d *Driver) checkChain(parent string, ids []string) (string, error) {
+	if parent == "" {
+		parent = d.known.parentOf(ids[0])
+	}
+	below := parent
+	for _, l := range ids {
+		if err := validateLayer(l, below); err != nil {
+			return "", err
+		}
+		if !d.mayBeParent(l, below) {
+			return "", fmt.Errorf("lcfs: layer %s is not a child of %q", l,
+				below)
+		}
+		below = l
+	}
+	return parent, nil
+}
+
+// Copies the changes of a chain of layers ending with top, relative to the
+// parent of the chain, to a layer created from parent, replaced by tests
+var squashChanges = (*Driver).squashChanges
+
+// squashChanges applies the changes of layer relative to parent, comparing
+// the files of both as the file system tracks changes relative to the
+// parent of a layer only.  Files removed by any layer of the chain are
+// removed by the diff only if present in parent, so whiteouts of files added
+// and removed again within the chain are resolved.
+func (d *Driver) squashChanges(id, layer, parent string) error {
+	diff, err := d.driver.Diff(layer, parent)
+	if err != nil {
+		return fmt.Errorf("lcfs: exporting changes of layer %s: %v", layer, err)
+	}
+	defer diff.Close()
+	_, err = d.ApplyDiff(id, parent, diff)
+	return err
+}
+
+// Squash merges a chain of layers, each the parent of the next, into a new
+// read-only layer created from parent, the parent of the first layer, with
+// the files of the last layer.  The parent of the first layer is looked up
+// if not given and known, and is empty for layers of the base of an image.
+// Layers squashed are not changed, the id of the new layer is returned.
+func (d *Driver) Squash(parent string, ids ...string) (id string, err error) {
+	logrus.Debugf("Squash - %d layers parent %s", len(ids), parent)
+	if len(ids) == 0 {
+		return "", fmt.Errorf("lcfs: no layers to squash")
+	}
+	top := ids[len(ids)-1]
+	defer d.trackOp("Squash", top, parent)(&err)
+	parent, err = d.checkChain(parent, ids)
+	if err != nil {
+		return "", err
+	}
+	id, err = newLayerID()
+	if err != nil {
+		return "", err
+	}
+
+	defer d.layers.lock(top)()
+	for _, l := range ids {
+		if !d.Exists(l) {
+			return "", notFoundError(l)
+		}
+	}
+	if d.mounts.active(top) && !d.mounts.isReadOnly(top) {
+		return "", mountedError(top)
+	}
+	if err := d.Create(id, parent, "", nil); err != nil {
+		return "", err
+	}
+	if len(ids) == 1 {
+		err = copyChanges(d, id, top, parent)
+	} else {
+		err = squashChanges(d, id, top, parent)
+	}
+	if err != nil {
+		if rerr := d.Remove(id); rerr != nil {
+			logrus.Errorf("Removing squashed layer %s, err %v\n", id, rerr)
+		}
+		return "", err
+	}
+	logrus.Infof("Squashed %d layers up to %s as %s", len(ids), top, id)
+	return id, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	var copied []string
+	defer func() {
+		copyChanges = (*Driver).copyChanges
+		squashChanges = (*Driver).squashChanges
+	}()
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		copied = []string{"copy", layer, parent}
+		return nil
+	}
+	squashChanges = func(d *Driver, id, layer, parent string) error {
+		copied = []string{"squash", layer, parent}
+		return nil
+	}
+	below := ""
+	for _, id := range []string{"base", "l1", "l2", "l3"} {
+		if err := d.Create(id, below, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		below = id
+	}
+
+	id, err := d.Squash("", "l1", "l2", "l3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.parents[id] != "base" {
+		t.Errorf("squashed layer created from %q", f.parents[id])
+	}
+	if !reflect.DeepEqual(copied, []string{"squash", "l3", "base"}) {
+		t.Errorf("unexpected changes copied %v", copied)
+	}
+	if _, err := d.Squash("", "l2"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(copied, []string{"copy", "l2", "l1"}) {
+		t.Errorf("unexpected changes copied %v", copied)
+	}
+
+	// Chains out of order or with gaps
+	for _, ids := range [][]string{{"l2", "l1"}, {"base", "l2"}, {}} {
+		if _, err := d.Squash("", ids...); err == nil {
+			t.Errorf("squashed %v", ids)
+		}
+	}
+	if _, err := d.Squash("l1", "l3"); err == nil {
+		t.Error("squashed layer onto a parent not its own")
+	}
+}
+
+func TestIsParent(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	if err := d.snapshots.write(&snapshotRecord{ID: "snap", Layer: "rw",
+		Parent: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+
+	// Parents of layers listed at Init are not known, those of snapshots are
+	// recorded, also after a restart
+	d.known.seed([]string{"old", "snap"})
+	d.known.add("new", "old")
+	for _, c := range []struct {
+		id, parent  string
+		expected    bool
+		mayBeParent bool
+	}{
+		{"new", "old", true, true},
+		{"new", "other", false, false},
+		{"old", "any", false, true},
+		{"snap", "old", true, true},
+		{"snap", "older-snap", false, true},
+	} {
+		if d.isParent(c.id, c.parent) != c.expected {
+			t.Errorf("isParent(%s, %s) is not %v", c.id, c.parent, c.expected)
+		}
+		if d.mayBeParent(c.id, c.parent) != c.mayBeParent {
+			t.Errorf("mayBeParent(%s, %s) is not %v", c.id, c.parent,
+				c.mayBeParent)
+		}
+	}
+}
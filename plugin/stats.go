@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/docker/go-units"
+	"golang.org/x/sys/unix"
+)
+
+// capacityStats describes space and inode usage of the lcfs file system.
+type capacityStats struct {
+	TotalBytes  uint64 `json:"total_bytes"`
+	FreeBytes   uint64 `json:"free_bytes"`
+	UsedBytes   uint64 `json:"used_bytes"`
+	TotalInodes uint64 `json:"total_inodes"`
+	FreeInodes  uint64 `json:"free_inodes"`
+	Layers      int    `json:"layers"`
+}
+
+// layerIOStats contains I/O counters of a layer, laid out as struct
+// lc_layerStats in lcfs.h.
+type layerIOStats struct {
+	ReadBytes   uint64 `json:"read_bytes"`
+	WriteBytes  uint64 `json:"write_bytes"`
+	ReadOps     uint64 `json:"read_ops"`
+	WriteOps    uint64 `json:"write_ops"`
+	BlockReads  uint64 `json:"block_reads"`
+	BlockWrites uint64 `json:"block_writes"`
+	Inodes      uint64 `json:"inodes"`
+	DirtyPages  uint64 `json:"dirty_pages"`
+	CacheHits   uint64 `json:"cache_hits"`
+	CacheMisses uint64 `json:"cache_misses"`
+}
+
+// Size of the counters of struct lc_layerStats, and of the struct with the
+// depth of the layer following those
+const (
+	layerIOStatsSize = 10 * 8
+	layerStatsSize   = layerIOStatsSize + 8
+)
+
+// Depth of a layer the file system never returns
+const noDepth = ^uint64(0)
+
+// daemonStats contains resource usage of the file system daemon, laid out as
+// struct lc_daemonStats in lcfs.h.
+type daemonStats struct {
+	ResidentMemory  uint64 `json:"resident_memory"`
+	PageMemory      uint64 `json:"page_memory"`
+	PageMemoryLimit uint64 `json:"page_memory_limit"`
+	GlobalMemory    uint64 `json:"global_memory"`
+	Pages           uint64 `json:"pages"`
+	DirtyPages      uint64 `json:"dirty_pages"`
+	Layers          uint64 `json:"layers"`
+}
+
+// Size of struct lc_daemonStats
+const daemonStatsSize = 7 * 8
+
+// Buffer used for listing layers, holding about 120 names of 64 characters
+const layersBufferSize = 8192
+
+// Size of the header of struct lc_layerList
+const layerListHeaderSize = 16
+
+// Size of data pages of the file system, LC_BLOCK_SIZE in layout.h
+const lcfsBlockSize = 4096
+
+// driverStats combines capacity of the file system with metrics of driver
+// operations and I/O counters of layers.
+type driverStats struct {
+	Capacity   *capacityStats           `json:"capacity"`
+	Operations map[string]opMetric      `json:"operations"`
+	Layers     map[string]*layerIOStats `json:"layers,omitempty"`
+	Daemon     *daemonStats             `json:"daemon,omitempty"`
+	Fuse       *fuseStats               `json:"fuse,omitempty"`
+	Ioctls     *ioctlStats              `json:"ioctls,omitempty"`
+	Removals   int                      `json:"pending_removals"`
+	Dedup      *dedupStats              `json:"apply_diff_dedup,omitempty"`
+	Pruned     *pruneStats              `json:"snapshots_pruned,omitempty"`
+}
+
+// stats reports capacity, operation metrics and I/O counters of all layers.
+func (d *Driver) stats() (*driverStats, error) {
+	c, err := d.capacity()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := d.listLayers()
+	if err != nil {
+		return nil, err
+	}
+	s := &driverStats{Capacity: c, Operations: d.metrics.snapshot()}
+	s.Daemon, _ = d.daemonStats()
+	if d.fuse != nil {
+		s.Fuse = d.fuse.snapshot()
+	}
+	if l := ioctlLimit(); l != nil {
+		s.Ioctls = l.snapshot()
+	}
+	if d.reaper != nil {
+		s.Removals = d.reaper.count()
+	}
+	if d.opts != nil && d.opts.ApplyDiffDedup {
+		s.Dedup = d.dedup.snapshot()
+	}
+	if d.scheduler != nil {
+		s.Pruned = d.scheduler.pruner.stats.snapshot()
+	}
+	for _, id := range layers {
+		io, err := d.layerIOStats(id)
+		if err != nil {
+			continue
+		}
+		if s.Layers == nil {
+			s.Layers = make(map[string]*layerIOStats, len(layers))
+		}
+		s.Layers[id] = io
+	}
+	return s, nil
+}
+
+// layerIOStats queries I/O counters of a layer from the file system.
+func (d *Driver) layerIOStats(id string) (*layerIOStats, error) {
+	s, _, err := d.layerStats(id)
+	return s, err
+}
+
+// layerStats queries I/O counters of a layer from the file system, and the
+// depth of the layer, the number of its ancestors, or -1 if the file system
+// does not report it.  File systems not reporting it return the counters
+// only, so the depth is preset with a value never returned, unless the name
+// of the layer covers it.
+func (d *Driver) layerStats(id string) (*layerIOStats, int, error) {
+	size := layerStatsSize
+	if len(id)+1 > size {
+		size = len(id) + 1
+	}
+	buf := make([]byte, size)
+	depth := buf[layerIOStatsSize:layerStatsSize]
+	nativeEndian.PutUint64(depth, noDepth)
+	if err := d.ioctlRead(LayerStats, id, buf); err != nil {
+		return nil, -1, err
+	}
+	s, err := decodeLayerIOStats(buf)
+	if err != nil {
+		return nil, -1, err
+	}
+	n := nativeEndian.Uint64(depth)
+	if n == noDepth || len(id) >= layerIOStatsSize {
+		return s, -1, nil
+	}
+	return s, int(n), nil
+}
+
+// decodeLayerIOStats decodes counters returned by the file system.
+func decodeLayerIOStats(buf []byte) (*layerIOStats, error) {
+	var s layerIOStats
+
+	if len(buf) < layerIOStatsSize {
+		return nil, unix.EINVAL
+	}
+	err := binary.Read(bytes.NewReader(buf[:layerIOStatsSize]),
+		nativeEndian, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// metadata formats counters as returned by GetMetadata.
+func (s *layerIOStats) metadata() map[string]string {
+	return map[string]string{
+		"ReadBytes":   strconv.FormatUint(s.ReadBytes, 10),
+		"WriteBytes":  strconv.FormatUint(s.WriteBytes, 10),
+		"ReadOps":     strconv.FormatUint(s.ReadOps, 10),
+		"WriteOps":    strconv.FormatUint(s.WriteOps, 10),
+		"BlockReads":  strconv.FormatUint(s.BlockReads, 10),
+		"BlockWrites": strconv.FormatUint(s.BlockWrites, 10),
+		"Inodes":      strconv.FormatUint(s.Inodes, 10),
+		"DirtyPages":  strconv.FormatUint(s.DirtyPages, 10),
+		"CacheHits":   strconv.FormatUint(s.CacheHits, 10),
+		"CacheMisses": strconv.FormatUint(s.CacheMisses, 10),
+	}
+}
+
+// capacity reports current space usage of the file system.
+func (d *Driver) capacity() (*capacityStats, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Statfs(d.home, &st); err != nil {
+		return nil, err
+	}
+	layers, err := d.listLayers()
+	if err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	return &capacityStats{
+		TotalBytes:  st.Blocks * bsize,
+		FreeBytes:   st.Bfree * bsize,
+		UsedBytes:   (st.Blocks - st.Bfree) * bsize,
+		TotalInodes: st.Files,
+		FreeInodes:  st.Ffree,
+		Layers:      len(layers),
+	}, nil
+}
+
+// listLayers returns the ids of all layers, as listed by the file system, or
+// present in the layer root directory with file systems not listing layers or
+// the command not allowed.  Layers being removed or queued for removal are not
+// returned.
+func (d *Driver) listLayers() ([]string, error) {
+	var ids []string
+	var err error
+
+	// Policies written before the command existed are not warned about
+	query := ioctlPolicy.allows(LayersList)
+	if query {
+		ids, err = d.queryLayers()
+	}
+	if !query || err == unix.ENOTTY || err == unix.ENOSYS ||
+		err == unix.EINVAL || err == unix.EOPNOTSUPP {
+		ids, err = d.readLayers()
+	}
+	if err != nil {
+		return nil, err
+	}
+	layers := ids[:0]
+	for _, id := range ids {
+		if !d.removing(id) {
+			layers = append(layers, id)
+		}
+	}
+	return layers, nil
+}
+
+// queryLayers returns the ids of all layers known to the file system, as many
+// as fit in a buffer with each ioctl.  Layers created or removed while listing
+// may be missed or returned twice, duplicates are dropped.
+func (d *Driver) queryLayers() ([]string, error) {
+	var layers []string
+	var index uint64
+
+	seen := make(map[string]bool)
+	buf := make([]byte, layersBufferSize)
+	for {
+		// Pass the index of the first layer needed
+		n := copy(buf, strconv.FormatUint(index, 10))
+		buf[n] = 0
+		if err := d.ioctlBuffer(LayersList, buf); err != nil {
+			return nil, err
+		}
+		total, batch, err := decodeLayerList(buf)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range batch {
+			if !seen[id] {
+				seen[id] = true
+				layers = append(layers, id)
+			}
+		}
+		index += uint64(len(batch))
+		if len(batch) == 0 || index >= total {
+			return layers, nil
+		}
+	}
+}
+
+// decodeLayerList decodes names of layers returned by the file system,
+// returning the number of layers along with the names returned.
+func decodeLayerList(buf []byte) (uint64, []string, error) {
+	if len(buf) < layerListHeaderSize {
+		return 0, nil, unix.EINVAL
+	}
+	total := nativeEndian.Uint64(buf)
+	count := nativeEndian.Uint64(buf[8:])
+	names := buf[layerListHeaderSize:]
+	if count > uint64(len(names))/2 {
+		return 0, nil, unix.EINVAL
+	}
+	ids := make([]string, count)
+	for i := range ids {
+		n := bytes.IndexByte(names, 0)
+		if n < 0 {
+			return 0, nil, unix.EINVAL
+		}
+		ids[i] = string(names[:n])
+		names = names[n+1:]
+	}
+	return total, ids, nil
+}
+
+// readLayers returns the ids of all layers present in the layer root
+// directory.
+func (d *Driver) readLayers() ([]string, error) {
+	entries, err := ioutil.ReadDir(d.home)
+	if err != nil {
+		return nil, err
+	}
+	layers := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			layers = append(layers, e.Name())
+		}
+	}
+	return layers, nil
+}
+
+// daemonStats returns resource usage of the file system daemon, from the
+// stats page if the daemon publishes one.
+func (d *Driver) daemonStats() (*daemonStats, error) {
+	if p := d.statsPage; p != nil {
+		if s, err := p.read(); err == nil {
+			return s, nil
+		}
+	}
+	return d.queryDaemonStats()
+}
+
+// queryDaemonStats queries resource usage of the file system daemon.
+func (d *Driver) queryDaemonStats() (*daemonStats, error) {
+	var s daemonStats
+
+	buf := make([]byte, daemonStatsSize)
+	if err := d.ioctlRead(LcfsStats, "", buf); err != nil {
+		return nil, err
+	}
+	err := binary.Read(bytes.NewReader(buf), nativeEndian, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// status formats resource usage as reported by Status.  Dirty data is the
+// backlog of pages not yet written to disk.
+func (s *daemonStats) status() [][2]string {
+	return [][2]string{
+		{"Daemon Memory", units.BytesSize(float64(s.ResidentMemory))},
+		{"Page Cache", units.BytesSize(float64(s.PageMemory))},
+		{"Page Cache Limit", units.BytesSize(float64(s.PageMemoryLimit))},
+		{"Metadata Memory", units.BytesSize(float64(s.GlobalMemory))},
+		{"Cached Pages", strconv.FormatUint(s.Pages, 10)},
+		{"Dirty Data", units.BytesSize(float64(s.DirtyPages * lcfsBlockSize))},
+		{"Layers", strconv.FormatUint(s.Layers, 10)},
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeLayerIOStats(t *testing.T) {
+	var buf bytes.Buffer
+
+	for i := uint64(1); i <= 10; i++ {
+		binary.Write(&buf, nativeEndian, i*100)
+	}
+	buf.WriteString("padding")
+	s, err := decodeLayerIOStats(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := layerIOStats{100, 200, 300, 400, 500, 600, 700, 800, 900, 1000}
+	if *s != expected {
+		t.Errorf("expected %+v, got %+v", expected, *s)
+	}
+	m := s.metadata()
+	if m["ReadBytes"] != "100" || m["DirtyPages"] != "800" ||
+		m["CacheMisses"] != "1000" {
+		t.Errorf("unexpected metadata %v", m)
+	}
+	if _, err := decodeLayerIOStats(buf.Bytes()[:10]); err == nil {
+		t.Errorf("expected short buffer to be rejected")
+	}
+}
+
+func TestDaemonStatus(t *testing.T) {
+	s := daemonStats{
+		ResidentMemory: 64 * 1024 * 1024,
+		DirtyPages:     256,
+		Layers:         3,
+	}
+	status := make(map[string]string)
+	for _, kv := range s.status() {
+		status[kv[0]] = kv[1]
+	}
+	if status["Daemon Memory"] != "64 MiB" || status["Dirty Data"] != "1 MiB" ||
+		status["Layers"] != "3" {
+		t.Errorf("unexpected status %v", status)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Maximum size of a statsd packet, fitting in an Ethernet frame
+const statsdPacketSize = 1432
+
+// statsdExporter periodically sends operation and capacity metrics of the
+// driver to a statsd server.  Tags are added in DogStatsD format if
+// configured.
+type statsdExporter struct {
+	d      *Driver
+	conn   net.Conn
+	prefix string
+	tags   string
+	last   map[string]opMetric
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newStatsdExporter starts sending metrics to the statsd server at the given
+// address every interval.
+func newStatsdExporter(d *Driver, address, prefix string, tags []string,
+	interval time.Duration) (*statsdExporter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsdExporter{
+		d:      d,
+		conn:   conn,
+		prefix: prefix,
+		last:   make(map[string]opMetric),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if len(tags) > 0 {
+		s.tags = "|#" + strings.Join(tags, ",")
+	}
+	go s.run(interval)
+	logrus.Infof("Sending metrics to statsd at %s every %v", address, interval)
+	return s, nil
+}
+
+func (s *statsdExporter) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops sending metrics after sending the current values, once a
+// flush in progress completed, as flushes share the last counts sent.
+func (s *statsdExporter) close() error {
+	close(s.stop)
+	<-s.done
+	s.flush()
+	return s.conn.Close()
+}
+
+// flush sends counts accumulated since the last flush and current capacity.
+func (s *statsdExporter) flush() {
+	var lines []string
+
+	for op, o := range s.d.metrics.snapshot() {
+		name := "op." + strings.ToLower(op)
+		last := s.last[op]
+		if count := o.Count - last.Count; count > 0 {
+			lines = append(lines,
+				s.line(name+".count", fmt.Sprintf("%d|c", count)),
+				s.line(name+".time", fmt.Sprintf("%d|ms",
+					int64((o.Total-last.Total)/time.Millisecond)/int64(count))))
+		}
+		if errors := o.Errors - last.Errors; errors > 0 {
+			lines = append(lines, s.line(name+".errors", fmt.Sprintf("%d|c", errors)))
+		}
+		if slow := o.Slow - last.Slow; slow > 0 {
+			lines = append(lines, s.line(name+".slow", fmt.Sprintf("%d|c", slow)))
+		}
+		s.last[op] = o
+	}
+	if c, err := s.d.capacity(); err == nil {
+		lines = append(lines,
+			s.line("capacity.total_bytes", fmt.Sprintf("%d|g", c.TotalBytes)),
+			s.line("capacity.free_bytes", fmt.Sprintf("%d|g", c.FreeBytes)),
+			s.line("capacity.used_bytes", fmt.Sprintf("%d|g", c.UsedBytes)),
+			s.line("capacity.total_inodes", fmt.Sprintf("%d|g", c.TotalInodes)),
+			s.line("capacity.free_inodes", fmt.Sprintf("%d|g", c.FreeInodes)),
+			s.line("capacity.layers", fmt.Sprintf("%d|g", c.Layers)))
+	}
+	if m := s.d.fuse; m != nil {
+		f := m.snapshot()
+		lines = append(lines,
+			s.line("fuse.waiting", fmt.Sprintf("%d|g", f.Waiting)),
+			s.line("fuse.congestion_events", fmt.Sprintf("%d|g", f.CongestionEvents)))
+	}
+	if l := ioctlLimit(); l != nil {
+		i := l.snapshot()
+		lines = append(lines,
+			s.line("ioctl.active", fmt.Sprintf("%d|g", i.Active)),
+			s.line("ioctl.waiting", fmt.Sprintf("%d|g", i.Waiting)),
+			s.line("ioctl.queued", fmt.Sprintf("%d|g", i.Queued)))
+	}
+	s.send(lines)
+}
+
+func (s *statsdExporter) line(name, value string) string {
+	return s.prefix + name + ":" + value + s.tags
+}
+
+// send writes lines to the server, packing as many as possible in a packet.
+func (s *statsdExporter) send(lines []string) {
+	var buf bytes.Buffer
+
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > statsdPacketSize {
+			s.write(buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		s.write(buf.Bytes())
+	}
+}
+
+func (s *statsdExporter) write(packet []byte) {
+	if _, err := s.conn.Write(packet); err != nil {
+		logrus.Debugf("statsd: err %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdFlush(t *testing.T) {
+	home, err := ioutil.TempDir("", "lcfs-statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	d := &Driver{home: home}
+	s, err := newStatsdExporter(d, server.LocalAddr().String(), "lcfs.",
+		[]string{"host:a"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.metrics.record("Create", time.Now(), nil)
+	d.metrics.record("Create", time.Now(), errors.New("failed"))
+	s.close()
+
+	buf := make([]byte, statsdPacketSize)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := string(buf[:n])
+	for _, line := range []string{
+		"lcfs.op.create.count:2|c|#host:a",
+		"lcfs.op.create.errors:1|c|#host:a",
+		"lcfs.capacity.layers:0|g|#host:a",
+	} {
+		if !strings.Contains(packet, line) {
+			t.Errorf("expected %q in packet %q", line, packet)
+		}
+	}
+}
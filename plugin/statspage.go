@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// LC_STATS_PAGE_MAGIC and LC_STATS_PAGE_VERSION in lcfs.h
+	statsPageMagic   = 0x4c435350
+	statsPageVersion = 1
+
+	// Size of struct lc_statsPage and offset of its sequence number
+	statsPageSize      = 4 + 4 + 8 + 8 + daemonStatsSize
+	statsPageSeqOffset = 8
+
+	// Pages not updated for this long are not used, as the daemon updates
+	// those every second
+	statsPageMaxAge = 5 * time.Second
+)
+
+// statsPage maps the file the file system daemon publishes its resource
+// usage in when started with -S, laid out as struct lc_statsPage in lcfs.h.
+// Reading the page does not need a request to the daemon, so metrics can be
+// scraped as often as needed.  The file is kept open to check its size
+// before reading the page, as accessing the page past the end of the file,
+// truncated by the daemon when restarted, would fault.
+type statsPage struct {
+	file *os.File
+	data []byte
+}
+
+// openStatsPage maps the stats page published in file.
+func openStatsPage(file string) (*statsPage, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &statsPage{file: f}
+	if err := p.check(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.data, err = unix.Mmap(int(f.Fd()), 0, statsPageSize, unix.PROT_READ,
+		unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// check fails if the file is too short for the stats page.
+func (p *statsPage) check() error {
+	fi, err := p.file.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < statsPageSize {
+		return unix.EINVAL
+	}
+	return nil
+}
+
+// close unmaps the stats page.
+func (p *statsPage) close() error {
+	err := unix.Munmap(p.data)
+	p.file.Close()
+	return err
+}
+
+// read returns a consistent copy of the stats last published, retrying while
+// the daemon is updating the page.
+func (p *statsPage) read() (*daemonStats, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	seqp := (*uint64)(unsafe.Pointer(&p.data[statsPageSeqOffset]))
+	buf := make([]byte, statsPageSize)
+	for i := 0; i < 100; i++ {
+		seq := atomic.LoadUint64(seqp)
+		if seq&1 != 0 {
+			runtime.Gosched()
+			continue
+		}
+		copy(buf, p.data)
+		if atomic.LoadUint64(seqp) == seq {
+			return decodeStatsPage(buf, time.Now())
+		}
+	}
+	return nil, unix.EAGAIN
+}
+
+// decodeStatsPage decodes a copy of the stats page, failing if the page is
+// not initialized or was not updated recently, as when the daemon stopped.
+func decodeStatsPage(buf []byte, now time.Time) (*daemonStats, error) {
+	var hdr struct {
+		Magic   uint32
+		Version uint32
+		Seq     uint64
+		Time    uint64
+	}
+	var s daemonStats
+
+	if len(buf) < statsPageSize {
+		return nil, unix.EINVAL
+	}
+	r := bytes.NewReader(buf[:statsPageSize])
+	if err := binary.Read(r, nativeEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Magic != statsPageMagic || hdr.Version != statsPageVersion {
+		return nil, unix.EINVAL
+	}
+	if now.Sub(time.Unix(int64(hdr.Time), 0)) > statsPageMaxAge {
+		return nil, unix.ESTALE
+	}
+	if err := binary.Read(r, nativeEndian, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func encodeStatsPage(magic uint32, updated time.Time, s daemonStats) []byte {
+	var buf bytes.Buffer
+
+	binary.Write(&buf, nativeEndian, magic)
+	binary.Write(&buf, nativeEndian, uint32(statsPageVersion))
+	binary.Write(&buf, nativeEndian, uint64(2))
+	binary.Write(&buf, nativeEndian, uint64(updated.Unix()))
+	binary.Write(&buf, nativeEndian, s)
+	return buf.Bytes()
+}
+
+func TestStatsPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lcfs-stats-page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "stats")
+	expected := daemonStats{ResidentMemory: 1 << 20, Pages: 7, Layers: 3}
+	page := encodeStatsPage(statsPageMagic, time.Now(), expected)
+	if err := ioutil.WriteFile(file, page, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := openStatsPage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.close()
+	s, err := p.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s != expected {
+		t.Errorf("expected %+v, got %+v", expected, *s)
+	}
+
+	// Files truncated by the daemon restarting are not read
+	if err := os.Truncate(file, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.read(); err == nil {
+		t.Errorf("expected truncated page to be rejected")
+	}
+	if _, err := openStatsPage(file); err == nil {
+		t.Errorf("expected short file to be rejected")
+	}
+}
+
+func TestDecodeStatsPage(t *testing.T) {
+	now := time.Now()
+	page := encodeStatsPage(statsPageMagic, now.Add(-time.Minute), daemonStats{})
+	if _, err := decodeStatsPage(page, now); err == nil {
+		t.Errorf("expected stale page to be rejected")
+	}
+	page = encodeStatsPage(0, now, daemonStats{})
+	if _, err := decodeStatsPage(page, now); err == nil {
+		t.Errorf("expected page not initialized to be rejected")
+	}
+	page = encodeStatsPage(statsPageMagic, now, daemonStats{})
+	if _, err := decodeStatsPage(page[:statsPageSize-1], now); err == nil {
+		t.Errorf("expected short page to be rejected")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Operations changing capacity of the file system, invalidating the cached
+// status
+var capacityOps = map[string]bool{
+	"Create":          true,
+	"CreateReadWrite": true,
+	"Remove":          true,
+	"ApplyDiff":       true,
+}
+
+// statusCache caches the status reported by the driver for a short time, so
+// frequent callers do not query the file system every time.
+type statusCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	status  [][2]string
+	expires time.Time
+}
+
+// get returns the cached status, computing it again when expired.
+func (c *statusCache) get(compute func() [][2]string) [][2]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if c.status == nil || c.ttl <= 0 || !now.Before(c.expires) {
+		c.status = compute()
+		c.expires = now.Add(c.ttl)
+	}
+	return c.status
+}
+
+// invalidate drops the cached status.
+func (c *statusCache) invalidate() {
+	c.lock.Lock()
+	c.status = nil
+	c.lock.Unlock()
+}
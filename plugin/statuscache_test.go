@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatusCache(t *testing.T) {
+	calls := 0
+	compute := func() [][2]string {
+		calls++
+		return [][2]string{{"Calls", string(rune('0' + calls))}}
+	}
+	c := statusCache{ttl: time.Hour}
+	c.get(compute)
+	if status := c.get(compute); calls != 1 || status[0][1] != "1" {
+		t.Errorf("expected cached status, got %v after %d calls", status, calls)
+	}
+	c.invalidate()
+	if status := c.get(compute); calls != 2 || status[0][1] != "2" {
+		t.Errorf("expected status computed after invalidation, got %v", status)
+	}
+
+	c = statusCache{}
+	c.get(compute)
+	c.get(compute)
+	if calls != 4 {
+		t.Errorf("expected status not cached without ttl, %d calls", calls)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Sync requests failing as layers kept being created or removed
+const syncRetries = 3
+
+// syncLayers commits the file system to disk and waits for a commit started
+// after the request, so layers created survive a power loss right after.  The
+// file system gives up on a request if commits kept being skipped while other
+// layers are being created or removed, which is retried.  File systems not
+// supporting waiting for a commit are only asked to commit.
+func (d *Driver) syncLayers() error {
+	var err error
+
+	delay := time.Millisecond
+	for i := 0; i < syncRetries; i++ {
+		err = d.ioctl(LcfsSync, "", "")
+		if err != unix.EAGAIN {
+			break
+		}
+		time.Sleep(delay)
+		if delay < 100*time.Millisecond {
+			delay *= 2
+		}
+	}
+	switch err {
+	case unix.ENOTTY, unix.ENOSYS, unix.EINVAL:
+		logrus.Debugf("Not waiting for commit: %v", err)
+		return d.ioctl(LcfsCommit, "", "")
+	}
+	return err
+}
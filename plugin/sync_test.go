@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSyncCreate(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	if n := f.count(LcfsSync); n != 0 {
+		t.Errorf("%d commits waited for without sync_create", n)
+	}
+
+	d.opts = &driverOptions{SyncCreate: true}
+	createLayers(t, d, fakeLayer{"layer", "base", false},
+		fakeLayer{"rw", "layer", true})
+	if n := f.count(LcfsSync); n != 2 {
+		t.Errorf("%d commits waited for creating 2 layers", n)
+	}
+
+	// Only committing if waiting is not supported
+	f.noSync = true
+	createLayers(t, d, fakeLayer{"other", "base", false})
+	if n := f.count(LcfsCommit); n != 1 {
+		t.Errorf("%d commits issued without waiting for those", n)
+	}
+}
+
+func TestSyncRetry(t *testing.T) {
+	busy := syncRetries - 1
+	var cmds []uintptr
+	ioctlSyscall = func(op uintptr, buf []byte) error {
+		cmds = append(cmds, op)
+		if busy > 0 {
+			busy--
+			return unix.EAGAIN
+		}
+		return nil
+	}
+	defer func() { ioctlSyscall = rootIoctl }()
+	d := &Driver{home: "/lcfs"}
+	if err := d.syncLayers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != syncRetries || cmds[syncRetries-1] != LcfsSync {
+		t.Errorf("unexpected ioctls %v", cmds)
+	}
+
+	// Giving up once the file system failed every request
+	busy, cmds = syncRetries, nil
+	if err := d.syncLayers(); err != unix.EAGAIN {
+		t.Errorf("sync failing every request succeeded, err %v", err)
+	}
+	if len(cmds) != syncRetries {
+		t.Errorf("unexpected ioctls %v", cmds)
+	}
+}
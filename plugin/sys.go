@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Issues ioctls to the file system, replaced by tests
+var ioctlSyscall = rootIoctl
+
+// Byte order of the host, which structures the file system exchanges with
+// the plugin are laid out in
+var nativeEndian = hostByteOrder()
+
+// hostByteOrder returns the byte order of the host.
+func hostByteOrder() binary.ByteOrder {
+	word := uint16(1)
+	if *(*byte)(unsafe.Pointer(&word)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// Buffers passing names of layers with ioctls, reused as Get, Put and Exists
+// issue an ioctl on every call and the buffer escapes to the heap
+var nameBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 160)
+		return &buf
+	},
+}
+
+// Buffers passing batches of layers with ioctls
+var batchBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, existsBufferSize)
+		return &buf
+	},
+}
+
+// rootIoctl issues an ioctl on the layer root directory, passing buf to the
+// file system unless empty.  Every ioctl is answered by the file system daemon
+// and may block, so RawSyscall, which does not let the scheduler run other
+// goroutines meanwhile, cannot be used for any of those.  Ioctls wait for a
+// slot if the number of concurrent ioctls is limited.
+func rootIoctl(op uintptr, buf []byte) error {
+	return fdIoctl(fd, op, buf)
+}
+
+// fdIoctl issues an ioctl on the layer root directory of a file system open
+// as fd, like rootIoctl.
+func fdIoctl(fd int, op uintptr, buf []byte) error {
+	var arg unsafe.Pointer
+
+	if l := ioctlLimit(); l != nil {
+		l.acquire()
+		defer l.release()
+	}
+	if len(buf) > 0 {
+		arg = unsafe.Pointer(&buf[0])
+	}
+	_, _, ep := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), op, uintptr(arg))
+	if ep != 0 {
+		return ep
+	}
+	return nil
+}
+
+// errnoOf returns the errno an operation failed with, or zero if unknown.
+func errnoOf(err error) syscall.Errno {
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e
+	case *os.PathError:
+		return errnoOf(e.Err)
+	case *os.SyscallError:
+		return errnoOf(e.Err)
+	case *layerError:
+		return e.errno
+	case *invalidIDError:
+		return e.errno
+	case *opError:
+		return errnoOf(e.err)
+	case *commandError:
+		return syscall.EPERM
+	}
+	return 0
+}
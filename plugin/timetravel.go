@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// snapshotMount is the layer of a snapshot mounted read-only at a path
+// outside of the file system, next to the layer the snapshot was taken of.
+type snapshotMount struct {
+	Target   string    `json:"target"`
+	Layer    string    `json:"layer"`
+	Snapshot string    `json:"snapshot"`
+	ID       string    `json:"id"`
+	Since    time.Time `json:"since"`
+}
+
+// snapshotMounts tracks layers of snapshots mounted, by path mounted at.
+type snapshotMounts struct {
+	lock   sync.Mutex
+	mounts map[string]*snapshotMount
+}
+
+// add records a snapshot mounted, returning false if the path is taken.
+func (s *snapshotMounts) add(m *snapshotMount) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.mounts == nil {
+		s.mounts = make(map[string]*snapshotMount)
+	}
+	if s.mounts[m.Target] != nil {
+		return false
+	}
+	s.mounts[m.Target] = m
+	return true
+}
+
+// remove forgets the snapshot mounted at a path, returning it, or nil if none
+// is.
+func (s *snapshotMounts) remove(target string) *snapshotMount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m := s.mounts[target]
+	delete(s.mounts, target)
+	return m
+}
+
+// using checks if the layer of a snapshot is mounted at any path.
+func (s *snapshotMounts) using(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range s.mounts {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the snapshots mounted, sorted by path.
+func (s *snapshotMounts) list() []*snapshotMount {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	mounts := make([]*snapshotMount, 0, len(s.mounts))
+	for _, m := range s.mounts {
+		c := *m
+		mounts = append(mounts, &c)
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Target < mounts[j].Target
+	})
+	return mounts
+}
+
+// Mounts a directory read-only at another path, replaced by tests
+var bindMount = func(src, target string) error {
+	if err := unix.Mount(src, target, "", unix.MS_BIND, ""); err != nil {
+		return err
+	}
+	err := unix.Mount("", target, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY,
+		"")
+	if err != nil {
+		unix.Unmount(target, unix.MNT_DETACH)
+	}
+	return err
+}
+
+// Unmounts a path mounted by bindMount, replaced by tests
+var unbindMount = func(target string) error {
+	return unix.Unmount(target, unix.MNT_DETACH)
+}
+
+// MountSnapshot mounts the layer of a snapshot of a layer read-only at a
+// directory, while the layer stays mounted and in use, so old versions of
+// files are compared or copied out of the snapshot without stopping the
+// container.  The snapshot is not removed until unmounted.
+func (d *Driver) MountSnapshot(layer, ref, target string) (_ *snapshotMount, err error) {
+	logrus.Debugf("MountSnapshot - layer %s snapshot %s target %s", layer, ref,
+		target)
+	defer d.trackOp("MountSnapshot", layer, "")(&err)
+	s, err := d.snapshotsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateID(layer); err != nil {
+		return nil, err
+	}
+	target, err = d.hostPath(target, "to mount snapshot at")
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(target); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("lcfs: %s is not a directory", target)
+	}
+	rec, err := s.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Layer != layer {
+		return nil, fmt.Errorf("lcfs: snapshot %s is of layer %s, not of %s",
+			rec.Name, rec.Layer, layer)
+	}
+	m := &snapshotMount{Target: target, Layer: layer, Snapshot: rec.Name,
+		ID: rec.ID, Since: time.Now().UTC()}
+	if !d.snapshotMounts.add(m) {
+		return nil, fmt.Errorf("lcfs: a snapshot is mounted at %s already",
+			target)
+	}
+	dir, err := d.Get(rec.ID, "")
+	if err == nil {
+		if err = bindMount(dir, target); err != nil {
+			d.putSnapshot(rec.ID)
+		}
+	}
+	if err != nil {
+		d.snapshotMounts.remove(target)
+		return nil, err
+	}
+	logrus.Infof("Mounted snapshot %s of layer %s at %s", rec.Name, layer,
+		target)
+	c := *m
+	return &c, nil
+}
+
+// UnmountSnapshot unmounts the snapshot mounted at a directory.
+func (d *Driver) UnmountSnapshot(target string) (err error) {
+	logrus.Debugf("UnmountSnapshot - target %s", target)
+	defer d.trackOp("UnmountSnapshot", "", "")(&err)
+	target = path.Clean(target)
+	m := d.snapshotMounts.remove(target)
+	if m == nil {
+		return fmt.Errorf("lcfs: no snapshot mounted at %s", target)
+	}
+	if err := unbindMount(target); err != nil && err != unix.EINVAL {
+		d.snapshotMounts.add(m)
+		return err
+	}
+	d.putSnapshot(m.ID)
+	logrus.Infof("Unmounted snapshot %s of layer %s from %s", m.Snapshot,
+		m.Layer, target)
+	return nil
+}
+
+// SnapshotMounts lists the snapshots mounted.
+func (d *Driver) SnapshotMounts() []*snapshotMount {
+	return d.snapshotMounts.list()
+}
+
+// unmountSnapshots unmounts all snapshots mounted, when the plugin stops.
+func (d *Driver) unmountSnapshots() {
+	for _, m := range d.snapshotMounts.list() {
+		if err := d.UnmountSnapshot(m.Target); err != nil {
+			logrus.Errorf("Unmounting snapshot at %s, err %v\n", m.Target, err)
+		}
+	}
+}
+
+// putSnapshot releases the reference to the layer of a snapshot taken when
+// mounted.
+func (d *Driver) putSnapshot(id string) {
+	if err := d.Put(id); err != nil {
+		logrus.Errorf("Releasing snapshot layer %s, err %v\n", id, err)
+	}
+}
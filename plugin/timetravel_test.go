@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMountSnapshot(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	d.snapshots, _ = openSnapshotStore(path.Join(f.home, "snapshots"))
+	copyChanges = func(d *Driver, id, layer, parent string) error {
+		return nil
+	}
+	bind, unbind := bindMount, unbindMount
+	bound := make(map[string]string)
+	bindMount = func(src, target string) error {
+		bound[target] = src
+		return nil
+	}
+	unbindMount = func(target string) error {
+		delete(bound, target)
+		return nil
+	}
+	defer func() {
+		copyChanges = (*Driver).copyChanges
+		bindMount, unbindMount = bind, unbind
+	}()
+	for _, id := range []string{"base", "other"} {
+		if err := d.Create(id, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createLayers(t, d, fakeLayer{"rw", "base", true})
+	rec, err := d.Snapshot(&snapshotRequest{Layer: "rw", Name: "yesterday"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get("rw", ""); err != nil {
+		t.Fatal(err)
+	}
+	mount, cleanupMount := newPropagatedMount(t)
+	defer cleanupMount()
+	target := path.Join(mount, "snapshots")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused for snapshots of other layers and paths not absolute, not in
+	// the propagated mount or in the layer root
+	if _, err := d.MountSnapshot("other", "yesterday", target); err == nil {
+		t.Error("snapshot of another layer mounted")
+	}
+	if err := os.Symlink(f.home, path.Join(mount, "home")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"snapshots", os.TempDir(), mount,
+		path.Join(f.home, "snapshots"), path.Join(mount, "home", "base")} {
+		if _, err := d.MountSnapshot("rw", "yesterday", p); err == nil {
+			t.Errorf("snapshot mounted at %s", p)
+		}
+	}
+
+	m, err := d.MountSnapshot("rw", "yesterday", target+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Target != target || m.ID != rec.ID ||
+		bound[target] != path.Join(f.home, rec.ID) || !d.mounts.active(rec.ID) {
+		t.Errorf("snapshot not mounted, %+v bound %v", m, bound)
+	}
+	if _, err := d.MountSnapshot("rw", "yesterday", target); err == nil {
+		t.Error("two snapshots mounted at the same path")
+	}
+	if err := d.RemoveSnapshot("yesterday"); !errors.Is(err, errLayerBusy) {
+		t.Errorf("snapshot mounted removed, err %v", err)
+	}
+	if mounts := d.SnapshotMounts(); len(mounts) != 1 || mounts[0].Snapshot != "yesterday" {
+		t.Errorf("unexpected snapshots mounted %v", mounts)
+	}
+
+	if err := d.UnmountSnapshot(target); err != nil {
+		t.Fatal(err)
+	}
+	if len(bound) != 0 || d.mounts.active(rec.ID) || !d.mounts.active("rw") {
+		t.Errorf("snapshot not unmounted, bound %v", bound)
+	}
+	if err := d.UnmountSnapshot(target); err == nil {
+		t.Error("snapshot unmounted twice")
+	}
+	if err := d.RemoveSnapshot("yesterday"); err != nil {
+		t.Fatal(err)
+	}
+}
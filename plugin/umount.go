@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// umountRequest is a layer waiting to be unmounted.
+type umountRequest struct {
+	id   string
+	done chan error
+}
+
+// umountBatcher unmounts layers released at the same time with a single
+// ioctl, as Docker puts all layers of running containers at once when it
+// stops.  A layer released while no other is being unmounted is unmounted
+// right away, those released meanwhile are unmounted together next.
+type umountBatcher struct {
+	umount func(ids []string) []error
+
+	lock    sync.Mutex
+	pending []*umountRequest
+	running bool
+}
+
+// newUmountBatcher creates a batcher unmounting layers with the function
+// specified, returning an error for each layer.
+func newUmountBatcher(umount func(ids []string) []error) *umountBatcher {
+	return &umountBatcher{umount: umount}
+}
+
+// unmount waits for a layer to be unmounted in the next batch.
+func (b *umountBatcher) unmount(id string) error {
+	r := &umountRequest{id: id, done: make(chan error, 1)}
+	b.lock.Lock()
+	b.pending = append(b.pending, r)
+	if !b.running {
+		b.running = true
+		go b.run()
+	}
+	b.lock.Unlock()
+	return <-r.done
+}
+
+// run unmounts batches of layers until none are left.
+func (b *umountBatcher) run() {
+	for {
+		b.lock.Lock()
+		batch := b.pending
+		b.pending = nil
+		if len(batch) == 0 {
+			b.running = false
+			b.lock.Unlock()
+			return
+		}
+		b.lock.Unlock()
+		ids := make([]string, len(batch))
+		for i, r := range batch {
+			ids[i] = r.id
+		}
+		errs := b.umount(ids)
+		for i, r := range batch {
+			r.done <- errs[i]
+		}
+	}
+}
+
+// umount unmounts a layer, together with other layers released at the same
+// time.
+func (d *Driver) umount(id string) error {
+	if d.umounts == nil {
+		return d.ioctl(LayerUmount, "", id)
+	}
+	return d.umounts.unmount(id)
+}
+
+// umountLayers unmounts layers with as few ioctls as possible, falling back to
+// unmounting layers one by one if the file system does not support unmounting
+// a batch.
+func (d *Driver) umountLayers(ids []string) []error {
+	errs := make([]error, len(ids))
+	bufp := batchBuffers.Get().(*[]byte)
+	defer batchBuffers.Put(bufp)
+	buf := *bufp
+	for start := 0; start < len(ids); {
+		n, batch, next := packLayerNames(ids, start, buf)
+		for i := start; i < next; i++ {
+			errs[i] = unix.EINVAL
+		}
+		start = next
+		var err error = unix.ENOSYS
+		if len(batch) > 1 && d.batchUmount {
+			err = d.ioctlBuffer(LayersUmount, buf[:n+1])
+		}
+		if err == unix.ENOSYS {
+			if len(batch) > 1 {
+				d.batchUmount = false
+			}
+			for _, i := range batch {
+				errs[i] = d.ioctl(LayerUmount, "", ids[i])
+			}
+			continue
+		}
+		for j, i := range batch {
+			errs[i] = err
+			if err == nil && buf[j] != 0 {
+				errs[i] = syscall.Errno(buf[j])
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestUmountBatcher(t *testing.T) {
+	var lock sync.Mutex
+	var batches [][]string
+	release := make(chan struct{})
+	b := newUmountBatcher(func(ids []string) []error {
+		lock.Lock()
+		batches = append(batches, ids)
+		first := len(batches) == 1
+		lock.Unlock()
+		if first {
+			<-release
+		}
+		errs := make([]error, len(ids))
+		for i, id := range ids {
+			if id == "bad" {
+				errs[i] = fmt.Errorf("failed")
+			}
+		}
+		return errs
+	})
+
+	// Layers released while the first is unmounted are unmounted together
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := b.unmount("first"); err != nil {
+			t.Errorf("unmount failed: %v", err)
+		}
+	}()
+	for {
+		lock.Lock()
+		n := len(batches)
+		lock.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+	errs := make([]error, 3)
+	for i, id := range []string{"a", "bad", "b"} {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			errs[i] = b.unmount(id)
+		}(i, id)
+	}
+	for {
+		b.lock.Lock()
+		n := len(b.pending)
+		b.lock.Unlock()
+		if n == 3 {
+			break
+		}
+	}
+	close(release)
+	wg.Wait()
+	if len(batches) != 2 || len(batches[1]) != 3 {
+		t.Errorf("unexpected batches %v", batches)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
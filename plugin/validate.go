@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Longest id of a layer, as layers are directories of the layer root
+const maxLayerIDLength = 255
+
+// Longest parent and name passed with an ioctl, parent and name lengths are
+// encoded in 8 and 14 bits of the command
+const (
+	maxIoctlParent = 1<<8 - 1
+	maxIoctlName   = 1<<14 - 1
+)
+
+// invalidIDError is returned for ids and parents of layers which cannot be
+// used as a name of a directory of the layer root.  Ids too long match
+// ENAMETOOLONG with errors.Is.
+type invalidIDError struct {
+	id     string
+	reason string
+	errno  syscall.Errno
+}
+
+func (e *invalidIDError) Error() string {
+	id := e.id
+	if len(id) > 80 {
+		id = id[:64] + "..."
+	}
+	return fmt.Sprintf("lcfs: invalid layer id %q, %s", id, e.reason)
+}
+
+// Unwrap returns the errno of the condition, if any.
+func (e *invalidIDError) Unwrap() error {
+	if e.errno == 0 {
+		return nil
+	}
+	return e.errno
+}
+
+// nameTooLong returns the error of an id longer than max bytes.
+func nameTooLong(id string, max int) error {
+	return &invalidIDError{id, fmt.Sprintf("name too long, %d bytes, at most %d",
+		len(id), max), syscall.ENAMETOOLONG}
+}
+
+// validateID checks if an id of a layer is safe to be used as a path in the
+// layer root and passed to the file system.  Ids start with a letter or a
+// digit followed by letters, digits, '_', '.' and '-', like the ids Docker
+// generates and those of init layers, so those never contain a separator or
+// refer to a parent directory.
+func validateID(id string) error {
+	if id == "" {
+		return &invalidIDError{id, "empty", 0}
+	}
+	if len(id) > maxLayerIDLength {
+		return nameTooLong(id, maxLayerIDLength)
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case i > 0 && (c == '_' || c == '.' || c == '-'):
+		default:
+			return &invalidIDError{id, fmt.Sprintf("unexpected %q at %d", c, i),
+				0}
+		}
+	}
+	return nil
+}
+
+// validateLayer checks the id of a layer and its parent, if any.
+func validateLayer(id, parent string) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if parent != "" {
+		return validateID(parent)
+	}
+	return nil
+}
+
+// parentError is returned when creating a layer from a parent which cannot be
+// used as a base, matching os.ErrNotExist with errors.Is.  The message ends
+// with the text of ENOENT, like errors of layers not found.
+type parentError struct {
+	parent string
+	reason string
+}
+
+func (e *parentError) Error() string {
+	return fmt.Sprintf("lcfs: parent layer %q %s: %v", e.parent, e.reason,
+		syscall.ENOENT)
+}
+
+// Is matches os.ErrNotExist, as the parent cannot be found.
+func (e *parentError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// checkParent checks if a parent exists and is not being removed, before a
+// layer is created from it.
+func (d *Driver) checkParent(parent string) error {
+	if d.reaper != nil && d.reaper.queued(parent) {
+		return &parentError{parent, "is being removed"}
+	}
+	if d.known.has(parent) {
+		return nil
+	}
+	err := d.ioctl(LayerStat, "", parent)
+	if err == unix.ENOENT {
+		return &parentError{parent, "does not exist"}
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestValidateID(t *testing.T) {
+	for _, id := range []string{
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef-init",
+		"base",
+		"Layer_1.2",
+		strings.Repeat("a", maxLayerIDLength),
+	} {
+		if err := validateID(id); err != nil {
+			t.Errorf("id %q rejected: %v", id, err)
+		}
+	}
+	for _, id := range []string{
+		"",
+		".",
+		"..",
+		"../etc",
+		"a/b",
+		"/abs",
+		"-flag",
+		".hidden",
+		"a\x00b",
+		"a b",
+		"caf\xc3\xa9",
+		strings.Repeat("a", maxLayerIDLength+1),
+	} {
+		if _, ok := validateID(id).(*invalidIDError); !ok {
+			t.Errorf("id %q accepted", id)
+		}
+	}
+}
+
+func TestInvalidLayerNotIssued(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	if err := d.Create("../base", "", "", nil); err == nil {
+		t.Fatal("created layer ../base")
+	}
+	createLayers(t, d, fakeLayer{"base", "", false})
+	if err := d.CreateReadWrite("layer", "base/..", "", nil); err == nil {
+		t.Fatal("created layer with parent base/..")
+	}
+	if _, err := d.Get("../base", ""); err == nil {
+		t.Fatal("mounted layer ../base")
+	}
+	if err := d.Remove(".."); err == nil {
+		t.Fatal("removed layer ..")
+	}
+	if d.Exists("base/") {
+		t.Fatal("layer base/ exists")
+	}
+	if len(f.cmds) != 1 {
+		t.Fatalf("%d ioctls issued, expected 1", len(f.cmds))
+	}
+}
+
+func TestCheckParent(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	var perr *parentError
+	err := d.Create("layer", "missing", "", nil)
+	if !errors.As(err, &perr) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("creating layer from missing parent returned %v", err)
+	}
+	if n := f.count(LayerCreate); n != 0 {
+		t.Fatalf("%d layers created from missing parent", n)
+	}
+	createLayers(t, d, fakeLayer{"base", "", false})
+	d.reaper = &reaper{pending: map[string]int{"base": 0}}
+	err = d.Create("layer", "base", "", nil)
+	if !errors.As(err, &perr) {
+		t.Fatalf("creating layer from parent being removed returned %v", err)
+	}
+	d.reaper = nil
+
+	// Parents not created through the driver are looked up
+	d.known.remove("base")
+	createLayers(t, d, fakeLayer{"layer", "base", false})
+}
+
+func TestNameTooLong(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	long := strings.Repeat("a", maxLayerIDLength+1)
+	for _, err := range []error{
+		d.Create(long, "", "", nil),
+		d.Create("layer", long, "", nil),
+		d.ioctl(LayerStat, long, "layer"),
+		d.ioctl(LayerStat, "", strings.Repeat("a", maxIoctlName+1)),
+		d.ioctl(LayerStat, "base", strings.Repeat("a", maxIoctlName-4)),
+		d.ioctlRead(LayerStats, long, make([]byte, maxLayerIDLength)),
+	} {
+		if !errors.Is(err, syscall.ENAMETOOLONG) ||
+			!strings.Contains(err.Error(), "name too long") {
+			t.Errorf("id too long returned %v", err)
+		}
+	}
+	if len(f.cmds) != 0 {
+		t.Fatalf("%d ioctls issued with ids too long", len(f.cmds))
+	}
+	if err := d.ioctl(LayerStat, "", strings.Repeat("a", maxIoctlName)); err == nil ||
+		errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("longest name fitting the command returned %v", err)
+	}
+}
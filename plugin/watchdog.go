@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// inflightOp is a driver operation in progress.
+type inflightOp struct {
+	op       string
+	id       string
+	start    time.Time
+	goid     uint64
+	reported bool
+}
+
+// watchdog reports driver operations taking longer than a threshold, with
+// the stack of the goroutine processing the operation.
+type watchdog struct {
+	lock      sync.Mutex
+	ops       map[*inflightOp]struct{}
+	threshold time.Duration
+	stop      chan struct{}
+}
+
+// newWatchdog starts checking for operations exceeding threshold.
+func newWatchdog(threshold time.Duration) *watchdog {
+	w := &watchdog{
+		ops:       make(map[*inflightOp]struct{}),
+		threshold: threshold,
+		stop:      make(chan struct{}),
+	}
+	interval := threshold / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	go w.run(interval)
+	logrus.Infof("Reporting operations taking more than %v", threshold)
+	return w
+}
+
+func (w *watchdog) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// close stops checking for slow operations.
+func (w *watchdog) close() {
+	close(w.stop)
+}
+
+// begin starts watching an operation processed by the calling goroutine.
+func (w *watchdog) begin(op, id string) *inflightOp {
+	o := &inflightOp{op: op, id: id, start: time.Now(), goid: goroutineID()}
+	w.lock.Lock()
+	w.ops[o] = struct{}{}
+	w.lock.Unlock()
+	return o
+}
+
+// end stops watching an operation, returning true if it exceeded threshold.
+func (w *watchdog) end(o *inflightOp) bool {
+	w.lock.Lock()
+	delete(w.ops, o)
+	w.lock.Unlock()
+	elapsed := time.Since(o.start)
+	if elapsed <= w.threshold {
+		return false
+	}
+	logrus.Warnf("Slow operation %s on layer %s completed after %v",
+		o.op, o.id, elapsed)
+	return true
+}
+
+// check reports operations which exceeded threshold and are not reported yet.
+func (w *watchdog) check() {
+	var slow []*inflightOp
+
+	w.lock.Lock()
+	for o := range w.ops {
+		if !o.reported && time.Since(o.start) > w.threshold {
+			o.reported = true
+			slow = append(slow, o)
+		}
+	}
+	w.lock.Unlock()
+	for _, o := range slow {
+		logrus.Warnf("Operation %s on layer %s running for %v\n%s",
+			o.op, o.id, time.Since(o.start), goroutineStack(o.goid))
+	}
+}
+
+// goroutineID returns the id of the calling goroutine, parsed from its stack
+// header "goroutine <id> [...]".
+func goroutineID() uint64 {
+	var buf [64]byte
+
+	n := runtime.Stack(buf[:], false)
+	fields := bytes.Fields(buf[:n])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+// goroutineStack returns the stack of the goroutine with the given id.
+func goroutineStack(id uint64) string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	prefix := []byte(fmt.Sprintf("goroutine %d ", id))
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, prefix) {
+			return string(stack)
+		}
+	}
+	return fmt.Sprintf("goroutine %d not found", id)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoroutineStack(t *testing.T) {
+	stack := goroutineStack(goroutineID())
+	if !strings.Contains(stack, "TestGoroutineStack") {
+		t.Errorf("expected stack of the test goroutine, got %q", stack)
+	}
+}
+
+func TestWatchdogSlowOp(t *testing.T) {
+	var err error
+
+	d := &Driver{watchdog: newWatchdog(time.Millisecond)}
+	done := d.trackOp("Get", "layer", "")
+	time.Sleep(5 * time.Millisecond)
+	done(&err)
+	d.watchdog.close()
+
+	d.watchdog = newWatchdog(time.Hour)
+	done = d.trackOp("Get", "layer", "")
+	done(&err)
+	d.watchdog.close()
+
+	o := d.metrics.snapshot()["Get"]
+	if o.Count != 2 || o.Slow != 1 {
+		t.Errorf("expected 1 slow operation out of 2, got %+v", o)
+	}
+}
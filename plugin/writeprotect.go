@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// sealLayer makes the file system refuse any change to a read-only layer
+// right away, instead of once the layer is unmounted for the last time, so
+// an image layer cannot be modified after its diff is applied while it stays
+// mounted.
+func (d *Driver) sealLayer(id string) error {
+	err := d.ioctl(LayerSeal, "", id)
+	switch err {
+	case nil:
+		return nil
+	case unix.ENOSYS, unix.ENOTTY:
+		return fmt.Errorf("lcfs: file system does not support write "+
+			"protection: %v", err)
+	}
+	return fmt.Errorf("lcfs: sealing layer %s: %v", id, err)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSealLayer(t *testing.T) {
+	f, d, cleanup := newFakeFS(t)
+	defer cleanup()
+	createLayers(t, d, fakeLayer{"base", "", false})
+	if err := d.sealLayer("base"); err != nil {
+		t.Fatal(err)
+	}
+	if !f.sealed["base"] {
+		t.Error("layer not sealed")
+	}
+	if err := d.sealLayer("missing"); err == nil {
+		t.Error("sealed a layer not found")
+	}
+
+	// Failing if the file system cannot seal layers
+	ioctlSyscall = func(op uintptr, buf []byte) error {
+		return unix.ENOTTY
+	}
+	err := d.sealLayer("base")
+	if err == nil || !strings.Contains(err.Error(), "does not support") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWriteProtectOption(t *testing.T) {
+	opts, err := parseOptions([]string{"lcfs.write_protect=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.WriteProtect {
+		t.Error("write protection not enabled")
+	}
+	if _, err := parseOptions([]string{"lcfs.write_protect=maybe"}); err == nil {
+		t.Error("invalid value accepted")
+	}
+}